@@ -392,6 +392,20 @@ func CreateWebsiteHandler(c *gin.Context) {
 
 func DeleteWebsiteHandler(c *gin.Context) {
 	domain := c.Param("domain")
+
+	// An optional body selects what else to remove; the full delete runs as a task
+	var opts website.DeleteOptions
+	c.ShouldBindJSON(&opts)
+	if opts.Any() {
+		t, err := website.DeleteWebsiteFull(domain, opts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Website deletion started", "task_id": t.ID})
+		return
+	}
+
 	if err := website.DeleteWebsite(domain); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
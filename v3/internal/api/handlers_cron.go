@@ -1,51 +1,16 @@
 package api
 
 import (
-	"fmt"
 	"net/http"
-	"os"
-	"runtime"
-	"strings"
-	"time"
 
+	"github.com/acmavirus/panda-script/v3/internal/cron"
 	"github.com/acmavirus/panda-script/v3/internal/db"
 	"github.com/gin-gonic/gin"
 )
 
 // SyncCronJobs updates the system cron configuration based on the database
 func SyncCronJobs() error {
-	if runtime.GOOS == "windows" {
-		return nil
-	}
-
-	var crons []db.Cron
-	db.DB.Find(&crons)
-
-	var sb strings.Builder
-	sb.WriteString("# Panda Panel Managed Cron Jobs - DO NOT EDIT MANUALLY\n")
-	sb.WriteString("# Generated at " + time.Now().Format("2006-01-02 15:04:05") + "\n\n")
-
-	for _, cron := range crons {
-		if !cron.Enabled {
-			continue
-		}
-		// Format: expression user command
-		// We use root for now as the panel runs as root
-		sb.WriteString(fmt.Sprintf("%s root %s # %s\n", cron.Expression, cron.Command, cron.Name))
-	}
-
-	cronPath := "/etc/cron.d/panda"
-	// Check if directory exists
-	if _, err := os.Stat("/etc/cron.d"); os.IsNotExist(err) {
-		return fmt.Errorf("/etc/cron.d does not exist, cron synchronization aborted")
-	}
-
-	err := os.WriteFile(cronPath, []byte(sb.String()), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write cron file: %v", err)
-	}
-
-	return nil
+	return cron.Sync()
 }
 
 func ListCronsHandler(c *gin.Context) {
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/geoip"
+	"github.com/acmavirus/panda-script/v3/internal/website"
+	"github.com/gin-gonic/gin"
+)
+
+func GeoIPStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, geoip.Status())
+}
+
+func UpdateGeoIPHandler(c *gin.Context) {
+	var req struct {
+		Kind string `json:"kind" binding:"required"` // country, asn
+		Path string `json:"path" binding:"required"` // .mmdb file on the server
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	info, err := website.UpdateGeoDatabase(req.Kind, req.Path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "database": info})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func GeoIPLookupHandler(c *gin.Context) {
+	ip := c.Query("ip")
+	if net.ParseIP(ip) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+		return
+	}
+	c.JSON(http.StatusOK, geoip.Lookup(ip))
+}
+
+func GetPanelGeoRuleHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, website.GetPanelGeoRule())
+}
+
+func UpdatePanelGeoRuleHandler(c *gin.Context) {
+	var rule db.GeoRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saved, err := website.SetPanelGeoRule(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/acmavirus/panda-script/v3/internal/history"
+	"github.com/gin-gonic/gin"
+)
+
+func ListConfigFilesHandler(c *gin.Context) {
+	files, err := history.ListFiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, files)
+}
+
+func ListConfigVersionsHandler(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+		return
+	}
+	versions, err := history.ListVersions(path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+func GetConfigVersionHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	v, err := history.GetVersion(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// DiffConfigVersionsHandler compares two versions; without "to" the first
+// one is compared with the file on disk
+func DiffConfigVersionsHandler(c *gin.Context) {
+	from, _ := strconv.ParseUint(c.Query("from"), 10, 32)
+	to, _ := strconv.ParseUint(c.Query("to"), 10, 32)
+	diff, err := history.Diff(uint(from), uint(to))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"diff": diff})
+}
+
+func RollbackConfigVersionHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	v, err := history.Rollback(uint(id), c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Configuration rolled back", "version": v})
+}
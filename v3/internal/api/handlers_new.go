@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/acmavirus/panda-script/v3/internal/backup"
 	"github.com/acmavirus/panda-script/v3/internal/nginx"
@@ -10,6 +11,7 @@ import (
 	"github.com/acmavirus/panda-script/v3/internal/security"
 	"github.com/acmavirus/panda-script/v3/internal/services"
 	"github.com/acmavirus/panda-script/v3/internal/ssl"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
 	"github.com/gin-gonic/gin"
 )
 
@@ -106,7 +108,7 @@ func ObtainCertificateHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := ssl.ObtainCertificate(req.Domain, req.Email); err != nil {
+	if err := webserver.Current().ObtainCertificate(req.Domain, req.Email); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -209,7 +211,7 @@ func UpdatePHPConfigHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := php.UpdateConfig(version, config); err != nil {
+	if err := php.UpdateConfig(version, config, c.GetString("username")); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -261,6 +263,23 @@ func GetVhostHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, vhost)
 }
 
+func EditVhostHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	var req struct {
+		Edits []nginx.DirectiveEdit `json:"edits" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	vhost, err := nginx.EditVhost(domain, req.Edits, c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, vhost)
+}
+
 func DeleteVhostHandler(c *gin.Context) {
 	domain := c.Param("domain")
 	if err := nginx.DeleteVhost(domain); err != nil {
@@ -317,6 +336,41 @@ func NginxStatusHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": status})
 }
 
+func NginxMetricsHandler(c *gin.Context) {
+	metrics, err := nginx.CurrentMetrics()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, metrics)
+}
+
+// NginxMetricsHistoryHandler returns stored samples of the last hours; with
+// a domain, the request rates of that website
+func NginxMetricsHistoryHandler(c *gin.Context) {
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hours"})
+		return
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	if domain := c.Query("domain"); domain != "" {
+		samples, err := nginx.SiteMetricsHistory(domain, since)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, samples)
+		return
+	}
+	samples, err := nginx.MetricsHistory(since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, samples)
+}
+
 func NginxStartHandler(c *gin.Context) {
 	if err := nginx.Start(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -360,7 +414,7 @@ func SaveVhostContentHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := nginx.SaveVhostContent(req.Domain, req.Content); err != nil {
+	if err := nginx.SaveVhostContent(req.Domain, req.Content, c.GetString("username")); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -384,7 +438,7 @@ func SaveMainNginxConfigHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := nginx.SaveMainConfig(req.Content); err != nil {
+	if err := nginx.SaveMainConfig(req.Content, c.GetString("username")); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
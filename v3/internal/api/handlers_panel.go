@@ -2,11 +2,10 @@ package api
 
 import (
 	"net/http"
-	"os"
 	"runtime"
 
 	"github.com/acmavirus/panda-script/v3/internal/db"
-	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
 	"github.com/gin-gonic/gin"
 )
 
@@ -29,70 +28,12 @@ func EnablePanelSSLHandler(c *gin.Context) {
 		return
 	}
 
-	// Get SSL certificate using certbot
-	certCmd := "certbot certonly --nginx -d " + req.Domain + " --non-interactive --agree-tos"
-	if req.Email != "" {
-		certCmd += " --email " + req.Email
-	} else {
-		certCmd += " --register-unsafely-without-email"
-	}
-
-	_, err := system.Execute(certCmd)
-	if err != nil {
+	// Get a certificate and proxy the panel on the domain
+	if err := webserver.Current().ServePanel(req.Domain, req.Email); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to obtain SSL: " + err.Error()})
 		return
 	}
 
-	// Update Nginx config for panel
-	nginxConf := `server {
-    listen 80;
-    server_name ` + req.Domain + `;
-    return 301 https://$server_name$request_uri;
-}
-
-server {
-    listen 443 ssl http2;
-    server_name ` + req.Domain + `;
-    
-    ssl_certificate /etc/letsencrypt/live/` + req.Domain + `/fullchain.pem;
-    ssl_certificate_key /etc/letsencrypt/live/` + req.Domain + `/privkey.pem;
-    
-    ssl_session_timeout 1d;
-    ssl_session_cache shared:SSL:50m;
-    ssl_protocols TLSv1.2 TLSv1.3;
-    ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256;
-    ssl_prefer_server_ciphers off;
-    
-    add_header Strict-Transport-Security "max-age=63072000" always;
-    
-    location /panda {
-        proxy_pass http://127.0.0.1:8080;
-        proxy_http_version 1.1;
-        proxy_set_header Upgrade $http_upgrade;
-        proxy_set_header Connection "upgrade";
-        proxy_set_header Host $host;
-        proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-        proxy_set_header X-Forwarded-Proto $scheme;
-    }
-    
-    location /api {
-        proxy_pass http://127.0.0.1:8080;
-        proxy_http_version 1.1;
-        proxy_set_header Upgrade $http_upgrade;
-        proxy_set_header Connection "upgrade";
-        proxy_set_header Host $host;
-        proxy_set_header X-Real-IP $remote_addr;
-    }
-}
-`
-	configPath := "/etc/nginx/sites-available/panda-panel"
-	os.WriteFile(configPath, []byte(nginxConf), 0644)
-
-	// Enable and reload
-	system.Execute("ln -sf " + configPath + " /etc/nginx/sites-enabled/panda-panel")
-	system.Execute("nginx -t && systemctl reload nginx")
-
 	// Save setting
 	var setting db.Setting
 	db.DB.Where("key = ?", "panel_ssl_domain").First(&setting)
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/website"
+	"github.com/gin-gonic/gin"
+)
+
+func ListVhostTemplatesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, nginx.ListTemplates())
+}
+
+func GetVhostTemplateHandler(c *gin.Context) {
+	t, err := nginx.GetTemplate(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func SaveVhostTemplateHandler(c *gin.Context) {
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t, err := nginx.SaveTemplateOverride(c.Param("name"), req.Content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func DeleteVhostTemplateHandler(c *gin.Context) {
+	if err := nginx.DeleteTemplateOverride(c.Param("name")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Template restored to the built-in version"})
+}
+
+func PreviewVhostTemplateHandler(c *gin.Context) {
+	var req struct {
+		Vars    map[string]string `json:"vars"`
+		Content string            `json:"content"` // Unsaved override to preview instead
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	config, err := nginx.PreviewTemplate(c.Param("name"), req.Content, req.Vars)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "config": config})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"config": config})
+}
+
+func PreviewWebsiteVhostHandler(c *gin.Context) {
+	preview, err := website.PreviewVhost(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
@@ -114,86 +114,6 @@ func InstallWPCLIHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "WP-CLI installed successfully"})
 }
 
-func ExecuteWPCLIHandler(c *gin.Context) {
-	var req struct {
-		Path    string `json:"path" binding:"required"`
-		Command string `json:"command" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	if runtime.GOOS == "windows" {
-		c.JSON(http.StatusOK, gin.H{"output": "WP-CLI mock output"})
-		return
-	}
-
-	cmd := fmt.Sprintf("cd %s && wp %s --allow-root", req.Path, req.Command)
-	out, err := system.Execute(cmd)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "output": out})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"output": out})
-}
-
-// ============================================================================
-// Website Cloning
-// ============================================================================
-
-func CloneWebsiteHandler(c *gin.Context) {
-	var req struct {
-		SourceDomain string `json:"source_domain" binding:"required"`
-		TargetDomain string `json:"target_domain" binding:"required"`
-		CloneDB      bool   `json:"clone_db"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	if runtime.GOOS == "windows" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cloning requires Linux"})
-		return
-	}
-
-	sourcePath := "/home/" + req.SourceDomain
-	targetPath := "/home/" + req.TargetDomain
-
-	// Clone files
-	_, err := system.Execute(fmt.Sprintf("cp -r %s %s", sourcePath, targetPath))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clone files"})
-		return
-	}
-
-	// Clone database if WordPress
-	if req.CloneDB {
-		sourceDB := strings.ReplaceAll(req.SourceDomain, ".", "_")
-		targetDB := strings.ReplaceAll(req.TargetDomain, ".", "_")
-
-		system.Execute(fmt.Sprintf("mysql -e 'CREATE DATABASE IF NOT EXISTS %s'", targetDB))
-		system.Execute(fmt.Sprintf("mysqldump %s | mysql %s", sourceDB, targetDB))
-
-		// Update wp-config.php
-		wpConfig := targetPath + "/wp-config.php"
-		if _, err := os.Stat(wpConfig); err == nil {
-			content, _ := os.ReadFile(wpConfig)
-			newContent := strings.ReplaceAll(string(content), sourceDB, targetDB)
-			os.WriteFile(wpConfig, []byte(newContent), 0644)
-		}
-	}
-
-	// Set permissions
-	system.Execute("chown -R www-data:www-data " + targetPath)
-
-	CreateNotification("success", "Website Cloned", req.SourceDomain+" → "+req.TargetDomain)
-
-	c.JSON(http.StatusOK, gin.H{"message": "Website cloned successfully"})
-}
-
 // ============================================================================
 // Node.js / PM2 Support
 // ============================================================================
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+	"github.com/acmavirus/panda-script/v3/internal/website"
+	"github.com/gin-gonic/gin"
+)
+
+func ListWebServersHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"current": webserver.CurrentName(), "servers": webserver.List()})
+}
+
+func SwitchWebServerHandler(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required"` // nginx, caddy
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	servers, err := website.SwitchWebServer(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "current": webserver.CurrentName(), "servers": servers})
+		return
+	}
+	CreateNotification("success", "Web Server Switched", "Websites are now served by "+req.Name)
+	c.JSON(http.StatusOK, gin.H{"current": webserver.CurrentName(), "servers": servers})
+}
+
+func TestWebServerHandler(c *gin.Context) {
+	if err := webserver.Current().Test(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Web server configuration is valid"})
+}
+
+func ReloadWebServerHandler(c *gin.Context) {
+	if err := webserver.Current().Reload(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Web server reloaded"})
+}
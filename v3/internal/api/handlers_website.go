@@ -0,0 +1,750 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/backup"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/website"
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Uptime Monitoring
+// ============================================================================
+
+func GetWebsiteUptimeHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	stats, err := website.GetUptimeStats(domain)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func ListWebsiteUptimeChecksHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	checks, err := website.ListUptimeChecks(domain, limit)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, checks)
+}
+
+func UpdateWebsiteMonitorHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	var req website.MonitorConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.UpdateMonitorConfig(domain, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Monitor settings updated for " + domain})
+}
+
+// ============================================================================
+// Import Existing Sites
+// ============================================================================
+
+func ImportWebsitesHandler(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+	result, err := website.ImportExistingSites(dryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// ============================================================================
+// Reconciliation
+// ============================================================================
+
+func ReconcileWebsitesHandler(c *gin.Context) {
+	drifts, err := website.Reconcile()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, drifts)
+}
+
+func RepairWebsiteDriftHandler(c *gin.Context) {
+	var req struct {
+		Domain string `json:"domain" binding:"required"`
+		Action string `json:"action" binding:"required"`
+		Path   string `json:"path"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.RepairDrift(req.Domain, req.Action, req.Path); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Repair " + req.Action + " applied to " + req.Domain})
+}
+
+// ============================================================================
+// Domain Rename
+// ============================================================================
+
+func RenameWebsiteHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	var req website.RenameOptions
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t, err := website.RenameWebsite(domain, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Website rename started", "task_id": t.ID})
+}
+
+// ============================================================================
+// Environment Variables
+// ============================================================================
+
+func GetWebsiteEnvHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	config, err := website.GetEnv(domain)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, config)
+}
+
+func UpdateWebsiteEnvHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	var req website.EnvConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	changed, err := website.SetEnv(domain, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !changed {
+		c.JSON(http.StatusOK, gin.H{"message": "No changes", "changed": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Environment updated and app restarted", "changed": true})
+}
+
+// ============================================================================
+// Basic Auth
+// ============================================================================
+
+func ListWebsiteAuthHandler(c *gin.Context) {
+	rules, err := website.ListAuthRules(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func CreateWebsiteAuthHandler(c *gin.Context) {
+	var req website.AuthRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule, err := website.CreateAuthRule(c.Param("domain"), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+func UpdateWebsiteAuthHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	var req website.AuthRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule, err := website.UpdateAuthRule(c.Param("domain"), uint(id), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func DeleteWebsiteAuthHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err := website.DeleteAuthRule(c.Param("domain"), uint(id)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Protection removed"})
+}
+
+func SetWebsiteAuthUserHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	var req website.AuthUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.SetAuthUser(c.Param("domain"), uint(id), req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User " + req.Username + " saved"})
+}
+
+func DeleteWebsiteAuthUserHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err := website.DeleteAuthUser(c.Param("domain"), uint(id), c.Param("username")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User removed"})
+}
+
+// ============================================================================
+// Export / Import Bundles
+// ============================================================================
+
+func ExportWebsiteHandler(c *gin.Context) {
+	path, err := website.ExportWebsite(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.FileAttachment(path, filepath.Base(path))
+}
+
+// ImportBundleHandler accepts an uploaded bundle ("file") or pulls one from
+// another panel given its url, the domain and an API token of that panel
+func ImportBundleHandler(c *gin.Context) {
+	var bundlePath string
+	if file, err := c.FormFile("file"); err == nil {
+		os.MkdirAll(backup.BackupDir, 0755)
+		bundlePath = filepath.Join(backup.BackupDir, fmt.Sprintf("bundle_upload_%s.tar.gz", time.Now().Format("20060102_150405")))
+		if err := c.SaveUploadedFile(file, bundlePath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		var req struct {
+			URL    string `json:"url" binding:"required"`
+			Domain string `json:"domain" binding:"required"`
+			Token  string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload a bundle or provide url, domain and token"})
+			return
+		}
+		if bundlePath, err = website.FetchBundle(req.URL, req.Domain, req.Token); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	t, err := website.ImportBundle(bundlePath)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Website import started", "task_id": t.ID})
+}
+
+// ============================================================================
+// Traffic Statistics
+// ============================================================================
+
+// GetWebsiteStatsHandler returns daily rollups for ?from=YYYY-MM-DD&to=YYYY-MM-DD,
+// the last 30 days by default
+func GetWebsiteStatsHandler(c *gin.Context) {
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, use YYYY-MM-DD"})
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -29)
+	if v := c.Query("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, use YYYY-MM-DD"})
+			return
+		}
+		from = t
+	}
+
+	stats, err := website.GetSiteStats(c.Param("domain"), from, to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// ============================================================================
+// App Services (go, python, docker)
+// ============================================================================
+
+func GetWebsiteAppHandler(c *gin.Context) {
+	status, err := website.GetAppStatus(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func WebsiteAppActionHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	action := c.Param("action")
+	if err := website.AppAction(domain, action); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "App " + action + " done for " + domain})
+}
+
+func GetWebsiteAppLogsHandler(c *gin.Context) {
+	lines, _ := strconv.Atoi(c.DefaultQuery("lines", "200"))
+	out, err := website.GetAppLogs(c.Param("domain"), lines)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"logs": out})
+}
+
+// ============================================================================
+// Laravel Toolkit
+// ============================================================================
+
+func GetWebsiteLaravelHandler(c *gin.Context) {
+	info, err := website.GetLaravelInfo(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func UpdateWebsiteLaravelHandler(c *gin.Context) {
+	domain := c.Param("domain")
+	var req db.LaravelConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.UpdateLaravelConfig(domain, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Laravel settings updated for " + domain})
+}
+
+func RunWebsiteArtisanHandler(c *gin.Context) {
+	var req struct {
+		Command string `json:"command" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t, err := website.RunArtisan(c.Param("domain"), req.Command)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Artisan command started", "task_id": t.ID})
+}
+
+func DeployWebsiteLaravelHandler(c *gin.Context) {
+	t, err := website.DeployLaravel(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Laravel deploy started", "task_id": t.ID})
+}
+
+func FixWebsiteLaravelPermissionsHandler(c *gin.Context) {
+	if err := website.FixLaravelPermissions(c.Param("domain")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Storage permissions fixed"})
+}
+
+// ============================================================================
+// Staging
+// ============================================================================
+
+func GetWebsiteStagingHandler(c *gin.Context) {
+	info, err := website.GetStaging(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func CreateWebsiteStagingHandler(c *gin.Context) {
+	// The body is optional, the defaults are safe
+	var opts website.StagingOptions
+	c.ShouldBindJSON(&opts)
+	t, info, err := website.CreateStaging(c.Param("domain"), opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Staging creation started", "task_id": t.ID, "staging": info})
+}
+
+func PushWebsiteStagingHandler(c *gin.Context) {
+	// The body is optional, the defaults are safe
+	var opts website.PushOptions
+	c.ShouldBindJSON(&opts)
+	t, err := website.PushStagingToLive(c.Param("domain"), opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Push to live started", "task_id": t.ID})
+}
+
+func DeleteWebsiteStagingHandler(c *gin.Context) {
+	t, err := website.DeleteStaging(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Staging deletion started", "task_id": t.ID})
+}
+
+// ============================================================================
+// Error Pages & Maintenance Mode
+// ============================================================================
+
+func ListWebsitePagesHandler(c *gin.Context) {
+	pages, err := website.ListPages(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pages)
+}
+
+func UpdateWebsitePageHandler(c *gin.Context) {
+	var req struct {
+		HTML string `json:"html" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.SetPage(c.Param("domain"), c.Param("kind"), req.HTML); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Page saved"})
+}
+
+func DeleteWebsitePageHandler(c *gin.Context) {
+	if err := website.DeletePage(c.Param("domain"), c.Param("kind")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Page reverted to default"})
+}
+
+func GetWebsiteMaintenanceHandler(c *gin.Context) {
+	config, err := website.GetMaintenance(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, config)
+}
+
+func UpdateWebsiteMaintenanceHandler(c *gin.Context) {
+	var req website.MaintenanceConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.SetMaintenance(c.Param("domain"), req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	state := "disabled"
+	if req.Enabled {
+		state = "enabled"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Maintenance mode " + state})
+}
+
+// ============================================================================
+// Page Cache
+// ============================================================================
+
+func GetWebsiteCacheHandler(c *gin.Context) {
+	settings, err := website.GetCache(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func UpdateWebsiteCacheHandler(c *gin.Context) {
+	var req db.CacheConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings, err := website.SetCache(c.Param("domain"), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func PurgeWebsiteCacheHandler(c *gin.Context) {
+	var req website.PurgeRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	count, err := website.PurgeCache(c.Param("domain"), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Purged %d cached files", count), "purged": count})
+}
+
+// ============================================================================
+// Upstream Groups
+// ============================================================================
+
+func GetWebsiteUpstreamHandler(c *gin.Context) {
+	g, err := website.GetUpstream(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if g == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "website has no upstream group"})
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func UpdateWebsiteUpstreamHandler(c *gin.Context) {
+	var req website.UpstreamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	g, err := website.SetUpstream(c.Param("domain"), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func DeleteWebsiteUpstreamHandler(c *gin.Context) {
+	if err := website.DeleteUpstream(c.Param("domain")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Upstream group removed"})
+}
+
+func WebsiteBackendActionHandler(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	states := map[string]string{"drain": nginx.BackendDraining, "disable": nginx.BackendDisabled, "enable": nginx.BackendActive}
+	state, ok := states[c.Param("action")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown action: " + c.Param("action")})
+		return
+	}
+	g, err := website.SetBackendState(c.Param("domain"), uint(id), state)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+// ============================================================================
+// TLS & Security Headers
+// ============================================================================
+
+func GetWebsiteSecurityHandler(c *gin.Context) {
+	settings, err := website.GetSecurity(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// bindSecurityConfig applies the request body over the website's current
+// security config, so fields left out keep their value
+func bindSecurityConfig(c *gin.Context) (*db.SecurityConfig, bool) {
+	settings, err := website.GetSecurity(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err := c.ShouldBindJSON(&settings.SecurityConfig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &settings.SecurityConfig, true
+}
+
+func UpdateWebsiteSecurityHandler(c *gin.Context) {
+	config, ok := bindSecurityConfig(c)
+	if !ok {
+		return
+	}
+	settings, err := website.SetSecurity(c.Param("domain"), *config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func PreviewWebsiteSecurityHandler(c *gin.Context) {
+	config, ok := bindSecurityConfig(c)
+	if !ok {
+		return
+	}
+	preview, err := website.PreviewSecurity(c.Param("domain"), *config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// ============================================================================
+// Rate Limiting & Bot Blocking
+// ============================================================================
+
+func ListRateLimitPresetsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, website.ListRateLimitPresets())
+}
+
+func GetWebsiteRateLimitHandler(c *gin.Context) {
+	config, err := website.GetRateLimit(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, config)
+}
+
+func UpdateWebsiteRateLimitHandler(c *gin.Context) {
+	var config db.RateLimitConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saved, err := website.SetRateLimit(c.Param("domain"), config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+func ApplyWebsiteRateLimitPresetHandler(c *gin.Context) {
+	saved, err := website.ApplyRateLimitPreset(c.Param("domain"), c.Param("preset"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+func GetWebsiteRateLimitStatsHandler(c *gin.Context) {
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hours"})
+		return
+	}
+	stats, err := website.RateLimitStats(c.Param("domain"), hours)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// ============================================================================
+// Country Rules
+// ============================================================================
+
+func GetWebsiteGeoRuleHandler(c *gin.Context) {
+	settings, err := website.GetGeoRule(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func UpdateWebsiteGeoRuleHandler(c *gin.Context) {
+	var rule db.GeoRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings, err := website.SetGeoRule(c.Param("domain"), rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func DeleteWebsiteGeoRuleHandler(c *gin.Context) {
+	settings, err := website.DeleteGeoRule(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
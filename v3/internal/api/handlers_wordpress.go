@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/acmavirus/panda-script/v3/internal/website"
+	"github.com/gin-gonic/gin"
+)
+
+func ListWordPressSitesHandler(c *gin.Context) {
+	sites, err := website.ListWordPressSites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sites)
+}
+
+func GetWordPressSiteHandler(c *gin.Context) {
+	site, err := website.GetWordPressSite(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, site)
+}
+
+func UpdateWordPressHandler(c *gin.Context) {
+	var req website.WPUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t, err := website.UpdateWordPress(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "WordPress update started", "task_id": t.ID})
+}
+
+func VerifyWordPressChecksumsHandler(c *gin.Context) {
+	result, err := website.VerifyWordPressChecksums(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func SetWordPressMaintenanceHandler(c *gin.Context) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.SetWordPressMaintenance(c.Param("domain"), req.Enabled); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Maintenance mode updated"})
+}
+
+func SetWordPressDebugHandler(c *gin.Context) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := website.SetWordPressDebug(c.Param("domain"), req.Enabled); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Debug mode updated"})
+}
+
+func ResetWordPressPasswordHandler(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	password, err := website.ResetWordPressPassword(c.Param("domain"), req.Username, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset for " + req.Username, "password": password})
+}
@@ -57,12 +57,66 @@ func RegisterRoutes(r *gin.RouterGroup) {
 		{
 			webGroup.GET("/", ListWebsitesHandler)
 			webGroup.POST("/", CreateWebsiteHandler)
+			webGroup.POST("/import", ImportWebsitesHandler)
+			webGroup.POST("/import/bundle", ImportBundleHandler)
+			webGroup.GET("/reconcile", ReconcileWebsitesHandler)
+			webGroup.POST("/reconcile/repair", RepairWebsiteDriftHandler)
 			webGroup.DELETE("/:domain", DeleteWebsiteHandler)
 			webGroup.POST("/:domain/ssl", CreateWebsiteSSLHandler)
 			webGroup.POST("/:domain/db", CreateWebsiteDBHandler)
 			webGroup.POST("/:domain/fix-permissions", FixWebsitePermissionsHandler)
 			webGroup.POST("/:domain/hot", ToggleWebsiteHotHandler)
 			webGroup.POST("/:domain/php", UpdateWebsitePHPVersionHandler)
+			webGroup.GET("/:domain/uptime", GetWebsiteUptimeHandler)
+			webGroup.GET("/:domain/uptime/checks", ListWebsiteUptimeChecksHandler)
+			webGroup.PUT("/:domain/monitor", UpdateWebsiteMonitorHandler)
+			webGroup.POST("/:domain/rename", RenameWebsiteHandler)
+			webGroup.GET("/:domain/export", ExportWebsiteHandler)
+			webGroup.GET("/:domain/stats", GetWebsiteStatsHandler)
+			webGroup.GET("/:domain/app", GetWebsiteAppHandler)
+			webGroup.GET("/:domain/app/logs", GetWebsiteAppLogsHandler)
+			webGroup.POST("/:domain/app/:action", WebsiteAppActionHandler)
+			webGroup.GET("/:domain/laravel", GetWebsiteLaravelHandler)
+			webGroup.PUT("/:domain/laravel", UpdateWebsiteLaravelHandler)
+			webGroup.GET("/:domain/vhost/preview", PreviewWebsiteVhostHandler)
+			webGroup.POST("/:domain/laravel/artisan", RunWebsiteArtisanHandler)
+			webGroup.POST("/:domain/laravel/deploy", DeployWebsiteLaravelHandler)
+			webGroup.POST("/:domain/laravel/permissions", FixWebsiteLaravelPermissionsHandler)
+			webGroup.GET("/:domain/staging", GetWebsiteStagingHandler)
+			webGroup.POST("/:domain/staging", CreateWebsiteStagingHandler)
+			webGroup.POST("/:domain/staging/push", PushWebsiteStagingHandler)
+			webGroup.DELETE("/:domain/staging", DeleteWebsiteStagingHandler)
+			webGroup.GET("/:domain/pages", ListWebsitePagesHandler)
+			webGroup.PUT("/:domain/pages/:kind", UpdateWebsitePageHandler)
+			webGroup.DELETE("/:domain/pages/:kind", DeleteWebsitePageHandler)
+			webGroup.GET("/:domain/maintenance", GetWebsiteMaintenanceHandler)
+			webGroup.PUT("/:domain/maintenance", UpdateWebsiteMaintenanceHandler)
+			webGroup.GET("/:domain/cache", GetWebsiteCacheHandler)
+			webGroup.PUT("/:domain/cache", UpdateWebsiteCacheHandler)
+			webGroup.POST("/:domain/cache/purge", PurgeWebsiteCacheHandler)
+			webGroup.GET("/:domain/upstream", GetWebsiteUpstreamHandler)
+			webGroup.PUT("/:domain/upstream", UpdateWebsiteUpstreamHandler)
+			webGroup.DELETE("/:domain/upstream", DeleteWebsiteUpstreamHandler)
+			webGroup.POST("/:domain/upstream/backends/:id/:action", WebsiteBackendActionHandler)
+			webGroup.GET("/:domain/security", GetWebsiteSecurityHandler)
+			webGroup.PUT("/:domain/security", UpdateWebsiteSecurityHandler)
+			webGroup.POST("/:domain/security/preview", PreviewWebsiteSecurityHandler)
+			webGroup.GET("/ratelimit/presets", ListRateLimitPresetsHandler)
+			webGroup.GET("/:domain/ratelimit", GetWebsiteRateLimitHandler)
+			webGroup.PUT("/:domain/ratelimit", UpdateWebsiteRateLimitHandler)
+			webGroup.POST("/:domain/ratelimit/presets/:preset", ApplyWebsiteRateLimitPresetHandler)
+			webGroup.GET("/:domain/ratelimit/stats", GetWebsiteRateLimitStatsHandler)
+			webGroup.GET("/:domain/geoip", GetWebsiteGeoRuleHandler)
+			webGroup.PUT("/:domain/geoip", UpdateWebsiteGeoRuleHandler)
+			webGroup.DELETE("/:domain/geoip", DeleteWebsiteGeoRuleHandler)
+			webGroup.GET("/:domain/env", GetWebsiteEnvHandler)
+			webGroup.PUT("/:domain/env", UpdateWebsiteEnvHandler)
+			webGroup.GET("/:domain/auth", ListWebsiteAuthHandler)
+			webGroup.POST("/:domain/auth", CreateWebsiteAuthHandler)
+			webGroup.PUT("/:domain/auth/:id", UpdateWebsiteAuthHandler)
+			webGroup.DELETE("/:domain/auth/:id", DeleteWebsiteAuthHandler)
+			webGroup.POST("/:domain/auth/:id/users", SetWebsiteAuthUserHandler)
+			webGroup.DELETE("/:domain/auth/:id/users/:username", DeleteWebsiteAuthUserHandler)
 		}
 
 		// Databases
@@ -125,12 +179,15 @@ func RegisterRoutes(r *gin.RouterGroup) {
 			nginxGroup.GET("/vhosts", ListVhostsHandler)
 			nginxGroup.POST("/vhosts", CreateVhostHandler)
 			nginxGroup.GET("/vhosts/:domain", GetVhostHandler)
+			nginxGroup.PATCH("/vhosts/:domain", EditVhostHandler)
 			nginxGroup.DELETE("/vhosts/:domain", DeleteVhostHandler)
 			nginxGroup.POST("/ssl/:domain", EnableSSLVhostHandler)
 			nginxGroup.DELETE("/ssl/:domain", DisableSSLVhostHandler)
 			nginxGroup.POST("/test", TestNginxConfigHandler)
 			nginxGroup.POST("/reload", ReloadNginxHandler)
 			nginxGroup.GET("/status", NginxStatusHandler)
+			nginxGroup.GET("/metrics", NginxMetricsHandler)
+			nginxGroup.GET("/metrics/history", NginxMetricsHistoryHandler)
 			nginxGroup.POST("/start", NginxStartHandler)
 			nginxGroup.POST("/stop", NginxStopHandler)
 			nginxGroup.POST("/restart", NginxRestartHandler)
@@ -138,6 +195,30 @@ func RegisterRoutes(r *gin.RouterGroup) {
 			nginxGroup.POST("/config", SaveMainNginxConfigHandler)
 			nginxGroup.GET("/vhosts/:domain/content", GetVhostContentHandler)
 			nginxGroup.POST("/vhosts/content", SaveVhostContentHandler)
+			nginxGroup.GET("/templates", ListVhostTemplatesHandler)
+			nginxGroup.GET("/templates/:name", GetVhostTemplateHandler)
+			nginxGroup.PUT("/templates/:name", SaveVhostTemplateHandler)
+			nginxGroup.DELETE("/templates/:name", DeleteVhostTemplateHandler)
+			nginxGroup.POST("/templates/:name/preview", PreviewVhostTemplateHandler)
+		}
+
+		// Web server
+		webServerGroup := protected.Group("/webserver")
+		{
+			webServerGroup.GET("/", ListWebServersHandler)
+			webServerGroup.PUT("/", SwitchWebServerHandler)
+			webServerGroup.POST("/test", TestWebServerHandler)
+			webServerGroup.POST("/reload", ReloadWebServerHandler)
+		}
+
+		// GeoIP
+		geoGroup := protected.Group("/geoip")
+		{
+			geoGroup.GET("/", GeoIPStatusHandler)
+			geoGroup.POST("/update", UpdateGeoIPHandler)
+			geoGroup.GET("/lookup", GeoIPLookupHandler)
+			geoGroup.GET("/rule", GetPanelGeoRuleHandler)
+			geoGroup.PUT("/rule", UpdatePanelGeoRuleHandler)
 		}
 
 		// Security
@@ -294,6 +375,29 @@ func RegisterRoutes(r *gin.RouterGroup) {
 			pm2Group.GET("/:name/logs", GetPM2LogsHandler)
 		}
 
+		// WordPress
+		wpGroup := protected.Group("/wordpress")
+		{
+			wpGroup.GET("/", ListWordPressSitesHandler)
+			wpGroup.POST("/update", UpdateWordPressHandler)
+			wpGroup.POST("/wp-cli/install", InstallWPCLIHandler)
+			wpGroup.GET("/:domain", GetWordPressSiteHandler)
+			wpGroup.POST("/:domain/checksums", VerifyWordPressChecksumsHandler)
+			wpGroup.POST("/:domain/maintenance", SetWordPressMaintenanceHandler)
+			wpGroup.POST("/:domain/debug", SetWordPressDebugHandler)
+			wpGroup.POST("/:domain/password", ResetWordPressPasswordHandler)
+		}
+
+		// Config history
+		historyGroup := protected.Group("/config-history")
+		{
+			historyGroup.GET("/", ListConfigFilesHandler)
+			historyGroup.GET("/versions", ListConfigVersionsHandler)
+			historyGroup.GET("/versions/:id", GetConfigVersionHandler)
+			historyGroup.POST("/versions/:id/rollback", RollbackConfigVersionHandler)
+			historyGroup.GET("/diff", DiffConfigVersionsHandler)
+		}
+
 		// Cron
 		cronGroup := protected.Group("/cron")
 		{
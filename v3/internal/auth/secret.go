@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SecretKeyPath holds the key used to encrypt secrets stored in the database
+const SecretKeyPath = "/opt/panda/secret.key"
+
+var (
+	encKey   []byte
+	encKeyMu sync.Mutex
+)
+
+// loadEncryptionKey reads the at-rest encryption key, creating it on first use
+func loadEncryptionKey() ([]byte, error) {
+	encKeyMu.Lock()
+	defer encKeyMu.Unlock()
+
+	if encKey != nil {
+		return encKey, nil
+	}
+
+	key, err := os.ReadFile(SecretKeyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		os.MkdirAll(filepath.Dir(SecretKeyPath), 0755)
+		if err := os.WriteFile(SecretKeyPath, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", SecretKeyPath, err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain 32 bytes", SecretKeyPath)
+	}
+
+	encKey = key
+	return encKey, nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	key, err := loadEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals a value with AES-GCM and returns it base64 encoded
+func Encrypt(plaintext string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt
+func Decrypt(encoded string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -22,7 +22,7 @@ type BackupInfo struct {
 	Name      string    `json:"name"`
 	Path      string    `json:"path"`
 	Size      int64     `json:"size"`
-	Type      string    `json:"type"` // website, database, full, config
+	Type      string    `json:"type"` // website, database, full, config, final, snapshot, bundle
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -75,6 +75,84 @@ func BackupWebsite(domain string) (*BackupInfo, error) {
 	}, nil
 }
 
+// ArchiveWebsite creates a single archive holding a website's files, its
+// nginx configs and a dump of its database. Paths are stored relative to /
+// and the dump under opt/panda/backups/restore, so RestoreBackup puts
+// everything back in place.
+func ArchiveWebsite(domain, root, dbName string, configs []string) (*BackupInfo, error) {
+	return archiveWebsite("final", domain, root, dbName, configs)
+}
+
+// SnapshotWebsite archives a website's files and database the same way as
+// ArchiveWebsite, before a change that may need to be rolled back
+func SnapshotWebsite(domain, root, dbName string) (*BackupInfo, error) {
+	return archiveWebsite("snapshot", domain, root, dbName, nil)
+}
+
+func archiveWebsite(kind, domain, root, dbName string, configs []string) (*BackupInfo, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("website archive not supported on Windows")
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	backupName := fmt.Sprintf("%s_%s_%s.tar.gz", kind, domain, timestamp)
+	backupPath := filepath.Join(getBackupDir(), backupName)
+
+	var paths []string
+	if root != "" {
+		if _, err := os.Stat(root); err == nil {
+			paths = append(paths, strings.TrimPrefix(root, "/"))
+		}
+	}
+	for _, config := range configs {
+		if _, err := os.Stat(config); err == nil {
+			paths = append(paths, strings.TrimPrefix(config, "/"))
+		}
+	}
+
+	cmd := ""
+	if dbName != "" {
+		staging, err := os.MkdirTemp("", "panda-archive-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(staging)
+
+		dumpDir := filepath.Join(staging, "opt/panda/backups/restore")
+		os.MkdirAll(dumpDir, 0755)
+		dump := filepath.Join(dumpDir, dbName+".sql")
+		if _, err := system.Execute(fmt.Sprintf("mysqldump %s > %s 2>/dev/null", dbName, dump)); err != nil {
+			return nil, fmt.Errorf("database dump failed: %v", err)
+		}
+		cmd = fmt.Sprintf(" -C %s opt/panda/backups/restore", staging)
+	}
+
+	if len(paths) == 0 && cmd == "" {
+		return nil, fmt.Errorf("nothing to archive for %s", domain)
+	}
+	if len(paths) > 0 {
+		cmd = fmt.Sprintf(" -C / %s", strings.Join(paths, " ")) + cmd
+	}
+
+	if out, err := system.Execute(fmt.Sprintf("tar -czf %s%s", backupPath, cmd)); err != nil {
+		os.Remove(backupPath)
+		return nil, fmt.Errorf("archive failed: %s - %v", out, err)
+	}
+
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupInfo{
+		Name:      backupName,
+		Path:      backupPath,
+		Size:      info.Size(),
+		Type:      kind,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
 // BackupDatabase creates a backup of a MySQL database
 func BackupDatabase(name string) (*BackupInfo, error) {
 	if runtime.GOOS == "windows" {
@@ -218,6 +296,12 @@ func ListBackups() ([]BackupInfo, error) {
 			backupType = "full"
 		} else if strings.HasPrefix(name, "config_backup_") {
 			backupType = "config"
+		} else if strings.HasPrefix(name, "final_") {
+			backupType = "final"
+		} else if strings.HasPrefix(name, "snapshot_") {
+			backupType = "snapshot"
+		} else if strings.HasPrefix(name, "bundle_") {
+			backupType = "bundle"
 		} else if strings.HasSuffix(name, ".tar.gz") {
 			backupType = "website"
 		}
@@ -10,6 +10,8 @@ import (
 	"github.com/acmavirus/panda-script/v3/internal/auth"
 	"github.com/acmavirus/panda-script/v3/internal/db"
 	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+	"github.com/acmavirus/panda-script/v3/internal/website"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -48,9 +50,144 @@ func RegisterWebsiteCommands(rootCmd *cobra.Command) {
 		},
 	})
 
+	websiteCmd.AddCommand(&cobra.Command{
+		Use:   "export [domain]",
+		Short: "Export a website as a bundle for another server",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("📦 Exporting %s...\n", args[0])
+			path, err := website.ExportWebsite(args[0])
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			fmt.Printf("✅ Bundle created: %s\n", path)
+			fmt.Println("⚠️  The bundle contains secrets and the certificate key, keep it private")
+		},
+	})
+
+	importCmd := &cobra.Command{
+		Use:   "import [bundle | panel-url]",
+		Short: "Import a website bundle, or adopt existing nginx sites when no bundle is given",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 1 {
+				importBundle(cmd, args[0])
+				return
+			}
+
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			result, err := website.ImportExistingSites(dryRun)
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+
+			verb := "Imported"
+			if dryRun {
+				verb = "Would import"
+			}
+			for _, v := range result.Imported {
+				fmt.Printf("✅ %s %s (type: %s, root: %s", verb, v.Domain, v.Type, v.Root)
+				if v.PHPVersion != "" {
+					fmt.Printf(", php: %s", v.PHPVersion)
+				}
+				if v.BackendPort != 0 {
+					fmt.Printf(", port: %d", v.BackendPort)
+				}
+				if v.SSL {
+					fmt.Printf(", ssl: %s", v.CertPath)
+				}
+				fmt.Println(")")
+				for _, w := range v.Warnings {
+					fmt.Printf("   ⚠️  %s\n", w)
+				}
+			}
+			for _, s := range result.Skipped {
+				fmt.Printf("⏭️  Skipped %s: %s\n", s.Domain, s.Reason)
+			}
+			for _, f := range result.Failed {
+				fmt.Printf("❌ Could not understand %s: %s\n", f.File, f.Reason)
+			}
+			fmt.Printf("📊 %d imported, %d skipped, %d failed\n", len(result.Imported), len(result.Skipped), len(result.Failed))
+		},
+	}
+	importCmd.Flags().Bool("dry-run", false, "Only report what would be imported")
+	importCmd.Flags().String("domain", "", "Website to pull when importing from another panel")
+	importCmd.Flags().String("token", "", "API token of the other panel")
+	websiteCmd.AddCommand(importCmd)
+
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Find drift between website records, nginx configs and disk",
+		Run: func(cmd *cobra.Command, args []string) {
+			apply, _ := cmd.Flags().GetBool("apply")
+			drifts, err := website.Reconcile()
+			if err != nil {
+				fmt.Printf("❌ %v\n", err)
+				return
+			}
+			if len(drifts) == 0 {
+				fmt.Println("✅ Everything is in sync")
+				return
+			}
+
+			for _, d := range drifts {
+				fmt.Printf("⚠️  [%s] %s: %s\n", d.Kind, d.Domain, d.Detail)
+				if len(d.Repairs) == 0 {
+					continue
+				}
+				if !apply {
+					fmt.Printf("   🔧 Repairs: %s\n", strings.Join(d.Repairs, ", "))
+					continue
+				}
+				if err := website.RepairDrift(d.Domain, d.Repairs[0], d.Path); err != nil {
+					fmt.Printf("   ❌ %s failed: %v\n", d.Repairs[0], err)
+				} else {
+					fmt.Printf("   ✅ %s applied\n", d.Repairs[0])
+				}
+			}
+		},
+	}
+	reconcileCmd.Flags().Bool("apply", false, "Apply the first suggested repair for each mismatch")
+	websiteCmd.AddCommand(reconcileCmd)
+
 	rootCmd.AddCommand(websiteCmd)
 }
 
+// importBundle restores a website from a bundle file or pulls it from another panel
+func importBundle(cmd *cobra.Command, source string) {
+	bundlePath := source
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		domain, _ := cmd.Flags().GetString("domain")
+		token, _ := cmd.Flags().GetString("token")
+		if domain == "" || token == "" {
+			fmt.Println("❌ --domain and --token are required to import from another panel")
+			return
+		}
+		fmt.Printf("📥 Downloading %s from %s...\n", domain, source)
+		path, err := website.FetchBundle(source, domain, token)
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			return
+		}
+		bundlePath = path
+	}
+
+	t, err := website.ImportBundle(bundlePath)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	t.Wait()
+	fmt.Print(t.Output)
+	if t.Status == task.Failed {
+		fmt.Println("❌ Import failed")
+		return
+	}
+	fmt.Println("✅ Import complete")
+}
+
 func RegisterDatabaseCommands(rootCmd *cobra.Command) {
 	dbCmd := &cobra.Command{
 		Use:   "db",
@@ -0,0 +1,156 @@
+package cron
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/history"
+)
+
+const cronPath = "/etc/cron.d/panda"
+
+// Sync updates the system cron configuration based on the database
+func Sync() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	var crons []db.Cron
+	db.DB.Find(&crons)
+
+	var sb strings.Builder
+	sb.WriteString("# Panda Panel Managed Cron Jobs - DO NOT EDIT MANUALLY\n")
+	sb.WriteString("# Generated at " + time.Now().Format("2006-01-02 15:04:05") + "\n\n")
+
+	for _, cron := range crons {
+		if !cron.Enabled {
+			continue
+		}
+		// Format: expression user command
+		// We use root for now as the panel runs as root
+		sb.WriteString(fmt.Sprintf("%s root %s # %s\n", cron.Expression, cron.Command, cron.Name))
+	}
+
+	// Check if directory exists
+	if _, err := os.Stat("/etc/cron.d"); os.IsNotExist(err) {
+		return fmt.Errorf("/etc/cron.d does not exist, cron synchronization aborted")
+	}
+
+	err := history.WriteFile(cronPath, []byte(sb.String()), 0644, history.Panel, "")
+	if err != nil {
+		return fmt.Errorf("failed to write cron file: %v", err)
+	}
+
+	return nil
+}
+
+// References reports whether a cron command refers to a website: to its
+// root as a path, or to its domain as a whole name. A site's neighbours do
+// not match, e.g. a.com.au, sa.com or /home/a.com.au for a.com.
+func References(command, root, domain string) bool {
+	if root != "" && rootPattern(root).MatchString(command) {
+		return true
+	}
+	return domain != "" && domainPattern(domain).MatchString(command)
+}
+
+// rootPattern matches a path and anything below it
+func rootPattern(root string) *regexp.Regexp {
+	return regexp.MustCompile(regexp.QuoteMeta(strings.TrimSuffix(root, "/")) + `(/|\s|['";&|)]|$)`)
+}
+
+// domainPattern matches a domain or its www name when not part of a longer name
+func domainPattern(domain string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^A-Za-z0-9.-])(www\.)?` + regexp.QuoteMeta(domain) + `($|[^A-Za-z0-9.-])`)
+}
+
+// DeleteMatching removes every cron job that refers to a website, see
+// References, and re-syncs the cron file. It returns the removed jobs.
+func DeleteMatching(root, domain string) ([]db.Cron, error) {
+	var crons []db.Cron
+	if err := db.DB.Find(&crons).Error; err != nil {
+		return nil, err
+	}
+
+	var removed []db.Cron
+	for _, cron := range crons {
+		if References(cron.Command, root, domain) {
+			db.DB.Delete(&cron)
+			removed = append(removed, cron)
+		}
+	}
+
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	return removed, Sync()
+}
+
+// ReplaceRoot rewrites a moved website root in every cron command that
+// refers to it, see References, and re-syncs the cron file. It returns the
+// number of jobs changed.
+func ReplaceRoot(old, new string) (int, error) {
+	var crons []db.Cron
+	if err := db.DB.Find(&crons).Error; err != nil {
+		return 0, err
+	}
+
+	pattern := rootPattern(old)
+	replacement := strings.ReplaceAll(strings.TrimSuffix(new, "/"), "$", "$$") + "${1}"
+	changed := 0
+	for _, cron := range crons {
+		if !pattern.MatchString(cron.Command) {
+			continue
+		}
+		cron.Command = pattern.ReplaceAllString(cron.Command, replacement)
+		db.DB.Save(&cron)
+		changed++
+	}
+
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, Sync()
+}
+
+// Ensure creates or updates the cron job with the given name and re-syncs the cron file
+func Ensure(name, expression, command string) error {
+	var job db.Cron
+	db.DB.Where("name = ?", name).First(&job)
+	if job.ID != 0 && job.Expression == expression && job.Command == command && job.Enabled {
+		return nil
+	}
+
+	job.Name = name
+	job.Expression = expression
+	job.Command = command
+	job.Enabled = true
+	if err := db.DB.Save(&job).Error; err != nil {
+		return err
+	}
+	return Sync()
+}
+
+// DeleteByName removes the cron job with the given name and re-syncs the cron file
+func DeleteByName(name string) error {
+	result := db.DB.Where("name = ?", name).Delete(&db.Cron{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	return Sync()
+}
+
+// Exists reports whether an enabled cron job with the given name exists
+func Exists(name string) bool {
+	var count int64
+	db.DB.Model(&db.Cron{}).Where("name = ? AND enabled = ?", name, true).Count(&count)
+	return count > 0
+}
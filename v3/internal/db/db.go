@@ -26,7 +26,7 @@ type User struct {
 type Website struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
 	Domain      string    `gorm:"uniqueIndex;not null" json:"domain"`
-	Type        string    `json:"type"` // local, nodejs, php, laravel, wordpress, python
+	Type        string    `json:"type"` // php, laravel, wordpress, static, nodejs, python, go, docker, java
 	Port        int       `json:"port"`
 	Root        string    `json:"root"`
 	SSL         bool      `json:"ssl"`
@@ -38,8 +38,284 @@ type Website struct {
 	LastCheck   time.Time `json:"last_check"`   // Last background check time
 	OwnerID     uint      `json:"owner_id"`     // For multi-user
 	Hot         bool      `json:"hot"`          // Highlighted website
+
+	// Uptime monitoring
+	CheckInterval     int    `json:"check_interval"`      // Seconds between checks, 0 = default
+	CheckURL          string `json:"check_url"`           // Empty = http(s)://domain
+	CheckExpectStatus int    `json:"check_expect_status"` // 0 = any status below 500
+	CheckKeyword      string `json:"check_keyword"`       // Body must contain this, if set
+	MonitorDown       bool   `json:"monitor_down"`        // Last alerted state
+	MonitorStreak     int    `json:"-"`                   // Consecutive results disagreeing with MonitorDown
+
+	EnvTarget string `json:"env_target"` // dotenv, pm2, systemd; empty = by type
+
+	// Managed app backends (go, python, docker)
+	AppCommand    string `json:"app_command"`    // go: binary and arguments
+	AppModule     string `json:"app_module"`     // python: entry point, e.g. app:app
+	AppServer     string `json:"app_server"`     // python: gunicorn (WSGI) or uvicorn (ASGI)
+	DockerImage   string `json:"docker_image"`   // docker: image to run
+	ContainerPort int    `json:"container_port"` // docker: port the container listens on
+
+	StagingOf uint `gorm:"index" json:"staging_of"` // Production website ID, 0 = not a staging site
+
+	// Server names besides the domain and its www. name, and a certificate
+	// that is not certbot's, e.g. of an imported site
+	Aliases  []string `gorm:"serializer:json" json:"aliases"`
+	CertPath string   `json:"cert_path"`
+	KeyPath  string   `json:"key_path"`
+
+	// Maintenance mode
+	Maintenance      bool     `json:"maintenance"`
+	MaintenanceIPs   []string `gorm:"serializer:json" json:"maintenance_ips"` // IPs/CIDRs that still see the site
+	MaintenanceRetry int      `json:"maintenance_retry"`                      // Retry-After seconds, 0 = default
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UptimeCheck is a single availability probe of a website
+type UptimeCheck struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	WebsiteID  uint       `gorm:"index" json:"website_id"`
+	Up         bool       `json:"up"`
+	StatusCode int        `json:"status_code"`
+	LatencyMs  int64      `json:"latency_ms"`
+	TLSExpiry  *time.Time `json:"tls_expiry,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CheckedAt  time.Time  `gorm:"index" json:"checked_at"`
+}
+
+// EnvVar is a per-site environment variable. Secret values are encrypted.
+type EnvVar struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	WebsiteID uint      `gorm:"uniqueIndex:idx_env_site_key" json:"website_id"`
+	Key       string    `gorm:"uniqueIndex:idx_env_site_key;not null" json:"key"`
+	Value     string    `json:"value"`
+	Secret    bool      `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AuthRule protects a path of a website with HTTP basic auth
+type AuthRule struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	WebsiteID uint       `gorm:"index" json:"website_id"`
+	Path      string     `gorm:"not null" json:"path"` // URI prefix, "/" = whole site
+	Realm     string     `json:"realm"`
+	BypassIPs []string   `gorm:"serializer:json" json:"bypass_ips"` // IPs/CIDRs that skip the prompt
+	Enabled   bool       `json:"enabled"`
+	Users     []AuthUser `gorm:"foreignKey:RuleID" json:"users"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// AuthUser is a login of an AuthRule
+type AuthUser struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	RuleID    uint      `gorm:"index" json:"rule_id"`
+	Username  string    `gorm:"not null" json:"username"`
+	Hash      string    `json:"-"`         // htpasswd format
+	Algorithm string    `json:"algorithm"` // bcrypt, apr1
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ErrorPage is a custom page of a website: 404, 50x or maintenance
+type ErrorPage struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	WebsiteID uint      `gorm:"uniqueIndex:idx_page_site_kind" json:"website_id"`
+	Kind      string    `gorm:"uniqueIndex:idx_page_site_kind" json:"kind"`
+	HTML      string    `json:"html"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CacheConfig is the page cache of a website: fastcgi_cache for PHP sites,
+// proxy_cache for proxied apps
+type CacheConfig struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	WebsiteID     uint      `gorm:"uniqueIndex" json:"website_id"`
+	Enabled       bool      `json:"enabled"`
+	ZoneSize      int       `json:"zone_size"`                             // MB of shared memory for cache keys
+	MaxSize       int       `json:"max_size"`                              // MB on disk
+	TTL           int       `json:"ttl"`                                   // Seconds 200, 301 and 302 responses are cached
+	NotFoundTTL   int       `json:"not_found_ttl"`                         // Seconds 404 responses are cached, 0 = not cached
+	BypassCookies []string  `gorm:"serializer:json" json:"bypass_cookies"` // Requests with any of these cookies skip the cache
+	ExcludePaths  []string  `gorm:"serializer:json" json:"exclude_paths"`  // URI prefixes that are never cached
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// SecurityConfig is the TLS profile and security headers of a website. The
+// TLS settings apply once the site has a certificate.
+type SecurityConfig struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	WebsiteID         uint      `gorm:"uniqueIndex" json:"website_id"`
+	TLSProfile        string    `json:"tls_profile"` // modern, intermediate, old (Mozilla)
+	HTTP2             bool      `json:"http2"`
+	HTTP3             bool      `json:"http3"`
+	OCSPStapling      bool      `json:"ocsp_stapling"`
+	HTTPSRedirect     bool      `json:"https_redirect"`
+	HSTS              bool      `json:"hsts"`
+	HSTSMaxAge        int       `json:"hsts_max_age"` // Seconds
+	HSTSSubdomains    bool      `json:"hsts_subdomains"`
+	HSTSPreload       bool      `json:"hsts_preload"`
+	CSP               string    `json:"csp"` // Content-Security-Policy, empty = not sent
+	CSPReportOnly     bool      `json:"csp_report_only"`
+	ReferrerPolicy    string    `json:"referrer_policy"`    // Empty = not sent
+	PermissionsPolicy string    `json:"permissions_policy"` // Empty = not sent
+	FrameOptions      string    `json:"frame_options"`      // DENY, SAMEORIGIN, empty = not sent
+	NoSniff           bool      `json:"nosniff"`            // X-Content-Type-Options: nosniff
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// RateLimitConfig is the request limiting and blocking config of a website
+type RateLimitConfig struct {
+	ID            uint        `gorm:"primaryKey" json:"id"`
+	WebsiteID     uint        `gorm:"uniqueIndex" json:"website_id"`
+	Enabled       bool        `json:"enabled"`
+	Rate          string      `json:"rate"` // Requests per client, e.g. 10r/s or 30r/m, empty = no site-wide limit
+	Burst         int         `json:"burst"`
+	Connections   int         `json:"connections"`                           // Concurrent connections per client, 0 = unlimited
+	PathLimits    []PathLimit `gorm:"serializer:json" json:"path_limits"`    // Stricter limits below a path
+	BlockBots     bool        `json:"block_bots"`                            // Refuse user agents the log parser counts as bots
+	AllowedAgents []string    `gorm:"serializer:json" json:"allowed_agents"` // Never blocked by user agent, e.g. search engines
+	BlockedAgents []string    `gorm:"serializer:json" json:"blocked_agents"` // Refused user agent substrings
+	AllowIPs      []string    `gorm:"serializer:json" json:"allow_ips"`      // Never limited or blocked by user agent
+	DenyIPs       []string    `gorm:"serializer:json" json:"deny_ips"`       // Refused with 403
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// PathLimit is a request rate limit on a path prefix of a website
+type PathLimit struct {
+	Path  string `json:"path"`
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst"`
+}
+
+// GeoRule allows or denies the visitors of a website by country. The rule
+// with WebsiteID 0 is the panel-wide default for sites without their own.
+type GeoRule struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	WebsiteID uint      `gorm:"uniqueIndex" json:"website_id"`
+	Enabled   bool      `json:"enabled"`
+	Mode      string    `json:"mode"`                             // allow = only these countries, deny = all but these
+	Countries []string  `gorm:"serializer:json" json:"countries"` // ISO 3166-1 alpha-2 codes
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UpstreamGroup load balances a proxied website over several backends
+type UpstreamGroup struct {
+	ID        uint              `gorm:"primaryKey" json:"id"`
+	WebsiteID uint              `gorm:"uniqueIndex" json:"website_id"`
+	Name      string            `gorm:"uniqueIndex;not null" json:"name"` // nginx upstream name
+	Method    string            `json:"method"`                           // round_robin, least_conn, ip_hash
+	Backends  []UpstreamBackend `gorm:"foreignKey:GroupID" json:"backends"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// UpstreamBackend is a server of an UpstreamGroup
+type UpstreamBackend struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	GroupID     uint      `gorm:"index" json:"group_id"`
+	Address     string    `gorm:"not null" json:"address"` // host:port or unix:/path
+	Weight      int       `json:"weight"`                  // 0 = 1
+	MaxFails    int       `json:"max_fails"`               // 0 = nginx default
+	FailTimeout int       `json:"fail_timeout"`            // Seconds, 0 = nginx default
+	Backup      bool      `json:"backup"`
+	State       string    `json:"state"` // active, draining, disabled
 	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// NginxSample is a reading of nginx's stub_status. The counters run since
+// nginx started; RPS is derived from the previous sample.
+type NginxSample struct {
+	ID       uint      `gorm:"primaryKey" json:"-"`
+	Time     time.Time `gorm:"index" json:"time"`
+	Active   int       `json:"active"`
+	Reading  int       `json:"reading"`
+	Writing  int       `json:"writing"`
+	Waiting  int       `json:"waiting"`
+	Accepts  int64     `json:"accepts"`
+	Handled  int64     `json:"handled"`
+	Requests int64     `json:"requests"`
+	RPS      float64   `json:"rps"`
+}
+
+// SiteRequestSample is the request rate of a website over one sample
+// interval, counted from its access log. Intervals without requests are
+// not stored.
+type SiteRequestSample struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	WebsiteID uint      `gorm:"index" json:"-"`
+	Time      time.Time `gorm:"index" json:"time"`
+	Requests  int64     `json:"requests"`
+	RPS       float64   `json:"rps"`
+}
+
+// ConfigVersion is a stored copy of a config file, taken whenever the panel
+// writes it
+type ConfigVersion struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Path      string    `gorm:"index;not null" json:"path"`
+	Kind      string    `json:"kind"` // nginx, php, fpm, cron or other
+	Content   string    `json:"content,omitempty"`
+	Hash      string    `json:"hash"` // SHA-256 of Content
+	Size      int       `json:"size"`
+	Author    string    `json:"author"` // Panel user, "panel" or "external"
+	Note      string    `json:"note"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// StatCount is a value and how often it was seen, used for top lists
+type StatCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// SiteStatsDaily is one day of traffic and disk usage of a website
+type SiteStatsDaily struct {
+	ID            uint        `gorm:"primaryKey" json:"id"`
+	WebsiteID     uint        `gorm:"uniqueIndex:idx_site_stats_day" json:"website_id"`
+	Date          string      `gorm:"uniqueIndex:idx_site_stats_day" json:"date"` // YYYY-MM-DD, server time
+	Requests      int64       `json:"requests"`
+	BotRequests   int64       `json:"bot_requests"`
+	Bytes         int64       `json:"bytes"`
+	Visitors      int64       `json:"visitors"` // Estimated unique IPs
+	VisitorSketch []byte      `json:"-"`        // HyperLogLog registers behind Visitors
+	Status2xx     int64       `json:"status_2xx"`
+	Status3xx     int64       `json:"status_3xx"`
+	Status4xx     int64       `json:"status_4xx"`
+	Status5xx     int64       `json:"status_5xx"`
+	TopURLs       []StatCount `gorm:"serializer:json" json:"top_urls"`
+	TopReferrers  []StatCount `gorm:"serializer:json" json:"top_referrers"`
+	DiskBytes     int64       `json:"disk_bytes"` // Web root size, last measured that day
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// PoolStatsDaily is one day of resource usage of a PHP-FPM pool
+type PoolStatsDaily struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	Version       string    `gorm:"uniqueIndex:idx_pool_stats_day" json:"version"`
+	Pool          string    `gorm:"uniqueIndex:idx_pool_stats_day" json:"pool"`
+	Date          string    `gorm:"uniqueIndex:idx_pool_stats_day" json:"date"`
+	CPUSeconds    float64   `json:"cpu_seconds"`
+	AvgMemory     int64     `json:"avg_memory"` // Bytes, summed over workers
+	PeakMemory    int64     `json:"peak_memory"`
+	PeakProcesses int       `json:"peak_processes"`
+	Samples       int       `json:"samples"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// LaravelConfig holds the toolkit settings of a laravel website
+type LaravelConfig struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	WebsiteID  uint      `gorm:"uniqueIndex" json:"website_id"`
+	Workers    int       `json:"workers"`    // Queue worker processes, 0 = none
+	Connection string    `json:"connection"` // Queue connection, empty = QUEUE_CONNECTION
+	Queue      string    `json:"queue"`      // Comma separated queue names, empty = default
+	Tries      int       `json:"tries"`
+	Timeout    int       `json:"timeout"` // Seconds a job may run
+	Scheduler  bool      `json:"scheduler"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 type Setting struct {
@@ -118,7 +394,7 @@ func Init() {
 	}
 
 	// Migrate the schema
-	err = DB.AutoMigrate(&User{}, &Website{}, &Setting{}, &LoginToken{}, &IPWhitelist{}, &Notification{}, &App{}, &Cron{})
+	err = DB.AutoMigrate(&User{}, &Website{}, &Setting{}, &LoginToken{}, &IPWhitelist{}, &Notification{}, &App{}, &Cron{}, &UptimeCheck{}, &EnvVar{}, &AuthRule{}, &AuthUser{}, &SiteStatsDaily{}, &PoolStatsDaily{}, &LaravelConfig{}, &ErrorPage{}, &ConfigVersion{}, &CacheConfig{}, &UpstreamGroup{}, &UpstreamBackend{}, &NginxSample{}, &SiteRequestSample{}, &SecurityConfig{}, &RateLimitConfig{}, &GeoRule{})
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
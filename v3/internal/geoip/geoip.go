@@ -0,0 +1,314 @@
+package geoip
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Dir holds the GeoIP databases the panel uses; tests point it elsewhere
+var Dir = "/opt/panda/geoip"
+
+// Database kinds: a country (or city) database and an ASN database
+const (
+	KindCountry = "country"
+	KindASN     = "asn"
+)
+
+const maxCachedLookups = 10000
+
+var countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Location is what the GeoIP databases know about an address
+type Location struct {
+	Country     string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	CountryName string `json:"country_name,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+}
+
+// String is the location for log views, e.g. "Germany, AS3320 Deutsche Telekom AG"
+func (l Location) String() string {
+	var parts []string
+	if l.CountryName != "" {
+		parts = append(parts, l.CountryName)
+	} else if l.Country != "" {
+		parts = append(parts, l.Country)
+	}
+	if l.ASN != 0 {
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("AS%d %s", l.ASN, l.ASOrg)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DatabaseInfo is the state of a GeoIP database
+type DatabaseInfo struct {
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	Loaded   bool      `json:"loaded"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	mu      sync.RWMutex
+	readers map[string]*Reader // Loaded on first use; nil entries failed to load
+	errs    map[string]error
+	cache   = map[string]Location{}
+)
+
+// DatabasePath is where the database of a kind is installed
+func DatabasePath(kind string) string {
+	return filepath.Join(Dir, kind+".mmdb")
+}
+
+// ValidCountry reports whether a code is an uppercase ISO 3166-1 alpha-2
+// country code
+func ValidCountry(code string) bool {
+	return countryCodeRegex.MatchString(code)
+}
+
+func load() {
+	mu.RLock()
+	loaded := readers != nil
+	mu.RUnlock()
+	if loaded {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if readers != nil {
+		return
+	}
+	readers, errs = map[string]*Reader{}, map[string]error{}
+	for _, kind := range []string{KindCountry, KindASN} {
+		r, err := Open(DatabasePath(kind))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs[kind] = err
+			}
+			continue
+		}
+		readers[kind] = r
+	}
+}
+
+func reader(kind string) *Reader {
+	load()
+	mu.RLock()
+	defer mu.RUnlock()
+	return readers[kind]
+}
+
+// Available reports whether the database of a kind is installed and loads
+func Available(kind string) bool {
+	return reader(kind) != nil
+}
+
+// Status returns the state of the country and ASN databases
+func Status() []DatabaseInfo {
+	load()
+	mu.RLock()
+	defer mu.RUnlock()
+	var infos []DatabaseInfo
+	for _, kind := range []string{KindCountry, KindASN} {
+		info := DatabaseInfo{Kind: kind, Path: DatabasePath(kind)}
+		if r := readers[kind]; r != nil {
+			meta := r.Metadata
+			info.Loaded, info.Metadata = true, &meta
+		}
+		if err := errs[kind]; err != nil {
+			info.Error = err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Lookup returns the country and ASN of an address; fields the databases
+// do not know stay empty
+func Lookup(ip string) Location {
+	mu.RLock()
+	loc, ok := cache[ip]
+	mu.RUnlock()
+	if ok {
+		return loc
+	}
+
+	if addr := net.ParseIP(ip); addr != nil {
+		// Country databases may carry the ASN too, and ASN ones the country
+		for _, kind := range []string{KindCountry, KindASN} {
+			if r := reader(kind); r != nil {
+				if record, _, err := r.Lookup(addr); err == nil {
+					fillLocation(&loc, record)
+				}
+			}
+		}
+	}
+
+	mu.Lock()
+	if len(cache) >= maxCachedLookups {
+		cache = map[string]Location{}
+	}
+	cache[ip] = loc
+	mu.Unlock()
+	return loc
+}
+
+// fillLocation copies the fields of a record that loc does not have yet.
+// Country and City databases hold country.iso_code and country.names, ASN
+// databases autonomous_system_number and autonomous_system_organization.
+func fillLocation(loc *Location, record any) {
+	m, ok := record.(map[string]any)
+	if !ok {
+		return
+	}
+	if loc.Country == "" {
+		loc.Country, loc.CountryName = recordCountry(m)
+	}
+	if loc.ASN == 0 {
+		loc.ASN = uint(toUint(m["autonomous_system_number"]))
+		loc.ASOrg, _ = m["autonomous_system_organization"].(string)
+	}
+}
+
+// recordCountry returns the country code and English name of a record,
+// falling back to the registered country for anycast and satellite ranges
+func recordCountry(m map[string]any) (string, string) {
+	for _, key := range []string{"country", "registered_country"} {
+		c, ok := m[key].(map[string]any)
+		if !ok {
+			continue
+		}
+		code, _ := c["iso_code"].(string)
+		if code == "" {
+			continue
+		}
+		name := ""
+		if names, ok := c["names"].(map[string]any); ok {
+			name, _ = names["en"].(string)
+		}
+		return code, name
+	}
+	return "", ""
+}
+
+// Update installs a database from a local file, e.g. a download or a
+// bundled fixture, and reloads the databases. The file must be a MaxMind
+// DB of the right kind.
+func Update(kind, source string) (*DatabaseInfo, error) {
+	if kind != KindCountry && kind != KindASN {
+		return nil, fmt.Errorf("unknown database kind: %s", kind)
+	}
+	r, err := Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", source, err)
+	}
+	if err := checkKind(kind, r); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return nil, err
+	}
+	dest := DatabasePath(kind)
+	if err := copyFile(source, dest+".tmp"); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(dest+".tmp", dest); err != nil {
+		os.Remove(dest + ".tmp")
+		return nil, err
+	}
+
+	mu.Lock()
+	readers, errs, cache = nil, nil, map[string]Location{}
+	mu.Unlock()
+
+	for _, info := range Status() {
+		if info.Kind == kind {
+			return &info, nil
+		}
+	}
+	return nil, fmt.Errorf("database not found after update")
+}
+
+// checkKind verifies that a database has the records of its kind, by
+// database type or else by looking up a well-known address
+func checkKind(kind string, r *Reader) error {
+	dbType := strings.ToLower(r.Metadata.DatabaseType)
+	if kind == KindCountry && (strings.Contains(dbType, "country") || strings.Contains(dbType, "city")) {
+		return nil
+	}
+	if kind == KindASN && (strings.Contains(dbType, "asn") || strings.Contains(dbType, "isp")) {
+		return nil
+	}
+	var loc Location
+	for _, ip := range []string{"8.8.8.8", "1.1.1.1", "2001:4860:4860::8888"} {
+		if record, _, err := r.Lookup(net.ParseIP(ip)); err == nil {
+			fillLocation(&loc, record)
+		}
+	}
+	if (kind == KindCountry && loc.Country != "") || (kind == KindASN && loc.ASN != 0) {
+		return nil
+	}
+	return fmt.Errorf("%q is not a %s database", r.Metadata.DatabaseType, kind)
+}
+
+// CountryNetworks returns the networks of the country database that belong
+// to the given countries, as CIDRs
+func CountryNetworks(countries []string) ([]string, error) {
+	r := reader(KindCountry)
+	if r == nil {
+		return nil, fmt.Errorf("no country database installed, add one to %s", DatabasePath(KindCountry))
+	}
+	wanted := map[string]bool{}
+	for _, c := range countries {
+		wanted[c] = true
+	}
+
+	// Networks of a country share few records, so decode each one once
+	matches := map[int]bool{}
+	var networks []string
+	err := r.Networks(func(network *net.IPNet, offset int) error {
+		match, seen := matches[offset]
+		if !seen {
+			record, err := r.Record(offset)
+			if err != nil {
+				return err
+			}
+			if m, ok := record.(map[string]any); ok {
+				code, _ := recordCountry(m)
+				match = wanted[code]
+			}
+			matches[offset] = match
+		}
+		if match {
+			networks = append(networks, network.String())
+		}
+		return nil
+	})
+	return networks, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
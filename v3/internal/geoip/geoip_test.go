@@ -0,0 +1,128 @@
+package geoip
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fixture is a country database built by testdata/gen.go
+const fixture = "testdata/country.mmdb"
+
+// useFixture installs the fixture as the country database of a temporary
+// database directory
+func useFixture(t *testing.T) {
+	t.Helper()
+	dir := Dir
+	Dir = t.TempDir()
+	t.Cleanup(func() {
+		mu.Lock()
+		Dir, readers, errs, cache = dir, nil, nil, map[string]Location{}
+		mu.Unlock()
+	})
+	info, err := Update(KindCountry, fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Loaded || info.Metadata.DatabaseType != "Panda-Test-Country" {
+		t.Fatalf("fixture not loaded: %+v", info)
+	}
+}
+
+func TestReaderLookup(t *testing.T) {
+	r, err := Open(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		country string
+		prefix  int
+	}{
+		{"81.2.69.160", "GB", 24},
+		{"81.2.71.1", "GB", 23},
+		{"8.8.8.8", "US", 24},
+		{"::ffff:8.8.8.8", "US", 24},
+		{"2001:db8::1", "DE", 32},
+		{"9.9.9.9", "", 0},
+		{"2001:db9::1", "", 0},
+	}
+	for _, tt := range tests {
+		record, prefix, err := r.Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.ip, err)
+		}
+		var loc Location
+		fillLocation(&loc, record)
+		if loc.Country != tt.country || (record != nil && prefix != tt.prefix) {
+			t.Errorf("%s: got %q /%d, want %q /%d", tt.ip, loc.Country, prefix, tt.country, tt.prefix)
+		}
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	r, err := Open(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var networks []string
+	offsets := map[string]int{}
+	err = r.Networks(func(network *net.IPNet, offset int) error {
+		networks = append(networks, network.String())
+		offsets[network.String()] = offset
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IPv4 networks come first and are not repeated under ::ffff:0:0/96
+	want := []string{"8.8.8.0/24", "81.2.69.0/24", "81.2.70.0/23", "192.0.2.0/24", "2001:db8::/32"}
+	if !reflect.DeepEqual(networks, want) {
+		t.Fatalf("got %v, want %v", networks, want)
+	}
+	if offsets["81.2.69.0/24"] != offsets["81.2.70.0/23"] {
+		t.Errorf("networks of one record have different offsets: %v", offsets)
+	}
+	record, err := r.Record(offsets["2001:db8::/32"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := recordCountry(record.(map[string]any)); code != "DE" {
+		t.Errorf("record of 2001:db8::/32 is %v", record)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	useFixture(t)
+	tests := map[string]Location{
+		"8.8.8.8":     {Country: "US", CountryName: "United States", ASN: 15169, ASOrg: "GOOGLE"},
+		"192.0.2.10":  {Country: "NL", CountryName: "Netherlands"},
+		"2001:db8::5": {Country: "DE", CountryName: "Germany"},
+		"9.9.9.9":     {},
+		"not an ip":   {},
+	}
+	for ip, want := range tests {
+		if got := Lookup(ip); got != want {
+			t.Errorf("Lookup(%q) = %+v, want %+v", ip, got, want)
+		}
+	}
+}
+
+func TestCountryNetworks(t *testing.T) {
+	useFixture(t)
+	got, err := CountryNetworks([]string{"GB", "DE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"81.2.69.0/24", "81.2.70.0/23", "2001:db8::/32"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpdateRejectsUnknownKind(t *testing.T) {
+	if _, err := Update("city", fixture); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
@@ -0,0 +1,381 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// metadataMarker starts the metadata section at the end of a MaxMind DB
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Metadata describes a MaxMind DB file
+type Metadata struct {
+	DatabaseType string    `json:"database_type"`
+	Description  string    `json:"description"`
+	IPVersion    uint      `json:"ip_version"`
+	NodeCount    uint      `json:"node_count"`
+	RecordSize   uint      `json:"record_size"`
+	BuildTime    time.Time `json:"build_time"`
+}
+
+// Reader reads a MaxMind DB (.mmdb) file: a binary search tree over the
+// bits of an address whose leaves point into a data section of typed,
+// self-describing values. Files from MaxMind, DB-IP and others share it.
+type Reader struct {
+	Metadata  Metadata
+	buf       []byte
+	data      decoder
+	ipv4Start uint
+}
+
+// Open reads a MaxMind DB file into memory
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(buf)
+}
+
+func newReader(buf []byte) (*Reader, error) {
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file: metadata not found")
+	}
+	raw, _, err := decoder{buf[idx+len(metadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	meta, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+
+	r := &Reader{buf: buf}
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	r.Metadata.IPVersion = uint(toUint(meta["ip_version"]))
+	r.Metadata.NodeCount = uint(toUint(meta["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(meta["record_size"]))
+	r.Metadata.BuildTime = time.Unix(int64(toUint(meta["build_epoch"])), 0)
+	if desc, ok := meta["description"].(map[string]any); ok {
+		r.Metadata.Description, _ = desc["en"].(string)
+	}
+
+	if major := toUint(meta["binary_format_major_version"]); major != 2 {
+		return nil, fmt.Errorf("unsupported MaxMind DB format version %d", major)
+	}
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.Metadata.IPVersion)
+	}
+	treeSize := int(r.Metadata.NodeCount * r.Metadata.RecordSize / 4)
+	if treeSize+16 > idx {
+		return nil, fmt.Errorf("search tree is larger than the file")
+	}
+	r.data = decoder{buf[treeSize+16 : idx]}
+
+	// IPv4 addresses live under ::/96 of an IPv6 tree
+	if r.Metadata.IPVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.Metadata.NodeCount; i++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Lookup returns the record of an address and the prefix length of the
+// network it belongs to. The record is nil if the address is not in the
+// database.
+func (r *Reader) Lookup(ip net.IP) (any, int, error) {
+	bits, node, prefix := ip.To16(), uint(0), 0
+	if ip4 := ip.To4(); ip4 != nil {
+		bits, node = ip4, r.ipv4Start
+	} else if bits == nil || r.Metadata.IPVersion == 4 {
+		return nil, 0, nil
+	}
+
+	for ; prefix < len(bits)*8 && node < r.Metadata.NodeCount; prefix++ {
+		node = r.readNode(node, uint(bits[prefix>>3]>>(7-prefix&7))&1)
+	}
+	return r.resolve(node, prefix)
+}
+
+// Networks calls fn with every network of the database that has a record,
+// and the offset of that record; networks sharing an offset share their
+// record. IPv4 networks are reported once, not again under their IPv6
+// aliases.
+func (r *Reader) Networks(fn func(network *net.IPNet, offset int) error) error {
+	if r.Metadata.IPVersion == 6 {
+		if err := r.walk(r.ipv4Start, make(net.IP, 4), 0, fn); err != nil {
+			return err
+		}
+		return r.walk(0, make(net.IP, 16), 0, fn)
+	}
+	return r.walk(0, make(net.IP, 4), 0, fn)
+}
+
+// Record decodes the record at an offset reported by Networks
+func (r *Reader) Record(offset int) (any, error) {
+	v, _, err := r.data.decode(offset)
+	return v, err
+}
+
+func (r *Reader) walk(node uint, ip net.IP, depth int, fn func(*net.IPNet, int) error) error {
+	if node >= r.Metadata.NodeCount {
+		if node == r.Metadata.NodeCount {
+			return nil
+		}
+		offset := int(node - r.Metadata.NodeCount - 16)
+		network := &net.IPNet{IP: append(net.IP(nil), ip...), Mask: net.CIDRMask(depth, len(ip)*8)}
+		return fn(network, offset)
+	}
+	if depth == len(ip)*8 {
+		return fmt.Errorf("search tree is deeper than the address")
+	}
+	// Reached again through ::/96 or an alias like ::ffff:0:0/96
+	if len(ip) == 16 && depth > 0 && node == r.ipv4Start {
+		return nil
+	}
+	for bit := uint(0); bit < 2; bit++ {
+		if bit == 1 {
+			ip[depth>>3] |= 1 << (7 - depth&7)
+		}
+		if err := r.walk(r.readNode(node, bit), ip, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	ip[depth>>3] &^= 1 << (7 - depth&7)
+	return nil
+}
+
+func (r *Reader) resolve(node uint, prefix int) (any, int, error) {
+	switch {
+	case node == r.Metadata.NodeCount:
+		return nil, prefix, nil
+	case node < r.Metadata.NodeCount:
+		return nil, 0, fmt.Errorf("invalid search tree")
+	}
+	v, err := r.Record(int(node - r.Metadata.NodeCount - 16))
+	return v, prefix, err
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) readNode(node, bit uint) uint {
+	b := r.buf
+	switch r.Metadata.RecordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xF0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0F)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// Data types of the MaxMind DB format
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at an offset and the offset after it. Maps
+// decode to map[string]any, arrays to []any, unsigned integers to uint64
+// (uint128 to *big.Int), int32 to int64.
+func (d decoder) decode(off int) (any, int, error) {
+	ctrl, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	off++
+	typ := int(ctrl[0] >> 5)
+
+	if typ == typePointer {
+		ptr, next, err := d.pointer(ctrl[0], off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		ext, err := d.bytes(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(ext[0])
+		off++
+	}
+
+	size, off, err := d.size(ctrl[0], off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at %d is not a string", off)
+			}
+			if m[key], off, err = d.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, size)
+		for i := range a {
+			if a[i], off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	b, err := d.bytes(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size %d", size)
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), off, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d at %d", typ, off)
+}
+
+// size reads the payload size of a value from its control byte and the
+// bytes after it
+func (d decoder) size(ctrl byte, off int) (int, int, error) {
+	size := int(ctrl & 0x1f)
+	if size < 29 {
+		return size, off, nil
+	}
+	n := size - 28
+	b, err := d.bytes(off, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	switch n {
+	case 1:
+		v += 29
+	case 2:
+		v += 285
+	case 3:
+		v += 65821
+	}
+	return v, off + n, nil
+}
+
+// pointer reads a pointer into the data section
+func (d decoder) pointer(ctrl byte, off int) (int, int, error) {
+	n := int(ctrl>>3&3) + 1
+	b, err := d.bytes(off, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	v := 0
+	if n < 4 {
+		v = int(ctrl & 7)
+	}
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, off + n, nil
+}
+
+func (d decoder) bytes(off, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > len(d.buf) {
+		return nil, fmt.Errorf("unexpected end of data at %d", off)
+	}
+	return d.buf[off : off+n], nil
+}
+
+func toUint(v any) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
@@ -0,0 +1,236 @@
+//go:build ignore
+
+// gen writes country.mmdb, the fixture database of the geoip tests: an
+// IPv6 MaxMind DB with 24-bit records, IPv4 under ::/96 and aliased at
+// ::ffff:0:0/96 like the published databases. Run it from this directory
+// with: go run gen.go
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"sort"
+)
+
+type (
+	u16 uint16
+	u32 uint32
+	u64 uint64
+)
+
+func country(code, name string) map[string]any {
+	return map[string]any{"iso_code": code, "names": map[string]any{"en": name}}
+}
+
+var (
+	gb = map[string]any{"country": country("GB", "United Kingdom")}
+	us = map[string]any{
+		"country":                        country("US", "United States"),
+		"autonomous_system_number":       u32(15169),
+		"autonomous_system_organization": "GOOGLE",
+	}
+	nl = map[string]any{"registered_country": country("NL", "Netherlands")}
+	de = map[string]any{"country": country("DE", "Germany")}
+)
+
+var networks = []struct {
+	cidr   string
+	record map[string]any
+}{
+	{"81.2.69.0/24", gb},
+	{"81.2.70.0/23", gb},
+	{"8.8.8.0/24", us},
+	{"192.0.2.0/24", nl},
+	{"2001:db8::/32", de},
+}
+
+type node struct {
+	child  [2]*node
+	record int // Data section offset of a leaf, -1 for inner nodes and empty leaves
+	empty  bool
+}
+
+func newNode() *node { return &node{record: -1} }
+
+// insert adds a network, IPv4 ones under ::/96
+func insert(root *node, cidr string, offset int) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ones, _ := network.Mask.Size()
+	ip := network.IP.To16()
+	if network.IP.To4() != nil {
+		ip = append(make(net.IP, 12), network.IP.To4()...)
+		ones += 96
+	}
+	n := root
+	for i := 0; i < ones; i++ {
+		bit := ip[i>>3] >> (7 - i&7) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = newNode()
+		}
+		n = n.child[bit]
+	}
+	n.record = offset
+}
+
+// fill gives every inner node two children so each record is a leaf or a node
+func fill(n *node) {
+	if n.record >= 0 {
+		return
+	}
+	for i := range n.child {
+		if n.child[i] == nil {
+			n.child[i] = &node{record: -1, empty: true}
+		} else {
+			fill(n.child[i])
+		}
+	}
+}
+
+func encode(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		control(buf, 2, len(v))
+		buf.WriteString(v)
+	case u16:
+		encodeUint(buf, 5, uint64(v))
+	case u32:
+		encodeUint(buf, 6, uint64(v))
+	case u64:
+		encodeUint(buf, 9, uint64(v))
+	case map[string]any:
+		control(buf, 7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	case []any:
+		control(buf, 11, len(v))
+		for _, e := range v {
+			encode(buf, e)
+		}
+	default:
+		log.Fatalf("unsupported value %T", v)
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, typ int, v uint64) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	control(buf, typ, len(b))
+	buf.Write(b)
+}
+
+func control(buf *bytes.Buffer, typ, size int) {
+	var extra []byte
+	if size >= 29 {
+		if size >= 285 {
+			log.Fatalf("size %d is too large", size)
+		}
+		size, extra = 29, []byte{byte(size - 29)}
+	}
+	if typ <= 7 {
+		buf.WriteByte(byte(typ<<5 | size))
+	} else {
+		buf.Write([]byte{byte(size), byte(typ - 7)})
+	}
+	buf.Write(extra)
+}
+
+func main() {
+	var data bytes.Buffer
+	offsets := map[string]int{} // Networks with the same record share it
+	root := newNode()
+	for _, n := range networks {
+		var record bytes.Buffer
+		encode(&record, n.record)
+		offset, ok := offsets[record.String()]
+		if !ok {
+			offset = data.Len()
+			offsets[record.String()] = offset
+			data.Write(record.Bytes())
+		}
+		insert(root, n.cidr, offset)
+	}
+
+	// Alias ::ffff:0:0/96 to the IPv4 tree
+	ipv4 := root
+	for i := 0; i < 96; i++ {
+		ipv4 = ipv4.child[0]
+	}
+	alias := root
+	for i := 0; i < 95; i++ {
+		bit := 0
+		if i >= 80 {
+			bit = 1
+		}
+		if alias.child[bit] == nil {
+			alias.child[bit] = newNode()
+		}
+		alias = alias.child[bit]
+	}
+	alias.child[1] = ipv4
+	fill(root)
+
+	// Number the inner nodes, each once
+	ids := map[*node]int{}
+	var order []*node
+	var number func(n *node)
+	number = func(n *node) {
+		if _, seen := ids[n]; seen || n.record >= 0 || n.empty {
+			return
+		}
+		ids[n] = len(order)
+		order = append(order, n)
+		number(n.child[0])
+		number(n.child[1])
+	}
+	number(root)
+
+	count := len(order)
+	value := func(n *node) int {
+		switch {
+		case n.empty:
+			return count
+		case n.record >= 0:
+			return count + 16 + n.record
+		}
+		return ids[n]
+	}
+	var out bytes.Buffer
+	for _, n := range order {
+		for _, c := range n.child {
+			v := value(c)
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encode(&out, map[string]any{
+		"binary_format_major_version": u16(2),
+		"binary_format_minor_version": u16(0),
+		"build_epoch":                 u64(1767225600),
+		"database_type":               "Panda-Test-Country",
+		"description":                 map[string]any{"en": "Panda Panel test fixture"},
+		"ip_version":                  u16(6),
+		"languages":                   []any{"en"},
+		"node_count":                  u32(count),
+		"record_size":                 u16(24),
+	})
+
+	if err := os.WriteFile("country.mmdb", out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
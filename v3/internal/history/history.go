@@ -0,0 +1,297 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+const (
+	// Panel is the author of writes the panel makes on its own, e.g. when a
+	// vhost is re-rendered after a settings change
+	Panel = "panel"
+	// External is the author of changes found on disk that the panel did
+	// not make
+	External = "external"
+
+	maxVersions = 50 // Per file; older versions are pruned
+)
+
+var phpVersionRegex = regexp.MustCompile(`^/etc/php/(\d+\.\d+)/`)
+
+// File is a config file with stored versions
+type File struct {
+	Path      string    `json:"path"`
+	Kind      string    `json:"kind"`
+	Versions  int64     `json:"versions"`
+	LatestID  uint      `json:"latest_id"`
+	Author    string    `json:"author"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Kind classifies a config file by its path
+func Kind(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/etc/nginx/"):
+		return "nginx"
+	case strings.HasPrefix(path, "/etc/php") && strings.Contains(path, "/pool.d/"):
+		return "fpm"
+	case strings.HasPrefix(path, "/etc/php"):
+		return "php"
+	case strings.HasPrefix(path, "/etc/cron"):
+		return "cron"
+	}
+	return "other"
+}
+
+// Snapshot stores the current content of a file before the panel changes
+// it, if that content is not the latest version yet: the file is seen for
+// the first time, or was edited outside the panel. Missing files are ignored.
+func Snapshot(path string) {
+	var count int64
+	db.DB.Model(&db.ConfigVersion{}).Where("path = ?", path).Count(&count)
+	note := "changed outside the panel"
+	if count == 0 {
+		note = "initial"
+	}
+	record(path, External, note)
+}
+
+// Record stores the current content of a file as a new version, unless it
+// equals the latest one
+func Record(path, author, note string) error {
+	if err := record(path, author, note); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// WriteFile writes a config file and records the change
+func WriteFile(path string, data []byte, perm os.FileMode, author, note string) error {
+	Snapshot(path)
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	return Record(path, author, note)
+}
+
+func record(path, author, note string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	var latest db.ConfigVersion
+	if db.DB.Select("hash").Where("path = ?", path).Order("id desc").First(&latest).Error == nil && latest.Hash == hash {
+		return nil
+	}
+
+	v := db.ConfigVersion{
+		Path:    path,
+		Kind:    Kind(path),
+		Content: string(content),
+		Hash:    hash,
+		Size:    len(content),
+		Author:  author,
+		Note:    note,
+	}
+	if err := db.DB.Create(&v).Error; err != nil {
+		return err
+	}
+
+	// Prune the oldest versions of the file
+	var stale []uint
+	db.DB.Model(&db.ConfigVersion{}).Where("path = ?", path).Order("id desc").Offset(maxVersions).Pluck("id", &stale)
+	if len(stale) > 0 {
+		db.DB.Delete(&db.ConfigVersion{}, stale)
+	}
+	return nil
+}
+
+// ListFiles returns every file with stored versions, most recently changed
+// first
+func ListFiles() ([]File, error) {
+	files := []File{}
+	err := db.DB.Model(&db.ConfigVersion{}).
+		Select("path, kind, count(*) as versions, max(id) as latest_id").
+		Group("path, kind").Order("latest_id desc").Scan(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		var latest db.ConfigVersion
+		if db.DB.Select("author", "created_at").First(&latest, files[i].LatestID).Error == nil {
+			files[i].Author = latest.Author
+			files[i].UpdatedAt = latest.CreatedAt
+		}
+	}
+	return files, nil
+}
+
+// ListVersions returns the versions of a file, newest first, without their
+// content
+func ListVersions(path string) ([]db.ConfigVersion, error) {
+	versions := []db.ConfigVersion{}
+	err := db.DB.Omit("content").Where("path = ?", path).Order("id desc").Find(&versions).Error
+	return versions, err
+}
+
+// GetVersion returns a version with its content
+func GetVersion(id uint) (*db.ConfigVersion, error) {
+	var v db.ConfigVersion
+	if err := db.DB.First(&v, id).Error; err != nil {
+		return nil, fmt.Errorf("version %d not found", id)
+	}
+	return &v, nil
+}
+
+// Diff returns a unified diff between two versions. A to of 0 compares
+// against the file as it is on disk now.
+func Diff(from, to uint) (string, error) {
+	a, err := GetVersion(from)
+	if err != nil {
+		return "", err
+	}
+	bName, bContent := "", ""
+	if to == 0 {
+		content, err := os.ReadFile(a.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		bName, bContent = a.Path+" (current)", string(content)
+	} else {
+		b, err := GetVersion(to)
+		if err != nil {
+			return "", err
+		}
+		bName, bContent = versionLabel(b), b.Content
+	}
+	return UnifiedDiff(versionLabel(a), bName, a.Content, bContent)
+}
+
+func versionLabel(v *db.ConfigVersion) string {
+	return fmt.Sprintf("%s (version %d, %s by %s)", v.Path, v.ID, v.CreatedAt.Format("2006-01-02 15:04:05"), v.Author)
+}
+
+// ApplyNginx writes a file of the nginx config through the staged,
+// validated apply of the nginx package, which imports this one and sets it
+var ApplyNginx func(path string, content []byte, author, note string) error
+
+// Rollback writes a version back to its file, tests the configuration and
+// reloads the service that reads it. nginx files go through ApplyNginx,
+// which re-enables a restored vhost; other files are put back as they were
+// when the test or the reload fails. The restored content is recorded as a
+// new version.
+//
+// The cron file is generated from the cron jobs in the database, so a
+// rolled back cron file only lasts until the jobs are changed again.
+func Rollback(id uint, author string) (*db.ConfigVersion, error) {
+	v, err := GetVersion(id)
+	if err != nil {
+		return nil, err
+	}
+	note := fmt.Sprintf("rollback to version %d", v.ID)
+
+	if v.Kind == "nginx" && ApplyNginx != nil {
+		if err := ApplyNginx(v.Path, []byte(v.Content), author, note); err != nil {
+			return nil, err
+		}
+	} else if err := rollbackFile(v); err != nil {
+		return nil, err
+	} else if err := Record(v.Path, author, note); err != nil {
+		return nil, err
+	}
+
+	var latest db.ConfigVersion
+	if err := db.DB.Omit("content").Where("path = ?", v.Path).Order("id desc").First(&latest).Error; err != nil {
+		return nil, err
+	}
+	return &latest, nil
+}
+
+// rollbackFile writes a version over its file, then tests and reloads the
+// service. On failure the previous file is restored and the service
+// reloaded again.
+func rollbackFile(v *db.ConfigVersion) error {
+	Snapshot(v.Path)
+	perm := os.FileMode(0644)
+	previous, readErr := os.ReadFile(v.Path)
+	if info, err := os.Stat(v.Path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.WriteFile(v.Path, []byte(v.Content), perm); err != nil {
+		return err
+	}
+	restore := func() {
+		if readErr == nil {
+			os.WriteFile(v.Path, previous, perm)
+		} else {
+			os.Remove(v.Path)
+		}
+	}
+
+	if err := testConfig(v.Kind, v.Path); err != nil {
+		restore()
+		return err
+	}
+	if err := reload(v.Kind, v.Path); err != nil {
+		restore()
+		reload(v.Kind, v.Path)
+		return fmt.Errorf("reload failed, the previous file was restored: %v", err)
+	}
+	return nil
+}
+
+// phpService returns the FPM binary and service of a php.ini or pool file
+func phpService(path string) (string, string) {
+	if m := phpVersionRegex.FindStringSubmatch(path); len(m) > 1 {
+		return "php-fpm" + m[1], "php" + m[1] + "-fpm"
+	}
+	return "php-fpm", "php-fpm"
+}
+
+func testConfig(kind, path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	switch kind {
+	case "nginx":
+		out, err := system.Execute("nginx -t 2>&1")
+		if err != nil || !strings.Contains(out, "successful") {
+			return fmt.Errorf("nginx config test failed: %s", out)
+		}
+	case "php", "fpm":
+		bin, _ := phpService(path)
+		if out, err := system.Execute(bin + " -t 2>&1"); err != nil {
+			return fmt.Errorf("php-fpm config test failed: %s", out)
+		}
+	}
+	return nil
+}
+
+func reload(kind, path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	switch kind {
+	case "nginx":
+		_, err := system.Execute("systemctl reload nginx")
+		return err
+	case "php", "fpm":
+		_, service := phpService(path)
+		_, err := system.Execute("systemctl reload " + service)
+		return err
+	}
+	// cron re-reads /etc/cron.d on its own
+	return nil
+}
@@ -2,11 +2,15 @@ package logs
 
 import (
 	"bufio"
+	"encoding/json"
+	"math"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/geoip"
 )
 
 type AccessLogEntry struct {
@@ -17,24 +21,31 @@ type AccessLogEntry struct {
 	Path     string    `json:"path"`
 	URL      string    `json:"url"`
 	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Referer  string    `json:"referer"`
 	Agent    string    `json:"agent"`
 	IsBot    bool      `json:"is_bot"`
-	Location string    `json:"location"`
+	Location string    `json:"location"` // Country and ASN, from the GeoIP databases
+	Country  string    `json:"country,omitempty"`
+	ASN      uint      `json:"asn,omitempty"`
 }
 
 type SecurityLogEntry struct {
-	Time    string `json:"time"`
-	Type    string `json:"type"`   // SSH, Login, Sudo
-	Status  string `json:"status"` // Success, Failed
-	User    string `json:"user"`
-	IP      string `json:"ip"`
-	Message string `json:"message"`
+	Time     string `json:"time"`
+	Type     string `json:"type"`   // SSH, Login, Sudo
+	Status   string `json:"status"` // Success, Failed
+	User     string `json:"user"`
+	IP       string `json:"ip"`
+	Message  string `json:"message"`
+	Location string `json:"location"` // Country and ASN, from the GeoIP databases
+	Country  string `json:"country,omitempty"`
+	ASN      uint   `json:"asn,omitempty"`
 }
 
 var (
 	// Example Nginx: 127.0.0.1 - - [29/Dec/2025:03:35:12 +0700] "GET /api/health HTTP/1.1" 200 45 "http://example.com/page" "Mozilla/5.0..."
 	// Format: $remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"
-	nginxRegex = regexp.MustCompile(`^(\S+) \S+ \S+ \[(.*?)\] "(.*?) (.*?) .*?" (\d+) \d+ "(.*?)" "(.*?)"`)
+	nginxRegex = regexp.MustCompile(`^(\S+) \S+ \S+ \[(.*?)\] "(.*?) (.*?) .*?" (\d+) (\d+) "(.*?)" "(.*?)"`)
 
 	// Example Auth: Dec 29 03:35:12 panda-vps sshd[1234]: Failed password for root from 1.2.3.4 port 5678 ssh2
 	sshFailedRegex  = regexp.MustCompile(`Failed password for (?:invalid user )?(\S+) from (\S+) port \d+`)
@@ -44,6 +55,10 @@ var (
 	hostRegex = regexp.MustCompile(`https?://([^/]+)`)
 )
 
+// BotKeywords are the lowercase user agent substrings of crawlers and HTTP
+// libraries
+var BotKeywords = []string{"bot", "spider", "crawler", "go-http-client", "python-requests", "curl", "wget", "headless"}
+
 func ParseAccessLogs(limit int) ([]AccessLogEntry, error) {
 	path := "/var/log/nginx/access.log"
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -73,54 +88,8 @@ func ParseAccessLogs(limit int) ([]AccessLogEntry, error) {
 	}
 
 	for i := len(lines) - 1; i >= start; i-- {
-		line := lines[i]
-		matches := nginxRegex.FindStringSubmatch(line)
-		if len(matches) > 7 {
-			status, _ := strconv.Atoi(matches[5])
-			referer := matches[6]
-			agent := matches[7]
-			path := matches[4]
-
-			// Extract host from referer or default to server
-			host := ""
-			if referer != "-" && referer != "" {
-				if hostMatch := hostRegex.FindStringSubmatch(referer); len(hostMatch) > 1 {
-					host = hostMatch[1]
-				}
-			}
-
-			// Build full URL
-			fullURL := path
-			if host != "" {
-				fullURL = host + path
-			}
-
-			entry := AccessLogEntry{
-				IP:     matches[1],
-				Method: matches[3],
-				Host:   host,
-				Path:   path,
-				URL:    fullURL,
-				Status: status,
-				Agent:  agent,
-			}
-
-			// Parse time (Nginx format: 02/Jan/2006:15:04:05 -0700)
-			t, err := time.Parse("02/Jan/2006:15:04:05 -0700", matches[2])
-			if err == nil {
-				entry.Time = t
-			}
-
-			// Bot detection
-			lowAgent := strings.ToLower(entry.Agent)
-			botKeywords := []string{"bot", "spider", "crawler", "go-http-client", "python-requests", "curl", "wget", "headless"}
-			for _, keyword := range botKeywords {
-				if strings.Contains(lowAgent, keyword) {
-					entry.IsBot = true
-					break
-				}
-			}
-
+		if entry, ok := ParseAccessLine(lines[i]); ok {
+			entry.Location, entry.Country, entry.ASN = locate(entry.IP)
 			entries = append(entries, entry)
 		}
 	}
@@ -128,6 +97,108 @@ func ParseAccessLogs(limit int) ([]AccessLogEntry, error) {
 	return entries, nil
 }
 
+// caddyAccessLine is the part of a Caddy access log entry the panel reads
+type caddyAccessLine struct {
+	TS      float64 `json:"ts"`
+	Status  int     `json:"status"`
+	Size    int64   `json:"size"`
+	Request struct {
+		RemoteIP string              `json:"remote_ip"`
+		ClientIP string              `json:"client_ip"`
+		Method   string              `json:"method"`
+		URI      string              `json:"uri"`
+		Headers  map[string][]string `json:"headers"`
+	} `json:"request"`
+}
+
+// ParseAccessLine parses one line of an nginx access log in the combined
+// format, or of a Caddy access log (one JSON object per request)
+func ParseAccessLine(line string) (AccessLogEntry, bool) {
+	if strings.HasPrefix(line, "{") {
+		return parseCaddyLine(line)
+	}
+	matches := nginxRegex.FindStringSubmatch(line)
+	if len(matches) < 9 {
+		return AccessLogEntry{}, false
+	}
+
+	status, _ := strconv.Atoi(matches[5])
+	bytes, _ := strconv.ParseInt(matches[6], 10, 64)
+	entry := accessEntry(matches[1], matches[3], matches[4], status, bytes, matches[7], matches[8])
+
+	// Parse time (Nginx format: 02/Jan/2006:15:04:05 -0700)
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", matches[2])
+	if err == nil {
+		entry.Time = t
+	}
+	return entry, true
+}
+
+func parseCaddyLine(line string) (AccessLogEntry, bool) {
+	var l caddyAccessLine
+	if err := json.Unmarshal([]byte(line), &l); err != nil || l.Request.Method == "" {
+		return AccessLogEntry{}, false
+	}
+	ip := l.Request.ClientIP
+	if ip == "" {
+		ip = l.Request.RemoteIP
+	}
+	header := func(name string) string {
+		if v := l.Request.Headers[name]; len(v) > 0 {
+			return v[0]
+		}
+		return "-"
+	}
+	entry := accessEntry(ip, l.Request.Method, l.Request.URI, l.Status, l.Size, header("Referer"), header("User-Agent"))
+	if l.TS > 0 {
+		sec, frac := math.Modf(l.TS)
+		entry.Time = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	return entry, true
+}
+
+// accessEntry builds an entry from the fields of an access log line
+func accessEntry(ip, method, path string, status int, bytes int64, referer, agent string) AccessLogEntry {
+	// Extract host from referer or default to server
+	host := ""
+	if referer != "-" && referer != "" {
+		if hostMatch := hostRegex.FindStringSubmatch(referer); len(hostMatch) > 1 {
+			host = hostMatch[1]
+		}
+	}
+
+	// Build full URL
+	fullURL := path
+	if host != "" {
+		fullURL = host + path
+	}
+
+	entry := AccessLogEntry{
+		IP:      ip,
+		Method:  method,
+		Host:    host,
+		Path:    path,
+		URL:     fullURL,
+		Status:  status,
+		Bytes:   bytes,
+		Referer: referer,
+		Agent:   agent,
+	}
+	entry.IsBot = IsBotAgent(entry.Agent)
+	return entry
+}
+
+// IsBotAgent reports whether a user agent is a crawler or an HTTP library
+func IsBotAgent(agent string) bool {
+	lowAgent := strings.ToLower(agent)
+	for _, keyword := range BotKeywords {
+		if strings.Contains(lowAgent, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
 func ParseSecurityLogs(limit int) ([]SecurityLogEntry, error) {
 	path := "/var/log/auth.log"
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -180,9 +251,18 @@ func ParseSecurityLogs(limit int) ([]SecurityLogEntry, error) {
 		}
 	}
 
+	for i := range entries {
+		entries[i].Location, entries[i].Country, entries[i].ASN = locate(entries[i].IP)
+	}
 	return entries, nil
 }
 
+// locate returns the location, country code and ASN of an address
+func locate(ip string) (string, string, uint) {
+	loc := geoip.Lookup(ip)
+	return loc.String(), loc.Country, loc.ASN
+}
+
 func extractTime(line string) string {
 	if len(line) < 15 {
 		return ""
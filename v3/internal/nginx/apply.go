@@ -0,0 +1,397 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/history"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+const (
+	probeTimeout = 5 * time.Second
+	reloadSettle = 500 * time.Millisecond // Time for new workers to take over after a reload
+	tmpSuffix    = ".panda-tmp"
+)
+
+// applyMu serializes config changes, so a validation never sees another
+// change half applied
+var applyMu sync.Mutex
+
+func init() {
+	history.ApplyNginx = applyRollback
+}
+
+// applyRollback applies a file restored from the config history. A vhost
+// in sites-available is enabled again along with it.
+func applyRollback(path string, content []byte, author, note string) error {
+	file := FileChange{Path: path, Content: content}
+	if filepath.Dir(path) == SitesAvailable {
+		file.Link = filepath.Join(SitesEnabled, filepath.Base(path))
+	}
+	return Apply(ConfigChange{Files: []FileChange{file}, Author: author, Note: note})
+}
+
+// FileChange is one file of a config change. Link, if set, is the
+// sites-enabled entry of Path. Remove deletes Path and Link instead.
+// Private files, e.g. htpasswd files, are only readable by root and the
+// nginx worker group.
+type FileChange struct {
+	Path    string
+	Content []byte
+	Link    string
+	Remove  bool
+	Private bool
+}
+
+// ConfigChange is a set of files applied together by Apply
+type ConfigChange struct {
+	Files  []FileChange
+	Probe  []string // Hosts that must still get an HTTP answer after the reload
+	Author string   // Recorded in the config history, empty = panel
+	Note   string
+}
+
+type fileBackup struct {
+	path    string
+	existed bool
+	target  string // Symlink target, for links
+	content []byte
+	mode    os.FileMode
+	private bool
+}
+
+// Apply writes a config change as one transaction. The files are staged in
+// a copy of the config tree and checked with nginx -t against that copy, so
+// the live config is never touched by a change that does not validate. They
+// are then swapped in by renames and nginx is reloaded. If the reload fails,
+// nginx stops, or a probe host that answered before no longer does, the
+// previous files are put back and nginx is reloaded again.
+func Apply(change ConfigChange) error {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	if change.Author == "" {
+		change.Author = history.Panel
+	}
+	if runtime.GOOS == "windows" {
+		return applyCopies(change.Files)
+	}
+
+	for _, f := range change.Files {
+		if !strings.HasPrefix(f.Path, ConfDir+"/") || (f.Link != "" && !strings.HasPrefix(f.Link, ConfDir+"/")) {
+			return fmt.Errorf("%s is outside %s", f.Path, ConfDir)
+		}
+	}
+	if err := validateStaged(change.Files); err != nil {
+		return err
+	}
+
+	answered := probeHosts(change.Probe)
+	for _, f := range change.Files {
+		history.Snapshot(f.Path)
+	}
+	backups, err := swapFiles(change.Files)
+	if err != nil {
+		restoreFiles(backups)
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+
+	if err := reloadAndProbe(answered); err != nil {
+		restoreFiles(backups)
+		Reload()
+		return fmt.Errorf("%v; the previous config was restored", err)
+	}
+
+	for _, f := range change.Files {
+		if !f.Remove {
+			history.Record(f.Path, change.Author, change.Note)
+		}
+	}
+	return nil
+}
+
+// validateStaged copies the config tree with the change applied into a
+// temporary directory, points absolute paths at the copy and runs nginx -t
+// on it
+func validateStaged(files []FileChange) error {
+	stage, err := os.MkdirTemp("", "panda-nginx-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	byPath := map[string]*FileChange{}
+	byLink := map[string]*FileChange{}
+	for i := range files {
+		byPath[files[i].Path] = &files[i]
+		if files[i].Link != "" {
+			byLink[files[i].Link] = &files[i]
+		}
+	}
+	rewrite := func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte(ConfDir+"/"), []byte(stage+"/"))
+	}
+	staged := func(path string) string {
+		return filepath.Join(stage, strings.TrimPrefix(path, ConfDir))
+	}
+
+	err = filepath.WalkDir(ConfDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Unreadable entries are left out, as nginx could not read them either
+		}
+		target := staged(path)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if byLink[path] != nil || strings.HasSuffix(path, tmpSuffix) {
+			return nil
+		}
+
+		real := path
+		if d.Type()&fs.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				// Keep dangling links dangling
+				link, _ := os.Readlink(path)
+				return os.Symlink(link, target)
+			}
+			if info, err := os.Stat(resolved); err == nil && info.IsDir() {
+				return os.Symlink(resolved, target)
+			}
+			real = resolved
+		}
+
+		var content []byte
+		if f := byPath[real]; f != nil {
+			if f.Remove {
+				return nil
+			}
+			content = f.Content
+		} else if content, err = os.ReadFile(path); err != nil {
+			return nil
+		}
+		return os.WriteFile(target, rewrite(content), 0600)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stage config: %v", err)
+	}
+
+	// New files and links
+	for _, f := range files {
+		if f.Remove {
+			continue
+		}
+		for _, path := range []string{f.Path, f.Link} {
+			if path == "" {
+				continue
+			}
+			if _, err := os.Lstat(staged(path)); err == nil && path == f.Path {
+				continue
+			}
+			os.MkdirAll(filepath.Dir(staged(path)), 0755)
+			if err := os.WriteFile(staged(path), rewrite(f.Content), 0600); err != nil {
+				return fmt.Errorf("failed to stage config: %v", err)
+			}
+		}
+	}
+
+	out, err := system.Execute(fmt.Sprintf("nginx -t -c %s 2>&1", filepath.Join(stage, "nginx.conf")))
+	if err != nil || !strings.Contains(out, "successful") {
+		return fmt.Errorf("nginx config test failed: %s", strings.ReplaceAll(out, stage, ConfDir))
+	}
+	return nil
+}
+
+// swapFiles puts the change in place, returning what it replaced. Writes go
+// to a temporary file that is renamed over the old one, so nginx never reads
+// a partly written file.
+func swapFiles(files []FileChange) ([]fileBackup, error) {
+	var backups []fileBackup
+	for _, f := range files {
+		b := fileBackup{path: f.Path, mode: 0644, private: f.Private}
+		if info, err := os.Stat(f.Path); err == nil {
+			b.mode = info.Mode().Perm()
+		}
+		if content, err := os.ReadFile(f.Path); err == nil {
+			b.existed, b.content = true, content
+		}
+		backups = append(backups, b)
+		if f.Remove {
+			os.Remove(f.Path)
+		} else if err := writeChange(f, b.mode); err != nil {
+			return backups, err
+		}
+
+		if f.Link == "" {
+			continue
+		}
+		l := fileBackup{path: f.Link, mode: 0644}
+		if target, err := os.Readlink(f.Link); err == nil {
+			l.existed, l.target = true, target
+		} else if content, err := os.ReadFile(f.Link); err == nil {
+			l.existed, l.content = true, content
+		}
+		backups = append(backups, l)
+		if f.Remove {
+			os.Remove(f.Link)
+		} else if err := linkAtomic(f.Path, f.Link); err != nil {
+			return backups, err
+		}
+	}
+	return backups, nil
+}
+
+func restoreFiles(backups []fileBackup) {
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		switch {
+		case !b.existed:
+			os.Remove(b.path)
+		case b.target != "":
+			linkAtomic(b.target, b.path)
+		default:
+			writeChange(FileChange{Path: b.path, Content: b.content, Private: b.private}, b.mode)
+		}
+	}
+}
+
+// writeChange writes the file of a change, creating its directory. The
+// mode of a private file and its directory is set whether they are new or
+// not, as nginx workers open them on every request.
+func writeChange(f FileChange, mode os.FileMode) error {
+	dir := filepath.Dir(f.Path)
+	if !f.Private {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		return writeAtomic(f.Path, f.Content, mode, nil)
+	}
+
+	dirMode, fileMode := os.FileMode(0750), os.FileMode(0640)
+	gid, ok := workerGID()
+	if !ok {
+		dirMode, fileMode = 0755, 0644
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	if err := restrict(dir, dirMode, gid, ok); err != nil {
+		return err
+	}
+	return writeAtomic(f.Path, f.Content, fileMode, func(tmp string) error {
+		return restrict(tmp, fileMode, gid, ok)
+	})
+}
+
+// writeAtomic writes a file through a temporary one; prepare, if set, runs
+// on the temporary file before it is renamed into place
+func writeAtomic(path string, content []byte, mode os.FileMode, prepare func(tmp string) error) error {
+	tmp := path + tmpSuffix
+	if err := os.WriteFile(tmp, content, mode); err != nil {
+		return err
+	}
+	if prepare != nil {
+		if err := prepare(tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func linkAtomic(target, link string) error {
+	tmp := link + tmpSuffix
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// applyCopies writes a change without validation; on Windows there is no
+// nginx to test against and sites-enabled holds copies instead of links
+func applyCopies(files []FileChange) error {
+	for _, f := range files {
+		if f.Remove {
+			os.Remove(f.Path)
+			if f.Link != "" {
+				os.Remove(f.Link)
+			}
+			continue
+		}
+		os.MkdirAll(filepath.Dir(f.Path), 0755)
+		if err := os.WriteFile(f.Path, f.Content, 0644); err != nil {
+			return err
+		}
+		if f.Link != "" {
+			os.WriteFile(f.Link, f.Content, 0644)
+		}
+	}
+	return nil
+}
+
+func reloadAndProbe(answered map[string]bool) error {
+	if err := Reload(); err != nil {
+		return fmt.Errorf("nginx reload failed: %v", err)
+	}
+	time.Sleep(reloadSettle)
+	if status, _ := GetStatus(); status != "active" {
+		return fmt.Errorf("nginx is %s after the reload", status)
+	}
+	for host, ok := range answered {
+		if ok && !probeHost(host) {
+			return fmt.Errorf("%s no longer answers after the reload", host)
+		}
+	}
+	return nil
+}
+
+func probeHosts(hosts []string) map[string]bool {
+	answered := map[string]bool{}
+	for _, host := range hosts {
+		answered[host] = probeHost(host)
+	}
+	return answered
+}
+
+// probeHost reports whether nginx gives any HTTP answer for a host. The
+// status is not judged: an application error is not a config problem.
+func probeHost(host string) bool {
+	client := &http.Client{
+		Timeout: probeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+	if err != nil {
+		return false
+	}
+	req.Host = host
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
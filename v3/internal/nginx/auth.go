@@ -0,0 +1,140 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+)
+
+// HtpasswdDir holds the user files of basic auth rules
+const HtpasswdDir = "/etc/nginx/panda/htpasswd"
+
+var nonVarChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// AuthSnippet is the basic auth config of a site. HTTP goes before the
+// server block (geo/map), Server inside it.
+type AuthSnippet struct {
+	HTTP   string
+	Server string
+	Files  []FileChange // htpasswd files of the rules
+}
+
+// HtpasswdPath is the user file of an auth rule
+func HtpasswdPath(domain string, ruleID uint) string {
+	return filepath.Join(HtpasswdDir, fmt.Sprintf("%s_%d", domain, ruleID))
+}
+
+// RenderAuth renders the htpasswd files of a website's basic auth rules and
+// the nginx config that applies them. Each rule gets a geo block
+// for its bypass list; a map over "<bypass flags>:$uri" then picks the realm
+// and user file of the longest matching path, or off.
+func RenderAuth(domain string) (AuthSnippet, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return AuthSnippet{}, nil
+	}
+
+	var rules []db.AuthRule
+	if err := db.DB.Preload("Users").Where("website_id = ? AND enabled = ?", site.ID, true).Find(&rules).Error; err != nil {
+		return AuthSnippet{}, err
+	}
+
+	// A rule without users would lock everyone out
+	active := rules[:0]
+	for _, r := range rules {
+		if len(r.Users) > 0 {
+			active = append(active, r)
+		}
+	}
+	if len(active) == 0 {
+		return AuthSnippet{}, nil
+	}
+	sort.SliceStable(active, func(i, j int) bool { return len(active[i].Path) > len(active[j].Path) })
+
+	name := nonVarChars.ReplaceAllString(domain, "_")
+	realmVar := "$panda_auth_realm_" + name
+	fileVar := "$panda_auth_file_" + name
+
+	// nginx workers open the user files on every request, so they are
+	// readable by their group; everyone else is kept out
+	var files []FileChange
+	var http, key strings.Builder
+	for _, r := range active {
+		var lines strings.Builder
+		for _, u := range r.Users {
+			lines.WriteString(u.Username + ":" + u.Hash + "\n")
+		}
+		files = append(files, FileChange{Path: HtpasswdPath(domain, r.ID), Content: []byte(lines.String()), Private: true})
+
+		bypassVar := fmt.Sprintf("$panda_auth_bypass_%s_%d", name, r.ID)
+		fmt.Fprintf(&http, "geo %s {\n    default 0;\n", bypassVar)
+		for _, ip := range r.BypassIPs {
+			fmt.Fprintf(&http, "    %s 1;\n", ip)
+		}
+		http.WriteString("}\n")
+		key.WriteString(bypassVar)
+	}
+
+	for _, m := range []struct{ variable, def string }{{realmVar, "off"}, {fileVar, "/dev/null"}} {
+		fmt.Fprintf(&http, "map \"%s:$uri\" %s {\n    default %s;\n", key.String(), m.variable, m.def)
+		// Let's Encrypt HTTP-01 challenges must stay reachable
+		fmt.Fprintf(&http, "    \"~^[01]*:/\\.well-known/acme-challenge/\" %s;\n", m.def)
+		for i, r := range active {
+			value := fmt.Sprintf("%q", r.Realm)
+			if m.variable == fileVar {
+				value = HtpasswdPath(domain, r.ID)
+			}
+			fmt.Fprintf(&http, "    \"~^[01]{%d}0[01]*:%s\" %s;\n", i, regexp.QuoteMeta(r.Path), value)
+		}
+		http.WriteString("}\n")
+	}
+
+	return AuthSnippet{
+		HTTP:   "# Basic auth, managed by Panda Panel\n" + http.String(),
+		Server: fmt.Sprintf("auth_basic %s;\n    auth_basic_user_file %s;", realmVar, fileVar),
+		Files:  files,
+	}, nil
+}
+
+// workerGID is the group nginx workers run as: the group of the user
+// directive in nginx.conf, which defaults to the user's name, or www-data
+func workerGID() (int, bool) {
+	name := "www-data"
+	if config, err := ParseFile(filepath.Join(ConfDir, "nginx.conf")); err == nil {
+		if d := First(config.Directives, "user"); d != nil && d.Arg(0) != "" {
+			name = d.Arg(0)
+			if d.Arg(1) != "" {
+				name = d.Arg(1)
+			}
+		}
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, false
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	return gid, err == nil
+}
+
+// restrict sets the mode of a path, which WriteFile and MkdirAll leave alone
+// on existing files, and gives it to root and the worker group
+func restrict(path string, mode os.FileMode, gid int, chown bool) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if chown {
+		return os.Chown(path, 0, gid)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package nginx
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+)
+
+// CacheDir holds the page cache of each site
+const CacheDir = "/var/cache/nginx/panda"
+
+// Cache kinds
+const (
+	CacheFastCGI = "fastcgi"
+	CacheProxy   = "proxy"
+)
+
+// Cache defaults, used for settings left at 0
+const (
+	DefaultCacheZoneSize = 10   // MB
+	DefaultCacheMaxSize  = 1024 // MB
+	DefaultCacheTTL      = 3600 // Seconds
+)
+
+// cacheKey is the key of every cached response. Purging by URL depends on
+// it: the cache file of a key is named after its MD5.
+const cacheKey = "$scheme$request_method$host$request_uri"
+
+var cacheKeyMethods = []string{"GET", "HEAD"}
+
+// cachePathRegex limits excluded paths to characters that need no quoting
+// in a regex, other than dots
+var cachePathRegex = regexp.MustCompile(`^/[A-Za-z0-9._~/%-]*$`)
+
+var cacheCookieRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CacheSnippet is the page cache config of a site. HTTP goes before the
+// server block (the cache path), Server inside it.
+type CacheSnippet struct {
+	HTTP   string
+	Server string
+}
+
+// CacheKindForSiteType returns the page cache kind of a website type.
+// Static sites are served from disk and have none.
+func CacheKindForSiteType(siteType string) (string, error) {
+	switch TemplateForSiteType(siteType) {
+	case "static":
+		return "", fmt.Errorf("static sites are served from disk and have no page cache")
+	case "proxy":
+		return CacheProxy, nil
+	}
+	return CacheFastCGI, nil
+}
+
+// CachePath is the cache directory of a site
+func CachePath(domain string) string {
+	return filepath.Join(CacheDir, domain)
+}
+
+// CacheZone is the name of a site's cache zone
+func CacheZone(domain string) string {
+	return "panda_cache_" + nonVarChars.ReplaceAllString(domain, "_")
+}
+
+// ValidateCacheConfig checks the bypass cookies and excluded paths of a
+// cache config
+func ValidateCacheConfig(c db.CacheConfig) error {
+	if c.ZoneSize < 0 || c.MaxSize < 0 || c.TTL < 0 || c.NotFoundTTL < 0 {
+		return fmt.Errorf("sizes and TTLs must not be negative")
+	}
+	for _, cookie := range c.BypassCookies {
+		if !cacheCookieRegex.MatchString(cookie) {
+			return fmt.Errorf("invalid cookie name: %q", cookie)
+		}
+	}
+	for _, path := range c.ExcludePaths {
+		if !cachePathRegex.MatchString(path) {
+			return fmt.Errorf("invalid path: %q", path)
+		}
+	}
+	return nil
+}
+
+// RenderCache returns the page cache config of a website, empty when its
+// cache is off. kind is CacheFastCGI or CacheProxy, depending on how the
+// site's template reaches the application.
+//
+// Requests skip the cache when they carry a query string, one of the bypass
+// cookies or start with an excluded path. Responses the application marks
+// as private or sets cookies on are not stored either, as nginx honours
+// those headers.
+func RenderCache(domain, kind string) (CacheSnippet, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return CacheSnippet{}, nil
+	}
+	var c db.CacheConfig
+	if db.DB.Where("website_id = ?", site.ID).First(&c).Error != nil || !c.Enabled {
+		return CacheSnippet{}, nil
+	}
+	if kind != CacheFastCGI && kind != CacheProxy {
+		return CacheSnippet{}, fmt.Errorf("unknown cache kind: %s", kind)
+	}
+	if err := ValidateCacheConfig(c); err != nil {
+		return CacheSnippet{}, err
+	}
+	if c.ZoneSize == 0 {
+		c.ZoneSize = DefaultCacheZoneSize
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultCacheMaxSize
+	}
+	if c.TTL == 0 {
+		c.TTL = DefaultCacheTTL
+	}
+
+	dir := CachePath(domain)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return CacheSnippet{}, err
+	}
+	zone := CacheZone(domain)
+
+	var server strings.Builder
+	server.WriteString("set $panda_cache_skip 0;\n")
+	server.WriteString("    if ($query_string != \"\") {\n        set $panda_cache_skip 1;\n    }\n")
+	if kind == CacheProxy {
+		server.WriteString("    if ($http_upgrade != \"\") {\n        set $panda_cache_skip 1;\n    }\n")
+	}
+	if len(c.BypassCookies) > 0 {
+		fmt.Fprintf(&server, "    if ($http_cookie ~* \"(%s)\") {\n        set $panda_cache_skip 1;\n    }\n", strings.Join(c.BypassCookies, "|"))
+	}
+	if len(c.ExcludePaths) > 0 {
+		paths := make([]string, len(c.ExcludePaths))
+		for i, p := range c.ExcludePaths {
+			paths[i] = regexp.QuoteMeta(p)
+		}
+		fmt.Fprintf(&server, "    if ($request_uri ~* \"^(%s)\") {\n        set $panda_cache_skip 1;\n    }\n", strings.Join(paths, "|"))
+	}
+	fmt.Fprintf(&server, "    %s_cache %s;\n", kind, zone)
+	fmt.Fprintf(&server, "    %s_cache_key \"%s\";\n", kind, cacheKey)
+	fmt.Fprintf(&server, "    %s_cache_valid 200 301 302 %ds;\n", kind, c.TTL)
+	if c.NotFoundTTL > 0 {
+		fmt.Fprintf(&server, "    %s_cache_valid 404 %ds;\n", kind, c.NotFoundTTL)
+	}
+	fmt.Fprintf(&server, "    %s_cache_bypass $panda_cache_skip;\n", kind)
+	fmt.Fprintf(&server, "    %s_no_cache $panda_cache_skip;\n", kind)
+	fmt.Fprintf(&server, "    %s_cache_use_stale error timeout updating http_500 http_503;\n", kind)
+	fmt.Fprintf(&server, "    %s_cache_background_update on;\n", kind)
+	fmt.Fprintf(&server, "    %s_cache_lock on;\n", kind)
+	server.WriteString("    add_header X-Cache-Status $upstream_cache_status always;")
+
+	return CacheSnippet{
+		HTTP: fmt.Sprintf("# Page cache, managed by Panda Panel\n%s_cache_path %s levels=1:2 keys_zone=%s:%dm max_size=%dm inactive=%ds use_temp_path=off;\n",
+			kind, dir, zone, c.ZoneSize, c.MaxSize, max(c.TTL, DefaultCacheTTL)),
+		Server: server.String(),
+	}, nil
+}
+
+// PurgeCache deletes cached responses of a site without the purge module,
+// by removing their files; nginx treats a missing file as a miss. With url
+// and prefix empty the whole cache goes. url is a path with query, or a
+// full URL whose host must be one of hosts; without a host every host and
+// both schemes are purged. prefix matches the start of the path the same
+// way. Returns the number of files removed.
+func PurgeCache(domain string, hosts []string, url, prefix string) (int, error) {
+	dir := CachePath(domain)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if url == "" && prefix == "" {
+		count := 0
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			filepath.WalkDir(filepath.Join(dir, e.Name()), func(_ string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					count++
+				}
+				return nil
+			})
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return count, err
+			}
+		}
+		return count, nil
+	}
+
+	if url != "" {
+		keys, err := purgeKeys(url, hosts)
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, key := range keys {
+			if os.Remove(cacheFile(dir, key)) == nil {
+				count++
+			}
+		}
+		return count, nil
+	}
+
+	keys, err := purgeKeys(prefix, hosts)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		key, err := readCacheKey(path)
+		if err != nil {
+			return nil
+		}
+		for _, k := range keys {
+			if strings.HasPrefix(key, k) {
+				if os.Remove(path) == nil {
+					count++
+				}
+				break
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// purgeKeys expands a path or URL to the cache keys it can be stored under
+func purgeKeys(url string, hosts []string) ([]string, error) {
+	schemes := []string{"http", "https"}
+	path := url
+	if i := strings.Index(url, "://"); i >= 0 {
+		scheme := strings.ToLower(url[:i])
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("invalid URL: %s", url)
+		}
+		host, rest, _ := strings.Cut(url[i+3:], "/")
+		host = strings.ToLower(host)
+		if h, _, ok := strings.Cut(host, ":"); ok {
+			host = h
+		}
+		found := false
+		for _, h := range hosts {
+			if h == host {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not a host of this site", host)
+		}
+		schemes, hosts, path = []string{scheme}, []string{host}, "/"+rest
+	}
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t\r\n") {
+		return nil, fmt.Errorf("invalid path: %s", url)
+	}
+
+	var keys []string
+	for _, scheme := range schemes {
+		for _, method := range cacheKeyMethods {
+			for _, host := range hosts {
+				keys = append(keys, scheme+method+host+path)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// cacheFile is where nginx stores a key with levels=1:2
+func cacheFile(dir, key string) string {
+	sum := md5.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(dir, name[31:], name[29:31], name)
+}
+
+// readCacheKey reads the "KEY: " line from the header of a cache file
+func readCacheKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	i := bytes.Index(head[:n], []byte("\nKEY: "))
+	if i < 0 {
+		return "", fmt.Errorf("no cache key in %s", path)
+	}
+	line := head[i+6 : n]
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return "", fmt.Errorf("no cache key in %s", path)
+	}
+	return string(line[:end]), nil
+}
@@ -0,0 +1,172 @@
+package nginx
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/geoip"
+)
+
+const (
+	// GeoDir holds the networks of each country rule, included by its geo block
+	GeoDir = "/etc/nginx/panda/geo"
+	// GeoConfPath defines the variable of the panel-wide country rule
+	GeoConfPath = "/etc/nginx/conf.d/panda-geoip.conf"
+)
+
+// Country rule modes
+const (
+	GeoAllow = "allow" // Only the listed countries get through
+	GeoDeny  = "deny"  // Everyone but the listed countries gets through
+)
+
+const geoPanelVar = "$panda_geo_panel"
+
+// geoLocalNets have no country; allow rules let them through so the server
+// itself and private networks keep access
+var geoLocalNets = []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7"}
+
+// GeoSnippet is the country rule of a site. HTTP goes before the server
+// block (geo), Server inside it.
+type GeoSnippet struct {
+	HTTP   string
+	Server string
+	Files  []FileChange // Networks file of the rule
+}
+
+// GeoNetworksPath is the networks file of a site's country rule, or of the
+// panel-wide rule for an empty domain
+func GeoNetworksPath(domain string) string {
+	if domain == "" {
+		return filepath.Join(GeoDir, "panel.conf")
+	}
+	return filepath.Join(GeoDir, "sites", domain+".conf")
+}
+
+// ValidateGeoRule checks the mode and countries of a country rule
+func ValidateGeoRule(r db.GeoRule) error {
+	if r.Mode != GeoAllow && r.Mode != GeoDeny {
+		return fmt.Errorf("invalid mode %q, expected allow or deny", r.Mode)
+	}
+	if r.Enabled && len(r.Countries) == 0 {
+		return fmt.Errorf("at least one country is required")
+	}
+	for _, c := range r.Countries {
+		if !geoip.ValidCountry(c) {
+			return fmt.Errorf("invalid country code %q, expected e.g. US or DE", c)
+		}
+	}
+	return nil
+}
+
+// PanelGeoRule returns the panel-wide country rule, if one is stored
+func PanelGeoRule() (db.GeoRule, bool) {
+	var rule db.GeoRule
+	err := db.DB.Where("website_id = ?", 0).First(&rule).Error
+	return rule, err == nil
+}
+
+// RenderGeo returns the country rule config of a website. A site with a
+// rule of its own gets a geo block over the networks of its countries;
+// other sites check the panel-wide variable while that rule is enabled.
+// Refused visitors get 403.
+func RenderGeo(domain string) (GeoSnippet, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return GeoSnippet{}, nil
+	}
+
+	var rule db.GeoRule
+	if db.DB.Where("website_id = ?", site.ID).First(&rule).Error != nil {
+		if panel, ok := PanelGeoRule(); ok && panel.Enabled {
+			return GeoSnippet{Server: geoCheck(geoPanelVar)}, nil
+		}
+		return GeoSnippet{}, nil
+	}
+	if !rule.Enabled {
+		return GeoSnippet{}, nil
+	}
+	if err := ValidateGeoRule(rule); err != nil {
+		return GeoSnippet{}, err
+	}
+
+	path := GeoNetworksPath(domain)
+	networks, err := geoNetworks(path, rule)
+	if err != nil {
+		return GeoSnippet{}, err
+	}
+	variable := "$panda_geo_site_" + nonVarChars.ReplaceAllString(domain, "_")
+	return GeoSnippet{
+		HTTP:   "# Country rule, managed by Panda Panel\n" + geoBlock(variable, rule, path),
+		Server: geoCheck(variable),
+		Files:  []FileChange{networks},
+	}, nil
+}
+
+// ApplyPanelGeo writes the variable of the panel-wide country rule. It is
+// always defined once written, as 0 while the rule is off, so vhosts that
+// check it stay valid.
+func ApplyPanelGeo() error {
+	content := "# Panel-wide country rule, managed by Panda Panel\n"
+	var files []FileChange
+	if rule, ok := PanelGeoRule(); ok && rule.Enabled {
+		if err := ValidateGeoRule(rule); err != nil {
+			return err
+		}
+		path := GeoNetworksPath("")
+		networks, err := geoNetworks(path, rule)
+		if err != nil {
+			return err
+		}
+		files = append(files, networks)
+		content += geoBlock(geoPanelVar, rule, path)
+	} else {
+		content += fmt.Sprintf("geo %s {\n    default 0;\n}\n", geoPanelVar)
+	}
+	return Apply(ConfigChange{
+		Files: append(files, FileChange{Path: GeoConfPath, Content: []byte(content)}),
+		Note:  "panel-wide country rule",
+	})
+}
+
+func geoBlock(variable string, rule db.GeoRule, path string) string {
+	def := "0"
+	if rule.Mode == GeoAllow {
+		def = "1"
+	}
+	return fmt.Sprintf("geo %s {\n    default %s;\n    include %s;\n}\n", variable, def, path)
+}
+
+func geoCheck(variable string) string {
+	return fmt.Sprintf("if (%s) {\n        return 403;\n    }", variable)
+}
+
+// geoNetworks renders the networks file of a rule: the networks of its
+// countries with the value of the geo variable for them, 0 (let through)
+// for allow rules, 1 (refused) for deny rules. The list comes from the
+// country database, so it is rebuilt on every render and picks up database
+// updates.
+func geoNetworks(path string, rule db.GeoRule) (FileChange, error) {
+	networks, err := geoip.CountryNetworks(rule.Countries)
+	if err != nil {
+		return FileChange{}, err
+	}
+	value := "1"
+	if rule.Mode == GeoAllow {
+		value = "0"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Networks of %s, managed by Panda Panel\n", strings.Join(rule.Countries, ", "))
+	if rule.Mode == GeoAllow {
+		for _, n := range geoLocalNets {
+			fmt.Fprintf(&sb, "%s 0;\n", n)
+		}
+	}
+	for _, n := range networks {
+		fmt.Fprintf(&sb, "%s %s;\n", n, value)
+	}
+	return FileChange{Path: path, Content: []byte(sb.String())}, nil
+}
@@ -0,0 +1,54 @@
+package nginx
+
+import (
+	"os"
+	"testing"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/geoip"
+)
+
+func TestGeoMap(t *testing.T) {
+	dir := geoip.Dir
+	geoip.Dir = t.TempDir()
+	t.Cleanup(func() { geoip.Dir = dir })
+	if _, err := geoip.Update(geoip.KindCountry, "../geoip/testdata/country.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule db.GeoRule
+		want string
+	}{
+		{
+			db.GeoRule{Enabled: true, Mode: GeoDeny, Countries: []string{"GB", "DE"}},
+			"# Networks of GB, DE, managed by Panda Panel\n" +
+				"81.2.69.0/24 1;\n81.2.70.0/23 1;\n2001:db8::/32 1;\n",
+		},
+		{
+			db.GeoRule{Enabled: true, Mode: GeoAllow, Countries: []string{"US"}},
+			"# Networks of US, managed by Panda Panel\n" +
+				"127.0.0.0/8 0;\n10.0.0.0/8 0;\n172.16.0.0/12 0;\n192.168.0.0/16 0;\n::1/128 0;\nfc00::/7 0;\n" +
+				"8.8.8.0/24 0;\n",
+		},
+	}
+	for _, tt := range tests {
+		path := GeoNetworksPath("a.com")
+		file, err := geoNetworks(path, tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.Path != path || string(file.Content) != tt.want {
+			t.Errorf("%s %v: got %s\n%s\nwant\n%s", tt.rule.Mode, tt.rule.Countries, file.Path, file.Content, tt.want)
+		}
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("rendering wrote %s", path)
+		}
+	}
+
+	block := geoBlock("$panda_geo_site_a_com", db.GeoRule{Mode: GeoAllow}, "/etc/nginx/panda/geo/sites/a.com.conf")
+	want := "geo $panda_geo_site_a_com {\n    default 1;\n    include /etc/nginx/panda/geo/sites/a.com.conf;\n}\n"
+	if block != want {
+		t.Errorf("got\n%s\nwant\n%s", block, want)
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
-	"text/template"
 
+	"github.com/acmavirus/panda-script/v3/internal/db"
 	"github.com/acmavirus/panda-script/v3/internal/system"
 )
 
@@ -26,6 +27,16 @@ type VhostConfig struct {
 	Port       int    `json:"port"`
 }
 
+// templateVars returns the template variables of a vhost
+func (c VhostConfig) templateVars() map[string]string {
+	return map[string]string{
+		"Domain":     c.Domain,
+		"Root":       c.Root,
+		"Port":       strconv.Itoa(c.Port),
+		"PHPVersion": c.PHPVersion,
+	}
+}
+
 func getSitesAvailable() string {
 	if runtime.GOOS == "windows" {
 		return "nginx/sites-available"
@@ -52,78 +63,6 @@ func init() {
 	os.MkdirAll(getSitesEnabled(), 0755)
 }
 
-const vhostTemplate = `server {
-    listen {{.Port}};
-    listen [::]:{{.Port}};
-    
-    server_name {{.Domain}} www.{{.Domain}};
-    root {{.Root}};
-    index index.php index.html;
-    
-    access_log /home/{{.Domain}}/logs/access.log;
-    error_log /home/{{.Domain}}/logs/error.log;
-    
-    # Security headers
-    add_header X-Frame-Options "SAMEORIGIN" always;
-    add_header X-Content-Type-Options "nosniff" always;
-    
-    location / {
-        try_files $uri $uri/ /index.php?$query_string;
-    }
-    
-    location ~ \.php$ {
-        fastcgi_pass unix:/var/run/php/php{{.PHPVersion}}-fpm.sock;
-        fastcgi_index index.php;
-        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
-        include fastcgi_params;
-    }
-    
-    location ~ /\. {
-        deny all;
-    }
-    
-    location ~* \.(jpg|jpeg|png|gif|ico|css|js|woff2?)$ {
-        expires 30d;
-        add_header Cache-Control "public, immutable";
-    }
-}
-`
-
-const vhostSSLTemplate = `server {
-    listen 443 ssl http2;
-    listen [::]:443 ssl http2;
-    
-    server_name {{.Domain}} www.{{.Domain}};
-    root {{.Root}};
-    index index.php index.html;
-    
-    ssl_certificate {{.CertPath}}/fullchain.pem;
-    ssl_certificate_key {{.CertPath}}/privkey.pem;
-    ssl_protocols TLSv1.2 TLSv1.3;
-    ssl_prefer_server_ciphers on;
-    
-    # HSTS
-    add_header Strict-Transport-Security "max-age=31536000; includeSubDomains" always;
-    
-    location / {
-        try_files $uri $uri/ /index.php?$query_string;
-    }
-    
-    location ~ \.php$ {
-        fastcgi_pass unix:/var/run/php/php{{.PHPVersion}}-fpm.sock;
-        fastcgi_index index.php;
-        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
-        include fastcgi_params;
-    }
-}
-
-server {
-    listen 80;
-    server_name {{.Domain}} www.{{.Domain}};
-    return 301 https://$server_name$request_uri;
-}
-`
-
 // CreateVhost creates a new nginx virtual host
 func CreateVhost(config VhostConfig) error {
 	if config.PHPVersion == "" {
@@ -139,52 +78,21 @@ func CreateVhost(config VhostConfig) error {
 	// Create directories
 	webDir := filepath.Join(getWebRoot(), config.Domain)
 	os.MkdirAll(config.Root, 0755)
-	os.MkdirAll(filepath.Join(webDir, "logs"), 0755)
 
-	// Choose template
-	tmplString := vhostTemplate
+	certDir := ""
 	if config.SSLEnabled && config.CertPath != "" {
-		tmplString = vhostSSLTemplate
-	}
-
-	tmpl, err := template.New("vhost").Parse(tmplString)
-	if err != nil {
-		return fmt.Errorf("template parse error: %v", err)
+		certDir = config.CertPath
 	}
-
-	// Create config file
-	configPath := filepath.Join(getSitesAvailable(), config.Domain)
-	f, err := os.Create(configPath)
+	files, err := siteVhost(config, certDir)
 	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
-	}
-	defer f.Close()
-
-	if err := tmpl.Execute(f, config); err != nil {
-		return fmt.Errorf("template execute error: %v", err)
-	}
-
-	// Enable site (symlink)
-	enabledPath := filepath.Join(getSitesEnabled(), config.Domain)
-	os.Remove(enabledPath) // Remove existing if any
-	if runtime.GOOS != "windows" {
-		os.Symlink(configPath, enabledPath)
-	} else {
-		// On Windows, copy the file
-		content, _ := os.ReadFile(configPath)
-		os.WriteFile(enabledPath, content, 0644)
+		return err
 	}
 
-	// Test and reload nginx
-	if err := TestConfig(); err != nil {
-		// Rollback
-		os.Remove(configPath)
-		os.Remove(enabledPath)
-		return fmt.Errorf("nginx config test failed: %v", err)
+	// Write, enable, test and reload
+	if err := Apply(ConfigChange{Files: files, Probe: []string{config.Domain}}); err != nil {
+		return err
 	}
 
-	Reload()
-
 	// Create default index.php
 	indexPath := filepath.Join(config.Root, "index.php")
 	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
@@ -201,11 +109,11 @@ func CreateVhost(config VhostConfig) error {
 
 // DeleteVhost removes a virtual host
 func DeleteVhost(domain string) error {
-	configPath := filepath.Join(getSitesAvailable(), domain)
-	enabledPath := filepath.Join(getSitesEnabled(), domain)
-
-	os.Remove(enabledPath)
-	os.Remove(configPath)
+	// Older versions named the files after the bare domain
+	for _, name := range []string{domain + ".conf", domain} {
+		os.Remove(filepath.Join(getSitesEnabled(), name))
+		os.Remove(filepath.Join(getSitesAvailable(), name))
+	}
 
 	// Also remove SSL version if exists
 	os.Remove(filepath.Join(getSitesEnabled(), domain+"-ssl"))
@@ -215,125 +123,101 @@ func DeleteVhost(domain string) error {
 	return nil
 }
 
-// ListVhosts returns all configured virtual hosts
-func ListVhosts() ([]VhostConfig, error) {
-	sitesDir := getSitesAvailable()
-
-	files, err := os.ReadDir(sitesDir)
-	if err != nil {
-		return []VhostConfig{}, nil
-	}
-
-	var vhosts []VhostConfig
-	for _, file := range files {
-		if file.IsDir() || file.Name() == "default" {
-			continue
-		}
-
-		// Skip SSL duplicates
-		if strings.HasSuffix(file.Name(), "-ssl") {
-			continue
-		}
-
-		vhost := VhostConfig{
-			Domain:     file.Name(),
-			Root:       filepath.Join(getWebRoot(), file.Name(), "public"),
-			PHPVersion: "8.3",
-			Port:       80,
-		}
-
-		// Check if SSL is enabled
-		sslPath := filepath.Join(getSitesEnabled(), file.Name()+"-ssl")
-		if _, err := os.Stat(sslPath); err == nil {
-			vhost.SSLEnabled = true
-		}
-
-		// Check if enabled
-		enabledPath := filepath.Join(getSitesEnabled(), file.Name())
-		if _, err := os.Stat(enabledPath); err != nil {
-			continue // Not enabled
-		}
-
-		vhosts = append(vhosts, vhost)
+// EnableSSL serves a virtual host over HTTPS. The vhost is rendered again
+// from the template of its site type with the certificate; a <domain>-ssl
+// file of older versions is removed.
+func EnableSSL(domain, certPath string) error {
+	if certPath == "" {
+		certPath = fmt.Sprintf("/etc/letsencrypt/live/%s", domain)
 	}
 
-	return vhosts, nil
-}
-
-// GetVhost returns details of a specific virtual host
-func GetVhost(domain string) (*VhostConfig, error) {
-	configPath := filepath.Join(getSitesAvailable(), domain)
-
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("virtual host not found: %s", domain)
+	info, err := GetVhost(domain)
+	if err != nil {
+		return err
 	}
+	vhost := info.VhostConfig
+	vhost.SSLEnabled = true
+	vhost.CertPath = certPath
+	vhost.Port = 80
 
-	vhost := &VhostConfig{
-		Domain:     domain,
-		Root:       filepath.Join(getWebRoot(), domain, "public"),
-		PHPVersion: "8.3",
-		Port:       80,
+	files, err := siteVhost(vhost, certPath)
+	if err != nil {
+		return err
 	}
-
-	// Check SSL
-	sslPath := filepath.Join(getSitesEnabled(), domain+"-ssl")
-	if _, err := os.Stat(sslPath); err == nil {
-		vhost.SSLEnabled = true
-		vhost.CertPath = fmt.Sprintf("/etc/letsencrypt/live/%s", domain)
+	legacy := filepath.Join(getSitesAvailable(), domain+"-ssl")
+	if _, err := os.Lstat(legacy); err == nil {
+		files = append(files, FileChange{Path: legacy, Link: filepath.Join(getSitesEnabled(), domain+"-ssl"), Remove: true})
 	}
 
-	return vhost, nil
+	return Apply(ConfigChange{
+		Files: files,
+		Probe: []string{domain},
+		Note:  "SSL enabled",
+	})
 }
 
-// EnableSSL enables SSL for a virtual host
-func EnableSSL(domain, certPath string) error {
-	if certPath == "" {
-		certPath = fmt.Sprintf("/etc/letsencrypt/live/%s", domain)
+// siteVhost renders the vhost of a site as the nginx web server driver
+// does: from the template of its site type, with the full site context
+// (error pages, cache, upstream group, noindex, ...). The site record, if
+// there is one, supplies the type, root and ports; otherwise it is a PHP
+// site. The vhost comes first in the returned files, then the files it
+// refers to.
+func siteVhost(config VhostConfig, certDir string) ([]FileChange, error) {
+	siteType := "php"
+	vars := config.templateVars()
+	var record db.Website
+	if db.DB.Where("domain = ?", config.Domain).First(&record).Error == nil {
+		siteType = record.Type
+		if record.Root != "" {
+			vars["Root"] = record.Root
+		}
+		if record.PHPVersion != "" {
+			vars["PHPVersion"] = record.PHPVersion
+		}
+		if record.Port > 0 {
+			vars["Port"] = strconv.Itoa(record.Port)
+		}
+		if record.BackendPort > 0 {
+			vars["BackendPort"] = strconv.Itoa(record.BackendPort)
+		}
 	}
 
-	vhost, err := GetVhost(domain)
+	ctx, err := SiteContext(config.Domain, siteType, SiteSecurityConfig(config.Domain), certDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	vhost.SSLEnabled = true
-	vhost.CertPath = certPath
-
-	// Create SSL config
-	tmpl, err := template.New("vhost-ssl").Parse(vhostSSLTemplate)
+	content, err := RenderTemplate(TemplateForSiteType(siteType), vars, ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return append([]FileChange{{
+		Path:    filepath.Join(getSitesAvailable(), config.Domain+".conf"),
+		Content: []byte(content),
+		Link:    filepath.Join(getSitesEnabled(), config.Domain+".conf"),
+	}}, ctx.Files...), nil
+}
 
-	sslConfigPath := filepath.Join(getSitesAvailable(), domain+"-ssl")
-	f, err := os.Create(sslConfigPath)
+// DisableSSL serves a virtual host over HTTP only, rendering it again
+// without a certificate and removing a <domain>-ssl file of older versions
+func DisableSSL(domain string) error {
+	info, err := GetVhost(domain)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	vhost := info.VhostConfig
+	vhost.SSLEnabled = false
+	vhost.CertPath = ""
+	vhost.Port = 80
 
-	if err := tmpl.Execute(f, vhost); err != nil {
+	files, err := siteVhost(vhost, "")
+	if err != nil {
 		return err
 	}
-
-	// Enable SSL config
-	sslEnabledPath := filepath.Join(getSitesEnabled(), domain+"-ssl")
-	os.Remove(sslEnabledPath)
-	if runtime.GOOS != "windows" {
-		os.Symlink(sslConfigPath, sslEnabledPath)
-	} else {
-		content, _ := os.ReadFile(sslConfigPath)
-		os.WriteFile(sslEnabledPath, content, 0644)
+	legacy := filepath.Join(getSitesAvailable(), domain+"-ssl")
+	if _, err := os.Lstat(legacy); err == nil {
+		files = append(files, FileChange{Path: legacy, Link: filepath.Join(getSitesEnabled(), domain+"-ssl"), Remove: true})
 	}
-
-	return Reload()
-}
-
-// DisableSSL disables SSL for a virtual host
-func DisableSSL(domain string) error {
-	os.Remove(filepath.Join(getSitesEnabled(), domain+"-ssl"))
-	os.Remove(filepath.Join(getSitesAvailable(), domain+"-ssl"))
-	return Reload()
+	return Apply(ConfigChange{Files: files, Probe: []string{domain}, Note: "SSL disabled"})
 }
 
 // TestConfig tests the nginx configuration
@@ -399,7 +283,10 @@ func Stop() error {
 
 // GetVhostContent returns the raw config content for a virtual host
 func GetVhostContent(domain string) (string, error) {
-	configPath := filepath.Join(getSitesAvailable(), domain)
+	configPath, err := vhostPath(domain)
+	if err != nil {
+		return "", err
+	}
 	content, err := os.ReadFile(configPath)
 	if err != nil {
 		return "", err
@@ -407,24 +294,21 @@ func GetVhostContent(domain string) (string, error) {
 	return string(content), nil
 }
 
-// SaveVhostContent writes new config content for a virtual host
-func SaveVhostContent(domain, content string) error {
-	configPath := filepath.Join(getSitesAvailable(), domain)
-	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+// SaveVhostContent writes new config content for a virtual host. Content
+// that does not parse is rejected before nginx sees it.
+func SaveVhostContent(domain, content, author string) error {
+	configPath, err := vhostPath(domain)
+	if err != nil {
 		return err
 	}
-
-	// Update enabled symlink/file
-	enabledPath := filepath.Join(getSitesEnabled(), domain)
-	if runtime.GOOS == "windows" {
-		os.WriteFile(enabledPath, []byte(content), 0644)
-	}
-
-	// Test and reload
-	if err := TestConfig(); err != nil {
+	if _, err := Parse(configPath, content); err != nil {
 		return err
 	}
-	return Reload()
+	return Apply(ConfigChange{
+		Files:  []FileChange{vhostChange(configPath, []byte(content))},
+		Probe:  []string{domain},
+		Author: author,
+	})
 }
 
 // GetMainConfig returns the main nginx.conf content
@@ -440,15 +324,12 @@ func GetMainConfig() (string, error) {
 }
 
 // SaveMainConfig saves the main nginx.conf
-func SaveMainConfig(content string) error {
+func SaveMainConfig(content, author string) error {
 	if runtime.GOOS == "windows" {
 		return nil
 	}
-	if err := os.WriteFile("/etc/nginx/nginx.conf", []byte(content), 0644); err != nil {
-		return err
-	}
-	if err := TestConfig(); err != nil {
-		return err
-	}
-	return Reload()
+	return Apply(ConfigChange{
+		Files:  []FileChange{{Path: filepath.Join(ConfDir, "nginx.conf"), Content: []byte(content)}},
+		Author: author,
+	})
 }
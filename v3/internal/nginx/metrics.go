@@ -0,0 +1,286 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+)
+
+const (
+	// StatusConfPath is the server block serving stub_status to the panel
+	StatusConfPath = "/etc/nginx/conf.d/panda-status.conf"
+	statusListen   = "127.0.0.1:8089"
+	statusURI      = "/panda_status"
+
+	metricsInterval  = time.Minute
+	metricsRetention = 3 * 24 * time.Hour
+)
+
+var stubStatusRegex = regexp.MustCompile(`Active connections:\s*(\d+)\s+server accepts handled requests\s+(\d+)\s+(\d+)\s+(\d+)\s+Reading:\s*(\d+)\s+Writing:\s*(\d+)\s+Waiting:\s*(\d+)`)
+
+var (
+	metricsMu  sync.Mutex
+	lastSample *db.NginxSample
+	logOffsets = make(map[string]int64)
+	siteRates  = make(map[string]float64)
+	lastLogs   time.Time
+)
+
+// Metrics is the current load of nginx with the request rate of each
+// website over the last sample interval
+type Metrics struct {
+	db.NginxSample
+	Sites []SiteRate `json:"sites"`
+}
+
+// SiteRate is the request rate of a website
+type SiteRate struct {
+	Domain string  `json:"domain"`
+	RPS    float64 `json:"rps"`
+}
+
+// StartMetricsCollector samples stub_status and the per-site access logs in
+// the background, enabling stub_status first if needed
+func StartMetricsCollector() {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	ticker := time.NewTicker(metricsInterval)
+	go func() {
+		collectMetrics()
+		for range ticker.C {
+			collectMetrics()
+		}
+	}()
+}
+
+// EnableStatus writes the stub_status server, listening on loopback only
+func EnableStatus() error {
+	content := fmt.Sprintf(`# Status endpoint for the panel's metrics, managed by Panda Panel
+server {
+    listen %s;
+    server_name localhost;
+    access_log off;
+
+    location = %s {
+        stub_status;
+        allow 127.0.0.1;
+        deny all;
+    }
+}
+`, statusListen, statusURI)
+	if current, err := os.ReadFile(StatusConfPath); err == nil && string(current) == content {
+		return nil
+	}
+	return Apply(ConfigChange{
+		Files: []FileChange{{Path: StatusConfPath, Content: []byte(content)}},
+		Note:  "enable stub_status",
+	})
+}
+
+// ReadStatus reads stub_status now
+func ReadStatus() (*db.NginxSample, error) {
+	client := &http.Client{Timeout: probeTimeout}
+	resp, err := client.Get("http://" + statusListen + statusURI)
+	if err != nil {
+		return nil, fmt.Errorf("stub_status is not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	m := stubStatusRegex.FindStringSubmatch(string(body))
+	if resp.StatusCode != http.StatusOK || m == nil {
+		return nil, fmt.Errorf("unexpected stub_status response (%d)", resp.StatusCode)
+	}
+
+	n := make([]int64, len(m))
+	for i := 1; i < len(m); i++ {
+		n[i], _ = strconv.ParseInt(m[i], 10, 64)
+	}
+	return &db.NginxSample{
+		Time:     time.Now(),
+		Active:   int(n[1]),
+		Accepts:  n[2],
+		Handled:  n[3],
+		Requests: n[4],
+		Reading:  int(n[5]),
+		Writing:  int(n[6]),
+		Waiting:  int(n[7]),
+	}, nil
+}
+
+// CurrentMetrics reads stub_status now. The request rate is measured since
+// the last stored sample; site rates are those of the last interval.
+func CurrentMetrics() (*Metrics, error) {
+	sample, err := ReadStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if lastSample != nil {
+		sample.RPS = requestRate(lastSample, sample)
+	}
+	metrics := &Metrics{NginxSample: *sample, Sites: []SiteRate{}}
+	for domain, rps := range siteRates {
+		metrics.Sites = append(metrics.Sites, SiteRate{Domain: domain, RPS: rps})
+	}
+	sort.Slice(metrics.Sites, func(i, j int) bool {
+		if metrics.Sites[i].RPS != metrics.Sites[j].RPS {
+			return metrics.Sites[i].RPS > metrics.Sites[j].RPS
+		}
+		return metrics.Sites[i].Domain < metrics.Sites[j].Domain
+	})
+	return metrics, nil
+}
+
+// MetricsHistory returns the stored stub_status samples since a time
+func MetricsHistory(since time.Time) ([]db.NginxSample, error) {
+	samples := []db.NginxSample{}
+	err := db.DB.Where("time >= ?", since).Order("time").Find(&samples).Error
+	return samples, err
+}
+
+// SiteMetricsHistory returns the stored request rates of a website since a
+// time
+func SiteMetricsHistory(domain string, since time.Time) ([]db.SiteRequestSample, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %s", domain)
+	}
+	samples := []db.SiteRequestSample{}
+	err := db.DB.Where("website_id = ? AND time >= ?", site.ID, since).Order("time").Find(&samples).Error
+	return samples, err
+}
+
+func collectMetrics() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if status, _ := GetStatus(); status == "active" {
+		sample, err := ReadStatus()
+		if err != nil {
+			if err := EnableStatus(); err != nil {
+				fmt.Printf("Metrics: failed to enable stub_status: %v\n", err)
+			} else {
+				sample, err = ReadStatus()
+			}
+		}
+		if err == nil {
+			if lastSample != nil {
+				sample.RPS = requestRate(lastSample, sample)
+			}
+			db.DB.Create(sample)
+			lastSample = sample
+		}
+	}
+	collectSiteRates()
+
+	cutoff := time.Now().Add(-metricsRetention)
+	db.DB.Where("time < ?", cutoff).Delete(&db.NginxSample{})
+	db.DB.Where("time < ?", cutoff).Delete(&db.SiteRequestSample{})
+}
+
+// requestRate is the requests per second between two samples, 0 when nginx
+// restarted in between and its counters started over
+func requestRate(prev, cur *db.NginxSample) float64 {
+	elapsed := cur.Time.Sub(prev.Time).Seconds()
+	if elapsed <= 0 || cur.Requests < prev.Requests {
+		return 0
+	}
+	return float64(cur.Requests-prev.Requests) / elapsed
+}
+
+// collectSiteRates counts the lines added to each site's access log since
+// the last run. A log seen for the first time is only measured.
+func collectSiteRates() {
+	var websites []db.Website
+	if err := db.DB.Find(&websites).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(lastLogs).Seconds()
+	lastLogs = now
+
+	rates := make(map[string]float64)
+	for _, w := range websites {
+		path := filepath.Join("/var/log/nginx", w.Domain+".access.log")
+		offset, known := logOffsets[w.Domain]
+		if !known {
+			if info, err := os.Stat(path); err == nil {
+				logOffsets[w.Domain] = info.Size()
+			}
+			continue
+		}
+		count, offset, err := countLines(path, offset)
+		if err != nil {
+			continue
+		}
+		logOffsets[w.Domain] = offset
+
+		rps := float64(count) / elapsed
+		rates[w.Domain] = rps
+		if count > 0 {
+			db.DB.Create(&db.SiteRequestSample{WebsiteID: w.ID, Time: now, Requests: count, RPS: rps})
+		}
+	}
+	siteRates = rates
+}
+
+// countLines counts the complete lines of a file after offset and returns
+// the offset after the last one. A file smaller than offset was rotated and
+// is counted from the start.
+func countLines(path string, offset int64) (int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	var count int64
+	end := offset
+	buf := make([]byte, 64*1024)
+	for pos := offset; ; {
+		n, err := f.Read(buf)
+		chunk := buf[:n]
+		for {
+			i := bytes.IndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			count++
+			end = pos + int64(i) + 1
+			pos += int64(i) + 1
+			chunk = chunk[i+1:]
+		}
+		pos += int64(len(chunk))
+		if err != nil {
+			break
+		}
+	}
+	return count, end, nil
+}
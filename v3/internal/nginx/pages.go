@@ -0,0 +1,199 @@
+package nginx
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+)
+
+const (
+	// PagesDir holds the custom error and maintenance pages of each site
+	PagesDir = "/etc/nginx/panda/pages"
+	// MaintenanceDir holds the maintenance mode include of each site
+	MaintenanceDir = "/etc/nginx/panda/maintenance"
+)
+
+// Page kinds
+const (
+	PageNotFound    = "404"
+	PageServerError = "50x"
+	PageMaintenance = "maintenance"
+)
+
+// DefaultRetryAfter is sent with maintenance responses when none is configured
+const DefaultRetryAfter = 3600
+
+// pageCodes are the status codes each error page is used for
+var pageCodes = map[string]string{
+	PageNotFound:    "404",
+	PageServerError: "500 502 503 504",
+}
+
+// DefaultMaintenancePage is served while maintenance mode is on and the
+// site has no page of its own
+const DefaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>Down for maintenance</title>
+    <style>
+        body { font-family: 'Segoe UI', Arial, sans-serif; display: flex; justify-content: center; align-items: center; height: 100vh; margin: 0; background: #f5f6fa; color: #2f3640; }
+        .container { text-align: center; max-width: 32em; padding: 1em; }
+        h1 { font-size: 2.2em; margin-bottom: 0.4em; }
+        p { font-size: 1.1em; opacity: 0.8; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>We'll be back soon</h1>
+        <p>This site is undergoing scheduled maintenance. Please check back in a little while.</p>
+    </div>
+</body>
+</html>
+`
+
+// PageDir is the directory holding a site's pages
+func PageDir(domain string) string {
+	return filepath.Join(PagesDir, domain)
+}
+
+// MaintenancePath is the server block include that turns maintenance mode
+// on for a site
+func MaintenancePath(domain string) string {
+	return filepath.Join(MaintenanceDir, domain+".conf")
+}
+
+// MaintenanceMapPath is the http block include that decides which requests
+// of a site get the maintenance page
+func MaintenanceMapPath(domain string) string {
+	return filepath.Join(MaintenanceDir, domain+".map.conf")
+}
+
+// PagesSnippet is the error page and maintenance config of a site
+type PagesSnippet struct {
+	HTTP   string
+	Server string
+	Files  []FileChange // Pages and maintenance includes
+}
+
+// RenderPages renders a website's pages and maintenance includes and the
+// config that uses them. The includes are always referenced so maintenance
+// mode can be toggled by rewriting them and reloading.
+func RenderPages(domain string) (PagesSnippet, error) {
+	files, err := RenderMaintenance(domain)
+	if err != nil {
+		return PagesSnippet{}, err
+	}
+	snippet := PagesSnippet{
+		HTTP:   fmt.Sprintf("include %s;\n", MaintenanceMapPath(domain)),
+		Server: fmt.Sprintf("include %s;", MaintenancePath(domain)),
+		Files:  files,
+	}
+
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return snippet, nil
+	}
+	var pages []db.ErrorPage
+	if err := db.DB.Where("website_id = ?", site.ID).Order("kind").Find(&pages).Error; err != nil {
+		return PagesSnippet{}, err
+	}
+
+	dir := PageDir(domain)
+	var sb strings.Builder
+	for _, p := range pages {
+		if p.Kind == PageMaintenance {
+			continue // Part of the maintenance files
+		}
+		snippet.Files = append(snippet.Files, FileChange{Path: filepath.Join(dir, p.Kind+".html"), Content: []byte(p.HTML)})
+		if codes, ok := pageCodes[p.Kind]; ok {
+			fmt.Fprintf(&sb, "\n    error_page %s /panda-errors/%s.html;", codes, p.Kind)
+		}
+	}
+	if sb.Len() > 0 {
+		fmt.Fprintf(&sb, "\n    location ^~ /panda-errors/ {\n        internal;\n        alias %s/;\n    }", dir)
+	}
+	snippet.Server += sb.String()
+	return snippet, nil
+}
+
+// RenderMaintenance renders a website's maintenance includes: empty while
+// maintenance mode is off, otherwise everyone but the allowed IPs gets the
+// maintenance page with a 503 and Retry-After. Matching requests are
+// rewritten to an internal location before any of the site's own
+// locations run, so it works the same for PHP and proxied sites and leaves
+// the 403s and 503s of the site alone. Let's Encrypt HTTP-01 challenges
+// stay reachable.
+func RenderMaintenance(domain string) ([]FileChange, error) {
+	var files []FileChange
+	var site db.Website
+	mapContent := "# Maintenance mode is off, managed by Panda Panel\n"
+	content := mapContent
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err == nil && site.Maintenance {
+		dir := PageDir(domain)
+		html := DefaultMaintenancePage
+		var custom db.ErrorPage
+		if db.DB.Where("website_id = ? AND kind = ?", site.ID, PageMaintenance).First(&custom).Error == nil {
+			html = custom.HTML
+		}
+		files = append(files, FileChange{Path: filepath.Join(dir, PageMaintenance+".html"), Content: []byte(html)})
+
+		retry := site.MaintenanceRetry
+		if retry <= 0 {
+			retry = DefaultRetryAfter
+		}
+		name := nonVarChars.ReplaceAllString(domain, "_")
+		allowVar := "$panda_maintenance_allow_" + name
+		onVar := "$panda_maintenance_" + name
+
+		var m strings.Builder
+		m.WriteString("# Maintenance mode, managed by Panda Panel\n")
+		fmt.Fprintf(&m, "geo %s {\n    default 0;\n", allowVar)
+		for _, ip := range site.MaintenanceIPs {
+			fmt.Fprintf(&m, "    %s 1;\n", ip)
+		}
+		m.WriteString("}\n")
+		fmt.Fprintf(&m, "map \"%s:$uri\" %s {\n    default 1;\n    \"~^1:\" 0;\n", allowVar, onVar)
+		m.WriteString("    \"~^0:/\\.well-known/acme-challenge/\" 0;\n}\n")
+		mapContent = m.String()
+
+		content = fmt.Sprintf(`# Maintenance mode, managed by Panda Panel
+if (%s) {
+    rewrite ^ /panda-maintenance last;
+}
+location = /panda-maintenance {
+    internal;
+    error_page 503 @panda_maintenance;
+    return 503;
+}
+location @panda_maintenance {
+    root %s;
+    try_files /%s.html =503;
+    default_type text/html;
+    add_header Retry-After %d always;
+    add_header Cache-Control "no-store" always;
+}
+location ^~ /.well-known/acme-challenge/ {
+    allow all;
+}
+`, onVar, dir, PageMaintenance, retry)
+	}
+
+	return append(files,
+		FileChange{Path: MaintenanceMapPath(domain), Content: []byte(mapContent)},
+		FileChange{Path: MaintenancePath(domain), Content: []byte(content)},
+	), nil
+}
+
+// ApplyMaintenance rewrites a website's maintenance include and page and
+// reloads nginx
+func ApplyMaintenance(domain string) error {
+	files, err := RenderMaintenance(domain)
+	if err != nil {
+		return err
+	}
+	return Apply(ConfigChange{Files: files, Note: "maintenance mode"})
+}
@@ -0,0 +1,564 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/history"
+)
+
+// ConfDir is the directory relative include paths are resolved against
+const ConfDir = "/etc/nginx"
+
+// maxIncludeDepth stops include loops and runaway nesting
+const maxIncludeDepth = 8
+
+// Directive is a node of a parsed nginx config. Block is nil for simple
+// directives and non-nil (possibly empty) for block directives.
+//
+// The original text of every directive is kept, so a config that is parsed
+// and written back is byte for byte identical; only directives that were
+// changed are re-rendered.
+type Directive struct {
+	Name     string       `json:"name"`
+	Args     []string     `json:"args"`
+	Line     int          `json:"line"`
+	Path     string       `json:"path"` // Index path within its file, e.g. "2.0.5"
+	Block    []*Directive `json:"block,omitempty"`
+	Includes []*Config    `json:"includes,omitempty"`  // Files pulled in by an include directive
+	ReadOnly bool         `json:"read_only,omitempty"` // Read through an include; Path is relative to its own file
+
+	file  string
+	lead  string   // Whitespace and comments before the directive
+	raw   []string // Name and argument tokens as written, with the whitespace before each
+	end   string   // Whitespace before the ; or {
+	close string   // Whitespace and comments before the closing }
+	dirty bool
+}
+
+// Config is a parsed nginx config file
+type Config struct {
+	File       string       `json:"file"`
+	Directives []*Directive `json:"directives"`
+
+	trailing string
+	original string
+}
+
+type token struct {
+	kind  byte // 'w' for words, ';', '{', '}', 0 at the end
+	pre   string
+	raw   string
+	value string
+	line  int
+}
+
+// Parse parses nginx config text. Includes are not followed.
+func Parse(file, content string) (*Config, error) {
+	tokens, err := lex(file, content)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{file: file, tokens: tokens}
+	directives, trailing, err := p.block(false)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{File: file, Directives: directives, trailing: trailing, original: content}
+	c.reindex()
+	return c, nil
+}
+
+// ParseFile parses a config file and, recursively, the files its include
+// directives refer to
+func ParseFile(path string) (*Config, error) {
+	return parseFile(path, map[string]bool{}, 0)
+}
+
+func parseFile(path string, seen map[string]bool, depth int) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(path, string(content))
+	if err != nil {
+		return nil, err
+	}
+	seen[path] = true
+	if depth < maxIncludeDepth {
+		c.Walk(func(d *Directive) bool {
+			if d.Name != "include" || len(d.Args) != 1 {
+				return true
+			}
+			pattern := d.Args[0]
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(ConfDir, pattern)
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, m := range matches {
+				if seen[m] {
+					continue
+				}
+				if inc, err := parseFile(m, seen, depth+1); err == nil {
+					inc.markReadOnly()
+					d.Includes = append(d.Includes, inc)
+				}
+			}
+			return true
+		})
+	}
+	return c, nil
+}
+
+// String renders the config, keeping the original formatting of every
+// directive that was not changed
+func (c *Config) String() string {
+	var sb strings.Builder
+	writeDirectives(&sb, c.Directives)
+	sb.WriteString(c.trailing)
+	return sb.String()
+}
+
+// Save writes the config back to its file and records the change
+func (c *Config) Save() error {
+	content := c.String()
+	if err := history.WriteFile(c.File, []byte(content), 0644, history.Panel, ""); err != nil {
+		return err
+	}
+	c.original = content
+	return nil
+}
+
+// Changed reports whether the config differs from what was parsed or last saved
+func (c *Config) Changed() bool {
+	return c.String() != c.original
+}
+
+// Walk calls fn for every directive in the file, depth first. Returning
+// false skips the directive's block. Included files are not entered.
+func (c *Config) Walk(fn func(d *Directive) bool) {
+	walk(c.Directives, fn)
+}
+
+func walk(list []*Directive, fn func(d *Directive) bool) {
+	for _, d := range list {
+		if fn(d) && d.Block != nil {
+			walk(d.Block, fn)
+		}
+	}
+}
+
+// markReadOnly flags every directive of the file as read-only, for files
+// that are shown as part of another one but are not edited with it
+func (c *Config) markReadOnly() {
+	c.Walk(func(d *Directive) bool {
+		d.ReadOnly = true
+		return true
+	})
+}
+
+// Lookup returns the directive at an index path, with the list holding it
+func (c *Config) Lookup(path string) (*Directive, *[]*Directive, int, error) {
+	if path == "" {
+		return nil, nil, 0, fmt.Errorf("path is required")
+	}
+	list := &c.Directives
+	var d *Directive
+	idx := 0
+	parts := strings.Split(path, ".")
+	for n, part := range parts {
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= len(*list) {
+			return nil, nil, 0, fmt.Errorf("no directive at %s", path)
+		}
+		d, idx = (*list)[i], i
+		if n < len(parts)-1 {
+			if d.Block == nil {
+				return nil, nil, 0, fmt.Errorf("no directive at %s", path)
+			}
+			list = &d.Block
+		}
+	}
+	return d, list, idx, nil
+}
+
+// Set replaces a directive's arguments
+func (d *Directive) Set(args ...string) {
+	d.Args = args
+	d.dirty = true
+}
+
+// Arg returns the i-th argument or an empty string
+func (d *Directive) Arg(i int) string {
+	if i < len(d.Args) {
+		return d.Args[i]
+	}
+	return ""
+}
+
+// File returns the config file the directive was read from
+func (d *Directive) File() string {
+	return d.file
+}
+
+// Children returns the directives of a block with the contents of included
+// files in place of their include directives
+func (d *Directive) Children() []*Directive {
+	return expandIncludes(d.Block)
+}
+
+// All returns the top level directives with includes expanded
+func (c *Config) All() []*Directive {
+	return expandIncludes(c.Directives)
+}
+
+func expandIncludes(list []*Directive) []*Directive {
+	var out []*Directive
+	for _, d := range list {
+		if d.Name == "include" && len(d.Includes) > 0 {
+			for _, inc := range d.Includes {
+				out = append(out, inc.All()...)
+			}
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// Find returns the directives named name in a list, following includes
+func Find(list []*Directive, name string) []*Directive {
+	var out []*Directive
+	for _, d := range expandIncludes(list) {
+		if d.Name == name {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// First returns the first directive named name in a list, following includes
+func First(list []*Directive, name string) *Directive {
+	if found := Find(list, name); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// Insert adds a directive to a block (nil parent = top level) at position
+// index, or at the end when index is out of range. The indentation is
+// copied from its new siblings.
+func (c *Config) Insert(parent *Directive, index int, d *Directive) error {
+	list, tail := &c.Directives, &c.trailing
+	indent := ""
+	if parent != nil {
+		if parent.Block == nil {
+			return fmt.Errorf("%s is not a block directive", parent.Name)
+		}
+		list, tail = &parent.Block, &parent.close
+		indent = indentOf(parent.lead) + "    "
+	}
+	if index < 0 || index > len(*list) {
+		index = len(*list)
+	}
+	if len(*list) > 0 {
+		sibling := (*list)[len(*list)-1]
+		if index < len(*list) {
+			sibling = (*list)[index]
+		}
+		indent = indentOf(sibling.lead)
+	}
+
+	d.file = c.File
+	d.dirty = true
+	if d.Block != nil && d.close == "" {
+		d.close = "\n" + indent
+	}
+	// Whatever follows the insertion point up to the end of its line (a
+	// trailing comment of the previous directive) stays on that line
+	next := tail
+	if index < len(*list) {
+		next = &(*list)[index].lead
+	}
+	if i := strings.Index(*next, "\n"); i >= 0 {
+		d.lead = (*next)[:i] + "\n" + indent
+		*next = (*next)[i:]
+	} else {
+		d.lead = "\n" + indent
+		switch {
+		case index < len(*list):
+			*next = "\n" + indent
+		case parent != nil:
+			*next = "\n" + indentOf(parent.lead)
+		}
+	}
+	if index == 0 && parent == nil {
+		d.lead = strings.TrimPrefix(d.lead, "\n")
+	}
+
+	*list = append((*list)[:index], append([]*Directive{d}, (*list)[index:]...)...)
+	c.reindex()
+	return nil
+}
+
+// Remove deletes the directive at an index path together with its trailing
+// comment
+func (c *Config) Remove(path string) error {
+	_, list, idx, err := c.Lookup(path)
+	if err != nil {
+		return err
+	}
+	head := (*list)[idx].lead
+	if i := strings.Index(head, "\n"); i >= 0 {
+		head = head[:i]
+	} else {
+		head = ""
+	}
+	*list = append((*list)[:idx], (*list)[idx+1:]...)
+
+	next := &c.trailing
+	if idx < len(*list) {
+		next = &(*list)[idx].lead
+	} else if i := strings.LastIndex(path, "."); i >= 0 {
+		parent, _, _, _ := c.Lookup(path[:i])
+		next = &parent.close
+	}
+	if i := strings.Index(*next, "\n"); i >= 0 {
+		*next = head + (*next)[i:]
+	}
+	c.reindex()
+	return nil
+}
+
+func (c *Config) reindex() {
+	var set func(list []*Directive, prefix string)
+	set = func(list []*Directive, prefix string) {
+		for i, d := range list {
+			d.Path = prefix + strconv.Itoa(i)
+			d.file = c.File
+			if d.Block != nil {
+				set(d.Block, d.Path+".")
+			}
+		}
+	}
+	set(c.Directives, "")
+}
+
+// indentOf returns the whitespace after the last line break of a lead
+func indentOf(lead string) string {
+	if i := strings.LastIndex(lead, "\n"); i >= 0 {
+		lead = lead[i+1:]
+	}
+	return lead[:len(lead)-len(strings.TrimLeft(lead, " \t"))]
+}
+
+func writeDirectives(sb *strings.Builder, list []*Directive) {
+	for _, d := range list {
+		sb.WriteString(d.lead)
+		if d.dirty || d.raw == nil {
+			sb.WriteString(d.Name)
+			for _, a := range d.Args {
+				sb.WriteString(" " + QuoteArg(a))
+			}
+			if d.Block != nil {
+				sb.WriteString(" {")
+			} else {
+				sb.WriteString(";")
+			}
+		} else {
+			for _, r := range d.raw {
+				sb.WriteString(r)
+			}
+			sb.WriteString(d.end)
+			if d.Block != nil {
+				sb.WriteString("{")
+			} else {
+				sb.WriteString(";")
+			}
+		}
+		if d.Block != nil {
+			writeDirectives(sb, d.Block)
+			sb.WriteString(d.close)
+			sb.WriteString("}")
+		}
+	}
+}
+
+// QuoteArg returns an argument as it has to be written in a config file
+func QuoteArg(s string) string {
+	needs := s == "" || strings.ContainsAny(s, " \t\r\n;{}\"'#")
+	for _, esc := range []string{`\"`, `\'`, `\\`, `\t`, `\r`, `\n`} {
+		if strings.Contains(s, esc) {
+			needs = true
+		}
+	}
+	if !needs {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+type parser struct {
+	file   string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) block(nested bool) ([]*Directive, string, error) {
+	list := []*Directive{}
+	for {
+		tok := p.tokens[p.pos]
+		switch tok.kind {
+		case 0:
+			if nested {
+				return nil, "", fmt.Errorf("%s:%d: unexpected end of file, expecting \"}\"", p.file, tok.line)
+			}
+			return list, tok.pre, nil
+		case '}':
+			if !nested {
+				return nil, "", fmt.Errorf("%s:%d: unexpected \"}\"", p.file, tok.line)
+			}
+			p.pos++
+			return list, tok.pre, nil
+		case ';', '{':
+			return nil, "", fmt.Errorf("%s:%d: unexpected %q", p.file, tok.line, tok.raw)
+		}
+
+		d := &Directive{Name: tok.value, Args: []string{}, Line: tok.line, file: p.file, lead: tok.pre, raw: []string{tok.raw}}
+		p.pos++
+		for p.tokens[p.pos].kind == 'w' {
+			t := p.tokens[p.pos]
+			d.Args = append(d.Args, t.value)
+			d.raw = append(d.raw, t.pre+t.raw)
+			p.pos++
+		}
+
+		end := p.tokens[p.pos]
+		d.end = end.pre
+		switch end.kind {
+		case ';':
+			p.pos++
+		case '{':
+			p.pos++
+			children, closing, err := p.block(true)
+			if err != nil {
+				return nil, "", err
+			}
+			d.Block = children
+			d.close = closing
+		default:
+			return nil, "", fmt.Errorf("%s:%d: directive %q is not terminated by \";\"", p.file, d.Line, d.Name)
+		}
+		list = append(list, d)
+	}
+}
+
+// lex splits a config into tokens the way nginx does, attaching the
+// whitespace and comments before each token to it
+func lex(file, content string) ([]token, error) {
+	var tokens []token
+	n := len(content)
+	line := 1
+	i := 0
+	for {
+		start := i
+		for i < n {
+			c := content[i]
+			if c == ' ' || c == '\t' || c == '\r' {
+				i++
+			} else if c == '\n' {
+				line++
+				i++
+			} else if c == '#' {
+				for i < n && content[i] != '\n' {
+					i++
+				}
+			} else {
+				break
+			}
+		}
+		pre := content[start:i]
+		if i >= n {
+			return append(tokens, token{pre: pre, line: line}), nil
+		}
+
+		c := content[i]
+		tokLine := line
+		switch {
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, token{kind: c, pre: pre, raw: string(c), line: tokLine})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < n && content[j] != c {
+				if content[j] == '\\' && j+1 < n {
+					j++
+				}
+				if content[j] == '\n' {
+					line++
+				}
+				j++
+			}
+			if j >= n {
+				return nil, fmt.Errorf("%s:%d: unterminated string", file, tokLine)
+			}
+			tokens = append(tokens, token{kind: 'w', pre: pre, raw: content[i : j+1], value: unescapeArg(content[i+1 : j]), line: tokLine})
+			i = j + 1
+		default:
+			j := i
+			for j < n {
+				ch := content[j]
+				if ch == '\\' && j+1 < n {
+					if content[j+1] == '\n' {
+						line++
+					}
+					j += 2
+					continue
+				}
+				// "${" is part of a variable name, not a block
+				if ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n' || ch == ';' || (ch == '{' && (j == i || content[j-1] != '$')) {
+					break
+				}
+				j++
+			}
+			tokens = append(tokens, token{kind: 'w', pre: pre, raw: content[i:j], value: unescapeArg(content[i:j]), line: tokLine})
+			i = j
+		}
+	}
+}
+
+func unescapeArg(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case '"', '\'', '\\':
+				sb.WriteByte(s[i+1])
+				i++
+				continue
+			case 't':
+				sb.WriteByte('\t')
+				i++
+				continue
+			case 'r':
+				sb.WriteByte('\r')
+				i++
+				continue
+			case 'n':
+				sb.WriteByte('\n')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,236 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testVhost = `# Managed by hand
+map $http_upgrade $connection_upgrade {
+    default upgrade;
+    ''      close;   # no upgrade
+}
+
+server {
+	listen 80;
+	listen [::]:80;
+    server_name example.com "www.example.com";  # both names
+    root /var/www/example.com;
+
+    include snippets/ssl.conf;
+
+    location / {
+        if ($request_method = POST) {
+            return 405;
+        }
+        try_files $uri $uri/ /index.php?$args;
+    }
+
+    location ~ \.php$ {
+        fastcgi_pass unix:/run/php/php8.2-fpm.sock;
+        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+        add_header X-Note 'it\'s "quoted"';
+    }
+    rewrite ^/old/(.*)$ /new/${1} permanent;
+}
+# trailing comment
+`
+
+func TestParseRoundTrip(t *testing.T) {
+	configs := map[string]string{
+		"vhost": testVhost,
+		"empty": "",
+		"bare":  "events {}\nhttp{include mime.types;default_type application/octet-stream;}",
+		"crlf":  "server {\r\n    listen 80;\r\n}\r\n",
+	}
+	for name, content := range configs {
+		c, err := Parse(name, content)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := c.String(); got != content {
+			t.Errorf("%s: round trip changed the config:\n%s", name, got)
+		}
+		if c.Changed() {
+			t.Errorf("%s: unchanged config reported as changed", name)
+		}
+	}
+}
+
+func TestParseTree(t *testing.T) {
+	c, err := Parse("vhost", testVhost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Directives) != 2 || c.Directives[0].Name != "map" || c.Directives[1].Name != "server" {
+		t.Fatalf("unexpected top level: %+v", c.Directives)
+	}
+	// An empty quoted string is a valid map key
+	if d := c.Directives[0].Block[1]; d.Name != "" || d.Arg(0) != "close" {
+		t.Errorf("map entry: %q %q", d.Name, d.Args)
+	}
+
+	server := c.Directives[1]
+	if d := First(server.Block, "server_name"); d == nil || d.Arg(1) != "www.example.com" || d.Line != 10 {
+		t.Errorf("server_name: %+v", d)
+	}
+	d, _, _, err := c.Lookup("1.5.0")
+	if err != nil || d.Name != "if" || d.Arg(0) != "($request_method" || d.Block[0].Name != "return" {
+		t.Errorf("1.5.0: %+v %v", d, err)
+	}
+	if d, _, _, _ := c.Lookup("1.6.2"); d == nil || d.Arg(1) != `it's "quoted"` {
+		t.Errorf("quoted header: %+v", d)
+	}
+	if d, _, _, _ := c.Lookup("1.7"); d == nil || d.Arg(1) != "/new/${1}" {
+		t.Errorf("rewrite: %+v", d)
+	}
+	for _, path := range []string{"", "2", "1.2.0", "x"} {
+		if _, _, _, err := c.Lookup(path); err == nil {
+			t.Errorf("lookup %q: expected an error", path)
+		}
+	}
+
+	for _, bad := range []string{"server {", "}", "listen 80", "add_header X \"open;"} {
+		if _, err := Parse("bad", bad); err == nil {
+			t.Errorf("%q: expected a parse error", bad)
+		}
+	}
+}
+
+func TestEdits(t *testing.T) {
+	const content = "server {\n    listen 80;  # http\n    root /var/www/a;\n\n    location / {\n        try_files $uri =404;\n    }\n}\n"
+	tests := []struct {
+		name string
+		edit func(c *Config) error
+		want string
+	}{
+		{
+			"set",
+			func(c *Config) error {
+				d, _, _, err := c.Lookup("0.1")
+				if err == nil {
+					d.Set("/srv/my site")
+				}
+				return err
+			},
+			"server {\n    listen 80;  # http\n    root \"/srv/my site\";\n\n    location / {\n        try_files $uri =404;\n    }\n}\n",
+		},
+		{
+			"insert after a trailing comment",
+			func(c *Config) error {
+				return c.Insert(c.Directives[0], 1, &Directive{Name: "server_name", Args: []string{"a.com"}})
+			},
+			"server {\n    listen 80;  # http\n    server_name a.com;\n    root /var/www/a;\n\n    location / {\n        try_files $uri =404;\n    }\n}\n",
+		},
+		{
+			"insert a block at the end",
+			func(c *Config) error {
+				loc, _, _, _ := c.Lookup("0.2")
+				if err := c.Insert(c.Directives[0], -1, &Directive{Name: "location", Args: []string{"=", "/x"}, Block: []*Directive{}}); err != nil {
+					return err
+				}
+				return c.Insert(loc, 0, &Directive{Name: "index", Args: []string{"index.html"}})
+			},
+			"server {\n    listen 80;  # http\n    root /var/www/a;\n\n    location / {\n        index index.html;\n        try_files $uri =404;\n    }\n    location = /x {\n    }\n}\n",
+		},
+		{
+			"insert into a plain directive",
+			func(c *Config) error {
+				root, _, _, _ := c.Lookup("0.1")
+				return c.Insert(root, 0, &Directive{Name: "x"})
+			},
+			"",
+		},
+		{
+			"remove with its comment",
+			func(c *Config) error { return c.Remove("0.0") },
+			"server {\n    root /var/www/a;\n\n    location / {\n        try_files $uri =404;\n    }\n}\n",
+		},
+		{
+			"remove the last directive of a block",
+			func(c *Config) error { return c.Remove("0.2.0") },
+			"server {\n    listen 80;  # http\n    root /var/www/a;\n\n    location / {\n    }\n}\n",
+		},
+		{
+			"remove a missing path",
+			func(c *Config) error { return c.Remove("0.9") },
+			"",
+		},
+	}
+	for _, tt := range tests {
+		c, err := Parse("test", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tt.edit(c)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := c.String(); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+		if !c.Changed() {
+			t.Errorf("%s: edit not reported as a change", tt.name)
+		}
+		// Paths follow the edit
+		c.Walk(func(d *Directive) bool {
+			if found, _, _, err := c.Lookup(d.Path); err != nil || found != d {
+				t.Errorf("%s: %s does not resolve to %s", tt.name, d.Path, d.Name)
+			}
+			return true
+		})
+	}
+}
+
+func TestParseFileIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("ssl.conf", "ssl_certificate /etc/ssl/a.pem;\nlocation /inc {\n    return 204;\n}\n")
+	main := write("main.conf", "server {\n    listen 443 ssl;\n    include "+filepath.Join(dir, "*.conf")+";\n    include "+filepath.Join(dir, "missing.conf")+";\n}\n")
+
+	c, err := ParseFile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	include := c.Directives[0].Block[1]
+	if len(include.Includes) != 1 || include.Includes[0].File != filepath.Join(dir, "ssl.conf") {
+		t.Fatalf("includes: %+v", include.Includes)
+	}
+
+	children := c.Directives[0].Children()
+	names := []string{}
+	for _, d := range children {
+		names = append(names, d.Name)
+	}
+	if len(names) != 4 || names[1] != "ssl_certificate" || names[2] != "location" {
+		t.Fatalf("children: %v", names)
+	}
+	if children[0].ReadOnly || children[0].File() != main {
+		t.Errorf("listen: read-only %v, file %s", children[0].ReadOnly, children[0].File())
+	}
+	// Included directives keep paths within their own file
+	loc := children[2]
+	if !loc.ReadOnly || loc.File() != filepath.Join(dir, "ssl.conf") || loc.Path != "1" || !loc.Block[0].ReadOnly {
+		t.Errorf("included location: read-only %v, file %s, path %s", loc.ReadOnly, loc.File(), loc.Path)
+	}
+	if d := First(c.Directives[0].Block, "ssl_certificate"); d == nil || d.Arg(0) != "/etc/ssl/a.pem" {
+		t.Errorf("First does not follow includes: %+v", d)
+	}
+	if c.String() != "server {\n    listen 443 ssl;\n    include "+filepath.Join(dir, "*.conf")+";\n    include "+filepath.Join(dir, "missing.conf")+";\n}\n" {
+		t.Errorf("includes leaked into the file:\n%s", c.String())
+	}
+}
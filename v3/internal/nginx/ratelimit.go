@@ -0,0 +1,426 @@
+package nginx
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/logs"
+)
+
+// PanelUserAgent identifies the panel's own requests to websites in their
+// access logs. It does not get past user agent blocking, which anyone could
+// send; the panel is exempted by its addresses instead, see panelAddresses.
+const PanelUserAgent = "PandaPanel"
+
+const (
+	rateLimitZoneSize = "10m"
+	maxRateLimitValue = 100000 // Upper bound of bursts and connection limits
+	maxPathLimits     = 20
+)
+
+var (
+	rateLimitRegex = regexp.MustCompile(`^[1-9][0-9]{0,5}r/[sm]$`)
+	limitPathRegex = regexp.MustCompile(`^/[A-Za-z0-9._~/%-]*$`)
+	agentRegex     = regexp.MustCompile(`^[A-Za-z0-9 ._/+:;()-]{1,64}$`)
+
+	// Error log lines of rejected requests, e.g.
+	// 2025/12/29 03:35:12 [error] 812#812: *5 limiting requests, excess: 5.010 by zone "panda_req_example_com", client: 1.2.3.4, ...
+	rejectRegex = regexp.MustCompile(`^(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d) \[\w+\] .*?(?:limiting requests, excess: [0-9.]+ by zone "([^"]+)"|limiting connections by zone "([^"]+)"|(access forbidden by rule)), client: ([^,\s]+)`)
+)
+
+// Rules reported by RateLimitStats
+const (
+	RuleSite        = "site"
+	RulePath        = "path"
+	RuleConnections = "connections"
+	RuleDenyIPs     = "deny_ips"
+	RuleUserAgents  = "user_agents"
+)
+
+// RateLimitSnippet is the rate limiting config of a site. HTTP goes before
+// the server block (zones, geo/map), Server inside it.
+type RateLimitSnippet struct {
+	HTTP   string
+	Server string
+}
+
+// RateLimitStat counts the requests a rule rejected
+type RateLimitStat struct {
+	Rule       string        `json:"rule"`
+	Path       string        `json:"path,omitempty"` // Path of a path rule
+	Zone       string        `json:"zone,omitempty"`
+	Rejected   int           `json:"rejected"`
+	Last       *time.Time    `json:"last,omitempty"`
+	TopClients []ClientCount `json:"top_clients"`
+}
+
+// ClientCount is the number of rejected requests of a client
+type ClientCount struct {
+	IP    string `json:"ip"`
+	Count int    `json:"count"`
+}
+
+// RateLimitZone is the shared memory zone of a site-wide request limit,
+// or of the path limit with the given 1-based index
+func RateLimitZone(domain string, path int) string {
+	name := "panda_req_" + nonVarChars.ReplaceAllString(domain, "_")
+	if path > 0 {
+		name += fmt.Sprintf("_%d", path)
+	}
+	return name
+}
+
+// ConnLimitZone is the shared memory zone of a site's connection limit
+func ConnLimitZone(domain string) string {
+	return "panda_conn_" + nonVarChars.ReplaceAllString(domain, "_")
+}
+
+// ValidateRateLimitConfig checks the rates, paths, user agents and IPs of a
+// rate limit config
+func ValidateRateLimitConfig(c db.RateLimitConfig) error {
+	if c.Rate != "" && !rateLimitRegex.MatchString(c.Rate) {
+		return fmt.Errorf("invalid rate %q, expected e.g. 10r/s or 30r/m", c.Rate)
+	}
+	if c.Burst < 0 || c.Burst > maxRateLimitValue || c.Connections < 0 || c.Connections > maxRateLimitValue {
+		return fmt.Errorf("burst and connections must be between 0 and %d", maxRateLimitValue)
+	}
+	if len(c.PathLimits) > maxPathLimits {
+		return fmt.Errorf("at most %d path limits are allowed", maxPathLimits)
+	}
+	seen := map[string]bool{}
+	for _, p := range c.PathLimits {
+		if !limitPathRegex.MatchString(p.Path) {
+			return fmt.Errorf("invalid path: %q", p.Path)
+		}
+		if seen[p.Path] {
+			return fmt.Errorf("%s is limited twice", p.Path)
+		}
+		seen[p.Path] = true
+		if !rateLimitRegex.MatchString(p.Rate) {
+			return fmt.Errorf("invalid rate %q for %s", p.Rate, p.Path)
+		}
+		if p.Burst < 0 || p.Burst > maxRateLimitValue {
+			return fmt.Errorf("burst of %s must be between 0 and %d", p.Path, maxRateLimitValue)
+		}
+	}
+	for _, agents := range [][]string{c.AllowedAgents, c.BlockedAgents} {
+		for _, a := range agents {
+			if !agentRegex.MatchString(a) {
+				return fmt.Errorf("invalid user agent %q: use letters, digits, spaces and ._/+:;()-", a)
+			}
+		}
+	}
+	for _, ips := range [][]string{c.AllowIPs, c.DenyIPs} {
+		for _, ip := range ips {
+			if parseClientNet(ip) == nil {
+				return fmt.Errorf("invalid IP or CIDR: %q", ip)
+			}
+		}
+	}
+	return nil
+}
+
+// RenderRateLimit returns the rate limiting config of a website, empty
+// when it is off.
+//
+// Clients on the allow list are exempt: they map to an empty zone key,
+// which nginx does not account, and never match the user agent map. Path
+// limits get their own zone whose key is only set below the path, so all of
+// them apply at server level without extra locations. Rejected requests get
+// 429, blocked IPs and user agents 403.
+func RenderRateLimit(domain string) (RateLimitSnippet, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return RateLimitSnippet{}, nil
+	}
+	var c db.RateLimitConfig
+	if err := db.DB.Where("website_id = ? AND enabled = ?", site.ID, true).First(&c).Error; err != nil {
+		return RateLimitSnippet{}, nil
+	}
+	if err := ValidateRateLimitConfig(c); err != nil {
+		return RateLimitSnippet{}, err
+	}
+
+	name := nonVarChars.ReplaceAllString(domain, "_")
+	exemptVar := "$panda_exempt_" + name
+	keyVar := "$panda_req_key_" + name
+	agentVar := "$panda_block_agent_" + name
+
+	var http strings.Builder
+	var server []string
+	http.WriteString("# Rate limiting, managed by Panda Panel\n")
+	fmt.Fprintf(&http, "geo %s {\n    default 0;\n", exemptVar)
+	exempt := map[string]bool{}
+	for _, ip := range append(panelAddresses(), c.AllowIPs...) {
+		if !exempt[ip] {
+			exempt[ip] = true
+			fmt.Fprintf(&http, "    %s 1;\n", ip)
+		}
+	}
+	http.WriteString("}\n")
+
+	for _, ip := range c.DenyIPs {
+		server = append(server, fmt.Sprintf("deny %s;", ip))
+	}
+
+	if c.BlockBots || len(c.BlockedAgents) > 0 {
+		fmt.Fprintf(&http, "map \"%s:$http_user_agent\" %s {\n    default 0;\n", exemptVar, agentVar)
+		for _, a := range c.AllowedAgents {
+			fmt.Fprintf(&http, "    \"~*^0:.*%s\" 0;\n", regexp.QuoteMeta(a))
+		}
+		blocked := make([]string, 0, len(c.BlockedAgents)+len(logs.BotKeywords))
+		for _, a := range c.BlockedAgents {
+			blocked = append(blocked, regexp.QuoteMeta(a))
+		}
+		if c.BlockBots {
+			for _, k := range logs.BotKeywords {
+				blocked = append(blocked, regexp.QuoteMeta(k))
+			}
+		}
+		fmt.Fprintf(&http, "    \"~*^0:.*(%s)\" 1;\n}\n", strings.Join(blocked, "|"))
+		server = append(server, fmt.Sprintf("if (%s) {\n        return 403;\n    }", agentVar))
+	}
+
+	if c.Rate != "" || c.Connections > 0 {
+		fmt.Fprintf(&http, "map %s %s {\n    1 \"\";\n    default $binary_remote_addr;\n}\n", exemptVar, keyVar)
+	}
+	if c.Rate != "" {
+		zone := RateLimitZone(domain, 0)
+		fmt.Fprintf(&http, "limit_req_zone %s zone=%s:%s rate=%s;\n", keyVar, zone, rateLimitZoneSize, c.Rate)
+		server = append(server, limitReq(zone, c.Burst))
+	}
+	for i, p := range c.PathLimits {
+		zone := RateLimitZone(domain, i+1)
+		pathKey := fmt.Sprintf("%s_%d", keyVar, i+1)
+		fmt.Fprintf(&http, "map \"%s:$uri\" %s {\n    default \"\";\n    \"~^0:%s\" $binary_remote_addr;\n}\n", exemptVar, pathKey, regexp.QuoteMeta(p.Path))
+		fmt.Fprintf(&http, "limit_req_zone %s zone=%s:%s rate=%s;\n", pathKey, zone, rateLimitZoneSize, p.Rate)
+		server = append(server, limitReq(zone, p.Burst))
+	}
+	if c.Connections > 0 {
+		zone := ConnLimitZone(domain)
+		fmt.Fprintf(&http, "limit_conn_zone %s zone=%s:%s;\n", keyVar, zone, rateLimitZoneSize)
+		server = append(server, fmt.Sprintf("limit_conn %s %d;", zone, c.Connections))
+	}
+	if c.Rate != "" || len(c.PathLimits) > 0 {
+		server = append(server, "limit_req_status 429;")
+	}
+	if c.Connections > 0 {
+		server = append(server, "limit_conn_status 429;")
+	}
+
+	return RateLimitSnippet{HTTP: http.String(), Server: strings.Join(server, "\n    ")}, nil
+}
+
+// panelAddresses are the addresses the panel's own requests to websites,
+// e.g. uptime probes, come from: loopback and the server's own addresses.
+// Rate limits and user agent blocking exempt them.
+func panelAddresses() []string {
+	addrs := []string{"127.0.0.1", "::1"}
+	ifaces, _ := net.InterfaceAddrs()
+	for _, a := range ifaces {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+			addrs = append(addrs, n.IP.String())
+		}
+	}
+	return addrs
+}
+
+func limitReq(zone string, burst int) string {
+	if burst > 0 {
+		return fmt.Sprintf("limit_req zone=%s burst=%d nodelay;", zone, burst)
+	}
+	return fmt.Sprintf("limit_req zone=%s;", zone)
+}
+
+// RateLimitStats counts the requests each rule of a website rejected since
+// the given time. Rate, path and connection limits and the IP deny list
+// are read from the site's error log; user agent blocks are not logged
+// there, so they are counted from the 403s in its access log.
+func RateLimitStats(domain string, c db.RateLimitConfig, since time.Time) ([]RateLimitStat, error) {
+	var stats []*RateLimitStat
+	byZone := map[string]*RateLimitStat{}
+	if c.Rate != "" {
+		s := &RateLimitStat{Rule: RuleSite, Zone: RateLimitZone(domain, 0)}
+		stats = append(stats, s)
+		byZone[s.Zone] = s
+	}
+	for i, p := range c.PathLimits {
+		s := &RateLimitStat{Rule: RulePath, Path: p.Path, Zone: RateLimitZone(domain, i+1)}
+		stats = append(stats, s)
+		byZone[s.Zone] = s
+	}
+	if c.Connections > 0 {
+		s := &RateLimitStat{Rule: RuleConnections, Zone: ConnLimitZone(domain)}
+		stats = append(stats, s)
+		byZone[s.Zone] = s
+	}
+	var deny, agents *RateLimitStat
+	if len(c.DenyIPs) > 0 {
+		deny = &RateLimitStat{Rule: RuleDenyIPs}
+		stats = append(stats, deny)
+	}
+	if c.BlockBots || len(c.BlockedAgents) > 0 {
+		agents = &RateLimitStat{Rule: RuleUserAgents}
+		stats = append(stats, agents)
+	}
+
+	clients := map[*RateLimitStat]map[string]int{}
+	count := func(s *RateLimitStat, t time.Time, ip string) {
+		s.Rejected++
+		if s.Last == nil || t.After(*s.Last) {
+			last := t
+			s.Last = &last
+		}
+		if clients[s] == nil {
+			clients[s] = map[string]int{}
+		}
+		clients[s][ip]++
+	}
+
+	if len(byZone) > 0 || deny != nil {
+		denied := parseClientNets(c.DenyIPs)
+		err := scanLog(filepath.Join("/var/log/nginx", domain+".error.log"), func(line string) {
+			m := rejectRegex.FindStringSubmatch(line)
+			if m == nil {
+				return
+			}
+			t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+			if err != nil || t.Before(since) {
+				return
+			}
+			switch {
+			case m[2] != "" && byZone[m[2]] != nil:
+				count(byZone[m[2]], t, m[5])
+			case m[3] != "" && byZone[m[3]] != nil:
+				count(byZone[m[3]], t, m[5])
+			// Hidden files are refused by rule too
+			case m[4] != "" && deny != nil && clientIn(m[5], denied):
+				count(deny, t, m[5])
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if agents != nil {
+		allowed := parseClientNets(append(panelAddresses(), c.AllowIPs...))
+		err := scanLog(filepath.Join("/var/log/nginx", domain+".access.log"), func(line string) {
+			entry, ok := logs.ParseAccessLine(line)
+			if !ok || entry.Status != 403 || entry.Time.Before(since) || clientIn(entry.IP, allowed) {
+				return
+			}
+			if agentBlocked(c, entry.Agent) {
+				count(agents, entry.Time, entry.IP)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]RateLimitStat, 0, len(stats))
+	for _, s := range stats {
+		s.TopClients = topClients(clients[s], 5)
+		result = append(result, *s)
+	}
+	return result, nil
+}
+
+// agentBlocked mirrors the user agent map of RenderRateLimit
+func agentBlocked(c db.RateLimitConfig, agent string) bool {
+	low := strings.ToLower(agent)
+	for _, a := range c.AllowedAgents {
+		if strings.Contains(low, strings.ToLower(a)) {
+			return false
+		}
+	}
+	for _, a := range c.BlockedAgents {
+		if strings.Contains(low, strings.ToLower(a)) {
+			return true
+		}
+	}
+	return c.BlockBots && logs.IsBotAgent(agent)
+}
+
+func topClients(counts map[string]int, n int) []ClientCount {
+	top := make([]ClientCount, 0, len(counts))
+	for ip, count := range counts {
+		top = append(top, ClientCount{IP: ip, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].IP < top[j].IP
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// scanLog calls fn for each line of a log file; a missing file has no lines
+func scanLog(path string, fn func(line string)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// parseClientNet parses an IP or CIDR as nginx's allow/deny and geo do
+func parseClientNet(s string) *net.IPNet {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n
+	}
+	return nil
+}
+
+func parseClientNets(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if n := parseClientNet(s); n != nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func clientIn(ip string, nets []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package nginx
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+// TLS profiles, after the Mozilla server side TLS guidelines
+const (
+	TLSModern       = "modern"
+	TLSIntermediate = "intermediate"
+	TLSOld          = "old"
+)
+
+// hstsPreloadMinAge is the shortest max-age the HSTS preload list accepts
+const hstsPreloadMinAge = 31536000
+
+type tlsProfile struct {
+	protocols string
+	ciphers   string // Empty = the OpenSSL defaults, TLS 1.3 only
+	prefer    bool   // ssl_prefer_server_ciphers
+}
+
+var tlsProfiles = map[string]tlsProfile{
+	TLSModern: {protocols: "TLSv1.3"},
+	TLSIntermediate: {
+		protocols: "TLSv1.2 TLSv1.3",
+		ciphers:   "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305",
+	},
+	TLSOld: {
+		protocols: "TLSv1 TLSv1.1 TLSv1.2 TLSv1.3",
+		ciphers:   "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305:ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA",
+		prefer:    true,
+	},
+}
+
+var referrerPolicies = []string{
+	"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+	"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+}
+
+var nginxVersionRegex = regexp.MustCompile(`nginx/(\d+)\.(\d+)\.(\d+)`)
+
+var (
+	versionOnce sync.Once
+	http2On     bool // nginx supports "http2 on", 1.25.1 and later
+)
+
+// SecuritySnippet is the TLS and header config of a site, both inside the
+// server block
+type SecuritySnippet struct {
+	TLS     string
+	Headers string
+}
+
+// DefaultSecurityConfig is used by sites without a config of their own
+func DefaultSecurityConfig() db.SecurityConfig {
+	return db.SecurityConfig{
+		TLSProfile:     TLSIntermediate,
+		HTTP2:          true,
+		HTTPSRedirect:  true,
+		HSTS:           true,
+		HSTSMaxAge:     31536000,
+		ReferrerPolicy: "strict-origin-when-cross-origin",
+		FrameOptions:   "SAMEORIGIN",
+		NoSniff:        true,
+	}
+}
+
+// SiteSecurityConfig returns the security config of a website, or the
+// default one
+func SiteSecurityConfig(domain string) db.SecurityConfig {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err == nil {
+		var c db.SecurityConfig
+		if db.DB.Where("website_id = ?", site.ID).First(&c).Error == nil {
+			return c
+		}
+	}
+	return DefaultSecurityConfig()
+}
+
+// ValidateSecurityConfig checks a security config. Header values end up in
+// quoted nginx strings, so quotes, backslashes, variables and line breaks
+// are refused.
+func ValidateSecurityConfig(c db.SecurityConfig) error {
+	if _, ok := tlsProfiles[c.TLSProfile]; !ok {
+		return fmt.Errorf("unknown TLS profile: %q", c.TLSProfile)
+	}
+	if c.HSTS && c.HSTSMaxAge <= 0 {
+		return fmt.Errorf("hsts_max_age must be positive")
+	}
+	if c.HSTSPreload && (!c.HSTS || !c.HSTSSubdomains || c.HSTSMaxAge < hstsPreloadMinAge) {
+		return fmt.Errorf("HSTS preload requires includeSubDomains and a max-age of at least %d", hstsPreloadMinAge)
+	}
+	if c.ReferrerPolicy != "" {
+		for _, p := range strings.Split(c.ReferrerPolicy, ",") {
+			if !slices.Contains(referrerPolicies, strings.TrimSpace(p)) {
+				return fmt.Errorf("invalid referrer policy: %q", c.ReferrerPolicy)
+			}
+		}
+	}
+	switch c.FrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("frame_options must be DENY, SAMEORIGIN or empty")
+	}
+	for name, value := range map[string]string{"csp": c.CSP, "permissions_policy": c.PermissionsPolicy} {
+		if strings.ContainsAny(value, "\"\\$\r\n") {
+			return fmt.Errorf("%s must not contain quotes, backslashes, $ or line breaks", name)
+		}
+	}
+	return nil
+}
+
+// CertFiles are the certificate and key a site is served with. Chain is the
+// issuer chain OCSP responses are verified against, if there is one.
+type CertFiles struct {
+	Cert  string
+	Key   string
+	Chain string
+}
+
+// CertbotFiles returns the files of a certbot certificate directory, or no
+// files for an empty directory
+func CertbotFiles(dir string) CertFiles {
+	if dir == "" {
+		return CertFiles{}
+	}
+	return CertFiles{Cert: dir + "/fullchain.pem", Key: dir + "/privkey.pem", Chain: dir + "/chain.pem"}
+}
+
+// RenderSecurity returns the TLS and header config of a site. TLS is only
+// rendered with a certificate and key; HSTS and Alt-Svc go with it.
+func RenderSecurity(c db.SecurityConfig, cert CertFiles) (SecuritySnippet, error) {
+	if err := ValidateSecurityConfig(c); err != nil {
+		return SecuritySnippet{}, err
+	}
+
+	var headers []string
+	var tls strings.Builder
+	if cert.Cert != "" && cert.Key != "" {
+		profile := tlsProfiles[c.TLSProfile]
+		params := ""
+		if c.HTTP2 && !supportsHTTP2On() {
+			params = " http2"
+		}
+		fmt.Fprintf(&tls, "listen 443 ssl%s;\n    listen [::]:443 ssl%s;\n", params, params)
+		if c.HTTP2 && supportsHTTP2On() {
+			tls.WriteString("    http2 on;\n")
+		}
+		if c.HTTP3 {
+			tls.WriteString("    listen 443 quic;\n    listen [::]:443 quic;\n")
+			headers = append(headers, `add_header Alt-Svc 'h3=":443"; ma=86400' always;`)
+		}
+		fmt.Fprintf(&tls, "    ssl_certificate %s;\n    ssl_certificate_key %s;\n", QuoteArg(cert.Cert), QuoteArg(cert.Key))
+		fmt.Fprintf(&tls, "    ssl_protocols %s;\n", profile.protocols)
+		if profile.ciphers != "" {
+			fmt.Fprintf(&tls, "    ssl_ciphers %s;\n", profile.ciphers)
+		}
+		if profile.prefer {
+			tls.WriteString("    ssl_prefer_server_ciphers on;\n")
+		} else {
+			tls.WriteString("    ssl_prefer_server_ciphers off;\n")
+		}
+		tls.WriteString("    ssl_session_timeout 1d;\n    ssl_session_cache shared:panda_ssl:10m;\n    ssl_session_tickets off;")
+		if c.OCSPStapling {
+			tls.WriteString("\n    ssl_stapling on;\n    ssl_stapling_verify on;")
+			if cert.Chain != "" {
+				fmt.Fprintf(&tls, "\n    ssl_trusted_certificate %s;", QuoteArg(cert.Chain))
+			}
+			tls.WriteString("\n    resolver 1.1.1.1 8.8.8.8 valid=300s;\n    resolver_timeout 5s;")
+		}
+		if c.HTTPSRedirect {
+			tls.WriteString("\n    if ($scheme = http) {\n        return 301 https://$host$request_uri;\n    }")
+		}
+
+		if c.HSTS {
+			value := "max-age=" + strconv.Itoa(c.HSTSMaxAge)
+			if c.HSTSSubdomains {
+				value += "; includeSubDomains"
+			}
+			if c.HSTSPreload {
+				value += "; preload"
+			}
+			headers = append(headers, fmt.Sprintf(`add_header Strict-Transport-Security "%s" always;`, value))
+		}
+	}
+
+	if c.CSP != "" {
+		name := "Content-Security-Policy"
+		if c.CSPReportOnly {
+			name += "-Report-Only"
+		}
+		headers = append(headers, fmt.Sprintf(`add_header %s "%s" always;`, name, c.CSP))
+	}
+	if c.ReferrerPolicy != "" {
+		headers = append(headers, fmt.Sprintf(`add_header Referrer-Policy "%s" always;`, c.ReferrerPolicy))
+	}
+	if c.PermissionsPolicy != "" {
+		headers = append(headers, fmt.Sprintf(`add_header Permissions-Policy "%s" always;`, c.PermissionsPolicy))
+	}
+	if c.FrameOptions != "" {
+		headers = append(headers, fmt.Sprintf(`add_header X-Frame-Options "%s" always;`, c.FrameOptions))
+	}
+	if c.NoSniff {
+		headers = append(headers, `add_header X-Content-Type-Options "nosniff" always;`)
+	}
+
+	return SecuritySnippet{TLS: tls.String(), Headers: strings.Join(headers, "\n    ")}, nil
+}
+
+// supportsHTTP2On reports whether the installed nginx enables HTTP/2 with
+// the http2 directive instead of the listen parameter, which it deprecates
+func supportsHTTP2On() bool {
+	versionOnce.Do(func() {
+		out, _ := system.Execute("nginx -v 2>&1")
+		if m := nginxVersionRegex.FindStringSubmatch(out); m != nil {
+			major, _ := strconv.Atoi(m[1])
+			minor, _ := strconv.Atoi(m[2])
+			patch, _ := strconv.Atoi(m[3])
+			http2On = major > 1 || (major == 1 && (minor > 25 || (minor == 25 && patch >= 1)))
+		}
+	})
+	return http2On
+}
@@ -0,0 +1,667 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/history"
+	"gopkg.in/yaml.v3"
+)
+
+// TemplatesDir holds admin overrides of the built-in vhost templates, one
+// <name>.tmpl file each. A file may start with a template comment holding
+// YAML that replaces the description, site types or variables:
+//
+//	{{/*
+//	vars:
+//	  - name: Domain
+//	    type: domain
+//	    required: true
+//	*/}}
+const TemplatesDir = "/opt/panda/templates"
+
+var (
+	templateNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+	templateDomain    = regexp.MustCompile(`(?i)^([a-z0-9_]([a-z0-9_-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	templatePHP       = regexp.MustCompile(`^\d+\.\d+$`)
+)
+
+// TemplateVar declares a variable of a vhost template. Type is one of
+// string, int, bool, port, domain, path or php_version.
+type TemplateVar struct {
+	Name        string `json:"name" yaml:"name"`
+	Type        string `json:"type" yaml:"type"`
+	Required    bool   `json:"required" yaml:"required"`
+	Default     string `json:"default,omitempty" yaml:"default"`
+	Pattern     string `json:"pattern,omitempty" yaml:"pattern"` // Regex a string must match
+	Description string `json:"description,omitempty" yaml:"description"`
+}
+
+// VhostTemplate is a vhost config template
+type VhostTemplate struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	SiteTypes   []string      `json:"site_types"` // Website types rendered with it
+	Vars        []TemplateVar `json:"vars"`
+	Body        string        `json:"body"`
+	Override    string        `json:"override,omitempty"` // Override file in use
+	Error       string        `json:"error,omitempty"`    // Why an override file is not used
+}
+
+// TemplateContext is the config the panel generates for a site, which
+// templates include next to their variables
+type TemplateContext struct {
+	Auth      AuthSnippet
+	Geo       GeoSnippet
+	RateLimit RateLimitSnippet
+	Cache     CacheSnippet
+	Upstream  UpstreamSnippet
+	Security  SecuritySnippet
+	Pages     PagesSnippet
+	NoIndex   bool
+	Aliases   []string     // Server names besides the domain and its www. name
+	Files     []FileChange // Files the config refers to, applied along with it
+}
+
+type templateMeta struct {
+	Description string        `yaml:"description"`
+	SiteTypes   []string      `yaml:"site_types"`
+	Vars        []TemplateVar `yaml:"vars"`
+}
+
+// templatePartials are shared by all templates. "http" renders the config
+// that goes before the server block, "site" the TLS, security header,
+// country, rate limit, basic auth, page cache, noindex and error page config
+// inside it, "logs" the per-site log files and "backend" the proxy_pass
+// target: the site's upstream group if it has one, else the local port.
+const templatePartials = `{{define "http"}}{{.Geo.HTTP}}{{.RateLimit.HTTP}}{{.Auth.HTTP}}{{.Pages.HTTP}}{{.Cache.HTTP}}{{.Upstream.HTTP}}{{end}}
+{{- define "site"}}
+{{- with .Security.TLS}}
+    {{.}}
+{{- end}}
+{{- with .Security.Headers}}
+    {{.}}
+{{- end}}
+{{- with .Geo.Server}}
+    {{.}}
+{{- end}}
+{{- with .RateLimit.Server}}
+    {{.}}
+{{- end}}
+{{- with .Auth.Server}}
+    {{.}}
+{{- end}}
+{{- with .Cache.Server}}
+    {{.}}
+{{- end}}
+{{- if .NoIndex}}
+    add_header X-Robots-Tag "noindex, nofollow" always;
+    location = /robots.txt {
+        default_type text/plain;
+        return 200 "User-agent: *\nDisallow: /\n";
+    }
+{{- end}}
+{{- with .Pages.Server}}
+    {{.}}
+{{- end}}
+{{- end}}
+{{- define "logs"}}
+    access_log /var/log/nginx/{{.Domain}}.access.log;
+    error_log /var/log/nginx/{{.Domain}}.error.log;
+{{- end}}
+{{- define "backend"}}{{with .Upstream.Name}}{{.}}{{else}}127.0.0.1:{{.BackendPort}}{{end}}{{end}}`
+
+var (
+	domainVar = TemplateVar{Name: "Domain", Type: "domain", Required: true, Description: "Primary server name; www. is added as an alias"}
+	rootVar   = TemplateVar{Name: "Root", Type: "path", Required: true, Description: "Site directory"}
+	portVar   = TemplateVar{Name: "Port", Type: "port", Default: "80", Description: "Port to listen on"}
+	phpVar    = TemplateVar{Name: "PHPVersion", Type: "php_version", Description: "PHP-FPM version, empty = the default php-fpm socket"}
+)
+
+var builtinTemplates = []VhostTemplate{
+	{
+		Name:        "php",
+		Description: "PHP site served through PHP-FPM",
+		SiteTypes:   []string{"php", "wordpress"},
+		Vars:        []TemplateVar{domainVar, rootVar, portVar, phpVar},
+		Body: `{{template "http" .}}server {
+    listen {{.Port}};
+    listen [::]:{{.Port}};
+    server_name {{.Domain}} www.{{.Domain}}{{range .Aliases}} {{.}}{{end}};
+    root {{.Root}};
+    index index.php index.html index.htm;
+{{- template "site" .}}
+{{template "logs" .}}
+
+    location / {
+        try_files $uri $uri/ /index.php?$query_string;
+    }
+
+    location ~ \.php$ {
+        fastcgi_pass unix:/var/run/php/{{if .PHPVersion}}php{{.PHPVersion}}-fpm.sock{{else}}php-fpm.sock{{end}};
+        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+        include fastcgi_params;
+    }
+
+    location ~ /\.ht {
+        deny all;
+    }
+}
+`,
+	},
+	{
+		Name:        "laravel",
+		Description: "Laravel application, served from its public directory",
+		SiteTypes:   []string{"laravel"},
+		Vars:        []TemplateVar{domainVar, rootVar, portVar, phpVar},
+		Body: `{{template "http" .}}server {
+    listen {{.Port}};
+    listen [::]:{{.Port}};
+    server_name {{.Domain}} www.{{.Domain}}{{range .Aliases}} {{.}}{{end}};
+    root {{.Root}}/public;
+    index index.php index.html;
+{{- template "site" .}}
+{{template "logs" .}}
+
+    location / {
+        try_files $uri $uri/ /index.php?$query_string;
+    }
+
+    location ~ \.php$ {
+        fastcgi_pass unix:/var/run/php/{{if .PHPVersion}}php{{.PHPVersion}}-fpm.sock{{else}}php-fpm.sock{{end}};
+        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+        include fastcgi_params;
+    }
+
+    location ~ /\.ht {
+        deny all;
+    }
+}
+`,
+	},
+	{
+		Name:        "static",
+		Description: "Static files only",
+		SiteTypes:   []string{"static"},
+		Vars:        []TemplateVar{domainVar, rootVar, portVar},
+		Body: `{{template "http" .}}server {
+    listen {{.Port}};
+    listen [::]:{{.Port}};
+    server_name {{.Domain}} www.{{.Domain}}{{range .Aliases}} {{.}}{{end}};
+    root {{.Root}};
+    index index.html index.htm;
+{{- template "site" .}}
+{{template "logs" .}}
+
+    location / {
+        try_files $uri $uri/ =404;
+    }
+
+    location ~ /\. {
+        deny all;
+    }
+}
+`,
+	},
+	{
+		Name:        "proxy",
+		Description: "Reverse proxy to an application listening on a local port",
+		SiteTypes:   []string{"nodejs", "java", "go", "python", "docker"},
+		Vars: []TemplateVar{domainVar, portVar,
+			{Name: "BackendPort", Type: "port", Required: true, Description: "Local port of the application"}},
+		Body: `{{template "http" .}}server {
+    listen {{.Port}};
+    listen [::]:{{.Port}};
+    server_name {{.Domain}} www.{{.Domain}}{{range .Aliases}} {{.}}{{end}};
+{{- template "site" .}}
+{{template "logs" .}}
+
+    location / {
+        proxy_pass http://{{template "backend" .}};
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection 'upgrade';
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+    }
+}
+`,
+	},
+	{
+		Name:        "php-ssl",
+		Description: "PHP site on HTTPS with a redirect from HTTP",
+		Vars:        []TemplateVar{domainVar, rootVar, phpVar},
+		Body: `{{template "http" .}}server {
+    server_name {{.Domain}} www.{{.Domain}}{{range .Aliases}} {{.}}{{end}};
+    root {{.Root}};
+    index index.php index.html;
+{{- template "site" .}}
+{{template "logs" .}}
+
+    location / {
+        try_files $uri $uri/ /index.php?$query_string;
+    }
+
+    location ~ \.php$ {
+        fastcgi_pass unix:/var/run/php/{{if .PHPVersion}}php{{.PHPVersion}}-fpm.sock{{else}}php-fpm.sock{{end}};
+        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+        include fastcgi_params;
+    }
+}
+
+server {
+    listen 80;
+    listen [::]:80;
+    server_name {{.Domain}} www.{{.Domain}}{{range .Aliases}} {{.}}{{end}};
+    return 301 https://$host$request_uri;
+}
+`,
+	},
+}
+
+// ListTemplates returns the vhost templates with admin overrides applied.
+// An override that does not load is reported in Error and the built-in
+// template stays in use.
+func ListTemplates() []VhostTemplate {
+	templates := make([]VhostTemplate, 0, len(builtinTemplates))
+	for _, t := range builtinTemplates {
+		templates = append(templates, loadTemplate(t))
+	}
+
+	// Override files without a built-in template
+	files, _ := filepath.Glob(filepath.Join(TemplatesDir, "*.tmpl"))
+	sort.Strings(files)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if builtinTemplate(name) == nil {
+			templates = append(templates, VhostTemplate{Name: name, Override: file, Error: "there is no built-in template with this name"})
+		}
+	}
+	return templates
+}
+
+// GetTemplate returns a vhost template with its override applied
+func GetTemplate(name string) (*VhostTemplate, error) {
+	base := builtinTemplate(name)
+	if base == nil {
+		return nil, fmt.Errorf("unknown template: %s", name)
+	}
+	t := loadTemplate(*base)
+	return &t, nil
+}
+
+// TemplateForSiteType returns the name of the template a website type is
+// rendered with
+func TemplateForSiteType(siteType string) string {
+	for _, t := range builtinTemplates {
+		for _, st := range t.SiteTypes {
+			if st == siteType {
+				return t.Name
+			}
+		}
+	}
+	return "php"
+}
+
+// RenderTemplate validates vars against a template's declared variables and
+// renders it. Values for undeclared variables are ignored.
+func RenderTemplate(name string, vars map[string]string, ctx TemplateContext) (string, error) {
+	t, err := GetTemplate(name)
+	if err != nil {
+		return "", err
+	}
+	return t.Render(vars, ctx)
+}
+
+// SiteContext renders the panel-generated config of a website: security
+// (TLS with a certificate directory, or else the certificate stored with an
+// SSL site), country rule, rate limits, basic auth, error pages, page cache,
+// upstream group, server aliases and noindex for staging copies
+func SiteContext(domain, siteType string, security db.SecurityConfig, certDir string) (TemplateContext, error) {
+	var ctx TemplateContext
+	var err error
+	var record db.Website
+	found := db.DB.Where("domain = ?", domain).First(&record).Error == nil
+
+	cert := CertbotFiles(certDir)
+	if cert.Cert == "" && found && record.SSL {
+		cert = CertFiles{Cert: record.CertPath, Key: record.KeyPath}
+	}
+	if ctx.Security, err = RenderSecurity(security, cert); err != nil {
+		return ctx, fmt.Errorf("failed to render security config: %v", err)
+	}
+	if ctx.Geo, err = RenderGeo(domain); err != nil {
+		return ctx, fmt.Errorf("failed to render country rule: %v", err)
+	}
+	if ctx.RateLimit, err = RenderRateLimit(domain); err != nil {
+		return ctx, fmt.Errorf("failed to render rate limits: %v", err)
+	}
+	if ctx.Auth, err = RenderAuth(domain); err != nil {
+		return ctx, fmt.Errorf("failed to render basic auth: %v", err)
+	}
+	if ctx.Pages, err = RenderPages(domain); err != nil {
+		return ctx, fmt.Errorf("failed to render error pages: %v", err)
+	}
+	if kind, err := CacheKindForSiteType(siteType); err == nil {
+		if ctx.Cache, err = RenderCache(domain, kind); err != nil {
+			return ctx, fmt.Errorf("failed to render page cache: %v", err)
+		}
+	}
+	if ctx.Upstream, err = RenderUpstream(domain); err != nil {
+		return ctx, fmt.Errorf("failed to render upstream group: %v", err)
+	}
+	if found {
+		ctx.NoIndex = record.StagingOf != 0
+		ctx.Aliases = ServerAliases(record)
+	}
+	ctx.Files = append(append(ctx.Geo.Files, ctx.Auth.Files...), ctx.Pages.Files...)
+	return ctx, nil
+}
+
+// ServerAliases returns the server names of a website besides its domain and
+// the www. name every template serves
+func ServerAliases(site db.Website) []string {
+	var aliases []string
+	for _, name := range site.Aliases {
+		if name != site.Domain && name != "www."+site.Domain && !slices.Contains(aliases, name) {
+			aliases = append(aliases, name)
+		}
+	}
+	return aliases
+}
+
+// SiteFiles renders the files a website's config refers to (htpasswd
+// files, country networks, error and maintenance pages), for configs that
+// are not rendered from a template
+func SiteFiles(domain string) ([]FileChange, error) {
+	geo, err := RenderGeo(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render country rule: %v", err)
+	}
+	auth, err := RenderAuth(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render basic auth: %v", err)
+	}
+	pages, err := RenderPages(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render error pages: %v", err)
+	}
+	return append(append(geo.Files, auth.Files...), pages.Files...), nil
+}
+
+// Render validates vars and renders the template
+func (t *VhostTemplate) Render(vars map[string]string, ctx TemplateContext) (string, error) {
+	data := map[string]any{"Auth": ctx.Auth, "Geo": ctx.Geo, "RateLimit": ctx.RateLimit, "Cache": ctx.Cache, "Upstream": ctx.Upstream, "Security": ctx.Security, "Pages": ctx.Pages, "NoIndex": ctx.NoIndex, "Aliases": ctx.Aliases}
+	for _, v := range t.Vars {
+		value := strings.TrimSpace(vars[v.Name])
+		if value == "" {
+			value = v.Default
+		}
+		if value == "" && v.Required {
+			return "", fmt.Errorf("%s is required", v.Name)
+		}
+		typed, err := v.convert(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", v.Name, err)
+		}
+		data[v.Name] = typed
+	}
+
+	tmpl, err := t.compile()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("template %s: %v", t.Name, err)
+	}
+	return sb.String(), nil
+}
+
+// PreviewTemplate renders a template, or an unsaved override of it when
+// content is set, and checks that the result parses
+func PreviewTemplate(name, content string, vars map[string]string) (string, error) {
+	t, err := GetTemplate(name)
+	if err != nil {
+		return "", err
+	}
+	if content != "" {
+		if *t, err = parseOverride(*builtinTemplate(name), content); err != nil {
+			return "", err
+		}
+	}
+	out, err := t.Render(vars, TemplateContext{})
+	if err != nil {
+		return "", err
+	}
+	if _, err := Parse(name, out); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// SaveTemplateOverride stores an admin override of a built-in template. It
+// is rejected unless it renders a config that parses for sample values of
+// its variables.
+func SaveTemplateOverride(name, content string) (*VhostTemplate, error) {
+	base := builtinTemplate(name)
+	if base == nil {
+		return nil, fmt.Errorf("unknown template: %s", name)
+	}
+	t, err := parseOverride(*base, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(TemplatesDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(TemplatesDir, name+".tmpl")
+	if err := history.WriteFile(path, []byte(content), 0644, history.Panel, "template override"); err != nil {
+		return nil, err
+	}
+	t.Override = path
+	return &t, nil
+}
+
+// DeleteTemplateOverride removes an override, restoring the built-in template
+func DeleteTemplateOverride(name string) error {
+	if !templateNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid template name: %s", name)
+	}
+	path := filepath.Join(TemplatesDir, name+".tmpl")
+	history.Snapshot(path)
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("template %s has no override", name)
+	}
+	return err
+}
+
+func builtinTemplate(name string) *VhostTemplate {
+	for i := range builtinTemplates {
+		if builtinTemplates[i].Name == name {
+			return &builtinTemplates[i]
+		}
+	}
+	return nil
+}
+
+// loadTemplate applies the override file of a built-in template, if any
+func loadTemplate(base VhostTemplate) VhostTemplate {
+	path := filepath.Join(TemplatesDir, base.Name+".tmpl")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return base
+	}
+	t, err := parseOverride(base, string(content))
+	if err == nil {
+		err = t.check()
+	}
+	if err != nil {
+		base.Override = path
+		base.Error = err.Error()
+		return base
+	}
+	t.Override = path
+	return t
+}
+
+// parseOverride reads an override file: an optional YAML header in a
+// template comment, then the template body
+func parseOverride(base VhostTemplate, content string) (VhostTemplate, error) {
+	t := base
+	t.Body = content
+	trimmed := strings.TrimLeft(content, " \t\r\n")
+	if strings.HasPrefix(trimmed, "{{/*") {
+		end := strings.Index(trimmed, "*/}}")
+		if end < 0 {
+			return t, fmt.Errorf("unterminated header comment")
+		}
+		var meta templateMeta
+		if err := yaml.Unmarshal([]byte(trimmed[4:end]), &meta); err != nil {
+			return t, fmt.Errorf("invalid header: %v", err)
+		}
+		if meta.Description != "" {
+			t.Description = meta.Description
+		}
+		if meta.SiteTypes != nil {
+			t.SiteTypes = meta.SiteTypes
+		}
+		if meta.Vars != nil {
+			t.Vars = meta.Vars
+		}
+		t.Body = strings.TrimLeft(trimmed[end+4:], "\r\n")
+	}
+
+	for _, v := range t.Vars {
+		if !directiveNameRegex.MatchString(v.Name) {
+			return t, fmt.Errorf("invalid variable name: %q", v.Name)
+		}
+		switch v.Type {
+		case "string", "int", "bool", "port", "domain", "path", "php_version":
+		default:
+			return t, fmt.Errorf("variable %s: unknown type %q", v.Name, v.Type)
+		}
+		if v.Pattern != "" {
+			if _, err := regexp.Compile(v.Pattern); err != nil {
+				return t, fmt.Errorf("variable %s: invalid pattern: %v", v.Name, err)
+			}
+		}
+	}
+	if _, err := t.compile(); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func (t *VhostTemplate) compile() (*template.Template, error) {
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Parse(templatePartials)
+	if err == nil {
+		tmpl, err = tmpl.Parse(t.Body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %v", t.Name, err)
+	}
+	return tmpl, nil
+}
+
+// check renders the template with sample values and parses the result
+func (t *VhostTemplate) check() error {
+	samples := map[string]string{}
+	for _, v := range t.Vars {
+		samples[v.Name] = v.sample()
+	}
+	out, err := t.Render(samples, TemplateContext{})
+	if err != nil {
+		return err
+	}
+	if _, err := Parse(t.Name, out); err != nil {
+		return fmt.Errorf("rendered config does not parse: %v", err)
+	}
+	return nil
+}
+
+// convert checks a value against the variable's type. Empty values become
+// the zero value of the type.
+func (v TemplateVar) convert(value string) (any, error) {
+	switch v.Type {
+	case "int", "port":
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || (v.Type == "port" && (n < 1 || n > 65535)) {
+			return nil, fmt.Errorf("invalid %s: %s", v.Type, value)
+		}
+		return n, nil
+	case "bool":
+		if value == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool: %s", value)
+		}
+		return b, nil
+	}
+
+	if value == "" {
+		return "", nil
+	}
+	switch v.Type {
+	case "domain":
+		if len(value) > 253 || !templateDomain.MatchString(value) {
+			return nil, fmt.Errorf("invalid domain: %s", value)
+		}
+	case "path":
+		if !strings.HasPrefix(value, "/") || strings.ContainsAny(value, " \t\r\n;{}\"'$#") || strings.Contains(value, "..") {
+			return nil, fmt.Errorf("invalid path: %s", value)
+		}
+	case "php_version":
+		if !templatePHP.MatchString(value) {
+			return nil, fmt.Errorf("invalid PHP version: %s", value)
+		}
+	default:
+		if strings.ContainsAny(value, "\r\n;{}") {
+			return nil, fmt.Errorf("must not contain line breaks, ; or braces")
+		}
+	}
+	if v.Pattern != "" && !regexp.MustCompile(v.Pattern).MatchString(value) {
+		return nil, fmt.Errorf("does not match %s", v.Pattern)
+	}
+	return value, nil
+}
+
+func (v TemplateVar) sample() string {
+	if v.Default != "" {
+		return v.Default
+	}
+	switch v.Type {
+	case "int":
+		return "1"
+	case "port":
+		return "8080"
+	case "bool":
+		return "false"
+	case "domain":
+		return "example.com"
+	case "path":
+		return "/home/example.com"
+	case "php_version":
+		return "8.3"
+	}
+	return "value"
+}
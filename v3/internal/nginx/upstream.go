@@ -0,0 +1,152 @@
+package nginx
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+)
+
+// Balancing methods of an upstream group
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceIPHash     = "ip_hash"
+)
+
+// Backend states. A draining backend is marked down: it gets no new
+// requests, while requests in flight finish on the workers of the previous
+// config. A disabled backend is left out of the group, except with ip_hash,
+// which needs every server listed to keep the other clients on their
+// backend.
+const (
+	BackendActive   = "active"
+	BackendDraining = "draining"
+	BackendDisabled = "disabled"
+)
+
+var (
+	upstreamNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+	backendHostRegex  = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+	backendUnixRegex  = regexp.MustCompile(`^unix:/[A-Za-z0-9._/-]+$`)
+)
+
+// UpstreamSnippet is the upstream group of a site. HTTP goes before the
+// server block, Name is what proxy_pass points at.
+type UpstreamSnippet struct {
+	HTTP string
+	Name string
+}
+
+// UpstreamName is the default upstream name of a site
+func UpstreamName(domain string) string {
+	return "panda_" + nonVarChars.ReplaceAllString(domain, "_")
+}
+
+// ValidateUpstream checks an upstream group and its backends
+func ValidateUpstream(g db.UpstreamGroup) error {
+	if !upstreamNameRegex.MatchString(g.Name) {
+		return fmt.Errorf("invalid upstream name: %q", g.Name)
+	}
+	switch g.Method {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceIPHash:
+	default:
+		return fmt.Errorf("unknown balancing method: %s", g.Method)
+	}
+
+	serving := 0
+	for _, b := range g.Backends {
+		if err := validateBackendAddress(b.Address); err != nil {
+			return err
+		}
+		if b.Weight < 0 || b.MaxFails < 0 || b.FailTimeout < 0 {
+			return fmt.Errorf("%s: weight, max_fails and fail_timeout must not be negative", b.Address)
+		}
+		switch b.State {
+		case "", BackendActive:
+			if !b.Backup {
+				serving++
+			}
+		case BackendDraining, BackendDisabled:
+		default:
+			return fmt.Errorf("%s: unknown state %s", b.Address, b.State)
+		}
+		if b.Backup && g.Method == BalanceIPHash {
+			return fmt.Errorf("ip_hash does not support backup servers")
+		}
+	}
+	if len(g.Backends) > 0 && serving == 0 {
+		return fmt.Errorf("at least one active backend that is not a backup is required")
+	}
+	return nil
+}
+
+func validateBackendAddress(address string) error {
+	if strings.HasPrefix(address, "unix:") {
+		if !backendUnixRegex.MatchString(address) {
+			return fmt.Errorf("invalid backend address: %q", address)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid backend address %q: use host:port", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid backend port: %q", address)
+	}
+	if net.ParseIP(host) == nil && !backendHostRegex.MatchString(host) {
+		return fmt.Errorf("invalid backend host: %q", address)
+	}
+	return nil
+}
+
+// RenderUpstream returns the upstream group of a website, empty when it has
+// none or no backends
+func RenderUpstream(domain string) (UpstreamSnippet, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return UpstreamSnippet{}, nil
+	}
+	var g db.UpstreamGroup
+	if db.DB.Preload("Backends").Where("website_id = ?", site.ID).First(&g).Error != nil || len(g.Backends) == 0 {
+		return UpstreamSnippet{}, nil
+	}
+	if err := ValidateUpstream(g); err != nil {
+		return UpstreamSnippet{}, err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Upstream group, managed by Panda Panel\nupstream %s {\n", g.Name)
+	if g.Method == BalanceLeastConn || g.Method == BalanceIPHash {
+		fmt.Fprintf(&sb, "    %s;\n", g.Method)
+	}
+	for _, b := range g.Backends {
+		if b.State == BackendDisabled && g.Method != BalanceIPHash {
+			fmt.Fprintf(&sb, "    # server %s; disabled\n", b.Address)
+			continue
+		}
+		fmt.Fprintf(&sb, "    server %s", b.Address)
+		if b.Weight > 1 {
+			fmt.Fprintf(&sb, " weight=%d", b.Weight)
+		}
+		if b.MaxFails > 0 {
+			fmt.Fprintf(&sb, " max_fails=%d", b.MaxFails)
+		}
+		if b.FailTimeout > 0 {
+			fmt.Fprintf(&sb, " fail_timeout=%ds", b.FailTimeout)
+		}
+		if b.Backup {
+			sb.WriteString(" backup")
+		}
+		if b.State == BackendDraining || b.State == BackendDisabled {
+			sb.WriteString(" down")
+		}
+		sb.WriteString(";\n")
+	}
+	sb.WriteString("}\n")
+	return UpstreamSnippet{HTTP: sb.String(), Name: g.Name}, nil
+}
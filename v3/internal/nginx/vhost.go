@@ -0,0 +1,493 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	phpSocketRegex     = regexp.MustCompile(`php(\d+(?:\.\d+)?)-fpm`)
+	directiveNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Listen is a parsed listen directive
+type Listen struct {
+	Address       string   `json:"address,omitempty"`
+	Port          int      `json:"port,omitempty"`
+	SSL           bool     `json:"ssl"`
+	HTTP2         bool     `json:"http2"`
+	DefaultServer bool     `json:"default_server"`
+	Args          []string `json:"args,omitempty"` // Remaining parameters
+}
+
+// SSLSettings are the TLS directives of a server block
+type SSLSettings struct {
+	Certificate         string   `json:"certificate"`
+	CertificateKey      string   `json:"certificate_key"`
+	Protocols           []string `json:"protocols,omitempty"`
+	Ciphers             string   `json:"ciphers,omitempty"`
+	PreferServerCiphers bool     `json:"prefer_server_ciphers"`
+	Stapling            bool     `json:"stapling"`
+	HSTS                string   `json:"hsts,omitempty"`
+}
+
+// Location is a location block with its most relevant directives
+type Location struct {
+	Path        string     `json:"path"` // Index path of the block
+	File        string     `json:"file"`
+	Line        int        `json:"line"`
+	ReadOnly    bool       `json:"read_only,omitempty"` // Not in the vhost file itself
+	Modifier    string     `json:"modifier,omitempty"`  // =, ~, ~*, ^~ or @ for named locations
+	Match       string     `json:"match"`
+	Root        string     `json:"root,omitempty"`
+	Alias       string     `json:"alias,omitempty"`
+	TryFiles    []string   `json:"try_files,omitempty"`
+	ProxyPass   string     `json:"proxy_pass,omitempty"`
+	FastCGIPass string     `json:"fastcgi_pass,omitempty"`
+	Return      []string   `json:"return,omitempty"`
+	Locations   []Location `json:"locations,omitempty"`
+}
+
+// ServerBlock is a parsed server block
+type ServerBlock struct {
+	Path        string       `json:"path"`
+	File        string       `json:"file"`
+	Line        int          `json:"line"`
+	ReadOnly    bool         `json:"read_only,omitempty"` // Not in the vhost file itself
+	ServerNames []string     `json:"server_names"`
+	Listens     []Listen     `json:"listens"`
+	Root        string       `json:"root,omitempty"`
+	Index       []string     `json:"index,omitempty"`
+	PHPVersion  string       `json:"php_version,omitempty"`
+	Return      []string     `json:"return,omitempty"`
+	SSL         *SSLSettings `json:"ssl,omitempty"`
+	Locations   []Location   `json:"locations"`
+}
+
+// UpstreamServer is a server line of an upstream block
+type UpstreamServer struct {
+	Address string   `json:"address"`
+	Params  []string `json:"params,omitempty"`
+}
+
+// Upstream is a parsed upstream block
+type Upstream struct {
+	Name     string           `json:"name"`
+	Path     string           `json:"path"`
+	File     string           `json:"file"`
+	Line     int              `json:"line"`
+	ReadOnly bool             `json:"read_only,omitempty"` // Not in the vhost file itself
+	Servers  []UpstreamServer `json:"servers"`
+}
+
+// VhostInfo describes a virtual host as it is written in its config. The
+// embedded summary is derived from the server blocks; Tree holds the parsed
+// file, whose directive paths are what EditVhost expects. Directives read
+// through includes are marked read-only.
+type VhostInfo struct {
+	VhostConfig
+	File        string        `json:"file"`
+	Enabled     bool          `json:"enabled"`
+	ServerNames []string      `json:"server_names"`
+	Servers     []ServerBlock `json:"servers"`
+	Upstreams   []Upstream    `json:"upstreams"`
+	Includes    []string      `json:"includes,omitempty"` // Files read through include directives
+	Tree        *Config       `json:"tree"`
+}
+
+// DirectiveEdit is a change to a single directive. Path is the index path of
+// the directive for set and delete, and of the parent block for add (empty
+// for the top level). Edits are applied in order, so paths refer to the tree
+// as left by the previous edits. Paths are always within the vhost file;
+// File, when set, must be that file, so a path taken from a read-only
+// directive of an included file is refused rather than applied to
+// whatever sits at the same path in the vhost.
+type DirectiveEdit struct {
+	Op    string   `json:"op"` // set, add or delete
+	File  string   `json:"file,omitempty"`
+	Path  string   `json:"path"`
+	Name  string   `json:"name"` // Required for add; for set and delete it guards against stale paths
+	Args  []string `json:"args"`
+	Block bool     `json:"block"`           // add: create a block directive
+	Index *int     `json:"index,omitempty"` // add: position in the parent, default the end
+}
+
+// vhostPath returns the sites-available file of a domain, preferring the
+// <domain>.conf name used by websites over the bare legacy name
+func vhostPath(domain string) (string, error) {
+	if domain == "" || strings.ContainsAny(domain, `/\`) || strings.HasPrefix(domain, ".") {
+		return "", fmt.Errorf("invalid domain: %s", domain)
+	}
+	for _, name := range []string{domain + ".conf", domain} {
+		path := filepath.Join(getSitesAvailable(), name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("virtual host not found: %s", domain)
+}
+
+// GetVhost parses the config of a virtual host
+func GetVhost(domain string) (*VhostInfo, error) {
+	path, err := vhostPath(domain)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &VhostInfo{
+		VhostConfig: VhostConfig{Domain: domain},
+		File:        path,
+		Servers:     []ServerBlock{},
+		Upstreams:   []Upstream{},
+		Tree:        tree,
+	}
+	if _, err := os.Stat(filepath.Join(getSitesEnabled(), filepath.Base(path))); err == nil {
+		info.Enabled = true
+	}
+	collectIncludes(tree, &info.Includes)
+	inspectVhost(info, tree)
+
+	// Legacy SSL vhosts live in a separate <domain>-ssl file
+	sslPath := filepath.Join(getSitesAvailable(), domain+"-ssl")
+	if _, err := os.Stat(filepath.Join(getSitesEnabled(), domain+"-ssl")); err == nil {
+		if sslTree, err := ParseFile(sslPath); err == nil {
+			sslTree.markReadOnly()
+			collectIncludes(sslTree, &info.Includes)
+			inspectVhost(info, sslTree)
+		}
+		info.SSLEnabled = true
+	}
+
+	summarizeVhost(info)
+	return info, nil
+}
+
+// ListVhosts returns a summary of every enabled virtual host
+func ListVhosts() ([]VhostConfig, error) {
+	files, err := os.ReadDir(getSitesAvailable())
+	if err != nil {
+		return []VhostConfig{}, nil
+	}
+
+	vhosts := []VhostConfig{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || name == "default" || strings.HasSuffix(name, "-ssl") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(getSitesEnabled(), name)); err != nil {
+			continue // Not enabled
+		}
+
+		domain := strings.TrimSuffix(name, ".conf")
+		info, err := GetVhost(domain)
+		if err != nil {
+			// Still list configs that do not parse, so they can be fixed
+			vhosts = append(vhosts, VhostConfig{Domain: domain})
+			continue
+		}
+		vhosts = append(vhosts, info.VhostConfig)
+	}
+	return vhosts, nil
+}
+
+// EditVhost applies directive edits to a vhost file. The file is only
+// written when something changed, through Apply.
+// Directives pulled in by includes (and those of a legacy -ssl file) are
+// shown by GetVhost as read-only and are not editable here.
+func EditVhost(domain string, edits []DirectiveEdit, author string) (*VhostInfo, error) {
+	path, err := vhostPath(domain)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, edit := range edits {
+		if edit.File != "" && edit.File != path {
+			return nil, fmt.Errorf("edit %d: %s is read-only here, only %s can be edited", i+1, edit.File, path)
+		}
+		if err := applyEdit(tree, edit); err != nil {
+			return nil, fmt.Errorf("edit %d: %v", i+1, err)
+		}
+	}
+	if !tree.Changed() {
+		return GetVhost(domain)
+	}
+
+	err = Apply(ConfigChange{
+		Files:  []FileChange{vhostChange(path, []byte(tree.String()))},
+		Probe:  []string{domain},
+		Author: author,
+		Note:   fmt.Sprintf("%d directive edits", len(edits)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetVhost(domain)
+}
+
+func applyEdit(tree *Config, edit DirectiveEdit) error {
+	if edit.Name != "" && !directiveNameRegex.MatchString(edit.Name) {
+		return fmt.Errorf("invalid directive name: %s", edit.Name)
+	}
+
+	switch edit.Op {
+	case "set", "delete":
+		d, _, _, err := tree.Lookup(edit.Path)
+		if err != nil {
+			return err
+		}
+		if edit.Name != "" && d.Name != edit.Name {
+			return fmt.Errorf("directive at %s is %s, not %s", edit.Path, d.Name, edit.Name)
+		}
+		if edit.Op == "delete" {
+			return tree.Remove(edit.Path)
+		}
+		d.Set(edit.Args...)
+		return nil
+	case "add":
+		if edit.Name == "" {
+			return fmt.Errorf("name is required")
+		}
+		var parent *Directive
+		if edit.Path != "" {
+			var err error
+			if parent, _, _, err = tree.Lookup(edit.Path); err != nil {
+				return err
+			}
+		}
+		d := &Directive{Name: edit.Name, Args: edit.Args}
+		if d.Args == nil {
+			d.Args = []string{}
+		}
+		if edit.Block {
+			d.Block = []*Directive{}
+		}
+		index := -1
+		if edit.Index != nil {
+			index = *edit.Index
+		}
+		return tree.Insert(parent, index, d)
+	default:
+		return fmt.Errorf("unknown op %q (use set, add or delete)", edit.Op)
+	}
+}
+
+// vhostChange is the change that rewrites a sites-available file, keeping
+// its sites-enabled entry if the site is enabled
+func vhostChange(path string, content []byte) FileChange {
+	change := FileChange{Path: path, Content: content}
+	link := filepath.Join(getSitesEnabled(), filepath.Base(path))
+	if _, err := os.Lstat(link); err == nil {
+		change.Link = link
+	}
+	return change
+}
+
+func collectIncludes(c *Config, files *[]string) {
+	c.Walk(func(d *Directive) bool {
+		for _, inc := range d.Includes {
+			*files = append(*files, inc.File)
+			collectIncludes(inc, files)
+		}
+		return true
+	})
+}
+
+// inspectVhost adds the server and upstream blocks of a parsed file
+func inspectVhost(info *VhostInfo, c *Config) {
+	for _, d := range c.All() {
+		if d.Block == nil {
+			continue
+		}
+		switch d.Name {
+		case "server":
+			info.Servers = append(info.Servers, inspectServer(d))
+		case "upstream":
+			up := Upstream{Name: d.Arg(0), Path: d.Path, File: d.File(), Line: d.Line, ReadOnly: d.ReadOnly, Servers: []UpstreamServer{}}
+			for _, s := range Find(d.Block, "server") {
+				up.Servers = append(up.Servers, UpstreamServer{Address: s.Arg(0), Params: s.Args[min(1, len(s.Args)):]})
+			}
+			info.Upstreams = append(info.Upstreams, up)
+		}
+	}
+}
+
+func inspectServer(d *Directive) ServerBlock {
+	s := ServerBlock{Path: d.Path, File: d.File(), Line: d.Line, ReadOnly: d.ReadOnly, ServerNames: []string{}, Listens: []Listen{}, Locations: []Location{}}
+	for _, c := range d.Children() {
+		switch c.Name {
+		case "server_name":
+			s.ServerNames = append(s.ServerNames, c.Args...)
+		case "listen":
+			s.Listens = append(s.Listens, parseListen(c.Args))
+		case "root":
+			s.Root = c.Arg(0)
+		case "index":
+			s.Index = c.Args
+		case "return":
+			s.Return = c.Args
+		case "location":
+			s.Locations = append(s.Locations, inspectLocation(c))
+		case "ssl_certificate", "ssl_certificate_key", "ssl_protocols", "ssl_ciphers", "ssl_prefer_server_ciphers", "ssl_stapling":
+			if s.SSL == nil {
+				s.SSL = &SSLSettings{}
+			}
+			switch c.Name {
+			case "ssl_certificate":
+				s.SSL.Certificate = c.Arg(0)
+			case "ssl_certificate_key":
+				s.SSL.CertificateKey = c.Arg(0)
+			case "ssl_protocols":
+				s.SSL.Protocols = c.Args
+			case "ssl_ciphers":
+				s.SSL.Ciphers = c.Arg(0)
+			case "ssl_prefer_server_ciphers":
+				s.SSL.PreferServerCiphers = c.Arg(0) == "on"
+			case "ssl_stapling":
+				s.SSL.Stapling = c.Arg(0) == "on"
+			}
+		}
+	}
+
+	for _, c := range d.Children() {
+		if c.Name == "add_header" && strings.EqualFold(c.Arg(0), "Strict-Transport-Security") && s.SSL != nil {
+			s.SSL.HSTS = c.Arg(1)
+		}
+	}
+	if s.SSL == nil {
+		for _, l := range s.Listens {
+			if l.SSL {
+				s.SSL = &SSLSettings{}
+				break
+			}
+		}
+	}
+
+	// The PHP version is that of the first FastCGI socket anywhere in the block
+	var find func(list []*Directive) bool
+	find = func(list []*Directive) bool {
+		for _, c := range expandIncludes(list) {
+			if c.Name == "fastcgi_pass" {
+				if m := phpSocketRegex.FindStringSubmatch(c.Arg(0)); len(m) > 1 {
+					s.PHPVersion = m[1]
+					return true
+				}
+			}
+			if c.Block != nil && find(c.Block) {
+				return true
+			}
+		}
+		return false
+	}
+	find(d.Block)
+	return s
+}
+
+func inspectLocation(d *Directive) Location {
+	loc := Location{Path: d.Path, File: d.File(), Line: d.Line, ReadOnly: d.ReadOnly, Match: d.Arg(0)}
+	switch {
+	case len(d.Args) > 1:
+		loc.Modifier, loc.Match = d.Arg(0), d.Arg(1)
+	case strings.HasPrefix(loc.Match, "@"):
+		loc.Modifier = "@"
+	}
+	for _, c := range d.Children() {
+		switch c.Name {
+		case "root":
+			loc.Root = c.Arg(0)
+		case "alias":
+			loc.Alias = c.Arg(0)
+		case "try_files":
+			loc.TryFiles = c.Args
+		case "proxy_pass":
+			loc.ProxyPass = c.Arg(0)
+		case "fastcgi_pass":
+			loc.FastCGIPass = c.Arg(0)
+		case "return":
+			loc.Return = c.Args
+		case "location":
+			loc.Locations = append(loc.Locations, inspectLocation(c))
+		}
+	}
+	return loc
+}
+
+// parseListen splits a listen directive into address, port and flags
+func parseListen(args []string) Listen {
+	var l Listen
+	if len(args) == 0 {
+		return l
+	}
+	addr := args[0]
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		l.Address = addr
+	case strings.LastIndex(addr, ":") > strings.LastIndex(addr, "]"):
+		i := strings.LastIndex(addr, ":")
+		l.Address = addr[:i]
+		l.Port, _ = strconv.Atoi(addr[i+1:])
+	default:
+		if port, err := strconv.Atoi(addr); err == nil {
+			l.Port = port
+		} else {
+			l.Address, l.Port = addr, 80
+		}
+	}
+	for _, a := range args[1:] {
+		switch a {
+		case "ssl":
+			l.SSL = true
+		case "http2":
+			l.HTTP2 = true
+		case "default_server", "default":
+			l.DefaultServer = true
+		default:
+			l.Args = append(l.Args, a)
+		}
+	}
+	return l
+}
+
+// summarizeVhost fills the VhostConfig summary from the server blocks
+func summarizeVhost(info *VhostInfo) {
+	seen := map[string]bool{}
+	info.ServerNames = []string{}
+	for _, s := range info.Servers {
+		for _, name := range s.ServerNames {
+			if !seen[name] {
+				seen[name] = true
+				info.ServerNames = append(info.ServerNames, name)
+			}
+		}
+		if info.Root == "" {
+			info.Root = s.Root
+		}
+		if info.PHPVersion == "" {
+			info.PHPVersion = s.PHPVersion
+		}
+		if s.SSL != nil {
+			info.SSLEnabled = true
+			if info.CertPath == "" && s.SSL.Certificate != "" {
+				info.CertPath = filepath.Dir(s.SSL.Certificate)
+			}
+		}
+		if info.Port == 0 && len(s.Listens) > 0 {
+			info.Port = s.Listens[0].Port
+		}
+	}
+	if info.Port == 0 {
+		info.Port = 80
+	}
+}
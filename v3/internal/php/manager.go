@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/acmavirus/panda-script/v3/internal/history"
 	"github.com/acmavirus/panda-script/v3/internal/system"
 )
 
@@ -257,7 +258,7 @@ func GetConfig(version string) (*PHPConfig, error) {
 }
 
 // UpdateConfig updates PHP configuration
-func UpdateConfig(version string, config PHPConfig) error {
+func UpdateConfig(version string, config PHPConfig, author string) error {
 	if err := checkLinux(); err != nil {
 		return err
 	}
@@ -267,6 +268,8 @@ func UpdateConfig(version string, config PHPConfig) error {
 		iniPath = "/etc/php.ini"
 	}
 
+	history.Snapshot(iniPath)
+
 	// Use sed to update values
 	updates := map[string]string{
 		"memory_limit":        config.MemoryLimit,
@@ -291,6 +294,8 @@ func UpdateConfig(version string, config PHPConfig) error {
 		system.Execute(fmt.Sprintf(`sed -i "s/^;*opcache.memory_consumption=.*/opcache.memory_consumption=%d/" %s`, config.OpcacheMemory, iniPath))
 	}
 
+	history.Record(iniPath, author, "")
+
 	// Restart PHP-FPM
 	system.Execute(fmt.Sprintf("systemctl restart php%s-fpm 2>/dev/null || systemctl restart php-fpm", version))
 
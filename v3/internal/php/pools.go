@@ -0,0 +1,153 @@
+package php
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ClockTicks is the kernel USER_HZ used for CPU times in /proc/<pid>/stat
+const ClockTicks = 100
+
+var (
+	fpmMasterRegex  = regexp.MustCompile(`/etc/php/(\d+\.\d+)/fpm/`)
+	poolHeaderRegex = regexp.MustCompile(`^\s*\[([^\]]+)\]`)
+	poolListenRegex = regexp.MustCompile(`^\s*listen\s*=\s*(\S+)`)
+)
+
+// PoolSample is the resource usage of one PHP-FPM pool at a point in time
+type PoolSample struct {
+	Version     string         `json:"version"`
+	Pool        string         `json:"pool"`
+	Processes   int            `json:"processes"`
+	MemoryBytes int64          `json:"memory_bytes"`
+	Ticks       map[int]uint64 `json:"-"` // CPU ticks (user+system) by PID
+}
+
+// SamplePools reads the CPU time and resident memory of every PHP-FPM
+// worker from /proc and groups them by version and pool
+func SamplePools() ([]PoolSample, error) {
+	if err := checkLinux(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := int64(os.Getpagesize())
+	masters := make(map[int]string)
+	pools := make(map[string]*PoolSample)
+	var order []string
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			continue
+		}
+		cmd := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		if !strings.HasPrefix(cmd, "php-fpm") || !strings.Contains(cmd, ": pool ") {
+			continue
+		}
+		pool := strings.TrimSpace(cmd[strings.Index(cmd, ": pool ")+7:])
+
+		ppid, ticks, ok := readProcStat(pid)
+		if !ok {
+			continue
+		}
+		version, ok := masters[ppid]
+		if !ok {
+			version = masterVersion(ppid)
+			masters[ppid] = version
+		}
+
+		key := version + "/" + pool
+		sample, ok := pools[key]
+		if !ok {
+			sample = &PoolSample{Version: version, Pool: pool, Ticks: make(map[int]uint64)}
+			pools[key] = sample
+			order = append(order, key)
+		}
+		sample.Processes++
+		sample.Ticks[pid] = ticks
+		if statm, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid)); err == nil {
+			if fields := strings.Fields(string(statm)); len(fields) > 1 {
+				rss, _ := strconv.ParseInt(fields[1], 10, 64)
+				sample.MemoryBytes += rss * pageSize
+			}
+		}
+	}
+
+	samples := make([]PoolSample, 0, len(order))
+	for _, key := range order {
+		samples = append(samples, *pools[key])
+	}
+	return samples, nil
+}
+
+// readProcStat returns the parent PID and utime+stime of a process
+func readProcStat(pid int) (int, uint64, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	// The command name may contain spaces; fields start after the last ')'
+	s := string(data)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 13 {
+		return 0, 0, false
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	return ppid, utime + stime, true
+}
+
+// masterVersion reads the PHP version from an FPM master's config path
+func masterVersion(pid int) string {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	if m := fpmMasterRegex.FindStringSubmatch(string(cmdline)); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+// PoolForSocket returns the name of the pool of a PHP version that
+// listens on the given socket, or "" if none does
+func PoolForSocket(version, socket string) string {
+	files, _ := filepath.Glob(fmt.Sprintf("/etc/php/%s/fpm/pool.d/*.conf", version))
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		pool := ""
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if m := poolHeaderRegex.FindStringSubmatch(line); len(m) > 1 {
+				pool = m[1]
+			} else if m := poolListenRegex.FindStringSubmatch(line); len(m) > 1 && pool != "" {
+				// /run and /var/run are the same directory
+				if filepath.Base(m[1]) == filepath.Base(socket) {
+					f.Close()
+					return pool
+				}
+			}
+		}
+		f.Close()
+	}
+	return ""
+}
@@ -65,8 +65,10 @@ func InstallCertbot() error {
 	return fmt.Errorf("unable to install certbot: unsupported package manager")
 }
 
-// ObtainCertificate obtains a new SSL certificate from Let's Encrypt
-func ObtainCertificate(domain, email string) error {
+// ObtainCertificate obtains a new SSL certificate from Let's Encrypt.
+// plugin is the certbot flag of the web server plugin that answers the
+// challenge and installs the certificate, e.g. --nginx.
+func ObtainCertificate(domain, email, plugin string) error {
 	if err := checkLinux(); err != nil {
 		return err
 	}
@@ -79,8 +81,8 @@ func ObtainCertificate(domain, email string) error {
 		email = "admin@" + domain
 	}
 
-	cmd := fmt.Sprintf("certbot --nginx -d %s -d www.%s --non-interactive --agree-tos --email %s --redirect",
-		domain, domain, email)
+	cmd := fmt.Sprintf("certbot %s -d %s -d www.%s --non-interactive --agree-tos --email %s --redirect",
+		plugin, domain, domain, email)
 
 	if _, err := system.Execute(cmd); err != nil {
 		return fmt.Errorf("failed to obtain certificate: %v", err)
@@ -245,6 +247,20 @@ func RevokeCertificate(domain string) error {
 	return nil
 }
 
+// DeleteCertificate deletes a certificate without revoking it
+func DeleteCertificate(domain string) error {
+	if err := checkLinux(); err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("certbot delete --cert-name %s --non-interactive", domain)
+	if _, err := system.Execute(cmd); err != nil {
+		return fmt.Errorf("failed to delete certificate: %v", err)
+	}
+
+	return nil
+}
+
 // SetupAutoRenew configures automatic certificate renewal
 func SetupAutoRenew() error {
 	if err := checkLinux(); err != nil {
@@ -24,6 +24,8 @@ type Task struct {
 	Output    string     `json:"output"`
 	Progress  int        `json:"progress"`
 	CreatedAt time.Time  `json:"created_at"`
+
+	done chan struct{}
 }
 
 var (
@@ -76,3 +78,53 @@ func RunTask(id string) {
 	}
 	mu.Unlock()
 }
+
+// StartFunc creates a task and runs fn in the background. fn reports
+// its progress through Logf and SetProgress; a returned error fails the task.
+func StartFunc(name string, fn func(t *Task) error) *Task {
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	t := CreateTask(id, name)
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+		mu.Lock()
+		t.Status = Running
+		mu.Unlock()
+
+		err := fn(t)
+
+		mu.Lock()
+		if err != nil {
+			t.Status = Failed
+			t.Output += fmt.Sprintf("Error: %v\n", err)
+		} else {
+			t.Status = Completed
+			t.Progress = 100
+		}
+		mu.Unlock()
+	}()
+
+	return t
+}
+
+// Wait blocks until a task started with StartFunc has finished
+func (t *Task) Wait() {
+	if t.done != nil {
+		<-t.done
+	}
+}
+
+// Logf appends a line to the task output
+func (t *Task) Logf(format string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	t.Output += fmt.Sprintf(format, args...) + "\n"
+}
+
+// SetProgress updates the task progress percentage
+func (t *Task) SetProgress(progress int) {
+	mu.Lock()
+	defer mu.Unlock()
+	t.Progress = progress
+}
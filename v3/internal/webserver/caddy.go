@@ -0,0 +1,654 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+// CaddyDir holds the panel's Caddy config: a JSON file per site, the panel
+// route and the full config assembled from them. Tests point it elsewhere.
+var CaddyDir = "/etc/caddy/panda"
+
+const (
+	// CaddyAdmin is the admin API the assembled config is loaded through,
+	// at Caddy's default address
+	CaddyAdmin = "http://localhost:2019"
+
+	caddyLogDir  = "/var/log/caddy"
+	caddyDataDir = "/var/lib/caddy/.local/share/caddy" // Certificates of the caddy service user
+	caddyService = "/etc/systemd/system/caddy.service.d/panda.conf"
+
+	// acmeEmailKey stores the ACME account email Caddy registers with
+	acmeEmailKey = "acme_email"
+	adminTimeout = 30 * time.Second
+)
+
+var caddyLoggerChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// caddyMu serializes config changes, so a load never sees another change
+// half written
+var caddyMu sync.Mutex
+
+func init() {
+	register(caddyServer{})
+}
+
+// caddyServer serves sites with Caddy. Each site is a route stored as JSON;
+// every change assembles the full config and loads it through the admin
+// API, which only swaps it in once it is valid. Caddy obtains and renews
+// certificates by itself (automatic HTTPS), so certbot is not used.
+//
+// The nginx-only features (basic auth, page cache, upstream groups, rate
+// limits, country rules, error pages and maintenance mode) are refused
+// rather than silently dropped. HTTP/2, HTTP/3 and OCSP stapling are on for
+// every site; TLS profiles only set the minimum protocol.
+type caddyServer struct{}
+
+// caddySite is the stored config of a site
+type caddySite struct {
+	Hosts         []string         `json:"hosts"`
+	HTTPSRedirect bool             `json:"https_redirect"`
+	ProtocolMin   string           `json:"protocol_min,omitempty"`
+	AccessLog     string           `json:"access_log,omitempty"`
+	Routes        []map[string]any `json:"routes"`
+}
+
+func (caddyServer) Name() string { return Caddy }
+
+func (caddyServer) Installed() bool {
+	_, err := exec.LookPath("caddy")
+	return err == nil
+}
+
+func (c caddyServer) Render(site Site) (string, error) {
+	if site.Port != 0 && site.Port != 80 && site.Port != 443 {
+		return "", fmt.Errorf("caddy serves sites on ports 80 and 443 only, not %d", site.Port)
+	}
+	if missing := caddyUnsupported(site.Domain); len(missing) > 0 {
+		return "", fmt.Errorf("%s of %s require nginx", strings.Join(missing, ", "), site.Domain)
+	}
+	if err := nginx.ValidateSecurityConfig(site.Security); err != nil {
+		return "", err
+	}
+
+	var record db.Website
+	found := db.DB.Where("domain = ?", site.Domain).First(&record).Error == nil
+	noIndex := found && record.StagingOf != 0
+
+	var routes []map[string]any
+	if headers := caddyHeaders(site.Security, noIndex); headers != nil {
+		routes = append(routes, map[string]any{"handle": []any{headers}})
+	}
+	if noIndex {
+		routes = append(routes, map[string]any{
+			"match": []any{map[string]any{"path": []string{"/robots.txt"}}},
+			"handle": []any{map[string]any{
+				"handler": "static_response",
+				"headers": map[string][]string{"Content-Type": {"text/plain"}},
+				"body":    "User-agent: *\nDisallow: /\n",
+			}},
+			"terminal": true,
+		})
+	}
+
+	switch name := nginx.TemplateForSiteType(site.Type); name {
+	case "static":
+		routes = append(routes,
+			map[string]any{"handle": []any{map[string]any{"handler": "vars", "root": site.Root}}},
+			map[string]any{"handle": []any{map[string]any{"handler": "file_server", "hide": []string{".*"}}}},
+		)
+	case "php", "laravel":
+		root := site.Root
+		if name == "laravel" {
+			root = filepath.Join(root, "public")
+		}
+		routes = append(routes, phpRoutes(root, site.PHPVersion)...)
+	case "proxy":
+		if site.BackendPort <= 0 {
+			return "", fmt.Errorf("BackendPort is required")
+		}
+		routes = append(routes, map[string]any{"handle": []any{map[string]any{
+			"handler":   "reverse_proxy",
+			"upstreams": []any{map[string]any{"dial": "127.0.0.1:" + strconv.Itoa(site.BackendPort)}},
+			"headers": map[string]any{"request": map[string]any{
+				"set": map[string][]string{"X-Real-Ip": {"{http.request.remote.host}"}},
+			}},
+		}}})
+	default:
+		return "", fmt.Errorf("caddy has no config for template %s", name)
+	}
+
+	config := caddySite{
+		Hosts:         append([]string{site.Domain, "www." + site.Domain}, nginx.ServerAliases(record)...),
+		HTTPSRedirect: site.Security.HTTPSRedirect,
+		AccessLog:     c.AccessLog(site.Domain),
+		Routes:        routes,
+	}
+	if site.Security.TLSProfile == nginx.TLSModern {
+		config.ProtocolMin = "tls1.3"
+	}
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+// phpRoutes is what the php_fastcgi directive of a Caddyfile expands to:
+// directories get a trailing slash, requests for missing files go to
+// index.php, PHP files to PHP-FPM and the rest to the file server
+func phpRoutes(root, phpVersion string) []map[string]any {
+	socket := "php-fpm.sock"
+	if phpVersion != "" {
+		socket = "php" + phpVersion + "-fpm.sock"
+	}
+	return []map[string]any{
+		{"handle": []any{map[string]any{"handler": "vars", "root": root}}},
+		{
+			"match": []any{map[string]any{
+				"file": map[string]any{"try_files": []string{"{http.request.uri.path}/index.php"}},
+				"not":  []any{map[string]any{"path": []string{"*/"}}},
+			}},
+			"handle": []any{map[string]any{
+				"handler":     "static_response",
+				"headers":     map[string][]string{"Location": {"{http.request.orig_uri.path}/{http.request.orig_uri.prefixed_query}"}},
+				"status_code": 308,
+			}},
+		},
+		{
+			"match": []any{map[string]any{"file": map[string]any{
+				"try_files":  []string{"{http.request.uri.path}", "{http.request.uri.path}/index.php", "index.php"},
+				"split_path": []string{".php"},
+			}}},
+			"handle": []any{map[string]any{"handler": "rewrite", "uri": "{http.matchers.file.relative}"}},
+		},
+		{
+			"match": []any{map[string]any{"path": []string{"*.php"}}},
+			"handle": []any{map[string]any{
+				"handler":   "reverse_proxy",
+				"transport": map[string]any{"protocol": "fastcgi", "split_path": []string{".php"}},
+				"upstreams": []any{map[string]any{"dial": "unix//var/run/php/" + socket}},
+			}},
+		},
+		{"handle": []any{map[string]any{"handler": "file_server", "hide": []string{".ht*"}}}},
+	}
+}
+
+// caddyHeaders returns the headers handler of a security config, or nil if
+// it sets none. Every site is served over HTTPS, so HSTS always applies.
+func caddyHeaders(c db.SecurityConfig, noIndex bool) map[string]any {
+	set := map[string][]string{}
+	if c.HSTS {
+		value := "max-age=" + strconv.Itoa(c.HSTSMaxAge)
+		if c.HSTSSubdomains {
+			value += "; includeSubDomains"
+		}
+		if c.HSTSPreload {
+			value += "; preload"
+		}
+		set["Strict-Transport-Security"] = []string{value}
+	}
+	if c.CSP != "" {
+		name := "Content-Security-Policy"
+		if c.CSPReportOnly {
+			name += "-Report-Only"
+		}
+		set[name] = []string{c.CSP}
+	}
+	if c.ReferrerPolicy != "" {
+		set["Referrer-Policy"] = []string{c.ReferrerPolicy}
+	}
+	if c.PermissionsPolicy != "" {
+		set["Permissions-Policy"] = []string{c.PermissionsPolicy}
+	}
+	if c.FrameOptions != "" {
+		set["X-Frame-Options"] = []string{c.FrameOptions}
+	}
+	if c.NoSniff {
+		set["X-Content-Type-Options"] = []string{"nosniff"}
+	}
+	if noIndex {
+		set["X-Robots-Tag"] = []string{"noindex, nofollow"}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	// Deferred, so headers set by a proxied application are replaced
+	return map[string]any{"handler": "headers", "response": map[string]any{"set": set, "deferred": true}}
+}
+
+// caddyUnsupported returns the nginx-only features a website uses
+func caddyUnsupported(domain string) []string {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil
+	}
+	var missing []string
+	var count int64
+	if db.DB.Model(&db.AuthRule{}).Where("website_id = ? AND enabled = ?", site.ID, true).Count(&count); count > 0 {
+		missing = append(missing, "basic auth")
+	}
+	if db.DB.Model(&db.CacheConfig{}).Where("website_id = ? AND enabled = ?", site.ID, true).Count(&count); count > 0 {
+		missing = append(missing, "page cache")
+	}
+	if db.DB.Model(&db.UpstreamGroup{}).Where("website_id = ?", site.ID).Count(&count); count > 0 {
+		missing = append(missing, "upstream group")
+	}
+	if db.DB.Model(&db.RateLimitConfig{}).Where("website_id = ? AND enabled = ?", site.ID, true).Count(&count); count > 0 {
+		missing = append(missing, "rate limits")
+	}
+	var rule db.GeoRule
+	if db.DB.Where("website_id = ?", site.ID).First(&rule).Error == nil {
+		if rule.Enabled {
+			missing = append(missing, "country rule")
+		}
+	} else if panel, ok := nginx.PanelGeoRule(); ok && panel.Enabled {
+		missing = append(missing, "panel-wide country rule")
+	}
+	if db.DB.Model(&db.ErrorPage{}).Where("website_id = ? AND kind <> ?", site.ID, nginx.PageMaintenance).Count(&count); count > 0 {
+		missing = append(missing, "error pages")
+	}
+	if site.Maintenance {
+		missing = append(missing, "maintenance mode")
+	}
+	return missing
+}
+
+func (c caddyServer) Apply(site Site) error {
+	content, err := c.Render(site)
+	if err != nil {
+		return err
+	}
+	return c.change(c.ConfigPath(site.Domain), []byte(content))
+}
+
+func (c caddyServer) Remove(domain string) error {
+	path := c.ConfigPath(domain)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	if CurrentName() != Caddy {
+		return os.Remove(path)
+	}
+	return c.change(path, nil)
+}
+
+// change writes (or, for nil content, removes) a stored config and loads
+// the result. The previous file is put back if Caddy refuses the config.
+func (c caddyServer) change(path string, content []byte) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("caddy requires Linux")
+	}
+	caddyMu.Lock()
+	defer caddyMu.Unlock()
+
+	previous, readErr := os.ReadFile(path)
+	if content == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := c.load(false); err != nil {
+		if readErr == nil {
+			os.WriteFile(path, previous, 0644)
+		} else {
+			os.Remove(path)
+		}
+		return fmt.Errorf("%v; the previous config was restored", err)
+	}
+	return nil
+}
+
+func (caddyServer) ConfigPath(domain string) string {
+	return filepath.Join(CaddyDir, "sites", domain+".json")
+}
+
+func (caddyServer) panelPath() string {
+	return filepath.Join(CaddyDir, "panel.json")
+}
+
+func (caddyServer) configPath() string {
+	return filepath.Join(CaddyDir, "caddy.json")
+}
+
+// Sites returns the domains that have a stored config
+func (c caddyServer) Sites() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(CaddyDir, "sites", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var sites []string
+	for _, f := range files {
+		sites = append(sites, strings.TrimSuffix(filepath.Base(f), ".json"))
+	}
+	return sites, nil
+}
+
+// assemble builds the full Caddy config from the stored site configs. All
+// sites are served by one HTTPS server; sites without an HTTPS redirect
+// are also routed on port 80, ahead of the redirects Caddy adds there.
+func (c caddyServer) assemble() ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(CaddyDir, "sites", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(c.panelPath()); err == nil {
+		files = append(files, c.panelPath())
+	}
+
+	https := map[string]any{"listen": []string{":443"}}
+	plain := map[string]any{"listen": []string{":80"}}
+	var httpsRoutes, plainRoutes, policies []any
+	loggerNames := map[string]string{}
+	logs := map[string]any{}
+	var excluded []string
+
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var site caddySite
+		if err := json.Unmarshal(raw, &site); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %v", f, err)
+		}
+		if len(site.Hosts) == 0 {
+			continue
+		}
+		route := map[string]any{
+			"match":    []any{map[string]any{"host": site.Hosts}},
+			"handle":   []any{map[string]any{"handler": "subroute", "routes": site.Routes}},
+			"terminal": true,
+		}
+		httpsRoutes = append(httpsRoutes, route)
+		if !site.HTTPSRedirect {
+			plainRoutes = append(plainRoutes, route)
+		}
+		if site.ProtocolMin != "" {
+			policies = append(policies, map[string]any{
+				"match":        map[string]any{"sni": site.Hosts},
+				"protocol_min": site.ProtocolMin,
+			})
+		}
+		if site.AccessLog != "" {
+			logger := "panda_" + caddyLoggerChars.ReplaceAllString(site.Hosts[0], "_")
+			for _, h := range site.Hosts {
+				loggerNames[h] = logger
+			}
+			logs[logger] = map[string]any{
+				"writer":  map[string]any{"output": "file", "filename": site.AccessLog},
+				"encoder": map[string]any{"format": "json"},
+				"include": []string{"http.log.access." + logger},
+			}
+			excluded = append(excluded, "http.log.access."+logger)
+		}
+	}
+
+	https["routes"] = httpsRoutes
+	if len(policies) > 0 {
+		// The catch-all keeps the defaults for every other host
+		https["tls_connection_policies"] = append(policies, map[string]any{})
+	}
+	if len(loggerNames) > 0 {
+		https["logs"] = map[string]any{"logger_names": loggerNames}
+		plain["logs"] = map[string]any{"logger_names": loggerNames}
+	}
+	servers := map[string]any{"panda": https}
+	if len(plainRoutes) > 0 {
+		plain["routes"] = plainRoutes
+		servers["panda_http"] = plain
+	}
+
+	defaultLog := map[string]any{"writer": map[string]any{"output": "file", "filename": filepath.Join(caddyLogDir, "caddy.log")}}
+	if len(excluded) > 0 {
+		defaultLog["exclude"] = excluded
+	}
+	logs["default"] = defaultLog
+
+	apps := map[string]any{"http": map[string]any{"servers": servers}}
+	var email db.Setting
+	if db.DB.Where("key = ?", acmeEmailKey).First(&email).Error == nil && email.Value != "" {
+		apps["tls"] = map[string]any{"automation": map[string]any{"policies": []any{map[string]any{
+			"issuers": []any{map[string]any{"module": "acme", "email": email.Value}},
+		}}}}
+	}
+
+	// The admin API keeps its default address; loading an admin block would
+	// restart it and cut the load request
+	config := map[string]any{
+		"logging": map[string]any{"logs": logs},
+		"apps":    apps,
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// load assembles the config and loads it through the admin API. Caddy
+// keeps running the old config if the new one fails to load. The loaded
+// config is saved for the service to start with. force reloads even an
+// unchanged config.
+func (c caddyServer) load(force bool) error {
+	config, err := c.assemble()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(caddyLogDir, 0755); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, CaddyAdmin+"/load", bytes.NewReader(config))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// A load may restart the admin endpoint, which drops kept-alive
+	// connections to it
+	req.Close = true
+	if force {
+		req.Header.Set("Cache-Control", "must-revalidate")
+	}
+	resp, err := (&http.Client{Timeout: adminTimeout}).Do(req)
+	if err != nil {
+		return fmt.Errorf("caddy admin API unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("caddy refused the config: %s", strings.TrimSpace(string(body)))
+	}
+	return os.WriteFile(c.configPath(), config, 0644)
+}
+
+// Test validates the assembled config with caddy validate
+func (c caddyServer) Test() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	config, err := c.assemble()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "panda-caddy-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(config); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	out, err := system.Execute("caddy validate --config " + f.Name() + " 2>&1")
+	if err != nil {
+		return fmt.Errorf("caddy config test failed: %s", out)
+	}
+	return nil
+}
+
+func (c caddyServer) Reload() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	caddyMu.Lock()
+	defer caddyMu.Unlock()
+	return c.load(true)
+}
+
+func (caddyServer) Status() (string, error) {
+	if runtime.GOOS == "windows" {
+		return "mock", nil
+	}
+	out, _ := system.Execute("systemctl is-active caddy")
+	return strings.TrimSpace(out), nil
+}
+
+// Start points the caddy service at the assembled config, starts it and
+// loads the current site configs
+func (c caddyServer) Start() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	caddyMu.Lock()
+	defer caddyMu.Unlock()
+
+	binary, err := exec.LookPath("caddy")
+	if err != nil {
+		return fmt.Errorf("caddy is not installed")
+	}
+	if err := os.MkdirAll(CaddyDir, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(c.configPath()); err != nil {
+		config, err := c.assemble()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(c.configPath(), config, 0644); err != nil {
+			return err
+		}
+	}
+
+	unit := fmt.Sprintf("# Managed by Panda Panel\n[Service]\nExecStart=\nExecStart=%s run --environ --config %s\nExecReload=\nExecReload=%s reload --config %s --force\n",
+		binary, c.configPath(), binary, c.configPath())
+	if err := os.MkdirAll(filepath.Dir(caddyService), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(caddyService, []byte(unit), 0644); err != nil {
+		return err
+	}
+	if out, err := system.Execute("systemctl daemon-reload && systemctl enable caddy && systemctl restart caddy"); err != nil {
+		return fmt.Errorf("failed to start caddy: %s - %v", out, err)
+	}
+
+	// The admin API takes a moment to come up
+	for i := 0; ; i++ {
+		err := c.load(false)
+		if err == nil || i == 10 {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (caddyServer) Stop() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	_, err := system.Execute("systemctl stop caddy")
+	return err
+}
+
+// AccessLog is the site's access log, one JSON object per request
+func (caddyServer) AccessLog(domain string) string {
+	return filepath.Join(caddyLogDir, domain+".access.log")
+}
+
+// ErrorLog is the log of the caddy service, which is shared by all sites
+func (caddyServer) ErrorLog(domain string) string {
+	return filepath.Join(caddyLogDir, "caddy.log")
+}
+
+// ObtainCertificate stores the ACME email, if given, and reloads. Caddy
+// obtains the certificate of every served host by itself, in the
+// background, and redirects to HTTPS unless the site turned that off.
+func (c caddyServer) ObtainCertificate(domain, email string) error {
+	if _, err := os.Stat(c.ConfigPath(domain)); err != nil {
+		return fmt.Errorf("%s is not served by caddy", domain)
+	}
+	if email == "" {
+		return nil
+	}
+	if err := setACMEEmail(email); err != nil {
+		return err
+	}
+	return c.Reload()
+}
+
+// CertificatePath finds the certificate Caddy obtained for a domain, from
+// any issuer
+func (caddyServer) CertificatePath(domain string) string {
+	matches, _ := filepath.Glob(filepath.Join(caddyDataDir, "certificates", "*", domain, domain+".crt"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// ServePanel routes the panel UI and API on a domain to the panel, over
+// HTTPS with a certificate Caddy obtains
+func (c caddyServer) ServePanel(domain, email string) error {
+	if email != "" {
+		if err := setACMEEmail(email); err != nil {
+			return err
+		}
+	}
+	config := caddySite{
+		Hosts:         []string{domain},
+		HTTPSRedirect: true,
+		Routes: []map[string]any{{
+			"match": []any{map[string]any{"path": []string{"/panda*", "/api*"}}},
+			"handle": []any{map[string]any{
+				"handler":   "reverse_proxy",
+				"upstreams": []any{map[string]any{"dial": "127.0.0.1:" + strconv.Itoa(PanelPort)}},
+			}},
+		}},
+	}
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.change(c.panelPath(), append(content, '\n'))
+}
+
+func setACMEEmail(email string) error {
+	var setting db.Setting
+	db.DB.Where("key = ?", acmeEmailKey).First(&setting)
+	setting.Key = acmeEmailKey
+	setting.Value = email
+	return db.DB.Save(&setting).Error
+}
@@ -0,0 +1,220 @@
+package webserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/ssl"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+// nginxLogDir holds the access and error log of each site
+const nginxLogDir = "/var/log/nginx"
+
+// nginxPanelConfig is the vhost ServePanel writes, outside the website configs
+const nginxPanelConfig = "panda-panel"
+
+func init() {
+	register(nginxServer{})
+}
+
+// nginxServer renders sites with the vhost templates of the nginx package
+// and applies them through its transactional Apply
+type nginxServer struct{}
+
+func (nginxServer) Name() string { return Nginx }
+
+func (nginxServer) Installed() bool {
+	_, err := exec.LookPath("nginx")
+	return err == nil
+}
+
+// Render renders a site's vhost. The files it refers to, e.g. htpasswd
+// files and error pages, are only written by Apply.
+func (n nginxServer) Render(site Site) (string, error) {
+	content, _, err := n.render(site)
+	return content, err
+}
+
+// render returns a site's vhost and the files it refers to
+func (n nginxServer) render(site Site) (string, []nginx.FileChange, error) {
+	certDir := ""
+	if path := n.CertificatePath(site.Domain); path != "" {
+		certDir = filepath.Dir(path)
+	}
+	ctx, err := nginx.SiteContext(site.Domain, site.Type, site.Security, certDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	vars := map[string]string{
+		"Domain":     site.Domain,
+		"Root":       site.Root,
+		"PHPVersion": site.PHPVersion,
+	}
+	if site.Port > 0 {
+		vars["Port"] = strconv.Itoa(site.Port)
+	}
+	if site.BackendPort > 0 {
+		vars["BackendPort"] = strconv.Itoa(site.BackendPort)
+	}
+	content, err := nginx.RenderTemplate(nginx.TemplateForSiteType(site.Type), vars, ctx)
+	return content, ctx.Files, err
+}
+
+func (n nginxServer) Apply(site Site) error {
+	content, files, err := n.render(site)
+	if err != nil {
+		return err
+	}
+	return nginx.Apply(nginx.ConfigChange{
+		Files: append([]nginx.FileChange{{
+			Path:    n.ConfigPath(site.Domain),
+			Content: []byte(content),
+			Link:    filepath.Join(nginx.SitesEnabled, site.Domain+".conf"),
+		}}, files...),
+		Probe: []string{site.Domain},
+	})
+}
+
+// Remove deletes a site's config, including the bare-domain files of older
+// versions, and reloads nginx
+func (nginxServer) Remove(domain string) error {
+	for _, name := range []string{domain + ".conf", domain} {
+		os.Remove(filepath.Join(nginx.SitesEnabled, name))
+		os.Remove(filepath.Join(nginx.SitesAvailable, name))
+	}
+	if CurrentName() != Nginx {
+		return nil
+	}
+	return nginx.Reload()
+}
+
+func (nginxServer) ConfigPath(domain string) string {
+	return filepath.Join(nginx.SitesAvailable, domain+".conf")
+}
+
+// Sites returns the sites-enabled entries, e.g. example.com.conf. Panel
+// configs and rename redirects are among them.
+func (nginxServer) Sites() ([]string, error) {
+	dir := nginx.SitesEnabled
+	if runtime.GOOS == "windows" {
+		dir = "nginx/sites-enabled"
+		os.MkdirAll(dir, 0755)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sites []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			sites = append(sites, e.Name())
+		}
+	}
+	return sites, nil
+}
+
+func (nginxServer) Test() error             { return nginx.TestConfig() }
+func (nginxServer) Reload() error           { return nginx.Reload() }
+func (nginxServer) Status() (string, error) { return nginx.GetStatus() }
+func (nginxServer) Start() error            { return nginx.Start() }
+func (nginxServer) Stop() error             { return nginx.Stop() }
+
+func (nginxServer) AccessLog(domain string) string {
+	return filepath.Join(nginxLogDir, domain+".access.log")
+}
+
+func (nginxServer) ErrorLog(domain string) string {
+	return filepath.Join(nginxLogDir, domain+".error.log")
+}
+
+// ObtainCertificate runs certbot with its nginx plugin, which answers the
+// challenge through the site's vhost
+func (nginxServer) ObtainCertificate(domain, email string) error {
+	return ssl.ObtainCertificate(domain, email, "--nginx")
+}
+
+func (nginxServer) CertificatePath(domain string) string {
+	path := filepath.Join(ssl.CertbotLivePath, domain, "fullchain.pem")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// ServePanel gets a certificate for the panel domain and writes a vhost
+// that proxies the panel UI and API to it
+func (nginxServer) ServePanel(domain, email string) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("panel SSL requires Linux")
+	}
+
+	certCmd := "certbot certonly --nginx -d " + domain + " --non-interactive --agree-tos"
+	if email != "" {
+		certCmd += " --email " + email
+	} else {
+		certCmd += " --register-unsafely-without-email"
+	}
+	if out, err := system.Execute(certCmd); err != nil {
+		return fmt.Errorf("certbot failed: %s - %v", out, err)
+	}
+
+	certDir := filepath.Join(ssl.CertbotLivePath, domain)
+	backend := "http://127.0.0.1:" + strconv.Itoa(PanelPort)
+	conf := `server {
+    listen 80;
+    server_name ` + domain + `;
+    return 301 https://$server_name$request_uri;
+}
+
+server {
+    listen 443 ssl http2;
+    server_name ` + domain + `;
+
+    ssl_certificate ` + certDir + `/fullchain.pem;
+    ssl_certificate_key ` + certDir + `/privkey.pem;
+
+    ssl_session_timeout 1d;
+    ssl_session_cache shared:SSL:50m;
+    ssl_protocols TLSv1.2 TLSv1.3;
+    ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256;
+    ssl_prefer_server_ciphers off;
+
+    add_header Strict-Transport-Security "max-age=63072000" always;
+
+    location /panda {
+        proxy_pass ` + backend + `;
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection "upgrade";
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+    }
+
+    location /api {
+        proxy_pass ` + backend + `;
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection "upgrade";
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+    }
+}
+`
+	return nginx.Apply(nginx.ConfigChange{
+		Files: []nginx.FileChange{{
+			Path:    filepath.Join(nginx.SitesAvailable, nginxPanelConfig),
+			Content: []byte(conf),
+			Link:    filepath.Join(nginx.SitesEnabled, nginxPanelConfig),
+		}},
+		Note: "panel SSL",
+	})
+}
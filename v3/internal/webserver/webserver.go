@@ -0,0 +1,166 @@
+package webserver
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+)
+
+// settingKey stores the name of the web server the panel serves sites with
+const settingKey = "web_server"
+
+// Driver names. OpenLiteSpeed has no driver yet.
+const (
+	Nginx = "nginx"
+	Caddy = "caddy"
+)
+
+// Default is the web server of installs that never chose one
+const Default = Nginx
+
+// PanelPort is where the panel listens; ServePanel proxies to it
+const PanelPort = 8080
+
+// Site is what a web server needs to serve a website
+type Site struct {
+	Domain      string
+	Type        string // Website type, e.g. php, laravel, static, nodejs
+	Root        string
+	PHPVersion  string
+	Port        int
+	BackendPort int
+	Security    db.SecurityConfig
+}
+
+// WebServer serves the panel's websites. Implementations own the config
+// format, where it lives, how it is checked and applied, the service and
+// the log files of each site.
+type WebServer interface {
+	Name() string
+	// Installed reports whether the web server binary is on this host
+	Installed() bool
+
+	// Render returns the config of a site without applying it
+	Render(site Site) (string, error)
+	// Apply renders a site's config and activates it. A config the web
+	// server refuses leaves the previous one in place.
+	Apply(site Site) error
+	// Remove deactivates and deletes the config of a site. A server that
+	// is not in use only has the file deleted.
+	Remove(domain string) error
+	// ConfigPath is the file that holds the config of a site
+	ConfigPath(domain string) string
+	// Sites returns the names of the enabled site configs; a name is the
+	// domain, or a file named after it
+	Sites() ([]string, error)
+
+	Test() error
+	Reload() error
+	// Status is the service state, e.g. active or inactive
+	Status() (string, error)
+	Start() error
+	Stop() error
+
+	AccessLog(domain string) string
+	ErrorLog(domain string) string
+
+	// ObtainCertificate gets a certificate for a site and serves it over
+	// HTTPS
+	ObtainCertificate(domain, email string) error
+	// CertificatePath is the certificate served for a domain, empty if it
+	// has none
+	CertificatePath(domain string) string
+	// ServePanel serves the panel on a domain over HTTPS
+	ServePanel(domain, email string) error
+}
+
+var drivers = map[string]WebServer{}
+
+func register(w WebServer) {
+	drivers[w.Name()] = w
+}
+
+// Get returns the driver of a web server by name
+func Get(name string) (WebServer, error) {
+	w, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown web server: %s", name)
+	}
+	return w, nil
+}
+
+// Names returns the names of all drivers
+func Names() []string {
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CurrentName is the name of the web server this host serves sites with
+func CurrentName() string {
+	var setting db.Setting
+	if db.DB != nil && db.DB.Where("key = ?", settingKey).First(&setting).Error == nil {
+		if _, ok := drivers[setting.Value]; ok {
+			return setting.Value
+		}
+	}
+	return Default
+}
+
+// Current returns the driver of the web server this host serves sites with
+func Current() WebServer {
+	return drivers[CurrentName()]
+}
+
+// IsNginx reports whether sites are served by nginx, which the nginx-only
+// features (page cache, rate limits, country rules, ...) need
+func IsNginx() bool {
+	return CurrentName() == Nginx
+}
+
+// RequireNginx returns an error naming a feature that only works with nginx
+// while another web server is selected
+func RequireNginx(feature string) error {
+	if name := CurrentName(); name != Nginx {
+		return fmt.Errorf("%s requires nginx, but this server uses %s", feature, name)
+	}
+	return nil
+}
+
+// SetCurrent stores the web server sites are served with. It does not
+// touch the services or the site configs; see website.SwitchWebServer.
+func SetCurrent(name string) error {
+	if _, err := Get(name); err != nil {
+		return err
+	}
+	var setting db.Setting
+	db.DB.Where("key = ?", settingKey).First(&setting)
+	setting.Key = settingKey
+	setting.Value = name
+	return db.DB.Save(&setting).Error
+}
+
+// Info is the state of a web server on this host
+type Info struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+	Status    string `json:"status"`
+	Current   bool   `json:"current"`
+}
+
+// List returns the state of every web server
+func List() []Info {
+	current := CurrentName()
+	var infos []Info
+	for _, name := range Names() {
+		w := drivers[name]
+		info := Info{Name: name, Installed: w.Installed(), Current: name == current}
+		info.Status, _ = w.Status()
+		infos = append(infos, info)
+	}
+	return infos
+}
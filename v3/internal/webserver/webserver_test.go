@@ -0,0 +1,150 @@
+package webserver
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testSites cover the config templates: static, PHP and proxied sites
+var testSites = []Site{
+	{Domain: "static.test", Type: "static", Root: "/home/static.test"},
+	{Domain: "php.test", Type: "php", Root: "/home/php.test", PHPVersion: "8.2"},
+	{Domain: "laravel.test", Type: "laravel", Root: "/home/laravel.test", PHPVersion: "8.3"},
+	{Domain: "node.test", Type: "nodejs", Root: "/home/node.test", BackendPort: 3000},
+}
+
+// useTestDB points db.DB at an empty in-memory database
+func useTestDB(t *testing.T) {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&db.Website{}, &db.Setting{}, &db.AuthRule{}, &db.AuthUser{}, &db.ErrorPage{}, &db.CacheConfig{}, &db.UpstreamGroup{}, &db.UpstreamBackend{}, &db.SecurityConfig{}, &db.RateLimitConfig{}, &db.GeoRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db.DB
+	db.DB = conn
+	t.Cleanup(func() { db.DB = old })
+}
+
+func TestCaddyRenderAndTest(t *testing.T) {
+	if _, err := exec.LookPath("caddy"); err != nil {
+		t.Skip("caddy is not on PATH")
+	}
+	useTestDB(t)
+	dir := CaddyDir
+	CaddyDir = t.TempDir()
+	t.Cleanup(func() { CaddyDir = dir })
+
+	c := caddyServer{}
+	for _, site := range testSites {
+		site.Security = nginx.DefaultSecurityConfig()
+		out, err := c.Render(site)
+		if err != nil {
+			t.Fatalf("%s: %v", site.Domain, err)
+		}
+		var config caddySite
+		if err := json.Unmarshal([]byte(out), &config); err != nil {
+			t.Fatalf("%s: rendered config is not JSON: %v", site.Domain, err)
+		}
+		if len(config.Hosts) != 2 || config.Hosts[0] != site.Domain || len(config.Routes) == 0 {
+			t.Errorf("%s: unexpected config %+v", site.Domain, config)
+		}
+		path := c.ConfigPath(site.Domain)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(out), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Test(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A config Caddy cannot load fails the test
+	broken := `{"hosts": ["broken.test"], "routes": [{"handle": [{"handler": "no_such_handler"}]}]}`
+	if err := os.WriteFile(c.ConfigPath("broken.test"), []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Test(); err == nil {
+		t.Error("expected an unknown handler to fail the test")
+	}
+
+	if _, err := c.Render(Site{Domain: "port.test", Type: "static", Root: "/home/port.test", Port: 8080, Security: nginx.DefaultSecurityConfig()}); err == nil {
+		t.Error("expected a port other than 80 or 443 to be refused")
+	}
+}
+
+func TestNginxRenderAndTest(t *testing.T) {
+	if _, err := exec.LookPath("nginx"); err != nil {
+		t.Skip("nginx is not on PATH")
+	}
+	useTestDB(t)
+
+	// Each rendered vhost is checked on its own, inside a minimal nginx.conf
+	// under a scratch prefix: paths below /etc/nginx and /var/log/nginx move
+	// there and the files the vhost includes are created empty
+	n := nginxServer{}
+	for _, site := range testSites {
+		site.Security = nginx.DefaultSecurityConfig()
+		out, err := n.Render(site)
+		if err != nil {
+			t.Fatalf("%s: %v", site.Domain, err)
+		}
+		if !strings.Contains(out, "server_name "+site.Domain) {
+			t.Errorf("%s: server_name missing from\n%s", site.Domain, out)
+		}
+
+		dir := t.TempDir()
+		out = strings.NewReplacer(nginx.ConfDir+"/", dir+"/", nginxLogDir+"/", dir+"/").Replace(out)
+		config, err := nginx.Parse(site.Domain+".conf", out)
+		if err != nil {
+			t.Fatalf("%s: %v", site.Domain, err)
+		}
+		config.Walk(func(d *nginx.Directive) bool {
+			if d.Name == "include" {
+				path := d.Arg(0)
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(dir, path)
+				}
+				os.MkdirAll(filepath.Dir(path), 0755)
+				os.WriteFile(path, nil, 0644)
+			}
+			return true
+		})
+
+		vhost := filepath.Join(dir, site.Domain+".conf")
+		conf := filepath.Join(dir, "nginx.conf")
+		main := "pid " + filepath.Join(dir, "nginx.pid") + ";\nerror_log stderr;\nevents {}\nhttp {\n    include " + vhost + ";\n}\n"
+		if err := os.WriteFile(vhost, []byte(out), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(conf, []byte(main), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command("nginx", "-t", "-p", dir, "-c", conf).CombinedOutput(); err != nil {
+			t.Errorf("%s: nginx -t failed: %s", site.Domain, out)
+		}
+	}
+
+	// Test checks the host's own config, which only an installed nginx has
+	if _, err := os.Stat("/etc/nginx/nginx.conf"); err != nil {
+		t.Skip("no nginx config on this host")
+	}
+	if err := n.Test(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,377 @@
+package website
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+// Backend ports handed out to app sites that do not choose one
+const (
+	appPortMin = 10000
+	appPortMax = 19999
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+var (
+	pythonModuleRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*:[A-Za-z_][A-Za-z0-9_.()]*$`)
+	dockerImageRegex  = regexp.MustCompile(`^[a-z0-9][a-z0-9._/:@-]*$`)
+)
+
+const appUnitTemplate = `# Managed by Panda Panel, changes will be overwritten
+[Unit]
+Description=Panda app {{.Domain}}
+After=network.target{{if .Docker}} docker.service
+Requires=docker.service{{end}}
+
+[Service]
+Type=simple
+{{- if not .Docker}}
+User=www-data
+Group=www-data
+{{- end}}
+WorkingDirectory={{.Root}}
+Environment=PORT={{.Port}}
+EnvironmentFile=-{{.EnvFile}}
+{{- if .Docker}}
+ExecStartPre=-/usr/bin/docker rm -f {{.Name}}
+ExecStop=/usr/bin/docker stop {{.Name}}
+{{- end}}
+ExecStart={{.ExecStart}}
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// AppStatus is the state of a site's app service
+type AppStatus struct {
+	Domain      string `json:"domain"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit"`
+	BackendPort int    `json:"backend_port"`
+	Active      string `json:"active"` // active, inactive, failed, activating
+	SubState    string `json:"sub_state"`
+	Enabled     bool   `json:"enabled"`
+	MainPID     int    `json:"main_pid"`
+	Since       string `json:"since,omitempty"`
+	MemoryBytes int64  `json:"memory_bytes"`
+	Restarts    int    `json:"restarts"`
+	Listening   bool   `json:"listening"` // Backend port accepts connections
+}
+
+// isManagedApp reports whether the panel runs the site's backend as a service
+func isManagedApp(siteType string) bool {
+	return siteType == "go" || siteType == "python" || siteType == "docker"
+}
+
+// hasAppService reports whether the panel runs an existing site's backend.
+// Python sites from before the panel managed them have no app server set
+// and keep the backend they run themselves.
+func hasAppService(site Website) bool {
+	switch site.Type {
+	case "go":
+		return site.AppCommand != ""
+	case "python":
+		return site.AppServer != ""
+	case "docker":
+		return site.DockerImage != ""
+	}
+	return false
+}
+
+// prepareApp validates an app site and fills in defaults, including a free
+// backend port when none was given
+func prepareApp(site *Website) error {
+	switch site.Type {
+	case "go":
+		if site.AppCommand == "" {
+			return fmt.Errorf("app_command is required for go sites")
+		}
+		if strings.ContainsAny(site.AppCommand, "\r\n") {
+			return fmt.Errorf("invalid app_command")
+		}
+	case "python":
+		if site.AppModule == "" {
+			site.AppModule = "app:app"
+		}
+		if !pythonModuleRegex.MatchString(site.AppModule) {
+			return fmt.Errorf("invalid app_module: %q, expected module:callable", site.AppModule)
+		}
+		if site.AppServer == "" {
+			site.AppServer = "gunicorn"
+		}
+		if site.AppServer != "gunicorn" && site.AppServer != "uvicorn" {
+			return fmt.Errorf("app_server must be gunicorn or uvicorn")
+		}
+	case "docker":
+		if !dockerImageRegex.MatchString(site.DockerImage) {
+			return fmt.Errorf("invalid docker_image: %q", site.DockerImage)
+		}
+		if site.ContainerPort == 0 {
+			site.ContainerPort = 80
+		}
+	}
+
+	if site.BackendPort == 0 {
+		var existing db.Website
+		if err := db.DB.Where("domain = ?", site.Domain).First(&existing).Error; err == nil && existing.BackendPort != 0 {
+			site.BackendPort = existing.BackendPort
+		} else {
+			port, err := allocatePort()
+			if err != nil {
+				return err
+			}
+			site.BackendPort = port
+		}
+	}
+	return nil
+}
+
+// allocatePort returns a port in the app range that no site uses and nothing listens on
+func allocatePort() (int, error) {
+	var used []int
+	db.DB.Model(&db.Website{}).Where("backend_port >= ? AND backend_port <= ?", appPortMin, appPortMax).Pluck("backend_port", &used)
+	taken := make(map[int]bool)
+	for _, p := range used {
+		taken[p] = true
+	}
+
+	for port := appPortMin; port <= appPortMax; port++ {
+		if taken[port] {
+			continue
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free backend port between %d and %d", appPortMin, appPortMax)
+}
+
+func setAppFields(dbSite *db.Website, site Website) {
+	dbSite.AppCommand = site.AppCommand
+	dbSite.AppModule = site.AppModule
+	dbSite.AppServer = site.AppServer
+	dbSite.DockerImage = site.DockerImage
+	dbSite.ContainerPort = site.ContainerPort
+}
+
+// installApp writes the systemd unit of an app site and starts it.
+// Python sites get a virtualenv first, which runs in the background.
+func installApp(site Website) error {
+	name := ServiceName(site.Domain)
+	envFile := EnvFilePath(site.Domain)
+	if _, err := os.Stat(envFile); os.IsNotExist(err) {
+		// docker --env-file needs the file to exist
+		if err := writeEnvironmentFile(envFile, nil); err != nil {
+			return err
+		}
+	}
+
+	var execStart string
+	switch site.Type {
+	case "go":
+		execStart = site.AppCommand
+		if !filepath.IsAbs(execStart) {
+			execStart = filepath.Join(site.Root, execStart)
+		}
+	case "python":
+		bin := filepath.Join(site.Root, "venv/bin")
+		if site.AppServer == "uvicorn" {
+			execStart = fmt.Sprintf("%s/uvicorn %s --host 127.0.0.1 --port %d --workers 2", bin, site.AppModule, site.BackendPort)
+		} else {
+			execStart = fmt.Sprintf("%s/gunicorn %s --bind 127.0.0.1:%d --workers 2", bin, site.AppModule, site.BackendPort)
+		}
+	case "docker":
+		execStart = fmt.Sprintf("/usr/bin/docker run --rm --name %s -p 127.0.0.1:%d:%d --env-file %s %s",
+			name, site.BackendPort, site.ContainerPort, envFile, site.DockerImage)
+	}
+
+	t, err := template.New("unit").Parse(appUnitTemplate)
+	if err != nil {
+		return err
+	}
+	unitPath := filepath.Join(systemdUnitDir, name+".service")
+	f, err := os.Create(unitPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := map[string]interface{}{
+		"Domain":    site.Domain,
+		"Root":      site.Root,
+		"Port":      site.BackendPort,
+		"EnvFile":   envFile,
+		"Name":      name,
+		"Docker":    site.Type == "docker",
+		"ExecStart": execStart,
+	}
+	if err := t.Execute(f, data); err != nil {
+		return err
+	}
+
+	if _, err := system.Execute("systemctl daemon-reload"); err != nil {
+		return err
+	}
+
+	if site.Type == "python" {
+		go func() {
+			// Run in background as pip install might take time
+			setupVirtualenv(site)
+			system.Execute(fmt.Sprintf("systemctl enable --now %s", name))
+		}()
+		return nil
+	}
+
+	if site.Type == "docker" {
+		// Pull first so the start timeout does not cover the download
+		go func() {
+			system.Execute(fmt.Sprintf("docker pull %s", site.DockerImage))
+			system.Execute(fmt.Sprintf("systemctl enable %s && systemctl restart %s", name, name))
+		}()
+		return nil
+	}
+
+	out, err := system.Execute(fmt.Sprintf("systemctl enable %s && systemctl restart %s", name, name))
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// setupVirtualenv creates <root>/venv with the app server and requirements.txt
+func setupVirtualenv(site Website) error {
+	venv := filepath.Join(site.Root, "venv")
+	if _, err := os.Stat(filepath.Join(venv, "bin/python")); os.IsNotExist(err) {
+		if out, err := system.Execute(fmt.Sprintf("python3 -m venv %s", venv)); err != nil {
+			return fmt.Errorf("failed to create virtualenv: %s", strings.TrimSpace(out))
+		}
+	}
+
+	packages := "gunicorn"
+	if site.AppServer == "uvicorn" {
+		packages = "uvicorn"
+	}
+	cmd := fmt.Sprintf("%s/bin/pip install -q %s", venv, packages)
+	if _, err := os.Stat(filepath.Join(site.Root, "requirements.txt")); err == nil {
+		cmd += fmt.Sprintf(" -r %s", filepath.Join(site.Root, "requirements.txt"))
+	}
+	if out, err := system.Execute(cmd); err != nil {
+		return fmt.Errorf("pip install failed: %s", strings.TrimSpace(out))
+	}
+	system.Execute(fmt.Sprintf("chown -R www-data:www-data %s", venv))
+	return nil
+}
+
+// removeAppService stops and removes the app service of a site, if any
+func removeAppService(domain string) {
+	name := ServiceName(domain)
+	unitPath := filepath.Join(systemdUnitDir, name+".service")
+	if _, err := os.Stat(unitPath); err != nil {
+		return
+	}
+	system.Execute(fmt.Sprintf("systemctl disable --now %s", name))
+	os.Remove(unitPath)
+	system.Execute("systemctl daemon-reload")
+}
+
+// GetAppStatus reports the state of a site's app service
+func GetAppStatus(domain string) (*AppStatus, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if !isManagedApp(site.Type) {
+		return nil, fmt.Errorf("%s is a %s site without an app service", domain, site.Type)
+	}
+
+	name := ServiceName(domain)
+	status := &AppStatus{Domain: domain, Type: site.Type, Unit: name + ".service", BackendPort: site.BackendPort}
+
+	out, _ := system.Execute(fmt.Sprintf("systemctl show %s --property=ActiveState,SubState,UnitFileState,MainPID,ActiveEnterTimestamp,MemoryCurrent,NRestarts", name))
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ActiveState":
+			status.Active = value
+		case "SubState":
+			status.SubState = value
+		case "UnitFileState":
+			status.Enabled = value == "enabled"
+		case "MainPID":
+			status.MainPID, _ = strconv.Atoi(value)
+		case "ActiveEnterTimestamp":
+			status.Since = value
+		case "MemoryCurrent":
+			status.MemoryBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "NRestarts":
+			status.Restarts, _ = strconv.Atoi(value)
+		}
+	}
+
+	if site.BackendPort != 0 {
+		if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(site.BackendPort)); err == nil {
+			conn.Close()
+			status.Listening = true
+		}
+	}
+	return status, nil
+}
+
+// AppAction starts, stops or restarts a site's app service
+func AppAction(domain, action string) error {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return fmt.Errorf("website not found: %v", err)
+	}
+	if !isManagedApp(site.Type) {
+		return fmt.Errorf("%s is a %s site without an app service", domain, site.Type)
+	}
+
+	name := ServiceName(domain)
+	var cmd string
+	switch action {
+	case "start", "stop", "restart":
+		cmd = fmt.Sprintf("systemctl %s %s", action, name)
+	case "enable", "disable":
+		cmd = fmt.Sprintf("systemctl %s --now %s", action, name)
+	case "rebuild":
+		// Re-create the unit (and virtualenv) from the website record
+		return installApp(websiteFromRecord(site))
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+
+	if out, err := system.Execute(cmd); err != nil {
+		return fmt.Errorf("%s failed: %s", action, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// GetAppLogs returns the last lines of a site's app service journal
+func GetAppLogs(domain string, lines int) (string, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return "", fmt.Errorf("website not found: %v", err)
+	}
+	if lines <= 0 || lines > 5000 {
+		lines = 200
+	}
+	return system.Execute(fmt.Sprintf("journalctl -u %s -n %d --no-pager", ServiceName(domain), lines))
+}
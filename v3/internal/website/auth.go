@@ -0,0 +1,304 @@
+package website
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms for basic auth users
+const (
+	HashBcrypt = "bcrypt"
+	HashAPR1   = "apr1"
+)
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var (
+	authPathRegex  = regexp.MustCompile(`^/[A-Za-z0-9._~/%-]*$`)
+	authRealmRegex = regexp.MustCompile(`^[A-Za-z0-9 .,:;!?()_-]{1,64}$`)
+	authUserRegex  = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+	authHashRegex  = regexp.MustCompile(`^(\$apr1\$[./0-9A-Za-z]{1,8}\$[./0-9A-Za-z]{22}|\$2[aby]\$\d\d\$[./0-9A-Za-z]{53})$`)
+)
+
+// AuthRuleRequest creates or updates a protected path
+type AuthRuleRequest struct {
+	Path      string   `json:"path" binding:"required"`
+	Realm     string   `json:"realm"`
+	BypassIPs []string `json:"bypass_ips"`
+	Enabled   *bool    `json:"enabled"`
+}
+
+// AuthUserRequest adds a login to a rule. Either Password or a ready
+// htpasswd Hash (bcrypt or apr1) is required.
+type AuthUserRequest struct {
+	Username  string `json:"username" binding:"required"`
+	Password  string `json:"password"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"` // bcrypt (default), apr1
+}
+
+// ListAuthRules returns the basic auth rules of a website with their users
+func ListAuthRules(domain string) ([]db.AuthRule, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	rules := []db.AuthRule{}
+	err := db.DB.Preload("Users").Where("website_id = ?", site.ID).Order("path").Find(&rules).Error
+	return rules, err
+}
+
+// CreateAuthRule protects a path of a website
+func CreateAuthRule(domain string, req AuthRuleRequest) (*db.AuthRule, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+
+	rule := db.AuthRule{WebsiteID: site.ID, Enabled: true}
+	if err := applyAuthRuleRequest(&rule, req); err != nil {
+		return nil, err
+	}
+	var count int64
+	db.DB.Model(&db.AuthRule{}).Where("website_id = ? AND path = ?", site.ID, rule.Path).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("%s is already protected", rule.Path)
+	}
+
+	if err := db.DB.Create(&rule).Error; err != nil {
+		return nil, err
+	}
+	// Nothing to render until the rule has a user
+	return &rule, nil
+}
+
+// UpdateAuthRule changes a rule's path, realm, bypass list or state
+func UpdateAuthRule(domain string, id uint, req AuthRuleRequest) (*db.AuthRule, error) {
+	site, rule, err := findAuthRule(domain, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyAuthRuleRequest(rule, req); err != nil {
+		return nil, err
+	}
+	if err := db.DB.Save(rule).Error; err != nil {
+		return nil, err
+	}
+	return rule, applyVhost(websiteFromRecord(*site))
+}
+
+// DeleteAuthRule removes a rule, its users and its htpasswd file
+func DeleteAuthRule(domain string, id uint) error {
+	site, rule, err := findAuthRule(domain, id)
+	if err != nil {
+		return err
+	}
+	db.DB.Where("rule_id = ?", rule.ID).Delete(&db.AuthUser{})
+	if err := db.DB.Delete(rule).Error; err != nil {
+		return err
+	}
+	if err := applyVhost(websiteFromRecord(*site)); err != nil {
+		return err
+	}
+	os.Remove(nginx.HtpasswdPath(domain, id))
+	return nil
+}
+
+// SetAuthUser adds a login to a rule, replacing the password if the user exists
+func SetAuthUser(domain string, id uint, req AuthUserRequest) error {
+	site, rule, err := findAuthRule(domain, id)
+	if err != nil {
+		return err
+	}
+	if !authUserRegex.MatchString(req.Username) {
+		return fmt.Errorf("invalid username: %q", req.Username)
+	}
+
+	user := db.AuthUser{RuleID: rule.ID, Username: req.Username}
+	db.DB.Where("rule_id = ? AND username = ?", rule.ID, req.Username).First(&user)
+
+	switch {
+	case req.Hash != "":
+		if !authHashRegex.MatchString(req.Hash) {
+			return fmt.Errorf("hash must be in bcrypt or apr1 htpasswd format")
+		}
+		user.Hash = req.Hash
+		user.Algorithm = HashAPR1
+		if strings.HasPrefix(req.Hash, "$2") {
+			user.Algorithm = HashBcrypt
+		}
+	case req.Password != "":
+		algorithm := req.Algorithm
+		if algorithm == "" {
+			algorithm = HashBcrypt
+		}
+		hash, err := hashAuthPassword(req.Password, algorithm)
+		if err != nil {
+			return err
+		}
+		user.Hash = hash
+		user.Algorithm = algorithm
+	default:
+		return fmt.Errorf("password or hash is required")
+	}
+
+	if err := db.DB.Save(&user).Error; err != nil {
+		return err
+	}
+	return applyVhost(websiteFromRecord(*site))
+}
+
+// DeleteAuthUser removes a login from a rule
+func DeleteAuthUser(domain string, id uint, username string) error {
+	site, rule, err := findAuthRule(domain, id)
+	if err != nil {
+		return err
+	}
+	result := db.DB.Where("rule_id = ? AND username = ?", rule.ID, username).Delete(&db.AuthUser{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user not found: %s", username)
+	}
+	return applyVhost(websiteFromRecord(*site))
+}
+
+func findAuthRule(domain string, id uint) (*db.Website, *db.AuthRule, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, nil, fmt.Errorf("website not found: %v", err)
+	}
+	var rule db.AuthRule
+	if err := db.DB.Where("id = ? AND website_id = ?", id, site.ID).First(&rule).Error; err != nil {
+		return nil, nil, fmt.Errorf("auth rule not found: %v", err)
+	}
+	return &site, &rule, nil
+}
+
+func applyAuthRuleRequest(rule *db.AuthRule, req AuthRuleRequest) error {
+	if !authPathRegex.MatchString(req.Path) {
+		return fmt.Errorf("invalid path: %q", req.Path)
+	}
+	realm := req.Realm
+	if realm == "" {
+		realm = "Restricted"
+	}
+	if !authRealmRegex.MatchString(realm) {
+		return fmt.Errorf("invalid realm: %q", req.Realm)
+	}
+
+	bypass, err := parseIPList(req.BypassIPs)
+	if err != nil {
+		return err
+	}
+
+	rule.Path = req.Path
+	rule.Realm = realm
+	rule.BypassIPs = bypass
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	return nil
+}
+
+// parseIPList validates a list of IPs and CIDRs, dropping empty entries
+func parseIPList(ips []string) ([]string, error) {
+	list := []string{}
+	for _, ip := range ips {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR: %q", ip)
+			}
+		}
+		list = append(list, ip)
+	}
+	return list, nil
+}
+
+func hashAuthPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashAPR1:
+		salt := make([]byte, 8)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		for i := range salt {
+			salt[i] = apr1Alphabet[int(salt[i])%len(apr1Alphabet)]
+		}
+		return apr1Crypt(password, string(salt)), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm: %s", algorithm)
+}
+
+// apr1Crypt is Apache's MD5 crypt ($apr1$), as produced by `htpasswd -m`
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var sb strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			sb.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + sb.String()
+}
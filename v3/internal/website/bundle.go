@@ -0,0 +1,598 @@
+package website
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/backup"
+	"github.com/acmavirus/panda-script/v3/internal/cron"
+	"github.com/acmavirus/panda-script/v3/internal/database"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+// bundleVersion is bumped when the manifest changes incompatibly
+const bundleVersion = 1
+
+var (
+	wpDBPasswordRegex      = regexp.MustCompile(`define\(\s*['"]DB_PASSWORD['"]\s*,\s*['"]([^'"]*)['"]`)
+	laravelDBPasswordRegex = regexp.MustCompile(`(?m)^DB_PASSWORD=["']?([^"'\n]*)`)
+)
+
+// BundleManifest describes a website export. It is stored as manifest.json
+// next to database.sql; files, nginx configs and the certificate are stored
+// under their absolute paths.
+type BundleManifest struct {
+	Version     int              `json:"version"`
+	ExportedAt  time.Time        `json:"exported_at"`
+	Source      string           `json:"source"`
+	Website     db.Website       `json:"website"`
+	Database    *BundleDatabase  `json:"database,omitempty"`
+	Configs     []string         `json:"configs"`
+	Certificate bool             `json:"certificate"`
+	Cron        []db.Cron        `json:"cron"`
+	Env         *EnvConfig       `json:"env,omitempty"` // Secrets in plain text
+	Auth        []BundleAuthRule `json:"auth"`
+}
+
+// BundleDatabase is the database a bundled site uses
+type BundleDatabase struct {
+	Name     string `json:"name"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// BundleAuthRule is a basic auth rule including the password hashes
+type BundleAuthRule struct {
+	Path      string           `json:"path"`
+	Realm     string           `json:"realm"`
+	BypassIPs []string         `json:"bypass_ips"`
+	Enabled   bool             `json:"enabled"`
+	Users     []BundleAuthUser `json:"users"`
+}
+
+// BundleAuthUser is a basic auth login with its htpasswd hash
+type BundleAuthUser struct {
+	Username  string `json:"username"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+}
+
+// ExportWebsite writes a bundle with everything needed to recreate a website
+// on another server and returns its path. The bundle contains secrets and the
+// certificate private key.
+func ExportWebsite(domain string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", fmt.Errorf("website export requires Linux")
+	}
+
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return "", fmt.Errorf("website not found: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	manifest := BundleManifest{
+		Version:    bundleVersion,
+		ExportedAt: time.Now(),
+		Source:     hostname,
+		Website:    site,
+		Configs:    []string{},
+		Cron:       []db.Cron{},
+		Auth:       []BundleAuthRule{},
+	}
+
+	staging, err := os.MkdirTemp("", "panda-bundle-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	members := []string{"manifest.json"}
+
+	// Database
+	if name, user := websiteDatabase(site); name != "" {
+		manifest.Database = &BundleDatabase{Name: name, User: user, Password: configuredDBPassword(site)}
+		dump := filepath.Join(staging, "database.sql")
+		if out, err := system.Execute(fmt.Sprintf("mysqldump --single-transaction %s > %s", name, shellQuote(dump))); err != nil {
+			return "", fmt.Errorf("database dump failed: %s", strings.TrimSpace(out))
+		}
+		members = append(members, "database.sql")
+	}
+
+	// Files, vhost configs and certificate, stored relative to /
+	var paths []string
+	if _, err := os.Stat(site.Root); err == nil {
+		paths = append(paths, site.Root)
+	}
+	for _, config := range bundleConfigs(domain) {
+		if _, err := os.Stat(config); err == nil {
+			manifest.Configs = append(manifest.Configs, config)
+			paths = append(paths, config)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(letsencryptLive, domain, "fullchain.pem")); err == nil {
+		manifest.Certificate = true
+		paths = append(paths, bundleCertificate(domain)...)
+	}
+
+	// Cron jobs referencing the site
+	var crons []db.Cron
+	db.DB.Find(&crons)
+	for _, c := range crons {
+		if cron.References(c.Command, site.Root, domain) {
+			manifest.Cron = append(manifest.Cron, c)
+		}
+	}
+
+	// Environment, decrypted so the target can re-encrypt with its own key
+	var vars []db.EnvVar
+	db.DB.Where("website_id = ?", site.ID).Order("key").Find(&vars)
+	if len(vars) > 0 {
+		manifest.Env = &EnvConfig{Target: site.EnvTarget, Vars: []EnvEntry{}}
+		for _, v := range vars {
+			value, err := plainValue(v)
+			if err != nil {
+				return "", fmt.Errorf("failed to decrypt %s: %v", v.Key, err)
+			}
+			manifest.Env.Vars = append(manifest.Env.Vars, EnvEntry{Key: v.Key, Value: value, Secret: v.Secret})
+		}
+	}
+
+	// Basic auth
+	var rules []db.AuthRule
+	db.DB.Preload("Users").Where("website_id = ?", site.ID).Find(&rules)
+	for _, r := range rules {
+		rule := BundleAuthRule{Path: r.Path, Realm: r.Realm, BypassIPs: r.BypassIPs, Enabled: r.Enabled, Users: []BundleAuthUser{}}
+		for _, u := range r.Users {
+			rule.Users = append(rule.Users, BundleAuthUser{Username: u.Username, Hash: u.Hash, Algorithm: u.Algorithm})
+		}
+		manifest.Auth = append(manifest.Auth, rule)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(staging, "manifest.json"), data, 0600); err != nil {
+		return "", err
+	}
+
+	os.MkdirAll(backup.BackupDir, 0755)
+	bundlePath := filepath.Join(backup.BackupDir, fmt.Sprintf("bundle_%s_%s.tar.gz", domain, time.Now().Format("20060102_150405")))
+	cmd := fmt.Sprintf("tar -czf %s -C %s %s", shellQuote(bundlePath), shellQuote(staging), strings.Join(members, " "))
+	if len(paths) > 0 {
+		var rel []string
+		for _, p := range paths {
+			rel = append(rel, shellQuote(strings.TrimPrefix(p, "/")))
+		}
+		cmd += " -C / " + strings.Join(rel, " ")
+	}
+	if out, err := system.Execute(cmd); err != nil {
+		os.Remove(bundlePath)
+		return "", fmt.Errorf("archive failed: %s", strings.TrimSpace(out))
+	}
+	os.Chmod(bundlePath, 0600)
+
+	return bundlePath, nil
+}
+
+// FetchBundle downloads a website bundle from another Panda panel using
+// an API token of that panel and returns the local path
+func FetchBundle(panelURL, domain, token string) (string, error) {
+	if err := ValidateDomain(domain); err != nil {
+		return "", err
+	}
+	url := strings.TrimRight(panelURL, "/") + "/api/websites/" + domain + "/export"
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 2 * time.Hour}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach %s: %v", panelURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("export failed on %s: %s %s", panelURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	os.MkdirAll(backup.BackupDir, 0755)
+	path := filepath.Join(backup.BackupDir, fmt.Sprintf("bundle_%s_%s.tar.gz", domain, time.Now().Format("20060102_150405")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("download failed: %v", err)
+	}
+	return path, nil
+}
+
+// ReadBundleManifest returns the manifest of a bundle without extracting it
+func ReadBundleManifest(bundlePath string) (*BundleManifest, error) {
+	out, err := system.Execute(fmt.Sprintf("tar -xzOf %s manifest.json 2>/dev/null", shellQuote(bundlePath)))
+	if err != nil {
+		return nil, fmt.Errorf("not a website bundle: %s", bundlePath)
+	}
+	var manifest BundleManifest
+	if err := json.Unmarshal([]byte(out), &manifest); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %v", err)
+	}
+	if manifest.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+	if err := ValidateDomain(manifest.Website.Domain); err != nil {
+		return nil, err
+	}
+	if err := checkBundleManifest(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// bundleConfigs are the vhost configs of a site a bundle may carry
+func bundleConfigs(domain string) []string {
+	return []string{
+		filepath.Join(nginx.SitesAvailable, domain+".conf"),
+		filepath.Join(nginx.SitesAvailable, domain),
+		filepath.Join(nginx.SitesAvailable, domain+"-ssl"),
+	}
+}
+
+// bundleCertificate are the certbot paths of a site's certificate
+func bundleCertificate(domain string) []string {
+	return []string{
+		filepath.Join(letsencryptLive, domain),
+		filepath.Join("/etc/letsencrypt/archive", domain),
+		filepath.Join("/etc/letsencrypt/renewal", domain+".conf"),
+	}
+}
+
+// checkBundleManifest validates what a bundle would write on this server.
+// A bundle is a file or comes from another panel, so it is limited to the
+// site's web root, its vhost configs and its certificate, and the names that
+// reach SQL or a shell must be plain identifiers.
+func checkBundleManifest(m *BundleManifest) error {
+	domain := m.Website.Domain
+	if m.Website.Root == "" {
+		m.Website.Root = "/home/" + domain
+	}
+	root := m.Website.Root
+	if filepath.Clean(root) != root || !(strings.HasPrefix(root, "/home/") || strings.HasPrefix(root, "/var/www/")) {
+		return fmt.Errorf("invalid web root %q, expected a directory under /home or /var/www", root)
+	}
+
+	for _, config := range m.Configs {
+		if !slices.Contains(bundleConfigs(domain), config) {
+			return fmt.Errorf("invalid config %q, expected a vhost of %s in %s", config, domain, nginx.SitesAvailable)
+		}
+	}
+
+	if d := m.Database; d != nil {
+		if !dbIdentifierRegex.MatchString(d.Name) {
+			return fmt.Errorf("invalid database name %q", d.Name)
+		}
+		if d.User != "" && !dbIdentifierRegex.MatchString(d.User) {
+			return fmt.Errorf("invalid database user %q", d.User)
+		}
+	}
+
+	for _, r := range m.Auth {
+		rule := db.AuthRule{}
+		if err := applyAuthRuleRequest(&rule, AuthRuleRequest{Path: r.Path, Realm: r.Realm, BypassIPs: r.BypassIPs}); err != nil {
+			return fmt.Errorf("invalid basic auth rule: %v", err)
+		}
+		for _, u := range r.Users {
+			if !authUserRegex.MatchString(u.Username) || !authHashRegex.MatchString(u.Hash) {
+				return fmt.Errorf("invalid basic auth user %q", u.Username)
+			}
+		}
+	}
+	return nil
+}
+
+// checkBundleTree checks an extracted bundle before anything is copied out of
+// it: it may only hold the manifest, the dump and the paths the manifest
+// names, and its links may only point within those paths
+func checkBundleTree(staging string, m *BundleManifest) error {
+	allowed := append([]string{m.Website.Root}, m.Configs...)
+	if m.Certificate {
+		allowed = append(allowed, bundleCertificate(m.Website.Domain)...)
+	}
+	within := func(path string) bool {
+		for _, a := range allowed {
+			if path == a || strings.HasPrefix(path, a+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	above := func(path string) bool {
+		for _, a := range allowed {
+			if strings.HasPrefix(a, strings.TrimSuffix(path, "/")+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	return filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		abs := "/" + filepath.ToSlash(rel)
+		switch {
+		case abs == "/manifest.json" || abs == "/database.sql":
+			if !d.Type().IsRegular() {
+				return fmt.Errorf("bundle %s is not a regular file", rel)
+			}
+			return nil
+		case !within(abs):
+			if d.IsDir() && above(abs) {
+				return nil
+			}
+			return fmt.Errorf("bundle contains %s, which does not belong to the site", abs)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(abs), target)
+			}
+			if !within(filepath.Clean(target)) {
+				return fmt.Errorf("bundle link %s points outside the site: %s", abs, target)
+			}
+		case !d.IsDir() && !d.Type().IsRegular():
+			return fmt.Errorf("bundle contains special file %s", abs)
+		}
+		return nil
+	})
+}
+
+// ImportBundle recreates a website from a bundle as a tracked task
+func ImportBundle(bundlePath string) (*task.Task, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("website import requires Linux")
+	}
+
+	manifest, err := ReadBundleManifest(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	domain := manifest.Website.Domain
+	var count int64
+	db.DB.Model(&db.Website{}).Where("domain = ?", domain).Count(&count)
+	if count > 0 || len(availableConfigs(domain)) > 0 {
+		return nil, fmt.Errorf("%s already exists on this server", domain)
+	}
+	if manifest.Database != nil && checkMySQLDatabaseExists(manifest.Database.Name) {
+		return nil, fmt.Errorf("database %s already exists on this server", manifest.Database.Name)
+	}
+	root := manifest.Website.Root
+	db.DB.Model(&db.Website{}).Where("root = ?", root).Count(&count)
+	if entries, err := os.ReadDir(root); count > 0 || (err == nil && len(entries) > 0) {
+		return nil, fmt.Errorf("web root %s is already in use on this server", root)
+	}
+	out, err := system.Execute(fmt.Sprintf("tar -tzf %s", shellQuote(bundlePath)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %s", strings.TrimSpace(out))
+	}
+	for _, name := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(name, "/") || slices.Contains(strings.Split(name, "/"), "..") {
+			return nil, fmt.Errorf("bundle member %q escapes the bundle", name)
+		}
+	}
+
+	t := task.StartFunc("import website "+domain, func(t *task.Task) error {
+		staging, err := os.MkdirTemp("", "panda-bundle-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+
+		if out, err := system.Execute(fmt.Sprintf("tar -xzpf %s -C %s", shellQuote(bundlePath), shellQuote(staging))); err != nil {
+			return fmt.Errorf("failed to extract bundle: %s", strings.TrimSpace(out))
+		}
+		if err := checkBundleTree(staging, manifest); err != nil {
+			return err
+		}
+		t.Logf("Extracted bundle from %s (exported %s)", manifest.Source, manifest.ExportedAt.Format(time.RFC3339))
+		t.SetProgress(20)
+
+		// 1. Files
+		site := manifest.Website
+		if _, err := os.Stat(filepath.Join(staging, site.Root)); err == nil {
+			if err := os.MkdirAll(site.Root, 0755); err != nil {
+				return fmt.Errorf("failed to create web root: %v", err)
+			}
+			if out, err := system.Execute(fmt.Sprintf("cp -a -- %s/. %s/", shellQuote(filepath.Join(staging, site.Root)), shellQuote(site.Root))); err != nil {
+				return fmt.Errorf("failed to copy files: %s", strings.TrimSpace(out))
+			}
+			system.Execute(fmt.Sprintf("chown -R -h www-data:www-data %s", shellQuote(site.Root)))
+			t.Logf("Restored files to %s", site.Root)
+		}
+		t.SetProgress(40)
+
+		// 2. Database
+		if d := manifest.Database; d != nil {
+			if err := importBundleDatabase(d, filepath.Join(staging, "database.sql")); err != nil {
+				t.Logf("Warning: %v", err)
+			} else {
+				t.Logf("Restored database %s", d.Name)
+			}
+		}
+		t.SetProgress(55)
+
+		// 3. Certificate
+		if manifest.Certificate {
+			for _, p := range bundleCertificate(domain) {
+				os.MkdirAll(filepath.Dir(p), 0755)
+				system.Execute(fmt.Sprintf("cp -a -- %s %s", shellQuote(filepath.Join(staging, p)), shellQuote(filepath.Dir(p))))
+			}
+			t.Logf("Restored certificate")
+		}
+
+		// 4. Record, basic auth and environment
+		site.ID = 0
+		site.Status = ""
+		site.StatusCode = 0
+		site.LastCheck = time.Time{}
+		site.MonitorDown = false
+		site.MonitorStreak = 0
+		site.OwnerID = 0
+		site.CreatedAt = time.Time{}
+		site.UpdatedAt = time.Time{}
+		if err := db.DB.Create(&site).Error; err != nil {
+			return fmt.Errorf("failed to create website record: %v", err)
+		}
+
+		for _, r := range manifest.Auth {
+			rule := db.AuthRule{WebsiteID: site.ID, Path: r.Path, Realm: r.Realm, BypassIPs: r.BypassIPs, Enabled: r.Enabled}
+			for _, u := range r.Users {
+				rule.Users = append(rule.Users, db.AuthUser{Username: u.Username, Hash: u.Hash, Algorithm: u.Algorithm})
+			}
+			db.DB.Create(&rule)
+		}
+		t.SetProgress(70)
+
+		// 5. Vhost: the exported nginx configs keep any hand edits
+		web := websiteFromRecord(site)
+		exported := false
+		if len(manifest.Configs) > 0 && webserver.IsNginx() {
+			// Along with the htpasswd files and pages they refer to
+			files, err := nginx.SiteFiles(domain)
+			for _, config := range manifest.Configs {
+				content, err := os.ReadFile(filepath.Join(staging, config))
+				if err != nil {
+					continue
+				}
+				files = append(files, nginx.FileChange{
+					Path:    config,
+					Content: content,
+					Link:    filepath.Join(nginx.SitesEnabled, filepath.Base(config)),
+				})
+			}
+			if err == nil {
+				err = nginx.Apply(nginx.ConfigChange{Files: files, Probe: []string{domain}, Note: "imported from bundle"})
+			}
+			if err != nil {
+				t.Logf("Warning: exported vhost was not applied, regenerating: %v", err)
+			} else {
+				exported = true
+			}
+		}
+		if !exported {
+			if err := applyVhost(web); err != nil {
+				return err
+			}
+		}
+		if hasAppService(web) {
+			if err := installApp(web); err != nil {
+				t.Logf("Warning: failed to set up app service: %v", err)
+			}
+		}
+		if site.SSL && certificateDir(domain) == "" {
+			if err := CreateSSL(domain); err != nil {
+				t.Logf("Warning: no certificate for %s: %v", domain, err)
+			}
+		}
+		if site.PHPVersion != "" {
+			if _, err := os.Stat(fmt.Sprintf("/var/run/php/php%s-fpm.sock", site.PHPVersion)); err != nil {
+				t.Logf("Warning: PHP %s is not installed on this server", site.PHPVersion)
+			}
+		}
+		t.Logf("Created vhost for %s", domain)
+		t.SetProgress(85)
+
+		// 6. Cron jobs, which run as root, so they wait for an admin to
+		// review and enable them
+		for _, c := range manifest.Cron {
+			c.ID = 0
+			c.Enabled = false
+			c.CreatedAt = time.Time{}
+			c.UpdatedAt = time.Time{}
+			db.DB.Create(&c)
+		}
+		if len(manifest.Cron) > 0 {
+			t.Logf("Restored %d cron jobs, disabled until reviewed", len(manifest.Cron))
+		}
+
+		// 7. Environment, rendered and the app restarted
+		if manifest.Env != nil {
+			if _, err := SetEnv(domain, *manifest.Env); err != nil {
+				t.Logf("Warning: failed to apply environment: %v", err)
+			} else {
+				t.Logf("Restored %d environment variables", len(manifest.Env.Vars))
+			}
+		}
+
+		return nil
+	})
+
+	return t, nil
+}
+
+func importBundleDatabase(d *BundleDatabase, dump string) error {
+	if err := database.CreateDatabase(d.Name, "mysql"); err != nil {
+		return fmt.Errorf("failed to create database %s: %v", d.Name, err)
+	}
+	if _, err := os.Stat(dump); err == nil {
+		if out, err := system.Execute(fmt.Sprintf("mysql %s < %s", d.Name, shellQuote(dump))); err != nil {
+			return fmt.Errorf("failed to import database %s: %s", d.Name, strings.TrimSpace(out))
+		}
+	}
+	if d.User == "" || d.User == "root" {
+		return nil
+	}
+	// Sent without a shell, so only the SQL string needs escaping
+	password := strings.NewReplacer(`\`, `\\`, "'", "''").Replace(d.Password)
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		query := fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%s' IDENTIFIED BY '%s'; GRANT ALL PRIVILEGES ON `%s`.* TO '%s'@'%s';",
+			d.User, host, password, d.Name, d.User, host)
+		if _, err := mysqlQuery(query); err != nil {
+			return fmt.Errorf("failed to create database user %s: %v", d.User, err)
+		}
+	}
+	mysqlQuery("FLUSH PRIVILEGES;")
+	return nil
+}
+
+// configuredDBPassword returns the database password from a site's app config
+func configuredDBPassword(site db.Website) string {
+	if content, err := os.ReadFile(filepath.Join(site.Root, "wp-config.php")); err == nil {
+		if m := wpDBPasswordRegex.FindSubmatch(content); len(m) > 1 {
+			return string(m[1])
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(site.Root, ".env")); err == nil {
+		if m := laravelDBPasswordRegex.FindSubmatch(content); len(m) > 1 {
+			return string(m[1])
+		}
+	}
+	return ""
+}
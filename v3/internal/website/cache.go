@@ -0,0 +1,110 @@
+package website
+
+import (
+	"fmt"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+)
+
+// Default bypass rules of WordPress sites: logged-in users, commenters,
+// carts, and pages that must never be shared between visitors
+var (
+	wordpressCacheCookies = []string{"wordpress_logged_in", "wp-postpass", "comment_author", "woocommerce_items_in_cart", "woocommerce_cart_hash"}
+	wordpressCachePaths   = []string{"/wp-admin/", "/wp-login.php", "/xmlrpc.php", "/wp-json/", "/cart/", "/checkout/", "/my-account/"}
+)
+
+// CacheSettings is the page cache config of a website with the values the
+// panel derives: the cache kind, zone and directory
+type CacheSettings struct {
+	db.CacheConfig
+	Kind string `json:"kind"` // fastcgi or proxy
+	Zone string `json:"zone"`
+	Path string `json:"path"`
+}
+
+// PurgeRequest selects what PurgeCache removes; with both fields empty the
+// whole cache of the site is purged
+type PurgeRequest struct {
+	URL    string `json:"url"`    // A single page: path with query, or full URL
+	Prefix string `json:"prefix"` // Every page below a path
+}
+
+// GetCache returns the page cache config of a website, or the defaults for
+// its type if it has none yet
+func GetCache(domain string) (*CacheSettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	kind, err := nginx.CacheKindForSiteType(site.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &CacheSettings{Kind: kind, Zone: nginx.CacheZone(domain), Path: nginx.CachePath(domain)}
+	if db.DB.Where("website_id = ?", site.ID).First(&settings.CacheConfig).Error != nil {
+		settings.CacheConfig = db.CacheConfig{
+			WebsiteID:     site.ID,
+			ZoneSize:      nginx.DefaultCacheZoneSize,
+			MaxSize:       nginx.DefaultCacheMaxSize,
+			TTL:           nginx.DefaultCacheTTL,
+			BypassCookies: []string{},
+			ExcludePaths:  []string{},
+		}
+		if site.Type == "wordpress" {
+			settings.BypassCookies = wordpressCacheCookies
+			settings.ExcludePaths = wordpressCachePaths
+		}
+	}
+	return settings, nil
+}
+
+// SetCache stores the page cache config of a website and renders it into
+// the vhost. The previous config is kept if the vhost does not validate.
+func SetCache(domain string, config db.CacheConfig) (*CacheSettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if _, err := nginx.CacheKindForSiteType(site.Type); err != nil {
+		return nil, err
+	}
+	if err := nginx.ValidateCacheConfig(config); err != nil {
+		return nil, err
+	}
+
+	var previous db.CacheConfig
+	existed := db.DB.Where("website_id = ?", site.ID).First(&previous).Error == nil
+	config.ID = previous.ID
+	config.WebsiteID = site.ID
+	if err := db.DB.Save(&config).Error; err != nil {
+		return nil, err
+	}
+
+	if err := applyVhost(websiteFromRecord(site)); err != nil {
+		if existed {
+			db.DB.Save(&previous)
+		} else {
+			db.DB.Delete(&config)
+		}
+		return nil, err
+	}
+	if !config.Enabled {
+		nginx.PurgeCache(domain, nil, "", "")
+	}
+	return GetCache(domain)
+}
+
+// PurgeCache removes cached pages of a website and returns how many
+// cache files were deleted
+func PurgeCache(domain string, req PurgeRequest) (int, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return 0, fmt.Errorf("website not found: %v", err)
+	}
+	if req.URL != "" && req.Prefix != "" {
+		return 0, fmt.Errorf("set either url or prefix, not both")
+	}
+	return nginx.PurgeCache(domain, []string{domain, "www." + domain}, req.URL, req.Prefix)
+}
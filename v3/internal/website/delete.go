@@ -0,0 +1,290 @@
+package website
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/backup"
+	"github.com/acmavirus/panda-script/v3/internal/cron"
+	"github.com/acmavirus/panda-script/v3/internal/database"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/ssl"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+var (
+	wpDBUserRegex      = regexp.MustCompile(`define\(\s*['"]DB_USER['"]\s*,\s*['"]([^'"]+)['"]`)
+	laravelDBUserRegex = regexp.MustCompile(`(?m)^DB_USERNAME=["']?([^"'\s]+)`)
+)
+
+// protectedDatabases are never dropped when a website is deleted
+var protectedDatabases = map[string]bool{
+	"mysql":              true,
+	"sys":                true,
+	"information_schema": true,
+	"performance_schema": true,
+}
+
+// DeleteOptions selects what is removed together with a website's nginx config
+type DeleteOptions struct {
+	Files       bool `json:"files"`       // Web root
+	Database    bool `json:"database"`    // Database and database user
+	Certificate bool `json:"certificate"` // Let's Encrypt certificate
+	Revoke      bool `json:"revoke"`      // Revoke the certificate before deleting it
+	Logs        bool `json:"logs"`        // Per-site nginx logs
+	Cron        bool `json:"cron"`        // Cron jobs referencing the site
+	Record      bool `json:"record"`      // db.Website row and its history
+	SkipBackup  bool `json:"skip_backup"` // Do not take a final archive first
+}
+
+// Any reports whether anything beyond the nginx config was selected
+func (o DeleteOptions) Any() bool {
+	return o.Files || o.Database || o.Certificate || o.Logs || o.Cron || o.Record
+}
+
+// DeleteWebsiteFull removes a website and the selected resources as a
+// tracked task. A final backup archive is taken before anything is removed.
+func DeleteWebsiteFull(domain string, opts DeleteOptions) (*task.Task, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("website deletion requires Linux")
+	}
+	if domain == "" || strings.ContainsAny(domain, "/ ") {
+		return nil, fmt.Errorf("invalid domain: %q", domain)
+	}
+
+	var site db.Website
+	hasRecord := db.DB.Where("domain = ?", domain).First(&site).Error == nil
+	if !hasRecord {
+		site = db.Website{Domain: domain, Root: "/home/" + domain}
+	}
+	if opts.Files {
+		if err := checkRemovableRoot(site); err != nil {
+			return nil, err
+		}
+	}
+
+	dbName, dbUser := websiteDatabase(site)
+
+	t := task.StartFunc("delete website "+domain, func(t *task.Task) error {
+		configs := append(availableConfigs(domain), filepath.Join(nginx.SitesAvailable, domain+"-ssl"))
+		if path := webserver.Current().ConfigPath(domain); !slices.Contains(configs, path) {
+			configs = append(configs, path)
+		}
+
+		// 1. Final archive
+		if !opts.SkipBackup {
+			t.Logf("Archiving %s", domain)
+			info, err := backup.ArchiveWebsite(domain, site.Root, dbName, configs)
+			if err != nil {
+				return fmt.Errorf("final backup failed, nothing was deleted: %v", err)
+			}
+			t.Logf("Archive created: %s", info.Path)
+		}
+		t.SetProgress(30)
+
+		// 2. Web server config
+		if err := DeleteWebsite(domain); err != nil {
+			return err
+		}
+		t.Logf("Removed web server config")
+		t.SetProgress(40)
+
+		// 3. Certificate
+		if opts.Certificate {
+			var err error
+			if opts.Revoke {
+				err = ssl.RevokeCertificate(domain)
+			} else {
+				err = ssl.DeleteCertificate(domain)
+			}
+			if err != nil {
+				t.Logf("Warning: %v", err)
+			} else {
+				t.Logf("Removed certificate")
+			}
+		}
+		t.SetProgress(50)
+
+		// 4. Database and user
+		if opts.Database {
+			if dbName == "" {
+				t.Logf("No database found for %s", domain)
+			} else if err := database.DeleteDatabase(dbName, "mysql"); err != nil {
+				t.Logf("Warning: failed to drop database %s: %v", dbName, err)
+			} else {
+				t.Logf("Dropped database %s", dbName)
+			}
+			if dbUser != "" && dbUser != "root" {
+				for _, host := range []string{"localhost", "127.0.0.1"} {
+					database.ExecuteQuery("", "mysql", fmt.Sprintf("DROP USER IF EXISTS '%s'@'%s';", dbUser, host))
+				}
+				database.ExecuteQuery("", "mysql", "FLUSH PRIVILEGES;")
+				t.Logf("Dropped database user %s", dbUser)
+			}
+		}
+		t.SetProgress(65)
+
+		// 5. Logs
+		if opts.Logs {
+			logDir := filepath.Dir(webserver.Current().AccessLog(domain))
+			matches, _ := filepath.Glob(filepath.Join(logDir, domain+".*.log*"))
+			for _, m := range matches {
+				os.Remove(m)
+			}
+			t.Logf("Removed %d log files", len(matches))
+		}
+
+		// 6. Cron jobs
+		if opts.Cron {
+			removed, err := cron.DeleteMatching(site.Root, domain)
+			if err != nil {
+				t.Logf("Warning: %v", err)
+			}
+			t.Logf("Removed %d cron jobs", len(removed))
+		}
+		t.SetProgress(75)
+
+		// 7. Web root
+		if opts.Files {
+			if err := os.RemoveAll(site.Root); err != nil {
+				return fmt.Errorf("failed to remove web root: %v", err)
+			}
+			t.Logf("Removed %s", site.Root)
+		}
+		t.SetProgress(90)
+
+		// 8. DB record
+		if opts.Record && hasRecord {
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.UptimeCheck{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.EnvVar{})
+			var rules []db.AuthRule
+			db.DB.Where("website_id = ?", site.ID).Find(&rules)
+			for _, r := range rules {
+				db.DB.Where("rule_id = ?", r.ID).Delete(&db.AuthUser{})
+				os.Remove(nginx.HtpasswdPath(domain, r.ID))
+			}
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.AuthRule{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.SiteStatsDaily{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.SiteRequestSample{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.LaravelConfig{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.ErrorPage{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.CacheConfig{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.SecurityConfig{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.RateLimitConfig{})
+			db.DB.Where("website_id = ?", site.ID).Delete(&db.GeoRule{})
+			deleteUpstream(site.ID)
+			cron.DeleteByName(schedulerCronName(domain))
+			db.DB.Where("key = ?", "stats_cursor:"+domain).Delete(&db.Setting{})
+			os.Remove(EnvFilePath(domain))
+			db.DB.Delete(&site)
+			t.Logf("Removed website record")
+		}
+
+		return nil
+	})
+
+	return t, nil
+}
+
+// passwdPath lists the login users, whose home directories are never a web
+// root to delete
+var passwdPath = "/etc/passwd"
+
+// checkRemovableRoot only lets a site's own directory be deleted: /home/<domain>
+// or another direct child of /home or /var/www, that is not a symlink, not a
+// login user's home and not used by another website
+func checkRemovableRoot(site db.Website) error {
+	clean := filepath.Clean(site.Root)
+	refuse := fmt.Errorf("refusing to delete web root %q", site.Root)
+
+	parent := filepath.Dir(clean)
+	switch {
+	case clean == filepath.Join("/home", site.Domain):
+	case parent == "/home":
+		if loginHomes()[clean] {
+			return refuse
+		}
+	case parent == "/var/www":
+		if clean == "/var/www/html" {
+			return refuse
+		}
+	default:
+		return refuse
+	}
+
+	if info, err := os.Lstat(clean); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 || !info.IsDir() {
+			return refuse
+		}
+		if resolved, err := filepath.EvalSymlinks(clean); err != nil || resolved != clean {
+			return refuse
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var others []db.Website
+	db.DB.Where("id <> ?", site.ID).Find(&others)
+	for _, other := range others {
+		root := filepath.Clean(other.Root)
+		if root == clean || strings.HasPrefix(root, clean+"/") {
+			return fmt.Errorf("refusing to delete web root %q, %s uses it", site.Root, other.Domain)
+		}
+	}
+	return nil
+}
+
+// loginHomes returns the home directories of the users in /etc/passwd
+func loginHomes() map[string]bool {
+	homes := map[string]bool{}
+	content, err := os.ReadFile(passwdPath)
+	if err != nil {
+		return homes
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Split(line, ":"); len(fields) > 5 && fields[5] != "" {
+			homes[filepath.Clean(fields[5])] = true
+		}
+	}
+	return homes
+}
+
+// websiteDatabase returns the database and user a site uses: the ones in its
+// app config if present, otherwise the names the panel derives from the domain
+func websiteDatabase(site db.Website) (string, string) {
+	name := configuredDatabase(site)
+	user := ""
+	if content, err := os.ReadFile(filepath.Join(site.Root, "wp-config.php")); err == nil {
+		if m := wpDBUserRegex.FindSubmatch(content); len(m) > 1 {
+			user = string(m[1])
+		}
+	} else if content, err := os.ReadFile(filepath.Join(site.Root, ".env")); err == nil {
+		if m := laravelDBUserRegex.FindSubmatch(content); len(m) > 1 {
+			user = string(m[1])
+		}
+	}
+
+	derived := strings.ReplaceAll(site.Domain, ".", "_")
+	derived = strings.ReplaceAll(derived, "-", "_")
+	if name == "" && checkMySQLDatabaseExists(derived) {
+		name = derived
+	}
+	if !dbIdentifierRegex.MatchString(user) {
+		user = ""
+	}
+	if user == "" && name == derived {
+		user = derived
+	}
+	if protectedDatabases[name] {
+		name = ""
+	}
+
+	return name, user
+}
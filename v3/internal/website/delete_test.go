@@ -0,0 +1,84 @@
+package website
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// useTestDB points db.DB at an empty in-memory database
+func useTestDB(t *testing.T) {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&db.Website{}); err != nil {
+		t.Fatal(err)
+	}
+	old := db.DB
+	db.DB = conn
+	t.Cleanup(func() { db.DB = old })
+}
+
+func TestCheckRemovableRoot(t *testing.T) {
+	useTestDB(t)
+	db.DB.Create(&db.Website{Domain: "other.com", Root: "/var/www/shared/public"})
+	db.DB.Create(&db.Website{Domain: "twin.com", Root: "/home/twin"})
+
+	passwd := filepath.Join(t.TempDir(), "passwd")
+	os.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\nubuntu:x:1000:1000::/home/ubuntu:/bin/bash\n"), 0644)
+	old := passwdPath
+	passwdPath = passwd
+	t.Cleanup(func() { passwdPath = old })
+
+	tests := []struct {
+		domain string
+		root   string
+		ok     bool
+	}{
+		{"a.com", "/home/a.com", true},
+		{"a.com", "/home/a.com/", true},
+		{"a.com", "/home/a-site", true},
+		{"a.com", "/var/www/a.com", true},
+		{"a.com", "/home/a.com/public", false},
+		{"a.com", "/home", false},
+		{"a.com", "/home/ubuntu", false},
+		{"a.com", "/home/twin", false},
+		{"a.com", "/var/www", false},
+		{"a.com", "/var/www/html", false},
+		{"a.com", "/var/www/shared", false},
+		{"a.com", "/usr/share/nginx/html", false},
+		{"a.com", "/etc/nginx", false},
+		{"a.com", "/", false},
+		{"a.com", "/home/../etc", false},
+		{"a.com", "relative/path", false},
+	}
+	for _, tt := range tests {
+		err := checkRemovableRoot(db.Website{Domain: tt.domain, Root: tt.root})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.root, err, tt.ok)
+		}
+	}
+
+	// The twin.com record may delete its own root
+	var twin db.Website
+	db.DB.Where("domain = ?", "twin.com").First(&twin)
+	if err := checkRemovableRoot(twin); err != nil {
+		t.Errorf("own root refused: %v", err)
+	}
+
+	link := filepath.Join("/home", "panda-test-link-"+filepath.Base(t.TempDir()))
+	if err := os.Symlink(t.TempDir(), link); err != nil {
+		t.Skipf("cannot create a symlink in /home: %v", err)
+	}
+	defer os.Remove(link)
+	if err := checkRemovableRoot(db.Website{Domain: "a.com", Root: link}); err == nil {
+		t.Errorf("symlinked root %s accepted", link)
+	}
+}
@@ -0,0 +1,388 @@
+package website
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/auth"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+)
+
+// Where a site's environment is rendered to
+const (
+	EnvTargetDotenv  = "dotenv"  // <root>/.env
+	EnvTargetPM2     = "pm2"     // <root>/ecosystem.panda.config.js
+	EnvTargetSystemd = "systemd" // /etc/panda/env/<domain>.env
+)
+
+// SecretMask replaces secret values on read. Sending it back unchanged keeps the stored value.
+const SecretMask = "********"
+
+// EnvDir holds the EnvironmentFiles of systemd managed sites
+const EnvDir = "/etc/panda/env"
+
+const pm2EcosystemFile = "ecosystem.panda.config.js"
+
+var (
+	envKeyRegex  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envLineRegex = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*=`)
+	envSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_./:@,+-]*$`)
+)
+
+// EnvEntry is a single variable as seen by the API
+type EnvEntry struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret"`
+}
+
+// EnvConfig is the full environment of a site
+type EnvConfig struct {
+	Target string     `json:"target"`
+	Vars   []EnvEntry `json:"vars"`
+}
+
+// ServiceName is the systemd unit the panel runs a site's app as
+func ServiceName(domain string) string {
+	return "panda-" + domain
+}
+
+// EnvFilePath is the systemd EnvironmentFile of a site
+func EnvFilePath(domain string) string {
+	return filepath.Join(EnvDir, domain+".env")
+}
+
+// envTarget returns where a site's environment is rendered
+func envTarget(site db.Website) string {
+	if site.EnvTarget != "" {
+		return site.EnvTarget
+	}
+	switch site.Type {
+	case "nodejs":
+		return EnvTargetPM2
+	case "python", "java", "go", "docker":
+		return EnvTargetSystemd
+	default:
+		return EnvTargetDotenv
+	}
+}
+
+// GetEnv returns a site's environment with secret values masked
+func GetEnv(domain string) (*EnvConfig, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+
+	var vars []db.EnvVar
+	if err := db.DB.Where("website_id = ?", site.ID).Order("key").Find(&vars).Error; err != nil {
+		return nil, err
+	}
+
+	config := &EnvConfig{Target: envTarget(site), Vars: []EnvEntry{}}
+	for _, v := range vars {
+		entry := EnvEntry{Key: v.Key, Value: v.Value, Secret: v.Secret}
+		if v.Secret {
+			entry.Value = SecretMask
+		}
+		config.Vars = append(config.Vars, entry)
+	}
+	return config, nil
+}
+
+// SetEnv replaces a site's environment. Variables missing from config are
+// removed. If anything changed the environment is rendered and the app restarted.
+func SetEnv(domain string, config EnvConfig) (bool, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return false, fmt.Errorf("website not found: %v", err)
+	}
+
+	switch config.Target {
+	case "", EnvTargetDotenv, EnvTargetPM2, EnvTargetSystemd:
+	default:
+		return false, fmt.Errorf("unknown env target: %s", config.Target)
+	}
+
+	var existing []db.EnvVar
+	if err := db.DB.Where("website_id = ?", site.ID).Find(&existing).Error; err != nil {
+		return false, err
+	}
+	current := make(map[string]db.EnvVar)
+	for _, v := range existing {
+		current[v.Key] = v
+	}
+
+	changed := config.Target != "" && config.Target != envTarget(site)
+	seen := make(map[string]bool)
+	var updated []db.EnvVar
+	for _, entry := range config.Vars {
+		if !envKeyRegex.MatchString(entry.Key) {
+			return false, fmt.Errorf("invalid variable name: %q", entry.Key)
+		}
+		if seen[entry.Key] {
+			return false, fmt.Errorf("duplicate variable: %s", entry.Key)
+		}
+		seen[entry.Key] = true
+
+		v, ok := current[entry.Key]
+		if !ok {
+			v = db.EnvVar{WebsiteID: site.ID, Key: entry.Key}
+		}
+
+		old, err := plainValue(v)
+		if ok && err != nil {
+			return false, fmt.Errorf("failed to decrypt %s: %v", entry.Key, err)
+		}
+		value := entry.Value
+		if value == SecretMask && ok && v.Secret {
+			value = old
+		} else if value == SecretMask && entry.Secret {
+			return false, fmt.Errorf("a value is required for %s", entry.Key)
+		}
+		if ok && value == old && entry.Secret == v.Secret {
+			continue
+		}
+
+		v.Secret = entry.Secret
+		v.Value = value
+		if v.Secret {
+			if v.Value, err = auth.Encrypt(value); err != nil {
+				return false, fmt.Errorf("failed to encrypt %s: %v", entry.Key, err)
+			}
+		}
+		updated = append(updated, v)
+		changed = true
+	}
+
+	var removed []string
+	for key := range current {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) > 0 {
+		changed = true
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	tx := db.DB.Begin()
+	for i := range updated {
+		if err := tx.Save(&updated[i]).Error; err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if len(removed) > 0 {
+		if err := tx.Where("website_id = ? AND key IN ?", site.ID, removed).Delete(&db.EnvVar{}).Error; err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if config.Target != "" {
+		site.EnvTarget = config.Target
+		if err := tx.Model(&site).Update("env_target", config.Target).Error; err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+
+	return true, applyEnv(site, removed)
+}
+
+// ApplyEnv renders a site's stored environment and restarts its app
+func ApplyEnv(domain string) error {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return fmt.Errorf("website not found: %v", err)
+	}
+	return applyEnv(site, nil)
+}
+
+func applyEnv(site db.Website, removed []string) error {
+	var vars []db.EnvVar
+	if err := db.DB.Where("website_id = ?", site.ID).Order("key").Find(&vars).Error; err != nil {
+		return err
+	}
+
+	env := make([]EnvEntry, 0, len(vars))
+	for _, v := range vars {
+		value, err := plainValue(v)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %v", v.Key, err)
+		}
+		env = append(env, EnvEntry{Key: v.Key, Value: value, Secret: v.Secret})
+	}
+
+	switch envTarget(site) {
+	case EnvTargetPM2:
+		path := filepath.Join(site.Root, pm2EcosystemFile)
+		if err := writePM2Ecosystem(path, site, env); err != nil {
+			return err
+		}
+		if out, err := system.Execute(fmt.Sprintf("pm2 startOrReload %s --update-env && pm2 save", path)); err != nil {
+			return fmt.Errorf("failed to restart PM2 app: %s", strings.TrimSpace(out))
+		}
+
+	case EnvTargetSystemd:
+		if err := writeEnvironmentFile(EnvFilePath(site.Domain), env); err != nil {
+			return err
+		}
+		// try-restart leaves the unit alone if it is not running
+		if out, err := system.Execute(fmt.Sprintf("systemctl try-restart %s.service", ServiceName(site.Domain))); err != nil {
+			return fmt.Errorf("failed to restart %s: %s", ServiceName(site.Domain), strings.TrimSpace(out))
+		}
+
+	default:
+		if err := writeDotenv(filepath.Join(site.Root, ".env"), env, removed); err != nil {
+			return err
+		}
+		if site.Type == "laravel" {
+			for _, args := range []string{"config:clear", "queue:restart"} {
+				cmd, err := artisanCommand(&site, args)
+				if err != nil {
+					return err
+				}
+				if out, err := system.Execute(cmd); err != nil {
+					return fmt.Errorf("failed to reload Laravel config: %s", strings.TrimSpace(out))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func plainValue(v db.EnvVar) (string, error) {
+	if !v.Secret || v.Value == "" {
+		return v.Value, nil
+	}
+	return auth.Decrypt(v.Value)
+}
+
+// writeDotenv updates the managed keys of a .env file in place, keeping
+// comments and variables the panel does not manage
+func writeDotenv(path string, env []EnvEntry, removed []string) error {
+	values := make(map[string]string)
+	for _, e := range env {
+		values[e.Key] = e.Key + "=" + quoteEnvValue(e.Value, true)
+	}
+	drop := make(map[string]bool)
+	for _, key := range removed {
+		drop[key] = true
+	}
+
+	mode := os.FileMode(0640)
+	var lines []string
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	written := make(map[string]bool)
+	var out []string
+	for _, line := range lines {
+		m := envLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			out = append(out, line)
+			continue
+		}
+		key := m[1]
+		if line, ok := values[key]; ok {
+			if !written[key] {
+				out = append(out, line)
+				written[key] = true
+			}
+			continue
+		}
+		if !drop[key] {
+			out = append(out, line)
+		}
+	}
+	for _, e := range env {
+		if !written[e.Key] {
+			out = append(out, values[e.Key])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), mode); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	system.Execute(fmt.Sprintf("chown www-data:www-data %s", path))
+	return nil
+}
+
+// writeEnvironmentFile writes a systemd EnvironmentFile readable by root only
+func writeEnvironmentFile(path string, env []EnvEntry) error {
+	var sb strings.Builder
+	sb.WriteString("# Managed by Panda Panel, changes will be overwritten\n")
+	for _, e := range env {
+		sb.WriteString(e.Key + "=" + quoteEnvValue(e.Value, false) + "\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// writePM2Ecosystem writes a PM2 ecosystem file that starts the app with `npm start`
+func writePM2Ecosystem(path string, site db.Website, env []EnvEntry) error {
+	envMap := make(map[string]string)
+	for _, e := range env {
+		envMap[e.Key] = e.Value
+	}
+	if site.BackendPort != 0 {
+		if _, ok := envMap["PORT"]; !ok {
+			envMap["PORT"] = fmt.Sprint(site.BackendPort)
+		}
+	}
+
+	app := map[string]interface{}{
+		"name":   site.Domain,
+		"cwd":    site.Root,
+		"script": "npm",
+		"args":   "start",
+		"env":    envMap,
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"apps": []interface{}{app}}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	content := "// Managed by Panda Panel, changes will be overwritten\nmodule.exports = " + string(data) + ";\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// quoteEnvValue quotes a value for a .env or EnvironmentFile line.
+// Single quotes keep dotenv parsers from expanding $ references.
+func quoteEnvValue(value string, allowSingle bool) string {
+	if envSafeRegex.MatchString(value) {
+		return value
+	}
+	if allowSingle && !strings.ContainsAny(value, "'\n") {
+		return "'" + value + "'"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(value) + `"`
+}
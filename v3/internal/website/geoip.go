@@ -0,0 +1,200 @@
+package website
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/geoip"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+// GeoSettings is the country rule in effect for a website
+type GeoSettings struct {
+	db.GeoRule
+	Inherited bool `json:"inherited"` // The site has no rule of its own and follows the panel-wide one
+}
+
+// GetGeoRule returns the country rule of a website, or the panel-wide rule
+// if it has none
+func GetGeoRule(domain string) (*GeoSettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	var rule db.GeoRule
+	if db.DB.Where("website_id = ?", site.ID).First(&rule).Error == nil {
+		return &GeoSettings{GeoRule: rule}, nil
+	}
+	return &GeoSettings{GeoRule: *GetPanelGeoRule(), Inherited: true}, nil
+}
+
+// SetGeoRule gives a website a country rule of its own, which replaces the
+// panel-wide rule for it; a disabled rule opts the site out. The previous
+// rule is kept if the vhost does not validate.
+func SetGeoRule(domain string, rule db.GeoRule) (*GeoSettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if err := checkGeoRule(&rule); err != nil {
+		return nil, err
+	}
+
+	var previous db.GeoRule
+	existed := db.DB.Where("website_id = ?", site.ID).First(&previous).Error == nil
+	rule.ID = previous.ID
+	rule.WebsiteID = site.ID
+	if err := db.DB.Save(&rule).Error; err != nil {
+		return nil, err
+	}
+
+	if err := applyVhost(websiteFromRecord(site)); err != nil {
+		if existed {
+			db.DB.Save(&previous)
+		} else {
+			db.DB.Delete(&rule)
+		}
+		return nil, err
+	}
+	if !rule.Enabled {
+		os.Remove(nginx.GeoNetworksPath(domain))
+	}
+	return GetGeoRule(domain)
+}
+
+// DeleteGeoRule removes the country rule of a website, so the panel-wide
+// rule applies to it again
+func DeleteGeoRule(domain string) (*GeoSettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	var previous db.GeoRule
+	if err := db.DB.Where("website_id = ?", site.ID).First(&previous).Error; err != nil {
+		return nil, fmt.Errorf("website has no country rule of its own")
+	}
+	if err := db.DB.Delete(&previous).Error; err != nil {
+		return nil, err
+	}
+
+	if err := applyVhost(websiteFromRecord(site)); err != nil {
+		db.DB.Create(&previous)
+		return nil, err
+	}
+	os.Remove(nginx.GeoNetworksPath(domain))
+	return GetGeoRule(domain)
+}
+
+// GetPanelGeoRule returns the panel-wide country rule, disabled and empty
+// if none is set
+func GetPanelGeoRule() *db.GeoRule {
+	rule, ok := nginx.PanelGeoRule()
+	if !ok {
+		rule = db.GeoRule{Mode: nginx.GeoDeny}
+	}
+	if rule.Countries == nil {
+		rule.Countries = []string{}
+	}
+	return &rule
+}
+
+// SetPanelGeoRule stores the panel-wide country rule and applies it. When
+// the rule is switched on or off, the websites without a rule of their own
+// are re-rendered to start or stop checking it.
+func SetPanelGeoRule(rule db.GeoRule) (*db.GeoRule, error) {
+	if err := webserver.RequireNginx("the panel-wide country rule"); err != nil {
+		return nil, err
+	}
+	if err := checkGeoRule(&rule); err != nil {
+		return nil, err
+	}
+
+	previous, existed := nginx.PanelGeoRule()
+	rule.ID = previous.ID
+	rule.WebsiteID = 0
+	if err := db.DB.Save(&rule).Error; err != nil {
+		return nil, err
+	}
+
+	if err := nginx.ApplyPanelGeo(); err != nil {
+		if existed {
+			db.DB.Save(&previous)
+		} else {
+			db.DB.Delete(&rule)
+		}
+		return nil, err
+	}
+	if !rule.Enabled {
+		os.Remove(nginx.GeoNetworksPath(""))
+	}
+
+	if rule.Enabled != (existed && previous.Enabled) {
+		var sites []db.Website
+		db.DB.Where("id NOT IN (?)", db.DB.Model(&db.GeoRule{}).Select("website_id")).Find(&sites)
+		var failed []string
+		for _, site := range sites {
+			if err := applyVhost(websiteFromRecord(site)); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", site.Domain, err))
+			}
+		}
+		if len(failed) > 0 {
+			return nil, fmt.Errorf("the rule was saved, but these websites were not updated: %s", strings.Join(failed, "; "))
+		}
+	}
+	return GetPanelGeoRule(), nil
+}
+
+// checkGeoRule normalizes the country codes of a rule and validates it.
+// An enabled rule needs the country database.
+func checkGeoRule(rule *db.GeoRule) error {
+	if rule.Mode == "" {
+		rule.Mode = nginx.GeoDeny
+	}
+	countries := []string{}
+	seen := map[string]bool{}
+	for _, c := range rule.Countries {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "" && !seen[c] {
+			seen[c] = true
+			countries = append(countries, c)
+		}
+	}
+	rule.Countries = countries
+	if err := nginx.ValidateGeoRule(*rule); err != nil {
+		return err
+	}
+	if rule.Enabled && !geoip.Available(geoip.KindCountry) {
+		return fmt.Errorf("no country database installed, add one to %s", geoip.DatabasePath(geoip.KindCountry))
+	}
+	return nil
+}
+
+// UpdateGeoDatabase installs a GeoIP database from a local file. A new
+// country database is rendered into the enabled country rules right away.
+func UpdateGeoDatabase(kind, path string) (*geoip.DatabaseInfo, error) {
+	info, err := geoip.Update(kind, path)
+	if err != nil || kind != geoip.KindCountry {
+		return info, err
+	}
+
+	var failed []string
+	if rule, ok := nginx.PanelGeoRule(); ok && rule.Enabled {
+		if err := nginx.ApplyPanelGeo(); err != nil {
+			failed = append(failed, fmt.Sprintf("panel-wide rule: %v", err))
+		}
+	}
+	var sites []db.Website
+	db.DB.Where("id IN (?)", db.DB.Model(&db.GeoRule{}).Select("website_id").Where("enabled = ?", true)).Find(&sites)
+	for _, site := range sites {
+		if err := applyVhost(websiteFromRecord(site)); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", site.Domain, err))
+		}
+	}
+	if len(failed) > 0 {
+		return info, fmt.Errorf("the database was installed, but these country rules were not updated: %s", strings.Join(failed, "; "))
+	}
+	return info, nil
+}
@@ -0,0 +1,335 @@
+package website
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+var (
+	phpSocketRegex = regexp.MustCompile(`php(\d+\.\d+)-fpm\.sock`)
+	proxyPortRegex = regexp.MustCompile(`^https?://(?:127\.0\.0\.1|localhost|\[::1\]):(\d+)`)
+)
+
+// ScannedVhost is what could be understood from an existing nginx config
+type ScannedVhost struct {
+	File        string   `json:"file"`
+	Domain      string   `json:"domain"`
+	Aliases     []string `json:"aliases,omitempty"`
+	Type        string   `json:"type"`
+	Root        string   `json:"root,omitempty"`
+	PHPVersion  string   `json:"php_version,omitempty"`
+	BackendPort int      `json:"backend_port,omitempty"`
+	SSL         bool     `json:"ssl"`
+	CertPath    string   `json:"cert_path,omitempty"`
+	KeyPath     string   `json:"key_path,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// ImportIssue describes a config that was not imported
+type ImportIssue struct {
+	File   string `json:"file"`
+	Domain string `json:"domain,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ImportResult is the report of an import scan
+type ImportResult struct {
+	Imported []ScannedVhost `json:"imported"`
+	Skipped  []ImportIssue  `json:"skipped"`
+	Failed   []ImportIssue  `json:"failed"`
+}
+
+// ImportExistingSites scans sites-enabled for vhosts that have no
+// db.Website row and creates records for the ones it understands.
+// With dryRun set nothing is written to the database.
+func ImportExistingSites(dryRun bool) (*ImportResult, error) {
+	if err := webserver.RequireNginx("importing existing sites"); err != nil {
+		return nil, err
+	}
+	enabledDir := "/etc/nginx/sites-enabled"
+	if runtime.GOOS == "windows" {
+		enabledDir = "nginx/sites-enabled"
+	}
+
+	files, err := os.ReadDir(enabledDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", enabledDir, err)
+	}
+
+	result := &ImportResult{
+		Imported: []ScannedVhost{},
+		Skipped:  []ImportIssue{},
+		Failed:   []ImportIssue{},
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !isWebsiteConfig(f.Name()) {
+			continue
+		}
+
+		path := filepath.Join(enabledDir, f.Name())
+		vhosts, issues, err := ScanVhosts(path)
+		if err != nil {
+			result.Failed = append(result.Failed, ImportIssue{File: path, Reason: err.Error()})
+			continue
+		}
+		result.Failed = append(result.Failed, issues...)
+
+		for _, vhost := range vhosts {
+			var count int64
+			db.DB.Model(&db.Website{}).Where("domain = ?", vhost.Domain).Count(&count)
+			if count > 0 {
+				result.Skipped = append(result.Skipped, ImportIssue{File: path, Domain: vhost.Domain, Reason: "already managed by the panel"})
+				continue
+			}
+
+			if !dryRun {
+				if err := db.DB.Create(vhost.record()).Error; err != nil {
+					result.Failed = append(result.Failed, ImportIssue{File: path, Domain: vhost.Domain, Reason: err.Error()})
+					continue
+				}
+			}
+			result.Imported = append(result.Imported, *vhost)
+		}
+	}
+
+	return result, nil
+}
+
+// record is the website row an imported vhost becomes. The aliases and
+// certificate are kept, so rendering the site again serves the same names
+// over HTTPS.
+func (v *ScannedVhost) record() *db.Website {
+	return &db.Website{
+		Domain:      v.Domain,
+		Type:        v.Type,
+		Port:        80,
+		Root:        v.Root,
+		SSL:         v.SSL,
+		PHPVersion:  v.PHPVersion,
+		BackendPort: v.BackendPort,
+		Aliases:     v.Aliases,
+		CertPath:    v.CertPath,
+		KeyPath:     v.KeyPath,
+	}
+}
+
+// ScanVhosts parses an nginx config, following its includes, and returns a
+// site for each domain its server blocks serve. The blocks of one domain,
+// e.g. an HTTP redirect and the HTTPS server, make up one site. Sites that
+// cannot be understood are returned as issues.
+func ScanVhosts(file string) ([]*ScannedVhost, []ImportIssue, error) {
+	config, err := nginx.ParseFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	servers := findServerBlocks(config.All())
+	if len(servers) == 0 {
+		return nil, nil, fmt.Errorf("no server block found")
+	}
+
+	// Group the blocks by domain, in the order they appear
+	var domains []string
+	groups := map[string][]*nginx.Directive{}
+	for _, server := range servers {
+		domain := serverDomain(server)
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], server)
+	}
+
+	var vhosts []*ScannedVhost
+	var issues []ImportIssue
+	for _, domain := range domains {
+		vhost, err := scanServers(file, groups[domain])
+		if err != nil {
+			issues = append(issues, ImportIssue{File: file, Domain: domain, Reason: err.Error()})
+			continue
+		}
+		vhosts = append(vhosts, vhost)
+	}
+
+	// A catch-all block next to real sites is not a site of its own
+	if len(vhosts) > 0 {
+		kept := issues[:0]
+		for _, issue := range issues {
+			if issue.Domain != "" {
+				kept = append(kept, issue)
+			}
+		}
+		issues = kept
+	}
+	return vhosts, issues, nil
+}
+
+// findServerBlocks returns the server blocks in a list of directives,
+// including those inside http blocks
+func findServerBlocks(list []*nginx.Directive) []*nginx.Directive {
+	var servers []*nginx.Directive
+	for _, d := range list {
+		switch {
+		case d.Block == nil:
+		case d.Name == "server":
+			servers = append(servers, d)
+		default:
+			servers = append(servers, findServerBlocks(d.Children())...)
+		}
+	}
+	return servers
+}
+
+// serverNames returns the usable names of a server block
+func serverNames(server *nginx.Directive) []string {
+	var names []string
+	for _, d := range nginx.Find(server.Block, "server_name") {
+		for _, name := range d.Args {
+			if name == "_" || name == "localhost" || strings.ContainsAny(name, "*~") {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// serverDomain is the domain a server block serves: its first name without
+// www., or an empty string when it has no usable name
+func serverDomain(server *nginx.Directive) string {
+	names := serverNames(server)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "www.") {
+			return name
+		}
+	}
+	if len(names) > 0 {
+		return strings.TrimPrefix(names[0], "www.")
+	}
+	return ""
+}
+
+// serverDirectives returns the directives of a block and its nested blocks,
+// with included files in place
+func serverDirectives(block *nginx.Directive) []*nginx.Directive {
+	var out []*nginx.Directive
+	for _, d := range block.Children() {
+		out = append(out, d)
+		if d.Block != nil {
+			out = append(out, serverDirectives(d)...)
+		}
+	}
+	return out
+}
+
+// scanServers extracts the site settings from the server blocks of one domain
+func scanServers(file string, servers []*nginx.Directive) (*ScannedVhost, error) {
+	vhost := &ScannedVhost{File: file, Domain: serverDomain(servers[0])}
+	if vhost.Domain == "" {
+		return nil, fmt.Errorf("no usable server_name")
+	}
+	hasFastCGI := false
+	for _, server := range servers {
+		for _, name := range serverNames(server) {
+			if name == vhost.Domain || containsString(vhost.Aliases, name) {
+				continue
+			}
+			// Aliases are written into server_name when the site is rendered
+			if ValidateDomain(name) != nil {
+				vhost.Warnings = append(vhost.Warnings, fmt.Sprintf("server name %q is not a plain domain and is not kept", name))
+				continue
+			}
+			vhost.Aliases = append(vhost.Aliases, name)
+		}
+		for _, d := range serverDirectives(server) {
+			switch d.Name {
+			case "root":
+				if vhost.Root == "" && len(d.Args) > 0 {
+					vhost.Root = d.Args[0]
+				}
+			case "listen":
+				for _, arg := range d.Args {
+					if arg == "ssl" {
+						vhost.SSL = true
+					}
+				}
+			case "ssl_certificate":
+				if len(d.Args) > 0 {
+					vhost.SSL = true
+					vhost.CertPath = d.Args[0]
+				}
+			case "ssl_certificate_key":
+				if len(d.Args) > 0 {
+					vhost.KeyPath = d.Args[0]
+				}
+			case "fastcgi_pass":
+				hasFastCGI = true
+				if len(d.Args) == 0 {
+					continue
+				}
+				if m := phpSocketRegex.FindStringSubmatch(d.Args[0]); len(m) > 1 {
+					vhost.PHPVersion = m[1]
+				} else if vhost.PHPVersion == "" {
+					vhost.Warnings = append(vhost.Warnings, "could not determine PHP version from fastcgi_pass "+d.Args[0])
+				}
+			case "proxy_pass":
+				if len(d.Args) == 0 || vhost.BackendPort != 0 {
+					continue
+				}
+				if m := proxyPortRegex.FindStringSubmatch(d.Args[0]); len(m) > 1 {
+					vhost.BackendPort, _ = strconv.Atoi(m[1])
+				} else {
+					vhost.Warnings = append(vhost.Warnings, "proxy_pass target is not a local port: "+d.Args[0])
+				}
+			}
+		}
+	}
+
+	switch {
+	case hasFastCGI:
+		vhost.Type = "php"
+		if strings.HasSuffix(vhost.Root, "/public") {
+			project := strings.TrimSuffix(vhost.Root, "/public")
+			if _, err := os.Stat(filepath.Join(project, "artisan")); err == nil {
+				vhost.Type = "laravel"
+				vhost.Root = project
+			}
+		} else if vhost.Root != "" {
+			if _, err := os.Stat(filepath.Join(vhost.Root, "wp-config.php")); err == nil {
+				vhost.Type = "wordpress"
+			}
+		}
+	case vhost.BackendPort != 0:
+		vhost.Type = "nodejs"
+	case vhost.Root != "":
+		vhost.Type = "static"
+	default:
+		return nil, fmt.Errorf("neither a document root nor a local proxy_pass was found")
+	}
+
+	if vhost.Root == "" {
+		vhost.Root = "/home/" + vhost.Domain
+	}
+	if base := strings.TrimSuffix(filepath.Base(file), ".conf"); base != vhost.Domain {
+		vhost.Warnings = append(vhost.Warnings, fmt.Sprintf("config file name %q does not match server_name %s", filepath.Base(file), vhost.Domain))
+	}
+
+	return vhost, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
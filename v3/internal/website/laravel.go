@@ -0,0 +1,444 @@
+package website
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/acmavirus/panda-script/v3/internal/cron"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+)
+
+// Status values of a LaravelCheck
+const (
+	CheckOK      = "ok"
+	CheckWarning = "warning"
+	CheckError   = "error"
+)
+
+const maxQueueWorkers = 32
+
+var (
+	artisanArgRegex   = regexp.MustCompile(`^[A-Za-z0-9:_\-=.,/@+]+$`)
+	queueNameRegex    = regexp.MustCompile(`^[A-Za-z0-9_\-,]*$`)
+	laravelKeyRegex   = regexp.MustCompile(`(?m)^APP_KEY=["']?([^"'\s]*)`)
+	laravelEnvRegex   = regexp.MustCompile(`(?m)^APP_ENV=["']?([^"'\s]*)`)
+	laravelDebugRegex = regexp.MustCompile(`(?m)^APP_DEBUG=["']?([^"'\s]*)`)
+)
+
+// artisanBlocked are commands that never return or need a terminal
+var artisanBlocked = map[string]bool{
+	"tinker":        true,
+	"serve":         true,
+	"queue:work":    true,
+	"queue:listen":  true,
+	"schedule:work": true,
+	"pail":          true,
+}
+
+const queueUnitTemplate = `# Managed by Panda Panel, changes will be overwritten
+[Unit]
+Description=Panda queue worker %i for {{.Domain}}
+After=network.target
+
+[Service]
+User=www-data
+Group=www-data
+WorkingDirectory={{.Root}}
+ExecStart={{.PHP}} {{.Root}}/artisan queue:work{{if .Connection}} {{.Connection}}{{end}}{{if .Queue}} --queue={{.Queue}}{{end}} --sleep=3 --tries={{.Tries}} --timeout={{.Timeout}} --max-time=3600
+Restart=always
+RestartSec=5
+TimeoutStopSec={{.StopTimeout}}
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// LaravelCheck is one item of the environment check
+type LaravelCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"` // Artisan command, or "permissions"
+}
+
+// LaravelInfo is the toolkit overview of a laravel website
+type LaravelInfo struct {
+	Domain         string           `json:"domain"`
+	Version        string           `json:"version"`
+	Config         db.LaravelConfig `json:"config"`
+	RunningWorkers int              `json:"running_workers"`
+	Checks         []LaravelCheck   `json:"checks"`
+}
+
+func findLaravelSite(domain string) (*db.Website, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if site.Type != "laravel" {
+		return nil, fmt.Errorf("%s is not a laravel site", domain)
+	}
+	return &site, nil
+}
+
+func laravelConfig(site *db.Website) db.LaravelConfig {
+	config := db.LaravelConfig{WebsiteID: site.ID, Tries: 3, Timeout: 60}
+	db.DB.Where("website_id = ?", site.ID).First(&config)
+	return config
+}
+
+// phpBinary returns the CLI binary of the site's PHP version
+func phpBinary(site *db.Website) string {
+	if site.PHPVersion != "" {
+		bin := "/usr/bin/php" + site.PHPVersion
+		if _, err := os.Stat(bin); err == nil {
+			return bin
+		}
+	}
+	return "/usr/bin/php"
+}
+
+func schedulerCronName(domain string) string {
+	return "laravel-scheduler:" + domain
+}
+
+func queueUnitName(domain string) string {
+	return ServiceName(domain) + "-queue@"
+}
+
+// artisanCommand builds the shell command that runs artisan as www-data
+func artisanCommand(site *db.Website, args string) (string, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("artisan command is required")
+	}
+	if artisanBlocked[fields[0]] {
+		return "", fmt.Errorf("%s is not available from the panel", fields[0])
+	}
+	for _, f := range fields {
+		if !artisanArgRegex.MatchString(f) {
+			return "", fmt.Errorf("invalid argument: %q", f)
+		}
+	}
+	return fmt.Sprintf("cd %s && runuser -u www-data -- %s artisan %s --no-interaction 2>&1",
+		shellQuote(site.Root), phpBinary(site), strings.Join(fields, " ")), nil
+}
+
+// RunArtisan runs an artisan command for a site as a tracked task
+func RunArtisan(domain, args string) (*task.Task, error) {
+	site, err := findLaravelSite(domain)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := artisanCommand(site, args)
+	if err != nil {
+		return nil, err
+	}
+
+	t := task.StartFunc("artisan "+args+" ("+domain+")", func(t *task.Task) error {
+		out, err := system.Execute(cmd)
+		t.Logf("%s", strings.TrimRight(out, "\n"))
+		return err
+	})
+	return t, nil
+}
+
+// DeployLaravel runs the usual deploy steps: composer install, storage
+// permissions, migrations, caches and a queue restart
+func DeployLaravel(domain string) (*task.Task, error) {
+	site, err := findLaravelSite(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	t := task.StartFunc("deploy laravel "+domain, func(t *task.Task) error {
+		if _, err := os.Stat(filepath.Join(site.Root, "composer.json")); err == nil {
+			t.Logf("$ composer install")
+			// Composer scripts are the site's code, so they run as www-data
+			out, err := system.Execute(fmt.Sprintf("cd %s && runuser -u www-data -- env HOME=/tmp COMPOSER_HOME=/tmp/composer-www-data composer install --no-dev --optimize-autoloader --no-interaction 2>&1", shellQuote(site.Root)))
+			t.Logf("%s", strings.TrimRight(out, "\n"))
+			if err != nil {
+				return fmt.Errorf("composer install failed")
+			}
+		}
+		t.SetProgress(30)
+
+		fixLaravelPermissions(site)
+		t.Logf("Fixed storage permissions")
+		t.SetProgress(40)
+
+		steps := []string{"migrate --force", "config:cache", "route:cache", "view:cache", "queue:restart"}
+		if _, err := os.Lstat(filepath.Join(site.Root, "public/storage")); os.IsNotExist(err) {
+			steps = append([]string{"storage:link"}, steps...)
+		}
+		for i, step := range steps {
+			cmd, _ := artisanCommand(site, step)
+			t.Logf("$ php artisan %s", step)
+			out, err := system.Execute(cmd)
+			t.Logf("%s", strings.TrimRight(out, "\n"))
+			if err != nil {
+				return fmt.Errorf("artisan %s failed", step)
+			}
+			t.SetProgress(40 + (i+1)*60/len(steps))
+		}
+		return nil
+	})
+	return t, nil
+}
+
+// FixLaravelPermissions makes storage and bootstrap/cache writable by the web server
+func FixLaravelPermissions(domain string) error {
+	site, err := findLaravelSite(domain)
+	if err != nil {
+		return err
+	}
+	return fixLaravelPermissions(site)
+}
+
+func fixLaravelPermissions(site *db.Website) error {
+	for _, dir := range []string{"storage", "bootstrap/cache"} {
+		path := filepath.Join(site.Root, dir)
+		os.MkdirAll(path, 0775)
+		if out, err := system.Execute(fmt.Sprintf("chown -R www-data:www-data %s && chmod -R ug+rwX %s", shellQuote(path), shellQuote(path))); err != nil {
+			return fmt.Errorf("failed to fix %s: %s", dir, strings.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// UpdateLaravelConfig saves the toolkit settings and applies them: the
+// queue worker units are scaled and the scheduler cron added or removed
+func UpdateLaravelConfig(domain string, req db.LaravelConfig) error {
+	site, err := findLaravelSite(domain)
+	if err != nil {
+		return err
+	}
+
+	if req.Workers < 0 || req.Workers > maxQueueWorkers {
+		return fmt.Errorf("workers must be between 0 and %d", maxQueueWorkers)
+	}
+	if !queueNameRegex.MatchString(req.Queue) || !queueNameRegex.MatchString(req.Connection) {
+		return fmt.Errorf("invalid queue or connection name")
+	}
+	if req.Tries <= 0 {
+		req.Tries = 3
+	}
+	if req.Timeout <= 0 {
+		req.Timeout = 60
+	}
+
+	config := laravelConfig(site)
+	config.Workers = req.Workers
+	config.Connection = req.Connection
+	config.Queue = req.Queue
+	config.Tries = req.Tries
+	config.Timeout = req.Timeout
+	config.Scheduler = req.Scheduler
+	if err := db.DB.Save(&config).Error; err != nil {
+		return err
+	}
+
+	return applyLaravelConfig(site, config)
+}
+
+// ApplyLaravelConfig re-creates the workers and scheduler of a site from
+// its stored settings, e.g. after a rename
+func ApplyLaravelConfig(domain string) error {
+	site, err := findLaravelSite(domain)
+	if err != nil {
+		return err
+	}
+	var config db.LaravelConfig
+	if err := db.DB.Where("website_id = ?", site.ID).First(&config).Error; err != nil {
+		return nil
+	}
+	return applyLaravelConfig(site, config)
+}
+
+func applyLaravelConfig(site *db.Website, config db.LaravelConfig) error {
+	// Scheduler
+	if config.Scheduler {
+		command := fmt.Sprintf("cd %s && runuser -u www-data -- %s artisan schedule:run >> /dev/null 2>&1", shellQuote(site.Root), phpBinary(site))
+		if err := cron.Ensure(schedulerCronName(site.Domain), "* * * * *", command); err != nil {
+			return fmt.Errorf("failed to add scheduler cron: %v", err)
+		}
+	} else if err := cron.DeleteByName(schedulerCronName(site.Domain)); err != nil {
+		return err
+	}
+
+	// Queue workers
+	unit := queueUnitName(site.Domain)
+	if config.Workers > 0 {
+		t, err := template.New("queue").Parse(queueUnitTemplate)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(systemdUnitDir, unit+".service"))
+		if err != nil {
+			return err
+		}
+		err = t.Execute(f, map[string]interface{}{
+			"Domain":      site.Domain,
+			"Root":        site.Root,
+			"PHP":         phpBinary(site),
+			"Connection":  config.Connection,
+			"Queue":       config.Queue,
+			"Tries":       config.Tries,
+			"Timeout":     config.Timeout,
+			"StopTimeout": config.Timeout + 10,
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+		system.Execute("systemctl daemon-reload")
+	}
+
+	running := queueInstances(site.Domain)
+	for _, instance := range running {
+		var n int
+		fmt.Sscanf(instance, "%d", &n)
+		if n > config.Workers {
+			system.Execute(fmt.Sprintf("systemctl disable --now %s%s", unit, instance))
+		}
+	}
+	for i := 1; i <= config.Workers; i++ {
+		// restart picks up a changed unit file
+		if out, err := system.Execute(fmt.Sprintf("systemctl enable %s%d && systemctl restart %s%d", unit, i, unit, i)); err != nil {
+			return fmt.Errorf("failed to start worker %d: %s", i, strings.TrimSpace(out))
+		}
+	}
+	if config.Workers == 0 {
+		os.Remove(filepath.Join(systemdUnitDir, unit+".service"))
+		system.Execute("systemctl daemon-reload")
+	}
+	return nil
+}
+
+// queueInstances returns the instance numbers of a site's loaded queue workers
+func queueInstances(domain string) []string {
+	unit := queueUnitName(domain)
+	out, _ := system.Execute(fmt.Sprintf("systemctl list-units '%s*' --all --plain --no-legend", unit))
+	var instances []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], unit) {
+			continue
+		}
+		instances = append(instances, strings.TrimSuffix(strings.TrimPrefix(fields[0], unit), ".service"))
+	}
+	return instances
+}
+
+// removeLaravelWorkers stops and removes a site's queue workers, if any
+func removeLaravelWorkers(domain string) {
+	unit := queueUnitName(domain)
+	unitPath := filepath.Join(systemdUnitDir, unit+".service")
+	if _, err := os.Stat(unitPath); err != nil {
+		return
+	}
+	for _, instance := range queueInstances(domain) {
+		system.Execute(fmt.Sprintf("systemctl disable --now %s%s", unit, instance))
+	}
+	os.Remove(unitPath)
+	system.Execute("systemctl daemon-reload")
+}
+
+// GetLaravelInfo returns the toolkit settings, worker state and environment checks
+func GetLaravelInfo(domain string) (*LaravelInfo, error) {
+	site, err := findLaravelSite(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &LaravelInfo{Domain: domain, Config: laravelConfig(site), Checks: []LaravelCheck{}}
+	if out, err := system.Execute(fmt.Sprintf("cd %s && runuser -u www-data -- %s artisan --version 2>/dev/null", shellQuote(site.Root), phpBinary(site))); err == nil {
+		info.Version = strings.TrimSpace(out)
+	}
+	out, _ := system.Execute(fmt.Sprintf("systemctl list-units '%s*' --state=active --plain --no-legend | wc -l", queueUnitName(domain)))
+	fmt.Sscanf(strings.TrimSpace(out), "%d", &info.RunningWorkers)
+
+	add := func(name, status, detail, fix string) {
+		info.Checks = append(info.Checks, LaravelCheck{Name: name, Status: status, Detail: detail, Fix: fix})
+	}
+
+	if _, err := os.Stat(filepath.Join(site.Root, "vendor/autoload.php")); err != nil {
+		add("dependencies", CheckError, "vendor/ is missing, run a deploy to install composer packages", "")
+	} else {
+		add("dependencies", CheckOK, "composer packages are installed", "")
+	}
+
+	env, err := os.ReadFile(filepath.Join(site.Root, ".env"))
+	if err != nil {
+		add("env", CheckError, ".env does not exist", "")
+	} else {
+		add("env", CheckOK, ".env exists", "")
+		if m := laravelKeyRegex.FindSubmatch(env); len(m) < 2 || len(m[1]) == 0 {
+			add("app_key", CheckError, "APP_KEY is not set", "key:generate --force")
+		} else {
+			add("app_key", CheckOK, "APP_KEY is set", "")
+		}
+		appEnv, debug := "", ""
+		if m := laravelEnvRegex.FindSubmatch(env); len(m) > 1 {
+			appEnv = string(m[1])
+		}
+		if m := laravelDebugRegex.FindSubmatch(env); len(m) > 1 {
+			debug = strings.ToLower(string(m[1]))
+		}
+		if appEnv == "production" && debug == "true" {
+			add("debug", CheckWarning, "APP_DEBUG is enabled in production", "")
+		} else {
+			add("debug", CheckOK, fmt.Sprintf("APP_ENV=%s, APP_DEBUG=%s", appEnv, debug), "")
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(site.Root, "public/storage")); err != nil {
+		add("storage_link", CheckWarning, "public/storage link is missing", "storage:link")
+	} else {
+		add("storage_link", CheckOK, "public/storage is linked", "")
+	}
+
+	writable := true
+	for _, dir := range []string{"storage", "bootstrap/cache"} {
+		if _, err := system.Execute(fmt.Sprintf("runuser -u www-data -- test -w %s", shellQuote(filepath.Join(site.Root, dir)))); err != nil {
+			writable = false
+		}
+	}
+	if writable {
+		add("permissions", CheckOK, "storage and bootstrap/cache are writable", "")
+	} else {
+		add("permissions", CheckError, "storage or bootstrap/cache is not writable by www-data", "permissions")
+	}
+
+	if _, err := os.Stat(filepath.Join(site.Root, "bootstrap/cache/config.php")); err != nil {
+		add("config_cache", CheckWarning, "configuration is not cached", "config:cache")
+	} else {
+		add("config_cache", CheckOK, "configuration is cached", "config:clear")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(site.Root, "bootstrap/cache/routes*.php")); len(matches) == 0 {
+		add("route_cache", CheckWarning, "routes are not cached", "route:cache")
+	} else {
+		add("route_cache", CheckOK, "routes are cached", "route:clear")
+	}
+
+	if info.Config.Scheduler && !cron.Exists(schedulerCronName(domain)) {
+		add("scheduler", CheckError, "scheduler is enabled but its cron job is missing", "")
+	} else if info.Config.Scheduler {
+		add("scheduler", CheckOK, "schedule:run runs every minute", "")
+	} else {
+		add("scheduler", CheckWarning, "scheduler is disabled", "")
+	}
+	if info.RunningWorkers < info.Config.Workers {
+		add("queue", CheckError, fmt.Sprintf("%d of %d queue workers are running", info.RunningWorkers, info.Config.Workers), "")
+	} else {
+		add("queue", CheckOK, fmt.Sprintf("%d queue workers running", info.RunningWorkers), "")
+	}
+
+	return info, nil
+}
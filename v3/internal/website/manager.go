@@ -1,95 +1,23 @@
 package website
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
 
 	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/history"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
 	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
 )
 
-const nginxPHPTemplate = `server {
-    listen {{.Port}};
-    listen [::]:{{.Port}};
-    server_name {{.Domain}} www.{{.Domain}};
-    root {{.Root}};
-    index index.php index.html index.htm;
-
-    access_log /var/log/nginx/{{.Domain}}.access.log;
-    error_log /var/log/nginx/{{.Domain}}.error.log;
-
-    location / {
-        try_files $uri $uri/ /index.php?$query_string;
-    }
-
-    location ~ \.php$ {
-        fastcgi_pass unix:/var/run/php/{{if .PHPVer}}php{{.PHPVer}}-fpm.sock{{else}}php-fpm.sock{{end}};
-        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
-        include fastcgi_params;
-    }
-
-    location ~ /\.ht {
-        deny all;
-    }
-}
-`
-
-const nginxLaravelTemplate = `server {
-    listen {{.Port}};
-    listen [::]:{{.Port}};
-    server_name {{.Domain}} www.{{.Domain}};
-    root {{.Root}}/public;
-    index index.php index.html;
-
-    access_log /var/log/nginx/{{.Domain}}.access.log;
-    error_log /var/log/nginx/{{.Domain}}.error.log;
-
-    location / {
-        try_files $uri $uri/ /index.php?$query_string;
-    }
-
-    location ~ \.php$ {
-        fastcgi_pass unix:/var/run/php/{{if .PHPVer}}php{{.PHPVer}}-fpm.sock{{else}}php-fpm.sock{{end}};
-        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
-        include fastcgi_params;
-    }
-
-    location ~ /\.ht {
-        deny all;
-    }
-}
-`
-
-const nginxProxyTemplate = `server {
-    listen {{.Port}};
-    listen [::]:{{.Port}};
-    server_name {{.Domain}} www.{{.Domain}};
-
-    access_log /var/log/nginx/{{.Domain}}.access.log;
-    error_log /var/log/nginx/{{.Domain}}.error.log;
-
-    location / {
-        proxy_pass http://127.0.0.1:{{.BackendPort}};
-        proxy_http_version 1.1;
-        proxy_set_header Upgrade $http_upgrade;
-        proxy_set_header Connection 'upgrade';
-        proxy_set_header Host $host;
-        proxy_cache_bypass $http_upgrade;
-        proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-    }
-}
-`
-
 var sslMutex sync.Mutex
 
 type Website struct {
@@ -106,16 +34,18 @@ type Website struct {
 	HasDB       bool      `json:"has_db"`
 	Hot         bool      `json:"hot"`
 	LastCheck   time.Time `json:"last_check"`
+
+	// Managed app backends, see app.go
+	AppCommand    string `json:"app_command,omitempty"`
+	AppModule     string `json:"app_module,omitempty"`
+	AppServer     string `json:"app_server,omitempty"`
+	DockerImage   string `json:"docker_image,omitempty"`
+	ContainerPort int    `json:"container_port,omitempty"`
 }
 
 func ListWebsites() ([]Website, error) {
-	enabledDir := "/etc/nginx/sites-enabled"
-	if runtime.GOOS == "windows" {
-		enabledDir = "nginx/sites-enabled"
-		os.MkdirAll(enabledDir, 0755)
-	}
-
-	files, err := os.ReadDir(enabledDir)
+	server := webserver.Current()
+	names, err := server.Sites()
 	if err != nil {
 		return []Website{}, nil
 	}
@@ -129,17 +59,13 @@ func ListWebsites() ([]Website, error) {
 	}
 
 	var sites []Website
-	for _, f := range files {
-		if f.IsDir() || f.Name() == "default" {
-			continue
-		}
-
-		// Skip system app configs (not websites)
-		if f.Name() == "phpmyadmin.conf" || f.Name() == "panda.conf" {
+	for _, name := range names {
+		// Skip system app configs and rename redirects (not websites)
+		if !isWebsiteConfig(name) {
 			continue
 		}
 
-		domain := strings.TrimSuffix(f.Name(), ".conf")
+		domain := strings.TrimSuffix(name, ".conf")
 		root := "/home/" + domain
 
 		// Check if directory exists
@@ -151,8 +77,7 @@ func ListWebsites() ([]Website, error) {
 		hasSSL := false
 		sslExpiry := ""
 		if runtime.GOOS != "windows" {
-			certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
-			if _, err := os.Stat(certPath); err == nil {
+			if certPath := server.CertificatePath(domain); certPath != "" {
 				hasSSL = true
 				// Get expiry date
 				out, _ := system.Execute(fmt.Sprintf("openssl x509 -enddate -noout -in %s 2>/dev/null | cut -d= -f2", certPath))
@@ -199,6 +124,9 @@ func ListWebsites() ([]Website, error) {
 	return sites, nil
 }
 
+// CreateWebsite sets up a website: web root, app service, vhost, record and
+// certificate. Changes to an existing site re-render its vhost with
+// applyVhost instead, which leaves the app service alone.
 func CreateWebsite(site Website) error {
 	if runtime.GOOS == "windows" {
 		return fmt.Errorf("website creation requires Linux")
@@ -218,14 +146,11 @@ func CreateWebsite(site Website) error {
 	}
 
 	// 3. Select Template and handle Type specific setup
-	var selectedTmpl string
 	switch site.Type {
 	case "laravel":
-		selectedTmpl = nginxLaravelTemplate
 		// Optional: Create laravel subfolders if doesn't exist
 		os.MkdirAll(filepath.Join(site.Root, "public"), 0755)
 	case "wordpress":
-		selectedTmpl = nginxPHPTemplate
 		// Check if doc root is empty, if so download WP
 		files, _ := os.ReadDir(site.Root)
 		if len(files) <= 1 { // Only index.html or empty
@@ -235,8 +160,11 @@ func CreateWebsite(site Website) error {
 				system.Execute(fmt.Sprintf("chown -R www-data:www-data %s", site.Root))
 			}()
 		}
-	case "nodejs", "python", "java":
-		selectedTmpl = nginxProxyTemplate
+	case "go", "python", "docker":
+		if err := prepareApp(&site); err != nil {
+			return err
+		}
+	case "nodejs", "java":
 		if site.BackendPort == 0 {
 			if site.Type == "java" {
 				site.BackendPort = 8080
@@ -244,8 +172,6 @@ func CreateWebsite(site Website) error {
 				site.BackendPort = 3000
 			}
 		}
-	default:
-		selectedTmpl = nginxPHPTemplate
 	}
 
 	// 4. Create default index.html if empty
@@ -275,54 +201,25 @@ func CreateWebsite(site Website) error {
 		os.WriteFile(indexPath, []byte(indexContent), 0644)
 	}
 
-	t, err := template.New("nginx").Parse(selectedTmpl)
-	if err != nil {
+	// 4. Write and enable the site, 5. test and reload the web server
+	if err := applyVhost(site); err != nil {
 		return err
 	}
 
-	configDir := "/etc/nginx/sites-available"
-	configFile := filepath.Join(configDir, site.Domain+".conf")
-
-	f, err := os.Create(configFile)
-	if err != nil {
-		return fmt.Errorf("failed to create nginx config: %v", err)
-	}
-	defer f.Close()
-
-	if err := t.Execute(f, site); err != nil {
-		return fmt.Errorf("failed to write nginx config: %v", err)
-	}
-
-	// 4. Enable site (create symlink)
-	enabledDir := "/etc/nginx/sites-enabled"
-	symlink := filepath.Join(enabledDir, site.Domain+".conf")
-	os.Remove(symlink) // Remove if exists
-	if err := os.Symlink(configFile, symlink); err != nil {
-		return fmt.Errorf("failed to enable site: %v", err)
-	}
-
-	// 5. Reload nginx
-	if _, err := system.Execute("systemctl reload nginx"); err != nil {
-		return fmt.Errorf("failed to reload nginx: %v", err)
-	}
-
-	// 6. Create index.php if it doesn't exist
-	phpPath := filepath.Join(site.Root, "index.php")
-	if _, err := os.Stat(phpPath); os.IsNotExist(err) {
-		phpContent := fmt.Sprintf("<?php phpinfo(); ?>")
-		os.WriteFile(phpPath, []byte(phpContent), 0644)
-	}
-
-	// 7. Create SSL if requested
-	if site.SSL {
-		if err := CreateSSL(site.Domain); err != nil {
-			// SSL creation failed but website is created
-			// Log error but don't fail the entire operation
-			fmt.Printf("SSL creation failed for %s: %v\n", site.Domain, err)
+	// 6. Create index.php if it doesn't exist, or the app service
+	if isManagedApp(site.Type) {
+		if err := installApp(site); err != nil {
+			return fmt.Errorf("failed to set up app service: %v", err)
+		}
+	} else if site.Type != "static" {
+		phpPath := filepath.Join(site.Root, "index.php")
+		if _, err := os.Stat(phpPath); os.IsNotExist(err) {
+			phpContent := fmt.Sprintf("<?php phpinfo(); ?>")
+			os.WriteFile(phpPath, []byte(phpContent), 0644)
 		}
 	}
 
-	// 8. Save to DB
+	// 7. Save to DB
 	var dbSite db.Website
 	if err := db.DB.Where("domain = ?", site.Domain).First(&dbSite).Error; err != nil {
 		dbSite = db.Website{
@@ -334,6 +231,7 @@ func CreateWebsite(site Website) error {
 			SSL:         site.SSL,
 			PHPVersion:  site.PHPVer,
 		}
+		setAppFields(&dbSite, site)
 		db.DB.Create(&dbSite)
 	} else {
 		dbSite.Type = site.Type
@@ -342,12 +240,98 @@ func CreateWebsite(site Website) error {
 		dbSite.Root = site.Root
 		dbSite.SSL = site.SSL
 		dbSite.PHPVersion = site.PHPVer
+		setAppFields(&dbSite, site)
 		db.DB.Save(&dbSite)
 	}
 
+	// 8. Create SSL if requested and the site has no certificate yet
+	if site.SSL && certificateDir(site.Domain) == "" {
+		if err := CreateSSL(site.Domain); err != nil {
+			// SSL creation failed but website is created
+			// Log error but don't fail the entire operation
+			fmt.Printf("SSL creation failed for %s: %v\n", site.Domain, err)
+		}
+	}
+
 	return nil
 }
 
+// applyVhost renders a website's config for the current web server and
+// activates it
+func applyVhost(site Website) error {
+	return webserver.Current().Apply(vhostSite(site, nil))
+}
+
+// certificateDir returns the directory of the certificate the web server
+// serves for a domain, or an empty string when it has none
+func certificateDir(domain string) string {
+	path := webserver.Current().CertificatePath(domain)
+	if path == "" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// renderVhost renders the config of a website for the current web server.
+// security replaces the stored security config, for previews.
+func renderVhost(site Website, security *db.SecurityConfig) (string, error) {
+	return webserver.Current().Render(vhostSite(site, security))
+}
+
+// vhostSite is what the web server needs to serve a website
+func vhostSite(site Website, security *db.SecurityConfig) webserver.Site {
+	if security == nil {
+		c := nginx.SiteSecurityConfig(site.Domain)
+		security = &c
+	}
+	return webserver.Site{
+		Domain:      site.Domain,
+		Type:        site.Type,
+		Root:        site.Root,
+		PHPVersion:  site.PHPVer,
+		Port:        site.Port,
+		BackendPort: site.BackendPort,
+		Security:    *security,
+	}
+}
+
+// VhostPreview is the config a website would get from its template, next
+// to the config it has now
+type VhostPreview struct {
+	Template string `json:"template"`
+	Config   string `json:"config"`
+	Current  string `json:"current"`
+	Diff     string `json:"diff"` // Unified diff from Current to Config
+}
+
+// PreviewVhost renders a website's config without applying it
+func PreviewVhost(domain string) (*VhostPreview, error) {
+	return previewVhost(domain, nil)
+}
+
+func previewVhost(domain string, security *db.SecurityConfig) (*VhostPreview, error) {
+	var record db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&record).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %s", domain)
+	}
+	site := websiteFromRecord(record)
+	if site.Root == "" {
+		site.Root = "/home/" + site.Domain
+	}
+
+	content, err := renderVhost(site, security)
+	if err != nil {
+		return nil, err
+	}
+	preview := &VhostPreview{Template: nginx.TemplateForSiteType(site.Type), Config: content}
+	path := webserver.Current().ConfigPath(domain)
+	if current, err := os.ReadFile(path); err == nil {
+		preview.Current = string(current)
+	}
+	preview.Diff, err = history.UnifiedDiff(path, path+" (rendered)", preview.Current, preview.Config)
+	return preview, err
+}
+
 // CreateSSL creates/renews SSL certificate for a domain using Let's Encrypt
 func CreateSSL(domain string) error {
 	if runtime.GOOS == "windows" {
@@ -357,21 +341,16 @@ func CreateSSL(domain string) error {
 	sslMutex.Lock()
 	defer sslMutex.Unlock()
 
-	// Check if certbot is installed
-	if _, err := system.Execute("which certbot"); err != nil {
-		// Install certbot
-		if _, err := system.Execute("apt-get update && apt-get install -y certbot python3-certbot-nginx"); err != nil {
-			return fmt.Errorf("failed to install certbot: %v", err)
-		}
+	if err := webserver.Current().ObtainCertificate(domain, ""); err != nil {
+		return err
 	}
 
-	// Run certbot
-	cmd := fmt.Sprintf("certbot --nginx -d %s -d www.%s --non-interactive --agree-tos --email admin@%s --redirect", domain, domain, domain)
-	out, err := system.Execute(cmd)
-	if err != nil {
-		return fmt.Errorf("certbot failed: %s - %v", out, err)
+	// Render the panel's own TLS config over certbot's edits, so the site's
+	// security profile applies and survives later re-renders
+	var site db.Website
+	if db.DB.Where("domain = ?", domain).First(&site).Error == nil {
+		return applyVhost(websiteFromRecord(site))
 	}
-
 	return nil
 }
 
@@ -397,36 +376,49 @@ func DeleteWebsite(domain string) error {
 		return fmt.Errorf("website deletion requires Linux")
 	}
 
-	// Remove symlink (enabled site)
-	os.Remove(filepath.Join("/etc/nginx/sites-enabled", domain+".conf"))
-	os.Remove(filepath.Join("/etc/nginx/sites-enabled", domain))
-
-	// Remove config file
-	os.Remove(filepath.Join("/etc/nginx/sites-available", domain+".conf"))
-	os.Remove(filepath.Join("/etc/nginx/sites-available", domain))
+	// Remove the config of every web server, so switching back later does
+	// not bring the site back
+	for _, name := range webserver.Names() {
+		if server, err := webserver.Get(name); err == nil {
+			server.Remove(domain)
+		}
+	}
 
-	// Reload nginx
-	system.Execute("systemctl reload nginx")
+	// Stop the app service, if the site has one
+	removeAppService(domain)
+	removeLaravelWorkers(domain)
+	removePages(domain)
+	os.RemoveAll(nginx.CachePath(domain))
+	os.Remove(nginx.GeoNetworksPath(domain))
 
 	// NOTE: Web root and SSL certs are NOT deleted for safety
 	return nil
 }
+
+// checkMySQLDatabaseExists reports whether a MySQL database exists
 func checkMySQLDatabaseExists(name string) bool {
-	// We need to use mysql command
-	cmd := fmt.Sprintf("mysql -uroot -e \"SHOW DATABASES LIKE '%s';\" -N", name)
-	out, err := system.Execute(cmd)
-	if err == nil && strings.TrimSpace(out) == name {
-		return true
+	if !dbIdentifierRegex.MatchString(name) {
+		return false
 	}
+	out, err := mysqlQuery(fmt.Sprintf("SHOW DATABASES LIKE '%s';", strings.ReplaceAll(name, "_", `\_`)))
+	return err == nil && strings.TrimSpace(out) == name
+}
 
-	// Try docker if native failed
-	cmd = fmt.Sprintf("docker exec panda-mysql mysql -uroot -proot -e \"SHOW DATABASES LIKE '%s';\" -N", name)
-	out, err = system.Execute(cmd)
-	if err == nil && strings.TrimSpace(out) == name {
-		return true
+// mysqlQuery runs a query as root, natively or in the panda-mysql container,
+// and returns the rows tab-separated without a header. The query is passed
+// as an argument, not through a shell.
+func mysqlQuery(query string) (string, error) {
+	var out []byte
+	var err error
+	for _, args := range [][]string{
+		{"mysql", "-uroot", "-N", "-B", "-e", query},
+		{"docker", "exec", "panda-mysql", "mysql", "-uroot", "-proot", "-N", "-B", "-e", query},
+	} {
+		if out, err = exec.Command(args[0], args[1:]...).Output(); err == nil {
+			return string(out), nil
+		}
 	}
-
-	return false
+	return "", err
 }
 
 // GetPHPVersions returns a list of installed PHP versions on the system
@@ -470,85 +462,6 @@ func UpdateWebsitePHPVersion(domain, version string) error {
 		return err
 	}
 
-	// Re-generate Nginx config
-	wsSite := Website{
-		Domain:      site.Domain,
-		Type:        site.Type,
-		Port:        site.Port,
-		Root:        site.Root,
-		SSL:         site.SSL,
-		PHPVer:      site.PHPVersion,
-		BackendPort: site.BackendPort,
-	}
-
-	return CreateWebsite(wsSite)
-}
-
-// StartStatusChecker starts the background worker for checking website status
-func StartStatusChecker() {
-	ticker := time.NewTicker(10 * time.Minute)
-	go func() {
-		// Initial check
-		checkAllWebsites()
-		for range ticker.C {
-			checkAllWebsites()
-		}
-	}()
-}
-
-func checkAllWebsites() {
-	var websites []db.Website
-	if err := db.DB.Find(&websites).Error; err != nil {
-		return
-	}
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{
-		Timeout:   10 * time.Second,
-		Transport: tr,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 5 {
-				return fmt.Errorf("stopped after 5 redirects")
-			}
-			return nil
-		},
-	}
-
-	var wg sync.WaitGroup
-	for i := range websites {
-		wg.Add(1)
-		go func(w *db.Website) {
-			defer wg.Done()
-
-			protocol := "http://"
-			if w.SSL {
-				protocol = "https://"
-			}
-
-			url := protocol + w.Domain
-			resp, err := client.Get(url)
-			if err != nil && protocol == "https://" {
-				resp, err = client.Get("http://" + w.Domain)
-			}
-
-			status := "active"
-			statusCode := 0
-			if err != nil {
-				status = "error"
-			} else if resp != nil {
-				statusCode = resp.StatusCode
-				resp.Body.Close()
-			}
-
-			// Update DB
-			db.DB.Model(&db.Website{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
-				"status":      status,
-				"status_code": statusCode,
-				"last_check":  time.Now(),
-			})
-		}(&websites[i])
-	}
-	wg.Wait()
+	// Re-generate the web server config
+	return applyVhost(websiteFromRecord(site))
 }
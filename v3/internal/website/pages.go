@@ -0,0 +1,191 @@
+package website
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+// maxPageSize caps the size of a custom page
+const maxPageSize = 512 << 10
+
+var pageKinds = []string{nginx.PageNotFound, nginx.PageServerError, nginx.PageMaintenance}
+
+// Page is a custom page of a website. Custom is false when the site uses
+// the nginx default (or, for maintenance, the panel's default page).
+type Page struct {
+	Kind   string `json:"kind"`
+	Custom bool   `json:"custom"`
+	HTML   string `json:"html"`
+}
+
+// MaintenanceConfig is the maintenance mode state of a website
+type MaintenanceConfig struct {
+	Enabled    bool     `json:"enabled"`
+	AllowIPs   []string `json:"allow_ips"`
+	RetryAfter int      `json:"retry_after"` // Seconds, 0 = default
+}
+
+// ListPages returns the 404, 50x and maintenance pages of a website
+func ListPages(domain string) ([]Page, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	var rows []db.ErrorPage
+	db.DB.Where("website_id = ?", site.ID).Find(&rows)
+
+	pages := []Page{}
+	for _, kind := range pageKinds {
+		page := Page{Kind: kind}
+		if kind == nginx.PageMaintenance {
+			page.HTML = nginx.DefaultMaintenancePage
+		}
+		for _, r := range rows {
+			if r.Kind == kind {
+				page.Custom = true
+				page.HTML = r.HTML
+			}
+		}
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+// SetPage stores a custom page and renders it into the vhost
+func SetPage(domain, kind, html string) error {
+	if !containsString(pageKinds, kind) {
+		return fmt.Errorf("unknown page: %s", kind)
+	}
+	if strings.TrimSpace(html) == "" {
+		return fmt.Errorf("page content is required")
+	}
+	if len(html) > maxPageSize {
+		return fmt.Errorf("page is larger than %d KB", maxPageSize>>10)
+	}
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return fmt.Errorf("website not found: %v", err)
+	}
+
+	page := db.ErrorPage{WebsiteID: site.ID, Kind: kind}
+	existed := db.DB.Where("website_id = ? AND kind = ?", site.ID, kind).First(&page).Error == nil
+	page.HTML = html
+	if err := db.DB.Save(&page).Error; err != nil {
+		return err
+	}
+
+	// Replacing a page only changes the file nginx serves
+	if existed {
+		return nginx.Apply(nginx.ConfigChange{
+			Files: []nginx.FileChange{{Path: filepath.Join(nginx.PageDir(domain), kind+".html"), Content: []byte(html)}},
+			Note:  kind + " page",
+		})
+	}
+	return applyVhost(websiteFromRecord(site))
+}
+
+// DeletePage reverts a page to the default
+func DeletePage(domain, kind string) error {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return fmt.Errorf("website not found: %v", err)
+	}
+	result := db.DB.Where("website_id = ? AND kind = ?", site.ID, kind).Delete(&db.ErrorPage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%s has no custom %s page", domain, kind)
+	}
+	if err := applyVhost(websiteFromRecord(site)); err != nil {
+		return err
+	}
+	if kind != nginx.PageMaintenance {
+		os.Remove(filepath.Join(nginx.PageDir(domain), kind+".html"))
+	}
+	return nil
+}
+
+// GetMaintenance returns the maintenance mode state of a website
+func GetMaintenance(domain string) (*MaintenanceConfig, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	config := &MaintenanceConfig{
+		Enabled:    site.Maintenance,
+		AllowIPs:   site.MaintenanceIPs,
+		RetryAfter: site.MaintenanceRetry,
+	}
+	if config.AllowIPs == nil {
+		config.AllowIPs = []string{}
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = nginx.DefaultRetryAfter
+	}
+	return config, nil
+}
+
+// SetMaintenance turns maintenance mode on or off. Only the site's
+// maintenance includes are rewritten, then nginx is tested and reloaded; the
+// previous includes are restored if the test fails.
+func SetMaintenance(domain string, config MaintenanceConfig) error {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return fmt.Errorf("website not found: %v", err)
+	}
+	if err := webserver.RequireNginx("maintenance mode"); err != nil {
+		return err
+	}
+	ips, err := parseIPList(config.AllowIPs)
+	if err != nil {
+		return err
+	}
+	if config.RetryAfter < 0 {
+		return fmt.Errorf("retry_after must not be negative")
+	}
+
+	previous := site
+	site.Maintenance = config.Enabled
+	site.MaintenanceIPs = ips
+	site.MaintenanceRetry = config.RetryAfter
+	if err := db.DB.Save(&site).Error; err != nil {
+		return err
+	}
+
+	// Vhosts rendered before maintenance mode existed, or before it moved
+	// to a map, lack the includes
+	if !vhostIncludes(domain, nginx.MaintenanceMapPath(domain)) {
+		return applyVhost(websiteFromRecord(site))
+	}
+
+	if err := nginx.ApplyMaintenance(domain); err != nil {
+		db.DB.Save(&previous)
+		return err
+	}
+	return nil
+}
+
+// vhostIncludes reports whether a site's nginx config references path
+func vhostIncludes(domain, path string) bool {
+	for _, config := range availableConfigs(domain) {
+		content, err := os.ReadFile(config)
+		if err == nil && strings.Contains(string(content), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// removePages deletes the rendered pages and maintenance includes of a site
+func removePages(domain string) {
+	os.RemoveAll(nginx.PageDir(domain))
+	os.Remove(nginx.MaintenancePath(domain))
+	os.Remove(nginx.MaintenanceMapPath(domain))
+}
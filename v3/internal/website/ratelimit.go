@@ -0,0 +1,159 @@
+package website
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+)
+
+// RateLimitPreset is a ready rate limit config. Applying one keeps the IP
+// lists of the site.
+type RateLimitPreset struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Config      db.RateLimitConfig `json:"config"`
+}
+
+var (
+	// Vulnerability scanners and aggressive SEO crawlers
+	scannerAgents = []string{"sqlmap", "nikto", "wpscan", "masscan", "zgrab", "nuclei", "MJ12bot", "AhrefsBot", "SemrushBot", "DotBot", "PetalBot", "BLEXBot"}
+	// Search engines that stay reachable when all bots are blocked
+	searchEngineAgents = []string{"Googlebot", "bingbot", "DuckDuckBot", "YandexBot", "Applebot", "Baiduspider"}
+)
+
+var rateLimitPresets = []RateLimitPreset{
+	{
+		Name:        "wordpress",
+		Description: "WordPress hardening: brute force limits on wp-login.php and xmlrpc.php, scanners blocked",
+		Config: db.RateLimitConfig{
+			Rate:        "10r/s",
+			Burst:       40,
+			Connections: 30,
+			PathLimits: []db.PathLimit{
+				{Path: "/wp-login.php", Rate: "10r/m", Burst: 5},
+				{Path: "/xmlrpc.php", Rate: "2r/m", Burst: 2},
+			},
+			BlockedAgents: scannerAgents,
+		},
+	},
+	{
+		Name:        "api",
+		Description: "API backends: generous per-client limits, no user agent blocking",
+		Config: db.RateLimitConfig{
+			Rate:        "20r/s",
+			Burst:       50,
+			Connections: 50,
+		},
+	},
+	{
+		Name:        "strict",
+		Description: "Tight per-client limits, every bot but the major search engines blocked",
+		Config: db.RateLimitConfig{
+			Rate:          "5r/s",
+			Burst:         10,
+			Connections:   10,
+			BlockBots:     true,
+			AllowedAgents: searchEngineAgents,
+			BlockedAgents: scannerAgents,
+		},
+	},
+}
+
+// ListRateLimitPresets returns the rate limit presets
+func ListRateLimitPresets() []RateLimitPreset {
+	return rateLimitPresets
+}
+
+// GetRateLimit returns the rate limit config of a website, disabled and
+// empty if it has none yet
+func GetRateLimit(domain string) (*db.RateLimitConfig, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	var config db.RateLimitConfig
+	if db.DB.Where("website_id = ?", site.ID).First(&config).Error != nil {
+		config = db.RateLimitConfig{WebsiteID: site.ID}
+	}
+	for _, list := range []*[]string{&config.AllowedAgents, &config.BlockedAgents, &config.AllowIPs, &config.DenyIPs} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	if config.PathLimits == nil {
+		config.PathLimits = []db.PathLimit{}
+	}
+	return &config, nil
+}
+
+// SetRateLimit stores the rate limit config of a website and renders it
+// into the vhost. The previous config is kept if the vhost does not
+// validate.
+func SetRateLimit(domain string, config db.RateLimitConfig) (*db.RateLimitConfig, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	var err error
+	if config.AllowIPs, err = parseIPList(config.AllowIPs); err != nil {
+		return nil, err
+	}
+	if config.DenyIPs, err = parseIPList(config.DenyIPs); err != nil {
+		return nil, err
+	}
+	if err := nginx.ValidateRateLimitConfig(config); err != nil {
+		return nil, err
+	}
+
+	var previous db.RateLimitConfig
+	existed := db.DB.Where("website_id = ?", site.ID).First(&previous).Error == nil
+	config.ID = previous.ID
+	config.WebsiteID = site.ID
+	if err := db.DB.Save(&config).Error; err != nil {
+		return nil, err
+	}
+
+	if err := applyVhost(websiteFromRecord(site)); err != nil {
+		if existed {
+			db.DB.Save(&previous)
+		} else {
+			db.DB.Delete(&config)
+		}
+		return nil, err
+	}
+	return GetRateLimit(domain)
+}
+
+// ApplyRateLimitPreset replaces the limits and user agent rules of a
+// website with a preset and enables them
+func ApplyRateLimitPreset(domain, name string) (*db.RateLimitConfig, error) {
+	current, err := GetRateLimit(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range rateLimitPresets {
+		if p.Name == name {
+			config := p.Config
+			config.Enabled = true
+			config.AllowIPs = current.AllowIPs
+			config.DenyIPs = current.DenyIPs
+			return SetRateLimit(domain, config)
+		}
+	}
+	return nil, fmt.Errorf("unknown preset: %s", name)
+}
+
+// RateLimitStats counts the requests each rate limit rule of a website
+// rejected in the last hours
+func RateLimitStats(domain string, hours int) ([]nginx.RateLimitStat, error) {
+	config, err := GetRateLimit(domain)
+	if err != nil {
+		return nil, err
+	}
+	if !config.Enabled {
+		return []nginx.RateLimitStat{}, nil
+	}
+	return nginx.RateLimitStats(domain, *config, time.Now().Add(-time.Duration(hours)*time.Hour))
+}
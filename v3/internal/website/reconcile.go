@@ -0,0 +1,414 @@
+package website
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+// Drift kinds reported by Reconcile
+const (
+	DriftMissingConfig      = "missing_config"
+	DriftNotEnabled         = "not_enabled"
+	DriftBrokenLink         = "broken_link"
+	DriftDuplicateConfig    = "duplicate_config"
+	DriftUnmanagedConfig    = "unmanaged_config"
+	DriftMissingWebroot     = "missing_webroot"
+	DriftMissingCertificate = "missing_certificate"
+	DriftOrphanCertificate  = "orphan_certificate"
+	DriftMissingDatabase    = "missing_database"
+)
+
+// Repair actions accepted by RepairDrift
+const (
+	RepairRegenerate       = "regenerate"
+	RepairRelink           = "relink"
+	RepairUnlink           = "unlink"
+	RepairRemoveRecord     = "remove_record"
+	RepairRemoveLegacy     = "remove_legacy"
+	RepairImport           = "import"
+	RepairCreateWebroot    = "create_webroot"
+	RepairIssueCertificate = "issue_certificate"
+	RepairDisableSSL       = "disable_ssl"
+)
+
+const letsencryptLive = "/etc/letsencrypt/live"
+
+var (
+	wpDBNameRegex      = regexp.MustCompile(`define\(\s*['"]DB_NAME['"]\s*,\s*['"]([^'"]+)['"]`)
+	laravelDBNameRegex = regexp.MustCompile(`(?m)^DB_DATABASE=["']?([^"'\s]+)`)
+
+	// dbIdentifierRegex is what a database or user name read from a site's
+	// app config must look like before it goes into SQL or a command
+	dbIdentifierRegex = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+)
+
+// systemConfigs are nginx configs that belong to the panel itself, not to websites
+var systemConfigs = map[string]bool{
+	"default":         true,
+	"phpmyadmin.conf": true,
+	"panda.conf":      true,
+	"panda-panel":     true,
+}
+
+// isWebsiteConfig reports whether a sites-enabled entry is a website vhost
+// rather than a panel config or a redirect left behind by a rename
+func isWebsiteConfig(name string) bool {
+	return !systemConfigs[name] && !strings.HasSuffix(name, redirectSuffix)
+}
+
+// Drift is a single mismatch between the DB, nginx and the disk.
+// Repairs lists the applicable actions, least destructive first.
+type Drift struct {
+	Kind    string   `json:"kind"`
+	Domain  string   `json:"domain"`
+	Path    string   `json:"path,omitempty"`
+	Detail  string   `json:"detail"`
+	Repairs []string `json:"repairs"`
+}
+
+// Reconcile compares website records with sites-available, sites-enabled,
+// webroots, certificates and databases and reports every mismatch
+func Reconcile() ([]Drift, error) {
+	if err := webserver.RequireNginx("reconciling website configs"); err != nil {
+		return nil, err
+	}
+	var sites []db.Website
+	if err := db.DB.Find(&sites).Error; err != nil {
+		return nil, err
+	}
+
+	drifts := []Drift{}
+	managed := make(map[string]bool)
+
+	for _, site := range sites {
+		managed[site.Domain] = true
+
+		available := availableConfigs(site.Domain)
+		switch len(available) {
+		case 0:
+			drifts = append(drifts, Drift{
+				Kind:    DriftMissingConfig,
+				Domain:  site.Domain,
+				Detail:  "no config in " + nginx.SitesAvailable,
+				Repairs: []string{RepairRegenerate, RepairRemoveRecord},
+			})
+		case 2:
+			drifts = append(drifts, Drift{
+				Kind:    DriftDuplicateConfig,
+				Domain:  site.Domain,
+				Path:    available[1],
+				Detail:  fmt.Sprintf("both %s and %s exist", filepath.Base(available[0]), filepath.Base(available[1])),
+				Repairs: []string{RepairRemoveLegacy},
+			})
+		}
+		if len(available) > 0 && !isEnabled(site.Domain) {
+			drifts = append(drifts, Drift{
+				Kind:    DriftNotEnabled,
+				Domain:  site.Domain,
+				Path:    available[0],
+				Detail:  "config exists but is not linked in " + nginx.SitesEnabled,
+				Repairs: []string{RepairRelink, RepairRegenerate},
+			})
+		}
+
+		if site.Root != "" {
+			if _, err := os.Stat(site.Root); os.IsNotExist(err) {
+				drifts = append(drifts, Drift{
+					Kind:    DriftMissingWebroot,
+					Domain:  site.Domain,
+					Path:    site.Root,
+					Detail:  "web root does not exist",
+					Repairs: []string{RepairCreateWebroot, RepairRemoveRecord},
+				})
+			} else if name := configuredDatabase(site); name != "" && !checkMySQLDatabaseExists(name) {
+				drifts = append(drifts, Drift{
+					Kind:    DriftMissingDatabase,
+					Domain:  site.Domain,
+					Detail:  fmt.Sprintf("application is configured for database %s which does not exist", name),
+					Repairs: []string{},
+				})
+			}
+		}
+
+		if site.SSL {
+			certDir := filepath.Join(letsencryptLive, site.Domain)
+			if _, err := os.Stat(filepath.Join(certDir, "fullchain.pem")); err != nil {
+				drifts = append(drifts, Drift{
+					Kind:    DriftMissingCertificate,
+					Domain:  site.Domain,
+					Path:    certDir,
+					Detail:  "SSL is enabled but no certificate was found",
+					Repairs: []string{RepairIssueCertificate, RepairDisableSSL},
+				})
+			}
+		}
+	}
+
+	// Configs nginx serves that the panel knows nothing about
+	entries, _ := os.ReadDir(nginx.SitesEnabled)
+	for _, e := range entries {
+		if !isWebsiteConfig(e.Name()) {
+			continue
+		}
+		path := filepath.Join(nginx.SitesEnabled, e.Name())
+		domain := strings.TrimSuffix(e.Name(), ".conf")
+
+		if _, err := os.Stat(path); err != nil {
+			// Lstat succeeded (ReadDir listed it) but Stat failed: dangling symlink
+			repairs := []string{RepairUnlink}
+			if managed[domain] {
+				repairs = []string{RepairRegenerate, RepairUnlink}
+			}
+			drifts = append(drifts, Drift{
+				Kind:    DriftBrokenLink,
+				Domain:  domain,
+				Path:    path,
+				Detail:  "symlink target does not exist",
+				Repairs: repairs,
+			})
+			continue
+		}
+
+		if managed[domain] {
+			continue
+		}
+		if vhosts, _, err := ScanVhosts(path); err == nil && len(vhosts) > 0 {
+			unmanaged := false
+			for _, vhost := range vhosts {
+				unmanaged = unmanaged || !managed[vhost.Domain]
+			}
+			if !unmanaged {
+				continue
+			}
+		}
+		drifts = append(drifts, Drift{
+			Kind:    DriftUnmanagedConfig,
+			Domain:  domain,
+			Path:    path,
+			Detail:  "enabled config has no website record",
+			Repairs: []string{RepairImport},
+		})
+	}
+
+	// Certificates without a website
+	certs, _ := os.ReadDir(letsencryptLive)
+	for _, e := range certs {
+		if !e.IsDir() || managed[e.Name()] {
+			continue
+		}
+		drifts = append(drifts, Drift{
+			Kind:    DriftOrphanCertificate,
+			Domain:  e.Name(),
+			Path:    filepath.Join(letsencryptLive, e.Name()),
+			Detail:  "certificate does not belong to any website",
+			Repairs: []string{},
+		})
+	}
+
+	return drifts, nil
+}
+
+// RepairDrift applies one repair action to the site the drift belongs to.
+// path is only used by actions that act on a specific file (unlink, import).
+func RepairDrift(domain, action, path string) error {
+	if err := webserver.RequireNginx("repairing website configs"); err != nil {
+		return err
+	}
+	var site db.Website
+	hasRecord := db.DB.Where("domain = ?", domain).First(&site).Error == nil
+
+	switch action {
+	case RepairRegenerate:
+		if !hasRecord {
+			return fmt.Errorf("website not found: %s", domain)
+		}
+		return applyVhost(websiteFromRecord(site))
+
+	case RepairRelink:
+		available := availableConfigs(domain)
+		if len(available) == 0 {
+			return fmt.Errorf("no config found for %s", domain)
+		}
+		link := filepath.Join(nginx.SitesEnabled, filepath.Base(available[0]))
+		undo := keepEntry(link)
+		os.Remove(link)
+		if err := os.Symlink(available[0], link); err != nil {
+			undo()
+			return fmt.Errorf("failed to enable site: %v", err)
+		}
+		return testAndReload(undo)
+
+	case RepairUnlink:
+		if path == "" || filepath.Dir(path) != nginx.SitesEnabled || !isWebsiteConfig(filepath.Base(path)) {
+			return fmt.Errorf("invalid path: %s", path)
+		}
+		undo := keepEntry(path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return testAndReload(undo)
+
+	case RepairRemoveRecord:
+		if !hasRecord {
+			return fmt.Errorf("website not found: %s", domain)
+		}
+		return db.DB.Delete(&site).Error
+
+	case RepairRemoveLegacy:
+		// nginx.CreateVhost names files after the bare domain; keep domain.conf
+		legacy := filepath.Join(nginx.SitesAvailable, domain)
+		if _, err := os.Stat(filepath.Join(nginx.SitesAvailable, domain+".conf")); err != nil {
+			return fmt.Errorf("%s.conf does not exist, refusing to remove %s", domain, legacy)
+		}
+		os.Remove(filepath.Join(nginx.SitesEnabled, domain))
+		if err := os.Remove(legacy); err != nil {
+			return err
+		}
+		return testAndReload(nil)
+
+	case RepairImport:
+		if path == "" || filepath.Dir(path) != nginx.SitesEnabled {
+			return fmt.Errorf("invalid path: %s", path)
+		}
+		vhosts, issues, err := ScanVhosts(path)
+		if err != nil {
+			return fmt.Errorf("could not understand %s: %v", path, err)
+		}
+		if len(vhosts) == 0 {
+			return fmt.Errorf("could not understand %s: %s", path, issues[0].Reason)
+		}
+		for _, vhost := range vhosts {
+			var count int64
+			db.DB.Model(&db.Website{}).Where("domain = ?", vhost.Domain).Count(&count)
+			if count > 0 {
+				continue
+			}
+			if err := db.DB.Create(vhost.record()).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case RepairCreateWebroot:
+		if !hasRecord {
+			return fmt.Errorf("website not found: %s", domain)
+		}
+		if err := os.MkdirAll(site.Root, 0755); err != nil {
+			return fmt.Errorf("failed to create web root: %v", err)
+		}
+		system.Execute(fmt.Sprintf("chown -R www-data:www-data %s", site.Root))
+		return nil
+
+	case RepairIssueCertificate:
+		return CreateSSL(domain)
+
+	case RepairDisableSSL:
+		if !hasRecord {
+			return fmt.Errorf("website not found: %s", domain)
+		}
+		site.SSL = false
+		return db.DB.Save(&site).Error
+	}
+
+	return fmt.Errorf("unknown repair action: %s", action)
+}
+
+// availableConfigs returns the configs for a domain in sites-available,
+// the website.CreateWebsite name (domain.conf) first
+func availableConfigs(domain string) []string {
+	var found []string
+	for _, name := range []string{domain + ".conf", domain} {
+		path := filepath.Join(nginx.SitesAvailable, name)
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		}
+	}
+	return found
+}
+
+func isEnabled(domain string) bool {
+	for _, name := range []string{domain + ".conf", domain} {
+		if _, err := os.Stat(filepath.Join(nginx.SitesEnabled, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredDatabase returns the database name an app in the web root is
+// configured for. The config is writable by the site, so a name that is not
+// a plain identifier is ignored.
+func configuredDatabase(site db.Website) string {
+	name := ""
+	if content, err := os.ReadFile(filepath.Join(site.Root, "wp-config.php")); err == nil {
+		if m := wpDBNameRegex.FindSubmatch(content); len(m) > 1 {
+			name = string(m[1])
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(site.Root, ".env")); err == nil && name == "" {
+		if m := laravelDBNameRegex.FindSubmatch(content); len(m) > 1 {
+			name = string(m[1])
+		}
+	}
+	if !dbIdentifierRegex.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+func websiteFromRecord(site db.Website) Website {
+	return Website{
+		Domain:      site.Domain,
+		Type:        site.Type,
+		Port:        site.Port,
+		Root:        site.Root,
+		SSL:         site.SSL,
+		PHPVer:      site.PHPVersion,
+		BackendPort: site.BackendPort,
+
+		AppCommand:    site.AppCommand,
+		AppModule:     site.AppModule,
+		AppServer:     site.AppServer,
+		DockerImage:   site.DockerImage,
+		ContainerPort: site.ContainerPort,
+	}
+}
+
+// keepEntry returns an undo that puts a sites-enabled entry back as it is
+// now: the link with its original target, the file with its content, or
+// nothing if it does not exist
+func keepEntry(path string) func() {
+	if target, err := os.Readlink(path); err == nil {
+		return func() {
+			os.Remove(path)
+			os.Symlink(target, path)
+		}
+	}
+	if content, err := os.ReadFile(path); err == nil {
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		return func() { os.WriteFile(path, content, mode) }
+	}
+	return func() { os.Remove(path) }
+}
+
+// testAndReload validates the nginx config and reloads it, calling undo first on failure
+func testAndReload(undo func()) error {
+	if err := nginx.TestConfig(); err != nil {
+		if undo != nil {
+			undo()
+		}
+		return err
+	}
+	return nginx.Reload()
+}
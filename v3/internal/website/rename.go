@@ -0,0 +1,353 @@
+package website
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/acmavirus/panda-script/v3/internal/cron"
+	"github.com/acmavirus/panda-script/v3/internal/database"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+// redirectSuffix names the configs that redirect a renamed site's old domain
+const redirectSuffix = ".redirect.conf"
+
+var (
+	domainRegex     = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z][a-z0-9-]*[a-z0-9]$`)
+	laravelURLRegex = regexp.MustCompile(`(?m)^APP_URL=.*$`)
+)
+
+const nginxRedirectTemplate = `server {
+    listen 80;
+    listen [::]:80;
+    server_name {{.OldDomain}} www.{{.OldDomain}};
+    return 301 $scheme://{{.NewDomain}}$request_uri;
+}
+{{if .CertPath}}
+server {
+    listen 443 ssl;
+    listen [::]:443 ssl;
+    server_name {{.OldDomain}} www.{{.OldDomain}};
+
+    ssl_certificate {{.CertPath}}/fullchain.pem;
+    ssl_certificate_key {{.CertPath}}/privkey.pem;
+
+    return 301 https://{{.NewDomain}}$request_uri;
+}
+{{end}}`
+
+// RenameOptions controls the optional parts of a domain change
+type RenameOptions struct {
+	NewDomain      string `json:"new_domain" binding:"required"`
+	MoveRoot       bool   `json:"move_root"`       // Move /home/<old> to /home/<new>
+	RenameDatabase bool   `json:"rename_database"` // Rename the database derived from the domain
+}
+
+// ValidateDomain checks that a string is a plain lowercase domain name
+func ValidateDomain(domain string) error {
+	if len(domain) > 253 || !domainRegex.MatchString(domain) {
+		return fmt.Errorf("invalid domain: %q", domain)
+	}
+	return nil
+}
+
+// RenameWebsite changes a website's primary domain as a tracked task.
+// The vhost is regenerated under the new name, a certificate is issued for
+// it when the site uses SSL, WordPress URLs are rewritten and the old domain
+// is left with a 301 redirect.
+func RenameWebsite(domain string, opts RenameOptions) (*task.Task, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("website rename requires Linux")
+	}
+	newDomain := strings.ToLower(strings.TrimSpace(opts.NewDomain))
+	if err := ValidateDomain(newDomain); err != nil {
+		return nil, err
+	}
+	if newDomain == domain {
+		return nil, fmt.Errorf("new domain is the same as the current one")
+	}
+
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	var count int64
+	db.DB.Model(&db.Website{}).Where("domain = ?", newDomain).Count(&count)
+	if count > 0 || len(availableConfigs(newDomain)) > 0 {
+		return nil, fmt.Errorf("%s is already in use", newDomain)
+	}
+
+	oldRoot := site.Root
+	newRoot := oldRoot
+	if opts.MoveRoot {
+		if oldRoot != "/home/"+domain {
+			return nil, fmt.Errorf("web root %s is not /home/%s, move it manually", oldRoot, domain)
+		}
+		newRoot = "/home/" + newDomain
+		if _, err := os.Stat(newRoot); err == nil {
+			return nil, fmt.Errorf("%s already exists", newRoot)
+		}
+	}
+
+	t := task.StartFunc(fmt.Sprintf("rename website %s to %s", domain, newDomain), func(t *task.Task) error {
+		// 1. Web root
+		if newRoot != oldRoot {
+			if err := os.Rename(oldRoot, newRoot); err != nil {
+				return fmt.Errorf("failed to move web root: %v", err)
+			}
+			t.Logf("Moved %s to %s", oldRoot, newRoot)
+			if _, err := cron.ReplaceRoot(oldRoot, newRoot); err != nil {
+				t.Logf("Warning: failed to update cron jobs: %v", err)
+			}
+		}
+		t.SetProgress(20)
+
+		// 2. Database
+		if opts.RenameDatabase {
+			if err := renameSiteDatabase(t, domain, newDomain, newRoot); err != nil {
+				t.Logf("Warning: %v", err)
+			}
+		}
+		t.SetProgress(40)
+
+		// 3. Record and vhost
+		site.Domain = newDomain
+		site.Root = newRoot
+		site.CheckURL = strings.Replace(site.CheckURL, "://"+domain, "://"+newDomain, 1)
+		if err := db.DB.Save(&site).Error; err != nil {
+			return fmt.Errorf("failed to update website record: %v", err)
+		}
+
+		DeleteWebsite(domain)
+		renamed := websiteFromRecord(site)
+		if err := applyVhost(renamed); err != nil {
+			return fmt.Errorf("failed to create vhost for %s: %v", newDomain, err)
+		}
+		t.Logf("Created vhost for %s", newDomain)
+		if hasAppService(renamed) {
+			if err := installApp(renamed); err != nil {
+				t.Logf("Warning: failed to set up app service %s: %v", ServiceName(newDomain), err)
+			} else {
+				t.Logf("Moved app service to %s", ServiceName(newDomain))
+			}
+		}
+		if site.SSL {
+			if err := CreateSSL(newDomain); err != nil {
+				t.Logf("Warning: no certificate for %s, it is served over HTTP until one is issued: %v", newDomain, err)
+			} else {
+				t.Logf("Issued certificate for %s", newDomain)
+			}
+		}
+		if envTarget(site) != EnvTargetDotenv {
+			os.Remove(EnvFilePath(domain))
+			if err := applyEnv(site, nil); err != nil {
+				t.Logf("Warning: failed to render environment: %v", err)
+			}
+		}
+		if site.Type == "laravel" {
+			cron.DeleteByName(schedulerCronName(domain))
+			if err := ApplyLaravelConfig(newDomain); err != nil {
+				t.Logf("Warning: failed to restore queue workers and scheduler: %v", err)
+			}
+		}
+		t.SetProgress(60)
+
+		// 4. Application URLs
+		if _, err := os.Stat(filepath.Join(newRoot, "wp-config.php")); err == nil {
+			out, err := exec.Command("wp", "search-replace", "//"+domain, "//"+newDomain,
+				"--all-tables", "--precise", "--skip-columns=guid", "--path="+newRoot, "--allow-root").CombinedOutput()
+			if err != nil {
+				t.Logf("Warning: WordPress search-replace failed: %s", strings.TrimSpace(string(out)))
+			} else {
+				t.Logf("Rewrote WordPress URLs: %s", strings.TrimSpace(string(out)))
+			}
+		}
+		envPath := filepath.Join(newRoot, ".env")
+		if content, err := os.ReadFile(envPath); err == nil {
+			updated := laravelURLRegex.ReplaceAllStringFunc(string(content), func(line string) string {
+				return strings.Replace(line, "://"+domain, "://"+newDomain, 1)
+			})
+			if err := os.WriteFile(envPath, []byte(updated), 0644); err != nil {
+				t.Logf("Warning: failed to update APP_URL in %s: %v", envPath, err)
+			}
+		}
+		t.SetProgress(80)
+
+		// 5. Redirect the old domain
+		if err := writeRedirect(domain, newDomain); err != nil {
+			t.Logf("Warning: failed to create redirect: %v", err)
+		} else {
+			t.Logf("%s now redirects to %s", domain, newDomain)
+		}
+
+		return nil
+	})
+
+	return t, nil
+}
+
+// renameSiteDatabase copies the database derived from the old domain into
+// one named after the new domain, renames its user and updates the app
+// config. The old database is kept; the copy is checked against it table by
+// table and dropped if it differs.
+func renameSiteDatabase(t *task.Task, oldDomain, newDomain, root string) error {
+	oldName, oldUser := websiteDatabase(db.Website{Domain: oldDomain, Root: root})
+	if oldName == "" {
+		return fmt.Errorf("no database found for %s", oldDomain)
+	}
+	newName := strings.ReplaceAll(strings.ReplaceAll(newDomain, ".", "_"), "-", "_")
+	if checkMySQLDatabaseExists(newName) {
+		return fmt.Errorf("database %s already exists", newName)
+	}
+
+	if _, err := database.ExecuteQuery("", "mysql", fmt.Sprintf("CREATE DATABASE %s;", newName)); err != nil {
+		return fmt.Errorf("failed to create database %s: %v", newName, err)
+	}
+	if out, err := system.Execute(fmt.Sprintf("set -o pipefail; mysqldump --single-transaction %s | mysql %s", oldName, newName)); err != nil {
+		database.DeleteDatabase(newName, "mysql")
+		return fmt.Errorf("failed to copy database: %s %v", strings.TrimSpace(out), err)
+	}
+	if err := compareDatabases(oldName, newName); err != nil {
+		database.DeleteDatabase(newName, "mysql")
+		return fmt.Errorf("the copy of %s is incomplete, the site keeps using it: %v", oldName, err)
+	}
+
+	newUser := oldUser
+	if oldUser == oldName {
+		newUser = newName
+		for _, host := range []string{"localhost", "127.0.0.1"} {
+			database.ExecuteQuery("", "mysql", fmt.Sprintf("RENAME USER '%s'@'%s' TO '%s'@'%s';", oldUser, host, newUser, host))
+		}
+	}
+	if newUser != "" {
+		for _, host := range []string{"localhost", "127.0.0.1"} {
+			database.ExecuteQuery("", "mysql", fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO '%s'@'%s';", newName, newUser, host))
+		}
+		database.ExecuteQuery("", "mysql", "FLUSH PRIVILEGES;")
+	}
+
+	replaceInFile(filepath.Join(root, "wp-config.php"), oldName, newName, oldUser, newUser)
+	replaceInFile(filepath.Join(root, ".env"), oldName, newName, oldUser, newUser)
+
+	t.Logf("Copied database %s to %s; %s is kept, drop it once the site is verified", oldName, newName, oldName)
+	return nil
+}
+
+// compareDatabases checks that every table of source is in target with the
+// same number of rows. Tables only target has are left out.
+func compareDatabases(source, target string) error {
+	want, err := tableRows(source)
+	if err != nil {
+		return err
+	}
+	got, err := tableRows(target)
+	if err != nil {
+		return err
+	}
+	for table, rows := range want {
+		if n, ok := got[table]; !ok {
+			return fmt.Errorf("table %s is missing", table)
+		} else if n != rows {
+			return fmt.Errorf("table %s has %d of %d rows", table, n, rows)
+		}
+	}
+	return nil
+}
+
+// tableRows returns the row count of every table in a database
+func tableRows(name string) (map[string]int64, error) {
+	out, err := mysqlQuery(fmt.Sprintf("SHOW FULL TABLES FROM `%s` WHERE Table_type = 'BASE TABLE';", name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables of %s: %v", name, err)
+	}
+	var counts []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		table, _, _ := strings.Cut(line, "\t")
+		if table != "" {
+			counts = append(counts, fmt.Sprintf("SELECT '%s', COUNT(*) FROM `%s`.`%s`",
+				strings.ReplaceAll(table, "'", "''"), name, strings.ReplaceAll(table, "`", "``")))
+		}
+	}
+	rows := map[string]int64{}
+	if len(counts) == 0 {
+		return rows, nil
+	}
+	out, err = mysqlQuery(strings.Join(counts, " UNION ALL ") + ";")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count rows of %s: %v", name, err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		table, count, _ := strings.Cut(line, "\t")
+		rows[table], _ = strconv.ParseInt(count, 10, 64)
+	}
+	return rows, nil
+}
+
+// replaceInFile swaps the database name and user in quoted or KEY=value settings
+func replaceInFile(path, oldName, newName, oldUser, newUser string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	s := string(content)
+	for _, pair := range [][2]string{{oldName, newName}, {oldUser, newUser}} {
+		if pair[0] == "" || pair[0] == pair[1] {
+			continue
+		}
+		for _, quote := range []string{"'", "\"", "="} {
+			end := quote
+			if quote == "=" {
+				end = "\n"
+			}
+			s = strings.ReplaceAll(s, quote+pair[0]+end, quote+pair[1]+end)
+		}
+	}
+	os.WriteFile(path, []byte(s), 0644)
+}
+
+// writeRedirect leaves a 301 redirect from a renamed site's old domain
+func writeRedirect(oldDomain, newDomain string) error {
+	if err := webserver.RequireNginx("the redirect from a renamed domain"); err != nil {
+		return err
+	}
+	data := struct {
+		OldDomain string
+		NewDomain string
+		CertPath  string
+	}{OldDomain: oldDomain, NewDomain: newDomain}
+
+	certPath := filepath.Join(letsencryptLive, oldDomain)
+	if _, err := os.Stat(filepath.Join(certPath, "fullchain.pem")); err == nil {
+		data.CertPath = certPath
+	}
+
+	t, err := template.New("redirect").Parse(nginxRedirectTemplate)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return err
+	}
+	return nginx.Apply(nginx.ConfigChange{
+		Files: []nginx.FileChange{{
+			Path:    filepath.Join(nginx.SitesAvailable, oldDomain+redirectSuffix),
+			Content: buf.Bytes(),
+			Link:    filepath.Join(nginx.SitesEnabled, oldDomain+redirectSuffix),
+		}},
+		Note: "redirect from renamed domain",
+	})
+}
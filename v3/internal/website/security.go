@@ -0,0 +1,65 @@
+package website
+
+import (
+	"fmt"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+)
+
+// SecuritySettings is the security config of a website and whether its TLS
+// part is in effect
+type SecuritySettings struct {
+	db.SecurityConfig
+	Certificate string `json:"certificate"` // Certificate directory, empty = no TLS
+}
+
+// GetSecurity returns the TLS profile and security headers of a website
+func GetSecurity(domain string) (*SecuritySettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	settings := &SecuritySettings{SecurityConfig: nginx.SiteSecurityConfig(domain), Certificate: certificateDir(domain)}
+	settings.WebsiteID = site.ID
+	return settings, nil
+}
+
+// SetSecurity stores the security config of a website and renders it. The
+// previous config is kept if the vhost does not validate.
+func SetSecurity(domain string, config db.SecurityConfig) (*SecuritySettings, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if err := nginx.ValidateSecurityConfig(config); err != nil {
+		return nil, err
+	}
+
+	var previous db.SecurityConfig
+	existed := db.DB.Where("website_id = ?", site.ID).First(&previous).Error == nil
+	config.ID = previous.ID
+	config.WebsiteID = site.ID
+	if err := db.DB.Save(&config).Error; err != nil {
+		return nil, err
+	}
+
+	if err := applyVhost(websiteFromRecord(site)); err != nil {
+		if existed {
+			db.DB.Save(&previous)
+		} else {
+			db.DB.Delete(&config)
+		}
+		return nil, err
+	}
+	return GetSecurity(domain)
+}
+
+// PreviewSecurity renders a website's config with an unsaved security
+// config, without applying it
+func PreviewSecurity(domain string, config db.SecurityConfig) (*VhostPreview, error) {
+	if err := nginx.ValidateSecurityConfig(config); err != nil {
+		return nil, err
+	}
+	return previewVhost(domain, &config)
+}
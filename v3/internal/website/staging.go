@@ -0,0 +1,378 @@
+package website
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/backup"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+)
+
+// StagingPrefix is prepended to a production domain to name its staging site
+const StagingPrefix = "staging."
+
+// stagingAuthUser is the basic auth login created for every staging site
+const stagingAuthUser = "staging"
+
+var rsyncExcludeRegex = regexp.MustCompile(`^[A-Za-z0-9._/*-]+$`)
+
+// stagingTypes are the site types that can be copied to staging. App
+// backends are left out: a copy would share the production port and service.
+var stagingTypes = map[string]bool{
+	"php":       true,
+	"wordpress": true,
+	"laravel":   true,
+	"static":    true,
+}
+
+// pushExcludes are never overwritten on production by a push: the app
+// config holds the production database credentials, storage holds uploads
+var pushExcludes = map[string][]string{
+	"wordpress": {"wp-config.php", ".maintenance"},
+	"laravel":   {".env", "storage/"},
+}
+
+// StagingInfo describes the staging copy of a website
+type StagingInfo struct {
+	Domain     string `json:"domain"`
+	Staging    string `json:"staging"`
+	Exists     bool   `json:"exists"`
+	Root       string `json:"root,omitempty"`
+	Database   string `json:"database,omitempty"`
+	AuthUser   string `json:"auth_user,omitempty"`
+	AuthPass   string `json:"auth_password,omitempty"` // Only returned on creation
+	CreatedAt  string `json:"created_at,omitempty"`
+	Production uint   `json:"production_id"`
+}
+
+// StagingOptions controls how a staging site is created
+type StagingOptions struct {
+	SkipDatabase bool   `json:"skip_database"`
+	Password     string `json:"password"` // Basic auth password, generated when empty
+}
+
+// PushOptions controls what a push to live overwrites
+type PushOptions struct {
+	Database   bool     `json:"database"`    // Replace the production database too
+	Exclude    []string `json:"exclude"`     // Extra rsync patterns to leave alone
+	SkipBackup bool     `json:"skip_backup"` // Do not archive production first
+}
+
+// StagingDomain returns the staging domain of a production domain
+func StagingDomain(domain string) string {
+	return StagingPrefix + domain
+}
+
+// GetStaging reports whether a website has a staging copy
+func GetStaging(domain string) (*StagingInfo, error) {
+	prod, err := findProduction(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &StagingInfo{Domain: domain, Staging: StagingDomain(domain), Production: prod.ID}
+	var staging db.Website
+	if err := db.DB.Where("domain = ? AND staging_of = ?", info.Staging, prod.ID).First(&staging).Error; err == nil {
+		info.Exists = true
+		info.Root = staging.Root
+		info.Database, _ = websiteDatabase(staging)
+		info.AuthUser = stagingAuthUser
+		info.CreatedAt = staging.CreatedAt.Format("2006-01-02 15:04:05")
+	}
+	return info, nil
+}
+
+func findProduction(domain string) (*db.Website, error) {
+	var prod db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&prod).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if prod.StagingOf != 0 {
+		return nil, fmt.Errorf("%s is itself a staging site", domain)
+	}
+	return &prod, nil
+}
+
+func findStaging(prod *db.Website) (*db.Website, error) {
+	var staging db.Website
+	if err := db.DB.Where("domain = ? AND staging_of = ?", StagingDomain(prod.Domain), prod.ID).First(&staging).Error; err != nil {
+		return nil, fmt.Errorf("%s has no staging site", prod.Domain)
+	}
+	return &staging, nil
+}
+
+// CreateStaging copies a website's files and database to staging.<domain>
+// as a tracked task. URLs are rewritten, the copy is hidden from search
+// engines and protected with basic auth; the returned info holds the login.
+func CreateStaging(domain string, opts StagingOptions) (*task.Task, *StagingInfo, error) {
+	if runtime.GOOS == "windows" {
+		return nil, nil, fmt.Errorf("staging requires Linux")
+	}
+	prod, err := findProduction(domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !stagingTypes[prod.Type] {
+		return nil, nil, fmt.Errorf("staging is not supported for %s sites", prod.Type)
+	}
+
+	stagingDomain := StagingDomain(domain)
+	var count int64
+	db.DB.Model(&db.Website{}).Where("domain = ?", stagingDomain).Count(&count)
+	if count > 0 || len(availableConfigs(stagingDomain)) > 0 {
+		return nil, nil, fmt.Errorf("%s already exists", stagingDomain)
+	}
+	stagingRoot := "/home/" + stagingDomain
+	if _, err := os.Stat(stagingRoot); err == nil {
+		return nil, nil, fmt.Errorf("%s already exists", stagingRoot)
+	}
+
+	password := opts.Password
+	if password == "" {
+		b := make([]byte, 9)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		password = hex.EncodeToString(b)
+	} else if len(password) < 8 {
+		return nil, nil, fmt.Errorf("password must be at least 8 characters")
+	}
+
+	info := &StagingInfo{
+		Domain:     domain,
+		Staging:    stagingDomain,
+		Root:       stagingRoot,
+		AuthUser:   stagingAuthUser,
+		AuthPass:   password,
+		Production: prod.ID,
+	}
+	prodDB, prodUser := websiteDatabase(*prod)
+	if prodDB != "" && !opts.SkipDatabase {
+		info.Database = derivedDatabaseName(stagingDomain)
+		if checkMySQLDatabaseExists(info.Database) {
+			return nil, nil, fmt.Errorf("database %s already exists", info.Database)
+		}
+	}
+
+	t := task.StartFunc("create staging for "+domain, func(t *task.Task) error {
+		// 1. Files
+		t.Logf("Copying %s to %s", prod.Root, stagingRoot)
+		if out, err := system.Execute(fmt.Sprintf("rsync -a %s %s 2>&1", shellQuote(prod.Root+"/"), shellQuote(stagingRoot+"/"))); err != nil {
+			return fmt.Errorf("failed to copy files: %s", strings.TrimSpace(out))
+		}
+		t.SetProgress(30)
+
+		// 2. Database
+		if info.Database != "" {
+			stagingUser := prodUser
+			if prodUser != "" && prodUser != "root" {
+				stagingUser = truncate("stg_"+prodUser, 32)
+			}
+			dump := filepath.Join(os.TempDir(), info.Database+".sql")
+			defer os.Remove(dump)
+			if out, err := system.Execute(fmt.Sprintf("mysqldump --single-transaction %s > %s", prodDB, shellQuote(dump))); err != nil {
+				return fmt.Errorf("failed to dump %s: %s", prodDB, strings.TrimSpace(out))
+			}
+			d := &BundleDatabase{Name: info.Database, User: stagingUser, Password: configuredDBPassword(*prod)}
+			if err := importBundleDatabase(d, dump); err != nil {
+				return err
+			}
+			replaceInFile(filepath.Join(stagingRoot, "wp-config.php"), prodDB, info.Database, prodUser, stagingUser)
+			replaceInFile(filepath.Join(stagingRoot, ".env"), prodDB, info.Database, prodUser, stagingUser)
+			t.Logf("Copied database %s to %s", prodDB, info.Database)
+		}
+		t.SetProgress(55)
+
+		// 3. Record and vhost
+		staging := db.Website{
+			Domain:     stagingDomain,
+			Type:       prod.Type,
+			Port:       prod.Port,
+			Root:       stagingRoot,
+			SSL:        prod.SSL,
+			PHPVersion: prod.PHPVersion,
+			EnvTarget:  prod.EnvTarget,
+			StagingOf:  prod.ID,
+		}
+		if err := db.DB.Create(&staging).Error; err != nil {
+			return fmt.Errorf("failed to create website record: %v", err)
+		}
+		rule, err := CreateAuthRule(stagingDomain, AuthRuleRequest{Path: "/", Realm: "Staging"})
+		if err != nil {
+			return fmt.Errorf("failed to protect staging: %v", err)
+		}
+		// SetAuthUser renders the vhost with the auth rule and noindex header
+		if err := SetAuthUser(stagingDomain, rule.ID, AuthUserRequest{Username: stagingAuthUser, Password: password}); err != nil {
+			return fmt.Errorf("failed to create vhost for %s: %v", stagingDomain, err)
+		}
+		t.Logf("Created vhost for %s", stagingDomain)
+		t.SetProgress(75)
+
+		// 4. URLs
+		rewriteSiteURLs(t, staging, domain, stagingDomain, info.Database != "")
+		if _, err := os.Stat(filepath.Join(stagingRoot, "wp-config.php")); err == nil && info.Database != "" {
+			wpCLI(stagingRoot, "option", "update", "blog_public", "0")
+		}
+
+		return nil
+	})
+
+	return t, info, nil
+}
+
+// PushStagingToLive copies the staging files, and optionally its database,
+// over production as a tracked task. Production is archived first.
+func PushStagingToLive(domain string, opts PushOptions) (*task.Task, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("staging requires Linux")
+	}
+	prod, err := findProduction(domain)
+	if err != nil {
+		return nil, err
+	}
+	staging, err := findStaging(prod)
+	if err != nil {
+		return nil, err
+	}
+
+	excludes := append([]string{}, pushExcludes[prod.Type]...)
+	for _, e := range opts.Exclude {
+		if !rsyncExcludeRegex.MatchString(e) || strings.Contains(e, "..") {
+			return nil, fmt.Errorf("invalid exclude pattern: %q", e)
+		}
+		excludes = append(excludes, e)
+	}
+
+	prodDB, _ := websiteDatabase(*prod)
+	stagingDB, _ := websiteDatabase(*staging)
+	if opts.Database && (prodDB == "" || stagingDB == "") {
+		return nil, fmt.Errorf("both sites need a database to push the database")
+	}
+	if opts.Database && prodDB == stagingDB {
+		return nil, fmt.Errorf("staging uses the production database, there is nothing to push")
+	}
+
+	t := task.StartFunc("push staging to "+domain, func(t *task.Task) error {
+		// 1. Backup
+		restore := "no backup was taken"
+		if !opts.SkipBackup {
+			dbName := ""
+			if opts.Database {
+				dbName = prodDB
+			}
+			info, err := backup.SnapshotWebsite(domain, prod.Root, dbName)
+			if err != nil {
+				return fmt.Errorf("backup failed, nothing was pushed: %v", err)
+			}
+			t.Logf("Backup created: %s", info.Path)
+			restore = "restore it from " + info.Path
+		}
+		t.SetProgress(30)
+
+		// 2. Files
+		args := ""
+		for _, e := range excludes {
+			args += " --exclude=" + shellQuote(e)
+		}
+		out, err := system.Execute(fmt.Sprintf("rsync -a --delete --stats%s %s %s 2>&1", args, shellQuote(staging.Root+"/"), shellQuote(prod.Root+"/")))
+		if err != nil {
+			return fmt.Errorf("failed to sync files: %s", strings.TrimSpace(out))
+		}
+		t.Logf("%s", strings.TrimSpace(out))
+		t.SetProgress(60)
+
+		// 3. Database
+		if opts.Database {
+			if out, err := system.Execute(fmt.Sprintf("set -o pipefail; mysqldump --single-transaction %s | mysql %s", stagingDB, prodDB)); err != nil {
+				return fmt.Errorf("failed to copy database, %s may be incomplete, %s: %s", prodDB, restore, strings.TrimSpace(out))
+			}
+			if err := compareDatabases(stagingDB, prodDB); err != nil {
+				return fmt.Errorf("%s does not match staging after the push, %s: %v", prodDB, restore, err)
+			}
+			t.Logf("Copied database %s to %s", stagingDB, prodDB)
+			rewriteSiteURLs(t, *prod, staging.Domain, domain, true)
+			if _, err := os.Stat(filepath.Join(prod.Root, "wp-config.php")); err == nil {
+				wpCLI(prod.Root, "option", "update", "blog_public", "1")
+			}
+		}
+		t.SetProgress(90)
+
+		if prod.Type == "laravel" {
+			if cmd, err := artisanCommand(prod, "optimize:clear"); err == nil {
+				system.Execute(cmd)
+			}
+			if cmd, err := artisanCommand(prod, "queue:restart"); err == nil {
+				system.Execute(cmd)
+			}
+		}
+		return nil
+	})
+
+	return t, nil
+}
+
+// DeleteStaging removes the staging site with its files, database and
+// certificate. No final archive is taken. A staging site created without
+// its own database keeps pointing at production's, which is never dropped.
+func DeleteStaging(domain string) (*task.Task, error) {
+	prod, err := findProduction(domain)
+	if err != nil {
+		return nil, err
+	}
+	staging, err := findStaging(prod)
+	if err != nil {
+		return nil, err
+	}
+	prodDB, _ := websiteDatabase(*prod)
+	stagingDB, _ := websiteDatabase(*staging)
+	return DeleteWebsiteFull(staging.Domain, DeleteOptions{
+		Files:       true,
+		Database:    stagingDB != "" && stagingDB != prodDB,
+		Certificate: true,
+		Logs:        true,
+		Cron:        true,
+		Record:      true,
+		SkipBackup:  true,
+	})
+}
+
+// rewriteSiteURLs points a copied site at its new domain. WordPress data
+// goes through wp search-replace, which keeps serialized values intact.
+func rewriteSiteURLs(t *task.Task, site db.Website, from, to string, database bool) {
+	if _, err := os.Stat(filepath.Join(site.Root, "wp-config.php")); err == nil && database {
+		out, err := wpCLI(site.Root, "search-replace", "//"+from, "//"+to, "--all-tables", "--precise", "--skip-columns=guid", "--report-changed-only")
+		if err != nil {
+			t.Logf("Warning: WordPress search-replace failed: %s", strings.TrimSpace(out))
+		} else {
+			t.Logf("Rewrote WordPress URLs: %s", strings.TrimSpace(out))
+		}
+	}
+
+	envPath := filepath.Join(site.Root, ".env")
+	if content, err := os.ReadFile(envPath); err == nil {
+		updated := laravelURLRegex.ReplaceAllStringFunc(string(content), func(line string) string {
+			return strings.Replace(line, "://"+from, "://"+to, 1)
+		})
+		os.WriteFile(envPath, []byte(updated), 0644)
+	}
+}
+
+// derivedDatabaseName is the database name the panel uses for a domain
+func derivedDatabaseName(domain string) string {
+	return truncate(strings.ReplaceAll(strings.ReplaceAll(domain, ".", "_"), "-", "_"), 64)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,455 @@
+package website
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/logs"
+	"github.com/acmavirus/panda-script/v3/internal/php"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+const (
+	statsInterval  = 5 * time.Minute
+	diskInterval   = time.Hour
+	statsRetention = 400 // days
+
+	// topListSize is how many URLs and referrers are kept per day
+	topListSize = 100
+
+	// sketchBits sets the HyperLogLog precision: 4096 registers, ~1.6% error
+	sketchBits = 12
+
+	dateLayout = "2006-01-02"
+)
+
+var (
+	statsMu   sync.Mutex
+	lastDisk  = make(map[uint]time.Time)
+	lastTicks = make(map[string]map[int]uint64)
+	lastPools time.Time
+)
+
+// SiteStats is the traffic report of a website over a date range
+type SiteStats struct {
+	Domain       string              `json:"domain"`
+	From         string              `json:"from"`
+	To           string              `json:"to"`
+	Totals       StatsTotals         `json:"totals"`
+	TopURLs      []db.StatCount      `json:"top_urls"`
+	TopReferrers []db.StatCount      `json:"top_referrers"`
+	DiskBytes    int64               `json:"disk_bytes"`
+	Days         []db.SiteStatsDaily `json:"days"`
+	PHPPool      *PoolStats          `json:"php_pool,omitempty"`
+}
+
+// StatsTotals sums the daily rollups of a range
+type StatsTotals struct {
+	Requests    int64            `json:"requests"`
+	BotRequests int64            `json:"bot_requests"`
+	Bytes       int64            `json:"bytes"`
+	Visitors    int64            `json:"visitors"` // Unique over the whole range
+	Status      map[string]int64 `json:"status"`
+}
+
+// PoolStats is the usage of the PHP-FPM pool serving a website
+type PoolStats struct {
+	Version string              `json:"version"`
+	Pool    string              `json:"pool"`
+	Shared  bool                `json:"shared"` // Other websites use the pool too
+	Days    []db.PoolStatsDaily `json:"days"`
+}
+
+// StartStatsCollector rolls up per-site access logs, PHP-FPM pool usage
+// and disk usage into daily statistics in the background
+func StartStatsCollector() {
+	ticker := time.NewTicker(statsInterval)
+	go func() {
+		collectStats()
+		for range ticker.C {
+			collectStats()
+		}
+	}()
+}
+
+func collectStats() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	var websites []db.Website
+	if err := db.DB.Find(&websites).Error; err != nil {
+		return
+	}
+
+	for _, w := range websites {
+		if err := collectAccessLog(w); err != nil {
+			fmt.Printf("Stats: %s: %v\n", w.Domain, err)
+		}
+		if time.Since(lastDisk[w.ID]) >= diskInterval {
+			collectDiskUsage(w)
+			lastDisk[w.ID] = time.Now()
+		}
+	}
+	collectPoolUsage()
+
+	cutoff := time.Now().AddDate(0, 0, -statsRetention).Format(dateLayout)
+	db.DB.Where("date < ?", cutoff).Delete(&db.SiteStatsDaily{})
+	db.DB.Where("date < ?", cutoff).Delete(&db.PoolStatsDaily{})
+}
+
+// collectAccessLog reads the lines added to a site's access log since the
+// last run. The read position is kept in the settings table; a file that
+// shrank was rotated and is read from the start.
+func collectAccessLog(w db.Website) error {
+	path := webserver.Current().AccessLog(w.Domain)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cursorKey := "stats_cursor:" + w.Domain
+	var cursor db.Setting
+	db.DB.Where("key = ?", cursorKey).First(&cursor)
+	offset, _ := strconv.ParseInt(cursor.Value, 10, 64)
+	if offset > info.Size() {
+		offset = 0
+	}
+	if offset == info.Size() {
+		return nil
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	days := make(map[string]*dayRollup)
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Leave a partially written last line for the next run
+			break
+		}
+		offset += int64(len(line))
+
+		entry, ok := logs.ParseAccessLine(strings.TrimRight(line, "\n"))
+		if !ok || entry.Time.IsZero() {
+			continue
+		}
+		date := entry.Time.Local().Format(dateLayout)
+		day, ok := days[date]
+		if !ok {
+			day = newDayRollup()
+			days[date] = day
+		}
+		day.add(entry, w.Domain)
+	}
+
+	for date, day := range days {
+		if err := day.save(w.ID, date); err != nil {
+			return err
+		}
+	}
+
+	cursor.Key = cursorKey
+	cursor.Value = strconv.FormatInt(offset, 10)
+	return db.DB.Save(&cursor).Error
+}
+
+// dayRollup accumulates one day of log lines before it is merged into the DB
+type dayRollup struct {
+	stats     db.SiteStatsDaily
+	sketch    []byte
+	urls      map[string]int64
+	referrers map[string]int64
+}
+
+func newDayRollup() *dayRollup {
+	return &dayRollup{
+		sketch:    make([]byte, 1<<sketchBits),
+		urls:      make(map[string]int64),
+		referrers: make(map[string]int64),
+	}
+}
+
+func (d *dayRollup) add(entry logs.AccessLogEntry, domain string) {
+	d.stats.Requests++
+	d.stats.Bytes += entry.Bytes
+	if entry.IsBot {
+		d.stats.BotRequests++
+	}
+	switch entry.Status / 100 {
+	case 2:
+		d.stats.Status2xx++
+	case 3:
+		d.stats.Status3xx++
+	case 4:
+		d.stats.Status4xx++
+	case 5:
+		d.stats.Status5xx++
+	}
+	sketchAdd(d.sketch, entry.IP)
+
+	if path, _, _ := strings.Cut(entry.Path, "?"); path != "" {
+		d.urls[path]++
+	}
+	if host := entry.Host; host != "" && host != domain && host != "www."+domain {
+		d.referrers[host]++
+	}
+}
+
+// save merges the rollup into the stored row of the day
+func (d *dayRollup) save(websiteID uint, date string) error {
+	var row db.SiteStatsDaily
+	db.DB.Where("website_id = ? AND date = ?", websiteID, date).First(&row)
+	row.WebsiteID = websiteID
+	row.Date = date
+	row.Requests += d.stats.Requests
+	row.BotRequests += d.stats.BotRequests
+	row.Bytes += d.stats.Bytes
+	row.Status2xx += d.stats.Status2xx
+	row.Status3xx += d.stats.Status3xx
+	row.Status4xx += d.stats.Status4xx
+	row.Status5xx += d.stats.Status5xx
+
+	row.VisitorSketch = sketchMerge(row.VisitorSketch, d.sketch)
+	row.Visitors = sketchCount(row.VisitorSketch)
+	row.TopURLs = mergeTop(row.TopURLs, d.urls, topListSize)
+	row.TopReferrers = mergeTop(row.TopReferrers, d.referrers, topListSize)
+
+	return db.DB.Save(&row).Error
+}
+
+func collectDiskUsage(w db.Website) {
+	if w.Root == "" {
+		return
+	}
+	out, err := system.Execute(fmt.Sprintf("du -sb %s 2>/dev/null | cut -f1", w.Root))
+	if err != nil {
+		return
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return
+	}
+
+	date := time.Now().Format(dateLayout)
+	var row db.SiteStatsDaily
+	db.DB.Where("website_id = ? AND date = ?", w.ID, date).First(&row)
+	row.WebsiteID = w.ID
+	row.Date = date
+	row.DiskBytes = size
+	db.DB.Save(&row)
+}
+
+// collectPoolUsage adds the CPU time used by each pool since the last sample.
+// Workers that did not exist at the last sample count with their full time.
+func collectPoolUsage() {
+	samples, err := php.SamplePools()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	date := now.Format(dateLayout)
+	first := lastPools.IsZero()
+	current := make(map[string]map[int]uint64)
+
+	for _, s := range samples {
+		key := s.Version + "/" + s.Pool
+		current[key] = s.Ticks
+
+		var ticks uint64
+		prev := lastTicks[key]
+		for pid, t := range s.Ticks {
+			if p, ok := prev[pid]; ok && t >= p {
+				ticks += t - p
+			} else if prev != nil {
+				ticks += t
+			}
+		}
+
+		var row db.PoolStatsDaily
+		db.DB.Where("version = ? AND pool = ? AND date = ?", s.Version, s.Pool, date).First(&row)
+		row.Version = s.Version
+		row.Pool = s.Pool
+		row.Date = date
+		if !first {
+			row.CPUSeconds += float64(ticks) / php.ClockTicks
+		}
+		row.AvgMemory = (row.AvgMemory*int64(row.Samples) + s.MemoryBytes) / int64(row.Samples+1)
+		row.Samples++
+		if s.MemoryBytes > row.PeakMemory {
+			row.PeakMemory = s.MemoryBytes
+		}
+		if s.Processes > row.PeakProcesses {
+			row.PeakProcesses = s.Processes
+		}
+		db.DB.Save(&row)
+	}
+
+	lastTicks = current
+	lastPools = now
+}
+
+// GetSiteStats returns the daily rollups of a website between two dates
+// (inclusive) with totals over the range
+func GetSiteStats(domain string, from, to time.Time) (*SiteStats, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("range end is before its start")
+	}
+	if to.Sub(from) > statsRetention*24*time.Hour {
+		return nil, fmt.Errorf("range is longer than %d days", statsRetention)
+	}
+
+	stats := &SiteStats{
+		Domain:       domain,
+		From:         from.Format(dateLayout),
+		To:           to.Format(dateLayout),
+		Totals:       StatsTotals{Status: map[string]int64{}},
+		TopURLs:      []db.StatCount{},
+		TopReferrers: []db.StatCount{},
+		Days:         []db.SiteStatsDaily{},
+	}
+	if err := db.DB.Where("website_id = ? AND date >= ? AND date <= ?", site.ID, stats.From, stats.To).
+		Order("date").Find(&stats.Days).Error; err != nil {
+		return nil, err
+	}
+
+	var sketch []byte
+	urls := make(map[string]int64)
+	referrers := make(map[string]int64)
+	for _, d := range stats.Days {
+		stats.Totals.Requests += d.Requests
+		stats.Totals.BotRequests += d.BotRequests
+		stats.Totals.Bytes += d.Bytes
+		stats.Totals.Status["2xx"] += d.Status2xx
+		stats.Totals.Status["3xx"] += d.Status3xx
+		stats.Totals.Status["4xx"] += d.Status4xx
+		stats.Totals.Status["5xx"] += d.Status5xx
+		sketch = sketchMerge(sketch, d.VisitorSketch)
+		for _, c := range d.TopURLs {
+			urls[c.Value] += c.Count
+		}
+		for _, c := range d.TopReferrers {
+			referrers[c.Value] += c.Count
+		}
+		if d.DiskBytes > 0 {
+			stats.DiskBytes = d.DiskBytes
+		}
+	}
+	stats.Totals.Visitors = sketchCount(sketch)
+	stats.TopURLs = mergeTop(nil, urls, 20)
+	stats.TopReferrers = mergeTop(nil, referrers, 20)
+
+	if site.PHPVersion != "" {
+		socket := fmt.Sprintf("php%s-fpm.sock", site.PHPVersion)
+		if pool := php.PoolForSocket(site.PHPVersion, socket); pool != "" {
+			stats.PHPPool = &PoolStats{Version: site.PHPVersion, Pool: pool, Days: []db.PoolStatsDaily{}}
+			db.DB.Where("version = ? AND pool = ? AND date >= ? AND date <= ?", site.PHPVersion, pool, stats.From, stats.To).
+				Order("date").Find(&stats.PHPPool.Days)
+			var shared int64
+			db.DB.Model(&db.Website{}).Where("php_version = ? AND id <> ?", site.PHPVersion, site.ID).Count(&shared)
+			stats.PHPPool.Shared = shared > 0
+		}
+	}
+
+	return stats, nil
+}
+
+// mergeTop adds counts to a top list and keeps the n largest entries
+func mergeTop(list []db.StatCount, counts map[string]int64, n int) []db.StatCount {
+	merged := make(map[string]int64, len(list)+len(counts))
+	for _, c := range list {
+		merged[c.Value] += c.Count
+	}
+	for v, c := range counts {
+		merged[v] += c
+	}
+
+	out := make([]db.StatCount, 0, len(merged))
+	for v, c := range merged {
+		out = append(out, db.StatCount{Value: v, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// sketchAdd records a value in a HyperLogLog sketch
+func sketchAdd(sketch []byte, value string) {
+	sum := sha256.Sum256([]byte(value))
+	h := binary.BigEndian.Uint64(sum[:8])
+	idx := h >> (64 - sketchBits)
+	rank := byte(bits.LeadingZeros64(h<<sketchBits|1<<(sketchBits-1)) + 1)
+	if rank > sketch[idx] {
+		sketch[idx] = rank
+	}
+}
+
+// sketchMerge returns the union of two sketches; either may be empty
+func sketchMerge(a, b []byte) []byte {
+	if len(a) != 1<<sketchBits {
+		a = make([]byte, 1<<sketchBits)
+	}
+	if len(b) != 1<<sketchBits {
+		return a
+	}
+	for i := range a {
+		if b[i] > a[i] {
+			a[i] = b[i]
+		}
+	}
+	return a
+}
+
+// sketchCount estimates the number of distinct values in a sketch
+func sketchCount(sketch []byte) int64 {
+	if len(sketch) != 1<<sketchBits {
+		return 0
+	}
+	m := float64(len(sketch))
+	sum := 0.0
+	zeros := 0
+	for _, r := range sketch {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Small range correction
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
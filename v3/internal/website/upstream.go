@@ -0,0 +1,179 @@
+package website
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+)
+
+// UpstreamRequest replaces the upstream group of a website
+type UpstreamRequest struct {
+	Name     string           `json:"name"`   // Empty = derived from the domain
+	Method   string           `json:"method"` // round_robin (default), least_conn, ip_hash
+	Backends []BackendRequest `json:"backends" binding:"required"`
+}
+
+// BackendRequest is a server of an upstream group
+type BackendRequest struct {
+	Address     string `json:"address" binding:"required"` // host:port or unix:/path
+	Weight      int    `json:"weight"`
+	MaxFails    int    `json:"max_fails"`
+	FailTimeout int    `json:"fail_timeout"`
+	Backup      bool   `json:"backup"`
+	State       string `json:"state"` // active (default), draining, disabled
+}
+
+// findProxySite returns a website that is served by the proxy template
+func findProxySite(domain string) (*db.Website, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if nginx.TemplateForSiteType(site.Type) != "proxy" {
+		return nil, fmt.Errorf("%s is a %s site; upstream groups are for proxied apps", domain, site.Type)
+	}
+	return &site, nil
+}
+
+// GetUpstream returns the upstream group of a website, or nil when it
+// proxies to its backend port only
+func GetUpstream(domain string) (*db.UpstreamGroup, error) {
+	site, err := findProxySite(domain)
+	if err != nil {
+		return nil, err
+	}
+	var g db.UpstreamGroup
+	if db.DB.Preload("Backends").Where("website_id = ?", site.ID).First(&g).Error != nil {
+		return nil, nil
+	}
+	return &g, nil
+}
+
+// SetUpstream replaces the upstream group of a website and renders it. The
+// previous group is restored if the vhost does not validate.
+func SetUpstream(domain string, req UpstreamRequest) (*db.UpstreamGroup, error) {
+	site, err := findProxySite(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	g := db.UpstreamGroup{WebsiteID: site.ID, Name: strings.TrimSpace(req.Name), Method: req.Method}
+	if g.Name == "" {
+		g.Name = nginx.UpstreamName(domain)
+	}
+	if g.Method == "" {
+		g.Method = nginx.BalanceRoundRobin
+	}
+	for _, b := range req.Backends {
+		if b.State == "" {
+			b.State = nginx.BackendActive
+		}
+		g.Backends = append(g.Backends, db.UpstreamBackend{
+			Address:     strings.TrimSpace(b.Address),
+			Weight:      b.Weight,
+			MaxFails:    b.MaxFails,
+			FailTimeout: b.FailTimeout,
+			Backup:      b.Backup,
+			State:       b.State,
+		})
+	}
+	if len(g.Backends) == 0 {
+		return nil, fmt.Errorf("at least one backend is required")
+	}
+	if err := nginx.ValidateUpstream(g); err != nil {
+		return nil, err
+	}
+	var count int64
+	db.DB.Model(&db.UpstreamGroup{}).Where("name = ? AND website_id <> ?", g.Name, site.ID).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("upstream %s is used by another website", g.Name)
+	}
+
+	previous, _ := GetUpstream(domain)
+	deleteUpstream(site.ID)
+	if err := db.DB.Create(&g).Error; err != nil {
+		restoreUpstream(site.ID, previous)
+		return nil, err
+	}
+	if err := applyVhost(websiteFromRecord(*site)); err != nil {
+		restoreUpstream(site.ID, previous)
+		return nil, err
+	}
+	return GetUpstream(domain)
+}
+
+// DeleteUpstream removes the upstream group of a website, which then
+// proxies to its backend port again
+func DeleteUpstream(domain string) error {
+	site, err := findProxySite(domain)
+	if err != nil {
+		return err
+	}
+	previous, _ := GetUpstream(domain)
+	if previous == nil {
+		return fmt.Errorf("%s has no upstream group", domain)
+	}
+	deleteUpstream(site.ID)
+	if err := applyVhost(websiteFromRecord(*site)); err != nil {
+		restoreUpstream(site.ID, previous)
+		return err
+	}
+	return nil
+}
+
+// SetBackendState drains, disables or re-enables a backend
+func SetBackendState(domain string, id uint, state string) (*db.UpstreamGroup, error) {
+	site, err := findProxySite(domain)
+	if err != nil {
+		return nil, err
+	}
+	g, err := GetUpstream(domain)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, fmt.Errorf("%s has no upstream group", domain)
+	}
+
+	var backend *db.UpstreamBackend
+	for i := range g.Backends {
+		if g.Backends[i].ID == id {
+			backend = &g.Backends[i]
+		}
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("backend %d not found", id)
+	}
+	previous := backend.State
+	backend.State = state
+	if err := nginx.ValidateUpstream(*g); err != nil {
+		return nil, err
+	}
+	if err := db.DB.Model(backend).Update("state", state).Error; err != nil {
+		return nil, err
+	}
+	if err := applyVhost(websiteFromRecord(*site)); err != nil {
+		db.DB.Model(backend).Update("state", previous)
+		return nil, err
+	}
+	return GetUpstream(domain)
+}
+
+func deleteUpstream(websiteID uint) {
+	var groups []db.UpstreamGroup
+	db.DB.Where("website_id = ?", websiteID).Find(&groups)
+	for _, g := range groups {
+		db.DB.Where("group_id = ?", g.ID).Delete(&db.UpstreamBackend{})
+		db.DB.Delete(&g)
+	}
+}
+
+// restoreUpstream puts back a group removed by deleteUpstream
+func restoreUpstream(websiteID uint, previous *db.UpstreamGroup) {
+	deleteUpstream(websiteID)
+	if previous != nil {
+		db.DB.Create(previous)
+	}
+}
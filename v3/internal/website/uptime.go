@@ -0,0 +1,322 @@
+package website
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
+)
+
+const (
+	// DefaultCheckInterval is used for websites without a custom interval
+	DefaultCheckInterval = 600
+	// MinCheckInterval is the shortest interval a website can be checked at
+	MinCheckInterval = 30
+
+	// flapThreshold is how many consecutive results are needed before
+	// a site is considered down (or recovered) and an alert is sent
+	flapThreshold = 2
+
+	// uptimeRetention is how long individual checks are kept
+	uptimeRetention = 31 * 24 * time.Hour
+
+	// maxKeywordBody caps how much of the response is searched for the keyword
+	maxKeywordBody = 1 << 20
+)
+
+// Notifier is called when a website goes down or recovers.
+// It is set by the API layer so alerts reach every configured channel.
+var Notifier func(title, message, notifType string)
+
+// MonitorConfig holds the per-site uptime check settings
+type MonitorConfig struct {
+	Interval     int    `json:"check_interval"`
+	URL          string `json:"check_url"`
+	ExpectStatus int    `json:"check_expect_status"`
+	Keyword      string `json:"check_keyword"`
+}
+
+// UptimeWindow summarizes the checks in a time window
+type UptimeWindow struct {
+	Checks  int64   `json:"checks"`
+	Up      int64   `json:"up"`
+	Percent float64 `json:"percent"`
+}
+
+// UptimeStats is the uptime report for a single website
+type UptimeStats struct {
+	Domain       string          `json:"domain"`
+	Down         bool            `json:"down"`
+	Config       MonitorConfig   `json:"config"`
+	Last         *db.UptimeCheck `json:"last,omitempty"`
+	AvgLatencyMs float64         `json:"avg_latency_ms"` // Last 24h, successful checks only
+	Day          UptimeWindow    `json:"uptime_24h"`
+	Week         UptimeWindow    `json:"uptime_7d"`
+	Month        UptimeWindow    `json:"uptime_30d"`
+}
+
+// StartStatusChecker starts the background worker for checking website status
+func StartStatusChecker() {
+	ticker := time.NewTicker(1 * time.Minute)
+	go func() {
+		// Initial check
+		checkAllWebsites(true)
+		for range ticker.C {
+			checkAllWebsites(false)
+		}
+	}()
+}
+
+func checkAllWebsites(force bool) {
+	var websites []db.Website
+	if err := db.DB.Find(&websites).Error; err != nil {
+		return
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("stopped after 5 redirects")
+			}
+			return nil
+		},
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := range websites {
+		w := &websites[i]
+		if !force && now.Sub(w.LastCheck) < checkInterval(w) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(w *db.Website) {
+			defer wg.Done()
+			check := checkWebsite(client, w)
+			recordCheck(w, check)
+		}(w)
+	}
+	wg.Wait()
+
+	db.DB.Where("checked_at < ?", now.Add(-uptimeRetention)).Delete(&db.UptimeCheck{})
+}
+
+func checkInterval(w *db.Website) time.Duration {
+	interval := w.CheckInterval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	if interval < MinCheckInterval {
+		interval = MinCheckInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// probe requests a URL as the panel. Bot blocking lets it through by its
+// source address, not by its user agent.
+func probe(client *http.Client, target string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", nginx.PanelUserAgent)
+	return client.Do(req)
+}
+
+// checkWebsite probes a website once and returns the result
+func checkWebsite(client *http.Client, w *db.Website) db.UptimeCheck {
+	check := db.UptimeCheck{
+		WebsiteID: w.ID,
+		CheckedAt: time.Now(),
+	}
+
+	target := w.CheckURL
+	if target == "" {
+		protocol := "http://"
+		if w.SSL {
+			protocol = "https://"
+		}
+		target = protocol + w.Domain
+	}
+
+	start := time.Now()
+	resp, err := probe(client, target)
+	if err != nil && w.CheckURL == "" && w.SSL {
+		start = time.Now()
+		resp, err = probe(client, "http://"+w.Domain)
+	}
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	defer resp.Body.Close()
+
+	check.StatusCode = resp.StatusCode
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		expiry := resp.TLS.PeerCertificates[0].NotAfter
+		check.TLSExpiry = &expiry
+	}
+
+	if w.CheckExpectStatus != 0 {
+		if resp.StatusCode != w.CheckExpectStatus {
+			check.Error = fmt.Sprintf("expected status %d, got %d", w.CheckExpectStatus, resp.StatusCode)
+		}
+	} else if resp.StatusCode >= 500 {
+		check.Error = fmt.Sprintf("server error: %s", resp.Status)
+	}
+
+	if check.Error == "" && w.CheckKeyword != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeywordBody))
+		if err != nil {
+			check.Error = fmt.Sprintf("failed to read body: %v", err)
+		} else if !strings.Contains(string(body), w.CheckKeyword) {
+			check.Error = fmt.Sprintf("keyword %q not found", w.CheckKeyword)
+		}
+	}
+
+	check.LatencyMs = time.Since(start).Milliseconds()
+	check.Up = check.Error == ""
+	return check
+}
+
+// recordCheck stores a check result and sends alerts on state changes
+func recordCheck(w *db.Website, check db.UptimeCheck) {
+	db.DB.Create(&check)
+
+	status := "active"
+	if !check.Up {
+		status = "error"
+	}
+
+	// Flap suppression: only flip the alert state after several
+	// consecutive results that disagree with it
+	down := w.MonitorDown
+	streak := 0
+	if check.Up == w.MonitorDown {
+		streak = w.MonitorStreak + 1
+		if streak >= flapThreshold {
+			down = !check.Up
+			streak = 0
+		}
+	}
+
+	db.DB.Model(&db.Website{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
+		"status":         status,
+		"status_code":    check.StatusCode,
+		"last_check":     check.CheckedAt,
+		"monitor_down":   down,
+		"monitor_streak": streak,
+	})
+
+	if down == w.MonitorDown || Notifier == nil {
+		return
+	}
+	if down {
+		Notifier("Website Down", fmt.Sprintf("%s is down: %s", w.Domain, check.Error), "error")
+	} else {
+		Notifier("Website Recovered", fmt.Sprintf("%s is back up (%d ms)", w.Domain, check.LatencyMs), "success")
+	}
+}
+
+// GetUptimeStats returns uptime percentages and the latest check for a website
+func GetUptimeStats(domain string) (*UptimeStats, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+
+	now := time.Now()
+	stats := &UptimeStats{
+		Domain: site.Domain,
+		Down:   site.MonitorDown,
+		Config: MonitorConfig{
+			Interval:     int(checkInterval(&site).Seconds()),
+			URL:          site.CheckURL,
+			ExpectStatus: site.CheckExpectStatus,
+			Keyword:      site.CheckKeyword,
+		},
+		Day:   uptimeWindow(site.ID, now.Add(-24*time.Hour)),
+		Week:  uptimeWindow(site.ID, now.AddDate(0, 0, -7)),
+		Month: uptimeWindow(site.ID, now.AddDate(0, 0, -30)),
+	}
+
+	var last db.UptimeCheck
+	if err := db.DB.Where("website_id = ?", site.ID).Order("checked_at desc").First(&last).Error; err == nil {
+		stats.Last = &last
+	}
+
+	var avg struct{ Avg float64 }
+	db.DB.Model(&db.UptimeCheck{}).
+		Select("COALESCE(AVG(latency_ms), 0) AS avg").
+		Where("website_id = ? AND up = ? AND checked_at >= ?", site.ID, true, now.Add(-24*time.Hour)).
+		Scan(&avg)
+	stats.AvgLatencyMs = avg.Avg
+
+	return stats, nil
+}
+
+func uptimeWindow(websiteID uint, since time.Time) UptimeWindow {
+	var w UptimeWindow
+	db.DB.Model(&db.UptimeCheck{}).Where("website_id = ? AND checked_at >= ?", websiteID, since).Count(&w.Checks)
+	db.DB.Model(&db.UptimeCheck{}).Where("website_id = ? AND checked_at >= ? AND up = ?", websiteID, since, true).Count(&w.Up)
+	if w.Checks > 0 {
+		w.Percent = float64(w.Up) * 100 / float64(w.Checks)
+	}
+	return w
+}
+
+// ListUptimeChecks returns the most recent checks for a website, newest first
+func ListUptimeChecks(domain string, limit int) ([]db.UptimeCheck, error) {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return nil, fmt.Errorf("website not found: %v", err)
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	var checks []db.UptimeCheck
+	err := db.DB.Where("website_id = ?", site.ID).Order("checked_at desc").Limit(limit).Find(&checks).Error
+	return checks, err
+}
+
+// UpdateMonitorConfig changes how a website is checked
+func UpdateMonitorConfig(domain string, config MonitorConfig) error {
+	var site db.Website
+	if err := db.DB.Where("domain = ?", domain).First(&site).Error; err != nil {
+		return fmt.Errorf("website not found: %v", err)
+	}
+
+	if config.Interval != 0 && config.Interval < MinCheckInterval {
+		return fmt.Errorf("check interval must be at least %d seconds", MinCheckInterval)
+	}
+	if config.ExpectStatus != 0 && (config.ExpectStatus < 100 || config.ExpectStatus > 599) {
+		return fmt.Errorf("invalid expected status: %d", config.ExpectStatus)
+	}
+	if config.URL != "" {
+		u, err := url.Parse(config.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid check URL: %s", config.URL)
+		}
+	}
+
+	return db.DB.Model(&site).Updates(map[string]interface{}{
+		"check_interval":      config.Interval,
+		"check_url":           config.URL,
+		"check_expect_status": config.ExpectStatus,
+		"check_keyword":       config.Keyword,
+	}).Error
+}
@@ -0,0 +1,77 @@
+package website
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/webserver"
+)
+
+// SwitchWebServer moves every website to another web server. Each site is
+// rendered for it first, so a site using features the new server lacks
+// stops the switch before anything changes. The old server is then stopped,
+// the new one started and every site applied; if that fails, the old
+// server is brought back.
+func SwitchWebServer(name string) ([]webserver.Info, error) {
+	next, err := webserver.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	previous := webserver.Current()
+	if next.Name() == previous.Name() {
+		return webserver.List(), nil
+	}
+	if !next.Installed() {
+		return nil, fmt.Errorf("%s is not installed", name)
+	}
+
+	var records []db.Website
+	if err := db.DB.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	var sites []webserver.Site
+	var refused []string
+	for _, record := range records {
+		site := websiteFromRecord(record)
+		if site.Root == "" {
+			site.Root = "/home/" + site.Domain
+		}
+		s := vhostSite(site, nil)
+		if _, err := next.Render(s); err != nil {
+			refused = append(refused, fmt.Sprintf("%s: %v", site.Domain, err))
+		}
+		sites = append(sites, s)
+	}
+	if len(refused) > 0 {
+		return nil, fmt.Errorf("%s cannot serve these websites: %s", name, strings.Join(refused, "; "))
+	}
+
+	// Both listen on ports 80 and 443
+	previous.Stop()
+	if err := webserver.SetCurrent(name); err != nil {
+		previous.Start()
+		return nil, err
+	}
+	err = next.Start()
+	for i := 0; err == nil && i < len(sites); i++ {
+		if err = next.Apply(sites[i]); err != nil {
+			err = fmt.Errorf("%s: %v", sites[i].Domain, err)
+		}
+	}
+	if err != nil {
+		next.Stop()
+		webserver.SetCurrent(previous.Name())
+		previous.Start()
+		return nil, fmt.Errorf("failed to switch to %s, %s was restored: %v", name, previous.Name(), err)
+	}
+
+	// The panel domain moves along, with a certificate from the new server
+	var panel db.Setting
+	if db.DB.Where("key = ?", "panel_ssl_domain").First(&panel).Error == nil && panel.Value != "" {
+		if err := next.ServePanel(panel.Value, ""); err != nil {
+			return webserver.List(), fmt.Errorf("switched to %s, but the panel domain was not moved: %v", name, err)
+		}
+	}
+	return webserver.List(), nil
+}
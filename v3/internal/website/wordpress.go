@@ -0,0 +1,432 @@
+package website
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/acmavirus/panda-script/v3/internal/backup"
+	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/system"
+	"github.com/acmavirus/panda-script/v3/internal/task"
+)
+
+// wpScanRoot is searched for WordPress installs
+const wpScanRoot = "/home"
+
+// wpScanWorkers caps how many sites are queried with WP-CLI at once
+const wpScanWorkers = 4
+
+var (
+	wpVersionRegex  = regexp.MustCompile(`\$wp_version\s*=\s*'([^']+)'`)
+	wpDebugRegex    = regexp.MustCompile(`define\(\s*['"]WP_DEBUG['"]\s*,\s*true\s*\)`)
+	wpUsernameRegex = regexp.MustCompile(`^[A-Za-z0-9_.@\- ]+$`)
+)
+
+// WPExtension is an installed plugin or theme
+type WPExtension struct {
+	Name          string `json:"name"`
+	Title         string `json:"title"`
+	Status        string `json:"status"`
+	Version       string `json:"version"`
+	UpdateVersion string `json:"update_version,omitempty"` // Empty when up to date
+}
+
+// WPAdmin is a user with the administrator role
+type WPAdmin struct {
+	ID    int    `json:"ID"`
+	Login string `json:"user_login"`
+	Email string `json:"user_email"`
+}
+
+// WPSite is a WordPress install found on disk
+type WPSite struct {
+	Domain      string        `json:"domain"`
+	Path        string        `json:"path"`
+	Managed     bool          `json:"managed"` // Has a website record
+	CoreVersion string        `json:"core_version"`
+	CoreUpdate  string        `json:"core_update,omitempty"`
+	Plugins     []WPExtension `json:"plugins"`
+	Themes      []WPExtension `json:"themes"`
+	Admins      []WPAdmin     `json:"admins,omitempty"`
+	Updates     int           `json:"updates"` // Core, plugin and theme updates pending
+	Maintenance bool          `json:"maintenance"`
+	Debug       bool          `json:"debug"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// WPUpdateRequest selects what a bulk update touches
+type WPUpdateRequest struct {
+	Domains    []string `json:"domains"` // Empty = every detected site
+	Core       bool     `json:"core"`
+	Plugins    bool     `json:"plugins"`
+	Themes     bool     `json:"themes"`
+	SkipBackup bool     `json:"skip_backup"`
+}
+
+// WPChecksumResult is the outcome of verifying core and plugin files
+type WPChecksumResult struct {
+	Domain    string `json:"domain"`
+	CoreOK    bool   `json:"core_ok"`
+	Core      string `json:"core"`
+	PluginsOK bool   `json:"plugins_ok"`
+	Plugins   string `json:"plugins"`
+}
+
+// DetectWordPress finds the WordPress installs under /home and matches
+// them to website records. Only files are read, WP-CLI is not called.
+func DetectWordPress() ([]WPSite, error) {
+	out, err := system.Execute(fmt.Sprintf("find %s -maxdepth 4 -name wp-config.php -not -path '*/wp-content/*' 2>/dev/null", wpScanRoot))
+	if err != nil && strings.TrimSpace(out) == "" {
+		return nil, fmt.Errorf("failed to scan %s: %v", wpScanRoot, err)
+	}
+
+	var records []db.Website
+	db.DB.Find(&records)
+	byRoot := make(map[string]string)
+	for _, r := range records {
+		byRoot[filepath.Clean(r.Root)] = r.Domain
+	}
+
+	sites := []WPSite{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		path := filepath.Dir(line)
+		content, err := os.ReadFile(filepath.Join(path, "wp-includes", "version.php"))
+		if err != nil {
+			// A config kept above the web root, the core files are found separately
+			continue
+		}
+
+		site := WPSite{Path: path, Plugins: []WPExtension{}, Themes: []WPExtension{}}
+		if domain, ok := byRoot[path]; ok {
+			site.Domain = domain
+			site.Managed = true
+		} else {
+			// Unmanaged installs are named after their directory in /home
+			rel, _ := filepath.Rel(wpScanRoot, path)
+			site.Domain = strings.Split(rel, string(filepath.Separator))[0]
+		}
+		if seen[site.Domain] {
+			continue
+		}
+		seen[site.Domain] = true
+
+		if m := wpVersionRegex.FindSubmatch(content); len(m) > 1 {
+			site.CoreVersion = string(m[1])
+		}
+		if _, err := os.Stat(filepath.Join(path, ".maintenance")); err == nil {
+			site.Maintenance = true
+		}
+		if config, err := os.ReadFile(line); err == nil {
+			site.Debug = wpDebugRegex.Match(config)
+		}
+		sites = append(sites, site)
+	}
+
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Domain < sites[j].Domain })
+	return sites, nil
+}
+
+// ListWordPressSites returns every detected install with its plugins,
+// themes and pending updates
+func ListWordPressSites() ([]WPSite, error) {
+	sites, err := DetectWordPress()
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, wpScanWorkers)
+	for i := range sites {
+		wg.Add(1)
+		go func(site *WPSite) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			inspectWordPress(site, false)
+		}(&sites[i])
+	}
+	wg.Wait()
+
+	return sites, nil
+}
+
+// GetWordPressSite returns a single install including its administrators
+func GetWordPressSite(domain string) (*WPSite, error) {
+	site, err := findWordPress(domain)
+	if err != nil {
+		return nil, err
+	}
+	inspectWordPress(site, true)
+	return site, nil
+}
+
+func findWordPress(domain string) (*WPSite, error) {
+	sites, err := DetectWordPress()
+	if err != nil {
+		return nil, err
+	}
+	for i := range sites {
+		if sites[i].Domain == domain {
+			return &sites[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no WordPress install found for %s", domain)
+}
+
+// inspectWordPress fills in versions and updates using WP-CLI
+func inspectWordPress(site *WPSite, admins bool) {
+	if out, err := wpCLI(site.Path, "core", "check-update", "--format=json"); err != nil {
+		site.Error = strings.TrimSpace(out)
+		return
+	} else if strings.Contains(out, "[") {
+		var updates []struct {
+			Version string `json:"version"`
+		}
+		if json.Unmarshal([]byte(jsonPart(out)), &updates) == nil && len(updates) > 0 {
+			site.CoreUpdate = updates[0].Version
+			site.Updates++
+		}
+	}
+
+	for _, kind := range []string{"plugin", "theme"} {
+		out, err := wpCLI(site.Path, kind, "list", "--fields=name,title,status,version,update_version", "--format=json")
+		if err != nil {
+			site.Error = strings.TrimSpace(out)
+			continue
+		}
+		list := []WPExtension{}
+		if err := json.Unmarshal([]byte(jsonPart(out)), &list); err != nil {
+			site.Error = fmt.Sprintf("failed to parse %s list: %v", kind, err)
+			continue
+		}
+		for _, ext := range list {
+			if ext.UpdateVersion != "" {
+				site.Updates++
+			}
+		}
+		if kind == "plugin" {
+			site.Plugins = list
+		} else {
+			site.Themes = list
+		}
+	}
+
+	if admins {
+		out, err := wpCLI(site.Path, "user", "list", "--role=administrator", "--fields=ID,user_login,user_email", "--format=json")
+		if err == nil {
+			json.Unmarshal([]byte(jsonPart(out)), &site.Admins)
+		}
+	}
+}
+
+// UpdateWordPress updates the selected sites as a tracked task. Each site
+// is archived first unless SkipBackup is set; a failed backup skips the site.
+func UpdateWordPress(req WPUpdateRequest) (*task.Task, error) {
+	if !req.Core && !req.Plugins && !req.Themes {
+		return nil, fmt.Errorf("nothing selected to update")
+	}
+	all, err := DetectWordPress()
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []WPSite
+	if len(req.Domains) == 0 {
+		sites = all
+	} else {
+		for _, domain := range req.Domains {
+			found := false
+			for _, site := range all {
+				if site.Domain == domain {
+					sites = append(sites, site)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no WordPress install found for %s", domain)
+			}
+		}
+	}
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("no WordPress sites found")
+	}
+
+	t := task.StartFunc(fmt.Sprintf("update %d WordPress sites", len(sites)), func(t *task.Task) error {
+		failed := 0
+		for i, site := range sites {
+			t.Logf("== %s (%s)", site.Domain, site.Path)
+			if err := updateWordPressSite(t, site, req); err != nil {
+				t.Logf("Error: %v", err)
+				failed++
+			}
+			t.SetProgress((i + 1) * 100 / len(sites))
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d sites failed to update", failed, len(sites))
+		}
+		return nil
+	})
+	return t, nil
+}
+
+func updateWordPressSite(t *task.Task, site WPSite, req WPUpdateRequest) error {
+	if !req.SkipBackup {
+		dbName, _ := websiteDatabase(db.Website{Domain: site.Domain, Root: site.Path})
+		info, err := backup.SnapshotWebsite(site.Domain, site.Path, dbName)
+		if err != nil {
+			return fmt.Errorf("backup failed, site was not updated: %v", err)
+		}
+		t.Logf("Backup created: %s", info.Path)
+	}
+
+	var steps [][]string
+	if req.Core {
+		steps = append(steps, []string{"core", "update"}, []string{"core", "update-db"})
+	}
+	if req.Plugins {
+		steps = append(steps, []string{"plugin", "update", "--all"})
+	}
+	if req.Themes {
+		steps = append(steps, []string{"theme", "update", "--all"})
+	}
+
+	for _, args := range steps {
+		t.Logf("$ wp %s", strings.Join(args, " "))
+		out, err := wpCLI(site.Path, args...)
+		t.Logf("%s", strings.TrimRight(out, "\n"))
+		if err != nil {
+			return fmt.Errorf("wp %s failed", strings.Join(args, " "))
+		}
+	}
+	return nil
+}
+
+// VerifyWordPressChecksums compares core and plugin files against wordpress.org
+func VerifyWordPressChecksums(domain string) (*WPChecksumResult, error) {
+	site, err := findWordPress(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &WPChecksumResult{Domain: site.Domain}
+	out, err := wpCLI(site.Path, "core", "verify-checksums")
+	result.Core = strings.TrimSpace(out)
+	result.CoreOK = err == nil
+	out, err = wpCLI(site.Path, "plugin", "verify-checksums", "--all")
+	result.Plugins = strings.TrimSpace(out)
+	result.PluginsOK = err == nil
+	return result, nil
+}
+
+// SetWordPressMaintenance turns maintenance mode on or off
+func SetWordPressMaintenance(domain string, enabled bool) error {
+	site, err := findWordPress(domain)
+	if err != nil {
+		return err
+	}
+	action := "deactivate"
+	if enabled {
+		action = "activate"
+	}
+	if out, err := wpCLI(site.Path, "maintenance-mode", action); err != nil {
+		return fmt.Errorf("failed to %s maintenance mode: %s", action, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// SetWordPressDebug turns WP_DEBUG on or off. When on, errors are logged to
+// wp-content/debug.log instead of being shown to visitors.
+func SetWordPressDebug(domain string, enabled bool) error {
+	site, err := findWordPress(domain)
+	if err != nil {
+		return err
+	}
+	values := map[string]bool{
+		"WP_DEBUG":         enabled,
+		"WP_DEBUG_LOG":     enabled,
+		"WP_DEBUG_DISPLAY": false,
+	}
+	for _, name := range []string{"WP_DEBUG", "WP_DEBUG_LOG", "WP_DEBUG_DISPLAY"} {
+		out, err := wpCLI(site.Path, "config", "set", name, strconv.FormatBool(values[name]), "--raw", "--type=constant")
+		if err != nil {
+			return fmt.Errorf("failed to set %s: %s", name, strings.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// ResetWordPressPassword sets a new password for a user. A random password
+// is generated when none is given; the password in effect is returned.
+func ResetWordPressPassword(domain, username, password string) (string, error) {
+	site, err := findWordPress(domain)
+	if err != nil {
+		return "", err
+	}
+	if !wpUsernameRegex.MatchString(username) {
+		return "", fmt.Errorf("invalid username: %q", username)
+	}
+	if password == "" {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		password = hex.EncodeToString(b)
+	} else if len(password) < 8 {
+		return "", fmt.Errorf("password must be at least 8 characters")
+	}
+
+	if out, err := wpCLI(site.Path, "user", "get", username, "--field=ID"); err != nil {
+		return "", fmt.Errorf("user %s not found: %s", username, strings.TrimSpace(out))
+	}
+	if out, err := wpCLI(site.Path, "user", "update", username, "--user_pass="+password, "--skip-email"); err != nil {
+		return "", fmt.Errorf("failed to reset password: %s", strings.TrimSpace(out))
+	}
+	return password, nil
+}
+
+// wpCLI runs WP-CLI in a WordPress install. Arguments are quoted, never
+// interpreted by the shell. Plugins and themes are not loaded so a broken
+// plugin cannot stop the panel from managing the site. The command runs as
+// the owner of the install so files it writes keep their ownership.
+func wpCLI(path string, args ...string) (string, error) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	prefix := "wp"
+	out, _ := system.Execute("stat -c %U " + shellQuote(path))
+	if owner := strings.TrimSpace(out); owner != "" && owner != "root" && owner != "UNKNOWN" {
+		prefix = fmt.Sprintf("runuser -u %s -- env HOME=/tmp WP_CLI_CACHE_DIR=/tmp/wp-cli-cache-%s wp", shellQuote(owner), owner)
+	}
+
+	cmd := fmt.Sprintf("%s %s --path=%s --skip-plugins --skip-themes --allow-root 2>&1",
+		prefix, strings.Join(quoted, " "), shellQuote(path))
+	return system.Execute(cmd)
+}
+
+// jsonPart drops warnings WP-CLI prints before its JSON output
+func jsonPart(out string) string {
+	if i := strings.IndexAny(out, "[{"); i > 0 {
+		return out[i:]
+	}
+	return out
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/acmavirus/panda-script/v3/internal/api"
 	"github.com/acmavirus/panda-script/v3/internal/cli"
 	"github.com/acmavirus/panda-script/v3/internal/db"
+	"github.com/acmavirus/panda-script/v3/internal/nginx"
 	"github.com/acmavirus/panda-script/v3/internal/website"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
@@ -88,7 +89,10 @@ func startWebServer() {
 	}
 
 	// Start Background Status Checker
+	website.Notifier = api.SendNotification
 	website.StartStatusChecker()
+	website.StartStatsCollector()
+	nginx.StartMetricsCollector()
 
 	// API Routes
 	apiGroup := r.Group("/api")